@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// validateAPIServer checks the allowedSourceCIDRs of a tunnel, and that a
+// tunnel for the API server can only be reached from them.
+func validateAPIServer(tunnel *inletsv1alpha1.Tunnel) error {
+	if err := validateAllowedSourceCIDRs(tunnel.Spec.AllowedSourceCIDRs); err != nil {
+		return err
+	}
+
+	if !tunnel.Spec.APIServer {
+		return nil
+	}
+
+	if len(tunnel.Spec.AllowedSourceCIDRs) == 0 {
+		return fmt.Errorf("apiServer tunnels must set allowedSourceCIDRs, so that the API server is not open to the Internet")
+	}
+
+	for _, cidr := range tunnel.Spec.AllowedSourceCIDRs {
+		if _, network, _ := net.ParseCIDR(cidr); network != nil {
+			if ones, _ := network.Mask.Size(); ones == 0 {
+				return fmt.Errorf("apiServer tunnels cannot allow every source with %q", cidr)
+			}
+		}
+	}
+
+	if len(tunnel.Spec.ServiceName) > 0 || tunnel.Spec.TLS != nil || tunnel.Spec.Protocol == "udp" {
+		return fmt.Errorf("apiServer tunnels cannot set serviceName, tls or the udp protocol")
+	}
+	return nil
+}
+
+// getAPIServerUpstream returns the address of the first endpoint of the
+// kubernetes Service, i.e. 10.0.0.1:6443, so that the API server is exposed
+// on the port it listens on rather than the port of the Service.
+func (c *Controller) getAPIServerUpstream() (string, error) {
+	endpoints, err := c.endpointsLister.Endpoints(metav1.NamespaceDefault).Get("kubernetes")
+	if err != nil {
+		return "", err
+	}
+
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) == 0 || len(subset.Ports) == 0 {
+			continue
+		}
+
+		port := subset.Ports[0].Port
+		for _, endpointPort := range subset.Ports {
+			if endpointPort.Name == "https" {
+				port = endpointPort.Port
+			}
+		}
+		return net.JoinHostPort(subset.Addresses[0].IP, fmt.Sprintf("%d", port)), nil
+	}
+	return "", fmt.Errorf("the kubernetes Service has no endpoints")
+}
+
+// setAPIServerUpstream points a tunnel for the API server at its endpoint,
+// forwarded at L4 with inlets-pro.
+func (c *Controller) setAPIServerUpstream(tunnel *inletsv1alpha1.Tunnel) error {
+	upstream, err := c.getAPIServerUpstream()
+	if err != nil {
+		return err
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Spec.Upstream = upstream
+	tunnelCopy.Spec.Protocol = "tcp"
+
+	_, err = c.updateTunnel(tunnelCopy)
+	return err
+}
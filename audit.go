@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// auditRecord records an action on a cloud resource, what triggered it and
+// its outcome. Actions done by a Job have the outcome "started" until the
+// Job finishes.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Operator  string    `json:"operator"`
+	Action    string    `json:"action"`
+	Trigger   string    `json:"trigger"`
+	Namespace string    `json:"namespace"`
+	Tunnel    string    `json:"tunnel"`
+	TunnelUID string    `json:"tunnelUID,omitempty"`
+	Provider  string    `json:"provider"`
+	Region    string    `json:"region,omitempty"`
+	HostID    string    `json:"hostID,omitempty"`
+	HostIP    string    `json:"hostIP,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditLog appends audit records to a file or stdout as JSON, one per line.
+type auditLog struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// openAuditLog opens the audit log at path for appending, or stdout for "-".
+func openAuditLog(path string) (*auditLog, error) {
+	if path == "-" {
+		return &auditLog{w: os.Stdout}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{w: file}, nil
+}
+
+func (a *auditLog) write(record auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, err = a.w.Write(append(line, '\n'))
+	return err
+}
+
+// audit counts an action on a cloud resource for a tunnel in the metrics,
+// and records it to the audit log when --audit-log is set, and as an Event
+// on the Tunnel when --audit-events is set. Exit-nodes of the warm pool and those kept by --deletion-ttl have
+// no Tunnel to record an Event on.
+func (c *Controller) audit(tunnel *inletsv1alpha1.Tunnel, record auditRecord, err error) {
+	if len(record.Provider) == 0 {
+		record.Provider = c.getTunnelProvider(tunnel)
+	}
+	c.metrics.recordOperation(record, err)
+
+	infra := c.infra()
+	if infra.AuditLog == nil && !infra.AuditEvents {
+		return
+	}
+
+	record.Time = time.Now().UTC()
+	record.Operator = infra.ShardIdentity
+	record.Namespace = tunnel.Namespace
+	record.Tunnel = tunnel.Name
+	record.TunnelUID = string(tunnel.UID)
+	if len(record.Outcome) == 0 {
+		record.Outcome = "success"
+	}
+	if err != nil {
+		record.Outcome = "failure"
+		record.Error = err.Error()
+	}
+
+	if infra.AuditLog != nil {
+		if err := infra.AuditLog.write(record); err != nil {
+			logWith().Error(err, "Error writing audit log")
+		}
+	}
+
+	if infra.AuditEvents && len(tunnel.UID) > 0 {
+		eventType := corev1.EventTypeNormal
+		if err != nil {
+			eventType = corev1.EventTypeWarning
+		}
+		c.recorder.Event(tunnel, eventType, AuditRecorded, formatAuditRecord(record))
+	}
+}
+
+// formatAuditRecord returns the message of the Event for an audit record.
+func formatAuditRecord(record auditRecord) string {
+	resource := record.HostID
+	if len(resource) == 0 {
+		resource = record.HostIP
+	}
+
+	message := fmt.Sprintf("%s %s with %s, triggered by %s: %s",
+		record.Action, resource, record.Provider, record.Trigger, record.Outcome)
+	if len(record.Error) > 0 {
+		message += ", " + record.Error
+	}
+	return message
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+const (
+	authProxyRelease = "https://github.com/oauth2-proxy/oauth2-proxy/releases/download/v5.1.1/oauth2-proxy-5.1.1.linux-amd64.go1.14.2.tar.gz"
+
+	// authProxyUpstreamPort is the port the inlets server serves HTTP on
+	// behind oauth2-proxy or Caddy, which is only reachable from the
+	// exit-node.
+	authProxyUpstreamPort = 8081
+)
+
+// authProxySettings maps the keys of the Secret of an auth proxy to the
+// environment variables of oauth2-proxy.
+var authProxySettings = map[string]string{
+	"client-id":       "OAUTH2_PROXY_CLIENT_ID",
+	"client-secret":   "OAUTH2_PROXY_CLIENT_SECRET",
+	"cookie-secret":   "OAUTH2_PROXY_COOKIE_SECRET",
+	"provider":        "OAUTH2_PROXY_PROVIDER",
+	"oidc-issuer-url": "OAUTH2_PROXY_OIDC_ISSUER_URL",
+	"email-domain":    "OAUTH2_PROXY_EMAIL_DOMAINS",
+}
+
+// hasExitNodeAuth returns true when visitors of a tunnel have to sign in on
+// its exit-node, with authProxy or auth.
+func hasExitNodeAuth(tunnel *inletsv1alpha1.Tunnel) bool {
+	return tunnel.Spec.AuthProxy != nil || (tunnel.Spec.Auth != nil && tunnel.Spec.Auth.Basic != nil)
+}
+
+func validateExitNodeAuth(tunnel *inletsv1alpha1.Tunnel) error {
+	if tunnel.Spec.AuthProxy != nil {
+		if len(tunnel.Spec.AuthProxy.SecretName) == 0 {
+			return fmt.Errorf("authProxy.secretName must be set")
+		}
+		if tunnel.Spec.Auth != nil && tunnel.Spec.Auth.Basic != nil {
+			return fmt.Errorf("only one of authProxy and auth.basic can be set")
+		}
+	}
+	if tunnel.Spec.Auth != nil && tunnel.Spec.Auth.Basic != nil && len(tunnel.Spec.Auth.Basic.SecretName) == 0 {
+		return fmt.Errorf("auth.basic.secretName must be set")
+	}
+
+	if hasExitNodeAuth(tunnel) && isProTunnel(tunnel) {
+		return fmt.Errorf("authProxy and auth can only be set on HTTP tunnels")
+	}
+	return nil
+}
+
+// makeAuthUpstreamUserdata returns a script which moves the inlets server
+// of an HTTP tunnel from port 80 to a port which is closed to other hosts,
+// so that an auth layer can listen on port 80 in front of it.
+func makeAuthUpstreamUserdata(tunnel *inletsv1alpha1.Tunnel) string {
+	return `
+
+mkdir -p /etc/systemd/system/inlets.service.d
+cat > /etc/systemd/system/inlets.service.d/auth.conf <<'EOF'
+[Service]
+ExecStart=
+ExecStart=/usr/local/bin/inlets server --port=` + fmt.Sprintf("%d", authProxyUpstreamPort) +
+		` --control-port=` + fmt.Sprintf("%d", inletsControlPort) + ` --token=` + tunnel.Spec.AuthToken + `
+EOF
+
+iptables -I INPUT -p tcp --dport ` + fmt.Sprintf("%d", authProxyUpstreamPort) + ` ! -i lo -j DROP
+
+systemctl daemon-reload && \
+	systemctl restart inlets`
+}
+
+// addAuthProxyUserdata adds oauth2-proxy to the userdata of the exit-node of
+// a tunnel with an auth proxy, configured from its Secret. oauth2-proxy
+// listens on port 80 in place of the inlets server, which is moved to a
+// port which is closed to other hosts. The Secret is read when the
+// exit-node is provisioned, so a change takes effect when it is replaced.
+func (c *Controller) addAuthProxyUserdata(tunnel *inletsv1alpha1.Tunnel, host *provision.BasicHost) error {
+	if tunnel.Spec.AuthProxy == nil {
+		return nil
+	}
+
+	secret, err := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace).Get(tunnel.Spec.AuthProxy.SecretName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading authProxy secret %s: %s", tunnel.Spec.AuthProxy.SecretName, err.Error())
+	}
+
+	for _, key := range []string{"client-id", "client-secret", "cookie-secret"} {
+		if len(secret.Data[key]) == 0 {
+			return fmt.Errorf("authProxy secret %s has no %s", secret.Name, key)
+		}
+	}
+
+	env := map[string]string{
+		"OAUTH2_PROXY_HTTP_ADDRESS":  "0.0.0.0:80",
+		"OAUTH2_PROXY_UPSTREAMS":     fmt.Sprintf("http://127.0.0.1:%d", authProxyUpstreamPort),
+		"OAUTH2_PROXY_PROVIDER":      "oidc",
+		"OAUTH2_PROXY_EMAIL_DOMAINS": "*",
+		"OAUTH2_PROXY_COOKIE_SECURE": "false",
+	}
+	if len(tunnel.Spec.Hostname) > 0 {
+		env["OAUTH2_PROXY_REDIRECT_URL"] = "http://" + tunnel.Spec.Hostname + "/oauth2/callback"
+	}
+	for key, name := range authProxySettings {
+		value := string(secret.Data[key])
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%s in authProxy secret %s must be on one line", key, secret.Name)
+		}
+		if len(value) > 0 {
+			env[name] = value
+		}
+	}
+
+	if env["OAUTH2_PROXY_PROVIDER"] == "oidc" && len(env["OAUTH2_PROXY_OIDC_ISSUER_URL"]) == 0 {
+		return fmt.Errorf("authProxy secret %s needs oidc-issuer-url for the oidc provider", secret.Name)
+	}
+
+	names := []string{}
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{}
+	for _, name := range names {
+		lines = append(lines, name+"="+strconv.Quote(env[name]))
+	}
+
+	host.UserData += makeAuthUpstreamUserdata(tunnel) + `
+
+cat > /etc/default/oauth2-proxy <<'EOF'
+` + strings.Join(lines, "\n") + `
+EOF
+chmod 600 /etc/default/oauth2-proxy
+
+` + makeVerifiedDownload(authProxyRelease, "/tmp/oauth2-proxy.tar.gz", c.infra().ReleaseChecksums["oauth2-proxy"]) + ` && \
+	tar -xzf /tmp/oauth2-proxy.tar.gz --strip-components=1 -C /usr/local/bin
+
+cat > /etc/systemd/system/oauth2-proxy.service <<EOF
+[Unit]
+Description=oauth2-proxy in front of inlets
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+EnvironmentFile=/etc/default/oauth2-proxy
+ExecStart=/usr/local/bin/oauth2-proxy
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start oauth2-proxy && \
+	systemctl enable oauth2-proxy`
+
+	return nil
+}
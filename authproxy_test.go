@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// createAuthSecret creates a Secret in the namespace of the tunnels of a
+// fixture.
+func (f *fixture) createAuthSecret(name string, data map[string]string) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault},
+		Data:       map[string][]byte{},
+	}
+	for key, value := range data {
+		secret.Data[key] = []byte(value)
+	}
+	if _, err := f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Create(secret); err != nil {
+		f.t.Fatalf("error creating secret: %s", err.Error())
+	}
+}
+
+func newAuthProxyTunnel(name string) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel(name)
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Spec.AuthProxy = &inletsv1alpha1.TunnelAuthProxy{SecretName: "app-oauth2"}
+	return tunnel
+}
+
+func TestValidateExitNodeAuthProxy(t *testing.T) {
+	cases := []struct {
+		name    string
+		change  func(tunnel *inletsv1alpha1.Tunnel)
+		wantErr bool
+	}{
+		{"auth proxy", func(tunnel *inletsv1alpha1.Tunnel) {}, false},
+		{"no secret", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.AuthProxy.SecretName = "" }, true},
+		{"basic auth too", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Auth = &inletsv1alpha1.TunnelAuth{Basic: &inletsv1alpha1.TunnelBasicAuth{SecretName: "app-basic"}}
+		}, true},
+		{"inlets-pro", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.Protocol = "tcp" }, true},
+	}
+
+	for _, c := range cases {
+		tunnel := newAuthProxyTunnel("app")
+		c.change(tunnel)
+		if err := validateExitNodeAuth(tunnel); (err != nil) != c.wantErr {
+			t.Errorf("%s: want error %v, got %v", c.name, c.wantErr, err)
+		}
+	}
+}
+
+func TestAddAuthProxyUserdata(t *testing.T) {
+	f := newFixture(t)
+	f.createAuthSecret("app-oauth2", map[string]string{
+		"client-id":       "inlets",
+		"client-secret":   "client-secret",
+		"cookie-secret":   "cookie-secret",
+		"oidc-issuer-url": "https://login.example.com",
+	})
+
+	tunnel := newAuthProxyTunnel("app")
+	host := provision.BasicHost{}
+	if err := f.controller.addAuthProxyUserdata(tunnel, &host); err != nil {
+		t.Fatalf("error adding userdata: %s", err.Error())
+	}
+
+	for _, want := range []string{
+		`OAUTH2_PROXY_CLIENT_SECRET="client-secret"`,
+		`OAUTH2_PROXY_OIDC_ISSUER_URL="https://login.example.com"`,
+		`OAUTH2_PROXY_REDIRECT_URL="http://app.example.com/oauth2/callback"`,
+		`OAUTH2_PROXY_UPSTREAMS="http://127.0.0.1:8081"`,
+		// The inlets server is moved behind oauth2-proxy
+		"inlets server --port=8081",
+		"--dport 8081 ! -i lo -j DROP",
+		`"` + fakeReleaseChecksum + `  /tmp/oauth2-proxy.tar.gz" | sha256sum -c`,
+	} {
+		if !strings.Contains(host.UserData, want) {
+			t.Errorf("want %q in the userdata", want)
+		}
+	}
+}
+
+func TestAddAuthProxyUserdataRejectsSecret(t *testing.T) {
+	cases := []struct {
+		name string
+		data map[string]string
+		want string
+	}{
+		{"no cookie secret", map[string]string{"client-id": "inlets", "client-secret": "secret", "oidc-issuer-url": "https://login.example.com"},
+			"has no cookie-secret"},
+		{"no issuer", map[string]string{"client-id": "inlets", "client-secret": "secret", "cookie-secret": "cookie"},
+			"needs oidc-issuer-url"},
+		{"newline", map[string]string{"client-id": "inlets", "client-secret": "secret\nOAUTH2_PROXY_UPSTREAMS=http://example.com", "cookie-secret": "cookie", "provider": "github"},
+			"must be on one line"},
+	}
+
+	for _, c := range cases {
+		f := newFixture(t)
+		f.createAuthSecret("app-oauth2", c.data)
+
+		err := f.controller.addAuthProxyUserdata(newAuthProxyTunnel("app"), &provision.BasicHost{})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: want an error with %q, got %v", c.name, c.want, err)
+		}
+	}
+
+	// Another provider than oidc needs no issuer
+	f := newFixture(t)
+	f.createAuthSecret("app-oauth2", map[string]string{"client-id": "inlets", "client-secret": "secret", "cookie-secret": "cookie", "provider": "github"})
+	if err := f.controller.addAuthProxyUserdata(newAuthProxyTunnel("app"), &provision.BasicHost{}); err != nil {
+		t.Errorf("want no error for the github provider, got %s", err.Error())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+const caddyRelease = "https://github.com/caddyserver/caddy/releases/download/v2.0.0/caddy_2.0.0_linux_amd64.tar.gz"
+
+// addBasicAuthUserdata adds Caddy to the userdata of the exit-node of a
+// tunnel with basic auth, which asks for the username and password in its
+// Secret in front of the inlets server. The password is hashed on the
+// exit-node, then its plaintext is removed. The Secret is read when the
+// exit-node is provisioned, so a change takes effect when it is replaced.
+func (c *Controller) addBasicAuthUserdata(tunnel *inletsv1alpha1.Tunnel, host *provision.BasicHost) error {
+	if tunnel.Spec.Auth == nil || tunnel.Spec.Auth.Basic == nil {
+		return nil
+	}
+
+	name := tunnel.Spec.Auth.Basic.SecretName
+	secret, err := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error reading auth.basic secret %s: %s", name, err.Error())
+	}
+
+	username := string(secret.Data[corev1.BasicAuthUsernameKey])
+	password := string(secret.Data[corev1.BasicAuthPasswordKey])
+	if len(username) == 0 || len(password) == 0 {
+		return fmt.Errorf("auth.basic secret %s must have a username and password", name)
+	}
+	if strings.ContainsAny(username, " \t\r\n{}$`") || strings.ContainsAny(password, "\r\n") {
+		return fmt.Errorf("auth.basic secret %s must have a username without spaces, braces or $, and a password on one line", name)
+	}
+
+	host.UserData += makeAuthUpstreamUserdata(tunnel) + `
+
+` + makeVerifiedDownload(caddyRelease, "/tmp/caddy.tar.gz", c.infra().ReleaseChecksums["caddy"]) + ` && \
+	tar -xzf /tmp/caddy.tar.gz -C /usr/local/bin caddy
+
+mkdir -p /etc/caddy
+cat > /etc/caddy/password <<'EOF'
+` + password + `
+EOF
+HASH=$(/usr/local/bin/caddy hash-password --plaintext "$(cat /etc/caddy/password)")
+rm -f /etc/caddy/password
+
+cat > /etc/caddy/Caddyfile <<EOF
+:80 {
+	basicauth {
+		` + username + ` $HASH
+	}
+	reverse_proxy 127.0.0.1:` + fmt.Sprintf("%d", authProxyUpstreamPort) + `
+}
+EOF
+
+cat > /etc/systemd/system/caddy.service <<EOF
+[Unit]
+Description=Caddy with basic auth in front of inlets
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+ExecStart=/usr/local/bin/caddy run --config /etc/caddy/Caddyfile --adapter caddyfile
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start caddy && \
+	systemctl enable caddy`
+
+	return nil
+}
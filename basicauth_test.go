@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+func newBasicAuthTunnel(name string) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel(name)
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Spec.Auth = &inletsv1alpha1.TunnelAuth{Basic: &inletsv1alpha1.TunnelBasicAuth{SecretName: "app-basic"}}
+	return tunnel
+}
+
+func TestValidateExitNodeBasicAuth(t *testing.T) {
+	cases := []struct {
+		name    string
+		change  func(tunnel *inletsv1alpha1.Tunnel)
+		wantErr bool
+	}{
+		{"basic auth", func(tunnel *inletsv1alpha1.Tunnel) {}, false},
+		{"no secret", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.Auth.Basic.SecretName = "" }, true},
+		{"inlets-pro", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.Protocol = "tcp" }, true},
+		{"no basic auth", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.Auth = &inletsv1alpha1.TunnelAuth{} }, false},
+	}
+
+	for _, c := range cases {
+		tunnel := newBasicAuthTunnel("app")
+		c.change(tunnel)
+		if err := validateExitNodeAuth(tunnel); (err != nil) != c.wantErr {
+			t.Errorf("%s: want error %v, got %v", c.name, c.wantErr, err)
+		}
+	}
+}
+
+func TestAddBasicAuthUserdata(t *testing.T) {
+	f := newFixture(t)
+	f.createAuthSecret("app-basic", map[string]string{
+		corev1.BasicAuthUsernameKey: "alex",
+		corev1.BasicAuthPasswordKey: "correct horse battery staple",
+	})
+
+	host := provision.BasicHost{}
+	if err := f.controller.addBasicAuthUserdata(newBasicAuthTunnel("app"), &host); err != nil {
+		t.Fatalf("error adding userdata: %s", err.Error())
+	}
+
+	for _, want := range []string{
+		"alex $HASH",
+		// The plaintext password is only kept until it is hashed
+		"rm -f /etc/caddy/password",
+		"reverse_proxy 127.0.0.1:8081",
+		"inlets server --port=8081",
+		"--dport 8081 ! -i lo -j DROP",
+		`"` + fakeReleaseChecksum + `  /tmp/caddy.tar.gz" | sha256sum -c`,
+	} {
+		if !strings.Contains(host.UserData, want) {
+			t.Errorf("want %q in the userdata", want)
+		}
+	}
+	if strings.Contains(host.UserData, "basicauth {\n\t\talex correct horse") {
+		t.Errorf("want the password to be hashed in the Caddyfile")
+	}
+}
+
+func TestAddBasicAuthUserdataRejectsSecret(t *testing.T) {
+	cases := []struct {
+		name string
+		data map[string]string
+	}{
+		{"no password", map[string]string{corev1.BasicAuthUsernameKey: "alex"}},
+		{"space in username", map[string]string{corev1.BasicAuthUsernameKey: "alex ellis", corev1.BasicAuthPasswordKey: "password"}},
+		{"variable in username", map[string]string{corev1.BasicAuthUsernameKey: "$HOME", corev1.BasicAuthPasswordKey: "password"}},
+		{"newline in password", map[string]string{corev1.BasicAuthUsernameKey: "alex", corev1.BasicAuthPasswordKey: "pass\nEOF"}},
+	}
+
+	for _, c := range cases {
+		f := newFixture(t)
+		f.createAuthSecret("app-basic", c.data)
+
+		if err := f.controller.addBasicAuthUserdata(newBasicAuthTunnel("app"), &provision.BasicHost{}); err == nil {
+			t.Errorf("%s: want an error", c.name)
+		}
+	}
+
+	f := newFixture(t)
+	if err := f.controller.addBasicAuthUserdata(newBasicAuthTunnel("app"), &provision.BasicHost{}); err == nil {
+		t.Errorf("want an error without the Secret")
+	}
+}
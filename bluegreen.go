@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// replacementDrainTimeout is how long the tunnel has to be verified
+// through the new exit-node after the client was moved over, before the
+// client is moved back to the old exit-node.
+const replacementDrainTimeout = 10 * time.Minute
+
+// usesBlueGreen returns true when the exit-node of a tunnel is replaced by
+// provisioning the new exit-node before the old one is deleted. Exit-nodes
+// provisioned by Jobs are recreated instead, since there is one Job for
+// each Tunnel, as are those which would exceed the quota of the operator.
+func (c *Controller) usesBlueGreen(tunnel *inletsv1alpha1.Tunnel) bool {
+	if c.infra().ReplacementStrategy != "bluegreen" {
+		return false
+	}
+
+	target := c.getTargets(tunnel)[0]
+	if c.usesJobs(tunnel, target.Provider) {
+		return false
+	}
+
+	// When the quota can't be checked, the replacement is held back by
+	// startReplacement rather than the exit-node being deleted
+	exceeded, _, err := c.quotaExceeded(c.makeExitHost(tunnel, target), target.Provider)
+	return err != nil || !exceeded
+}
+
+// getReplacementTunnel returns a copy of a tunnel with the exit-node of its
+// replacement, to poll or delete that exit-node.
+func getReplacementTunnel(tunnel *inletsv1alpha1.Tunnel) *inletsv1alpha1.Tunnel {
+	replacement := tunnel.Status.Replacement
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.HostStatus = replacement.HostStatus
+	tunnelCopy.Status.HostID = replacement.HostID
+	tunnelCopy.Status.HostIP = replacement.HostIP
+	tunnelCopy.Status.Provider = replacement.Provider
+	tunnelCopy.Status.Region = replacement.Region
+	tunnelCopy.Status.Replacement = nil
+	return tunnelCopy
+}
+
+// startReplacement provisions a new exit-node with the token for a tunnel,
+// which is recorded as its replacement whilst the old exit-node serves
+// traffic.
+func (c *Controller) startReplacement(tunnel *inletsv1alpha1.Tunnel, token, reason string) error {
+	key := tunnel.Namespace + "/" + tunnel.Name
+	c.startWork(key)
+	defer c.finishWork(key)
+
+	replacing := tunnel.DeepCopy()
+	replacing.Spec.AuthToken = token
+
+	// The old exit-node is counted against the quota until it is deleted
+	target := c.getTargets(tunnel)[0]
+	release, exceeded, message := c.reserveExitNode(replacing, c.makeExitHost(replacing, target), target.Provider)
+	if exceeded {
+		return fmt.Errorf("unable to provision a replacement exit-node: %s", message)
+	}
+	defer release()
+
+	res, target, err := c.provisionExitNode(replacing, c.getTargets(tunnel), strings.ToLower(reason))
+	if err == errProviderBusy {
+		c.workqueue.AddAfter(key, wait.Jitter(providerBusyRetry, 0.2))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	c.tunnelLog(tunnel).Info("Provisioning replacement exit-node", "replacementID", res.ID)
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Replacement = &inletsv1alpha1.TunnelReplacement{
+		HostStatus:          "provisioning",
+		HostID:              res.ID,
+		Provider:            target.Provider,
+		Region:              target.Region,
+		EstimatedHourlyCost: c.getHourlyCost(c.makeExitHost(replacing, target), target.Provider),
+		AuthToken:           getRecordedToken(tunnel, token),
+		Reason:              reason,
+	}
+
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err
+}
+
+// syncReplacement moves the client of a tunnel over to its new exit-node
+// once it is active, then deletes the old exit-node once traffic flows
+// through the new one and its IP was published. It returns true when the
+// tunnel should not be synced any further.
+func (c *Controller) syncReplacement(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	replacement := tunnel.Status.Replacement
+	if replacement == nil {
+		return false, nil
+	}
+
+	switch replacement.HostStatus {
+	case "provisioning":
+		provisioner, err := c.getTunnelProvisioner(getReplacementTunnel(tunnel))
+		if err != nil {
+			return true, err
+		}
+
+		if due, left := c.pollDue(tunnel); !due {
+			c.workqueue.AddAfter(tunnel.Namespace+"/"+tunnel.Name, left)
+			return true, nil
+		}
+
+		host, err := provisioner.Status(replacement.HostID)
+		if err != nil {
+			return true, err
+		}
+
+		if host.Status != "active" || len(host.IP) == 0 {
+			c.tunnelLog(tunnel).Info("Still provisioning replacement", "replacementID", replacement.HostID)
+			c.enqueueTunnelAfterPoll(tunnel, replacement.Provider, host.Status)
+			return true, nil
+		}
+
+		c.forgetPoll(tunnel)
+
+		// The tunnel is synced again after its IP is reserved
+		ip, updated, err := c.syncReservedIP(tunnel, replacement.HostID, host.IP)
+		if err != nil || updated {
+			return true, err
+		}
+
+		// The new exit-node is firewalled before the client moves to it
+		if len(tunnel.Spec.AllowedSourceCIDRs) > 0 || len(c.infra().ControlPlaneSources) > 0 {
+			if _, err := c.setFirewall(getReplacementTunnel(tunnel), replacement.HostID); err != nil {
+				return true, err
+			}
+		}
+
+		return true, c.moveToReplacement(tunnel, ip)
+
+	case "draining":
+		if !c.replacementVerified(tunnel) {
+			if tunnel.Status.ProvisionedAt != nil &&
+				time.Since(tunnel.Status.ProvisionedAt.Time) > replacementDrainTimeout {
+				return true, c.rollbackReplacement(tunnel)
+			}
+
+			// The client is moved and the IP published by the rest of the sync
+			return false, nil
+		}
+
+		c.tunnelLog(tunnel).Info("Deleting replaced exit-node", "replacementID", replacement.HostID, "ip", replacement.HostIP)
+		if err := c.deleteHost(getReplacementTunnel(tunnel), "replaced"); err != nil {
+			return true, err
+		}
+
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Status.Replacement = nil
+
+		_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+		return true, err
+	}
+
+	return false, nil
+}
+
+// moveToReplacement makes the new exit-node the exit-node of a tunnel, so
+// that its client is moved over, and keeps the old exit-node as draining
+// until the tunnel has been verified.
+func (c *Controller) moveToReplacement(tunnel *inletsv1alpha1.Tunnel, ip string) error {
+	replacement := tunnel.Status.Replacement
+	now := metav1.Now()
+
+	tunnelCopy := tunnel.DeepCopy()
+	if len(replacement.AuthToken) > 0 {
+		tunnelCopy.Spec.AuthToken = replacement.AuthToken
+	}
+	tunnelCopy.Status.HostID = replacement.HostID
+	tunnelCopy.Status.HostIP = ip
+	tunnelCopy.Status.Address = getTunnelAddress(tunnel, ip)
+	tunnelCopy.Status.ControlPlaneURL = getControlPlaneURL(tunnel, ip)
+	tunnelCopy.Status.ControlPlanePort = getControlPlanePort(tunnel, ip)
+	tunnelCopy.Status.Provider = replacement.Provider
+	tunnelCopy.Status.Region = replacement.Region
+	tunnelCopy.Status.EstimatedHourlyCost = replacement.EstimatedHourlyCost
+	tunnelCopy.Status.ProvisionedAt = &now
+	tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelPublished)
+	tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelDrifted)
+	tunnelCopy.Status.Replacement = &inletsv1alpha1.TunnelReplacement{
+		HostStatus:          "draining",
+		HostID:              tunnel.Status.HostID,
+		HostIP:              tunnel.Status.HostIP,
+		Provider:            tunnel.Status.Provider,
+		Region:              tunnel.Status.Region,
+		EstimatedHourlyCost: tunnel.Status.EstimatedHourlyCost,
+		AuthToken:           getRecordedToken(tunnel, tunnel.Spec.AuthToken),
+		ProvisionedAt:       tunnel.Status.ProvisionedAt,
+		Reason:              replacement.Reason,
+	}
+
+	if err := c.updateTunnelSpecAndStatus(tunnelCopy); err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessReplaced,
+		"Moving client to exit-node %s from %s", ip, tunnel.Status.HostIP)
+	return nil
+}
+
+// replacementVerified returns true when the old exit-node of a tunnel can
+// be deleted, which is once the IP of the new exit-node was published after
+// traffic flowed through it, or once a tunnel without a Service can be
+// probed, or whose client connected since it was moved when the operator
+// cannot reach its data-ports.
+func (c *Controller) replacementVerified(tunnel *inletsv1alpha1.Tunnel) bool {
+	if len(tunnel.Spec.ServiceName) > 0 {
+		return isPublished(tunnel)
+	}
+	if len(tunnel.Spec.AllowedSourceCIDRs) > 0 {
+		connected := getCondition(tunnel.Status.Conditions, inletsv1alpha1.TunnelClientConnected)
+		return connected != nil && connected.Status == corev1.ConditionTrue &&
+			tunnel.Status.ProvisionedAt != nil && connected.LastTransitionTime.After(tunnel.Status.ProvisionedAt.Time)
+	}
+	return probeTunnel(tunnel, nil) == nil
+}
+
+// rollbackReplacement moves the client of a tunnel back to its old
+// exit-node when the tunnel was not verified through the new exit-node
+// within replacementDrainTimeout, then deletes the new exit-node.
+func (c *Controller) rollbackReplacement(tunnel *inletsv1alpha1.Tunnel) error {
+	replacement := tunnel.Status.Replacement
+
+	c.tunnelLog(tunnel).Warn("Moving client back to replaced exit-node", "replacementID", replacement.HostID)
+	if err := c.deleteHost(tunnel, "replacement-failed"); err != nil {
+		return err
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	if len(replacement.AuthToken) > 0 {
+		tunnelCopy.Spec.AuthToken = replacement.AuthToken
+	}
+	tunnelCopy.Status.HostID = replacement.HostID
+	tunnelCopy.Status.HostIP = replacement.HostIP
+	tunnelCopy.Status.Address = getTunnelAddress(tunnel, replacement.HostIP)
+	tunnelCopy.Status.ControlPlaneURL = getControlPlaneURL(tunnel, replacement.HostIP)
+	tunnelCopy.Status.ControlPlanePort = getControlPlanePort(tunnel, replacement.HostIP)
+	tunnelCopy.Status.Provider = replacement.Provider
+	tunnelCopy.Status.Region = replacement.Region
+	tunnelCopy.Status.EstimatedHourlyCost = replacement.EstimatedHourlyCost
+	tunnelCopy.Status.ProvisionedAt = replacement.ProvisionedAt
+	tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelPublished)
+	tunnelCopy.Status.Replacement = nil
+
+	if err := c.updateTunnelSpecAndStatus(tunnelCopy); err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(tunnel, corev1.EventTypeWarning, ErrReplacementFailed,
+		"Moving client back to exit-node %s from %s, the tunnel was not verified within %s",
+		replacement.HostIP, tunnel.Status.HostIP, replacementDrainTimeout)
+	return nil
+}
+
+// deleteReplacement deletes the exit-node of a replacement which is in
+// progress, if any. The replacement must only be cleared from the status
+// of the tunnel once this returns without an error.
+func (c *Controller) deleteReplacement(tunnel *inletsv1alpha1.Tunnel) error {
+	replacement := tunnel.Status.Replacement
+	if replacement == nil || len(replacement.HostID) == 0 {
+		return nil
+	}
+
+	c.tunnelLog(tunnel).Info("Deleting exit-node of replacement", "replacementID", replacement.HostID)
+	if err := c.deleteHost(getReplacementTunnel(tunnel), "replacement-cancelled"); err != nil {
+		return fmt.Errorf("error deleting exit-node %s of replacement: %s", replacement.HostID, err)
+	}
+	return nil
+}
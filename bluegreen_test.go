@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// newReplacingTunnel returns a tunnel on exit-node fake-1 whose replacement
+// fake-2 was provisioned, and records both exit-nodes with the provisioner.
+func newReplacingTunnel(f *fixture, name string) *inletsv1alpha1.Tunnel {
+	for i := 0; i < 2; i++ {
+		if _, err := f.provisioner.Provision(provision.BasicHost{Name: name}); err != nil {
+			f.t.Fatalf("error provisioning host: %s", err.Error())
+		}
+	}
+
+	provisionedAt := metav1.NewTime(time.Now().Add(-time.Hour))
+	tunnel := newTunnel(name)
+	tunnel.Spec.AuthToken = "old-token"
+	tunnel.Status.HostStatus = "active"
+	tunnel.Status.HostID = "fake-1"
+	tunnel.Status.HostIP = "203.0.113.1"
+	tunnel.Status.Provider = "fake"
+	tunnel.Status.ProvisionedAt = &provisionedAt
+	tunnel.Status.Replacement = &inletsv1alpha1.TunnelReplacement{
+		HostStatus: "provisioning",
+		HostID:     "fake-2",
+		Provider:   "fake",
+		AuthToken:  "new-token",
+		Reason:     "Rotation",
+	}
+	return tunnel
+}
+
+func bluegreen(infra *InfraConfig) {
+	infra.ReplacementStrategy = "bluegreen"
+}
+
+func TestSyncReplacementMovesClientToNewExitNode(t *testing.T) {
+	f := newFixture(t, bluegreen)
+	f.create(newReplacingTunnel(f, "app"))
+
+	if stop, err := f.controller.syncReplacement(f.get("app")); err != nil || !stop {
+		t.Fatalf("want the client to be moved, got %v %v", stop, err)
+	}
+
+	got := f.get("app")
+	if got.Status.HostID != "fake-2" || got.Status.HostIP != "203.0.113.2" || got.Spec.AuthToken != "new-token" {
+		t.Errorf("want the tunnel on fake-2 with the new token, got %q %q %q", got.Status.HostID, got.Status.HostIP, got.Spec.AuthToken)
+	}
+
+	draining := got.Status.Replacement
+	if draining == nil || draining.HostStatus != "draining" || draining.HostID != "fake-1" {
+		t.Fatalf("want fake-1 to be draining, got %+v", draining)
+	}
+	if draining.AuthToken != "old-token" || draining.ProvisionedAt == nil {
+		t.Errorf("want the token and provisioning time of fake-1 to be kept, got %+v", draining)
+	}
+}
+
+func TestSyncReplacementDeletesVerifiedExitNode(t *testing.T) {
+	f := newFixture(t, bluegreen)
+	f.create(newReplacingTunnel(f, "app"))
+
+	if _, err := f.controller.syncReplacement(f.get("app")); err != nil {
+		t.Fatalf("error moving client: %s", err.Error())
+	}
+
+	// The tunnel is verified once the IP of fake-2 is published
+	tunnel := f.get("app")
+	tunnel.Status.Conditions = setCondition(tunnel.Status.Conditions, inletsv1alpha1.TunnelCondition{
+		Type:   inletsv1alpha1.TunnelPublished,
+		Status: corev1.ConditionTrue,
+	})
+
+	if stop, err := f.controller.syncReplacement(tunnel); err != nil || !stop {
+		t.Fatalf("want the old exit-node to be deleted, got %v %v", stop, err)
+	}
+	if _, ok := f.provisioner.Host("fake-1"); ok {
+		t.Errorf("want fake-1 to be deleted")
+	}
+	if got := f.get("app"); got.Status.Replacement != nil || got.Status.HostID != "fake-2" {
+		t.Errorf("want the tunnel on fake-2 without a replacement, got %q %+v", got.Status.HostID, got.Status.Replacement)
+	}
+}
+
+func TestSyncReplacementRollsBackUnverifiedExitNode(t *testing.T) {
+	f := newFixture(t, bluegreen)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+	f.create(newReplacingTunnel(f, "app"))
+
+	if _, err := f.controller.syncReplacement(f.get("app")); err != nil {
+		t.Fatalf("error moving client: %s", err.Error())
+	}
+	<-recorder.Events
+
+	// The IP of fake-2 was never published, i.e. as no traffic flowed
+	movedAt := metav1.NewTime(time.Now().Add(-replacementDrainTimeout - time.Minute))
+	tunnel := f.get("app")
+	tunnel.Status.ProvisionedAt = &movedAt
+
+	if stop, err := f.controller.syncReplacement(tunnel); err != nil || !stop {
+		t.Fatalf("want the client to be moved back, got %v %v", stop, err)
+	}
+
+	got := f.get("app")
+	if got.Status.HostID != "fake-1" || got.Status.HostIP != "203.0.113.1" || got.Spec.AuthToken != "old-token" {
+		t.Errorf("want the tunnel back on fake-1 with the old token, got %q %q %q", got.Status.HostID, got.Status.HostIP, got.Spec.AuthToken)
+	}
+	if got.Status.Replacement != nil {
+		t.Errorf("want the replacement to be cleared, got %+v", got.Status.Replacement)
+	}
+	if got.Status.ProvisionedAt == nil || !got.Status.ProvisionedAt.Time.Before(movedAt.Time) {
+		t.Errorf("want the provisioning time of fake-1 to be restored, got %v", got.Status.ProvisionedAt)
+	}
+	if _, ok := f.provisioner.Host("fake-1"); !ok {
+		t.Errorf("want fake-1 to be kept")
+	}
+	if _, ok := f.provisioner.Host("fake-2"); ok {
+		t.Errorf("want fake-2 to be deleted")
+	}
+
+	if event := <-recorder.Events; !strings.Contains(event, ErrReplacementFailed) {
+		t.Errorf("want a %s event, got %q", ErrReplacementFailed, event)
+	}
+}
+
+func TestDeleteExitNodeKeepsReplacementWhenDeleteFails(t *testing.T) {
+	f := newFixture(t, bluegreen)
+	f.create(newReplacingTunnel(f, "app"))
+	f.provisioner.FailNext("Delete", fmt.Errorf("unavailable"))
+
+	if err := f.controller.deleteExitNode(f.get("app"), "test"); err == nil {
+		t.Fatalf("want an error when the replacement can't be deleted")
+	}
+
+	got := f.get("app")
+	if got.Status.Replacement == nil || got.Status.HostID != "fake-1" {
+		t.Errorf("want the exit-node and replacement to be kept for a retry, got %q %+v", got.Status.HostID, got.Status.Replacement)
+	}
+	if _, ok := f.provisioner.Host("fake-2"); !ok {
+		t.Errorf("want fake-2 to be kept")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	// certificateAPIVersion is the version of the cert-manager API used to
+	// create Certificates, the cert-manager client is not vendored.
+	certificateAPIVersion = "cert-manager.io/v1alpha2"
+
+	tlsProxyImage     = "ghostunnel/ghostunnel:v1.5.2"
+	tlsProxyPort      = 443
+	tlsProxyMountPath = "/etc/inlets/tls"
+)
+
+// getCertificateSecretName returns the name of the Secret which
+// cert-manager stores the certificate of a tunnel in.
+func getCertificateSecretName(tunnel *inletsv1alpha1.Tunnel) string {
+	return tunnel.Name + "-tls"
+}
+
+func validateTLS(tunnel *inletsv1alpha1.Tunnel) error {
+	if tunnel.Spec.TLS == nil {
+		return nil
+	}
+
+	if len(getTLSHostname(tunnel)) == 0 {
+		return fmt.Errorf("tls.hostname or hostname must be set")
+	}
+	if len(tunnel.Spec.TLS.IssuerName) == 0 {
+		return fmt.Errorf("tls.issuerName must be set")
+	}
+
+	switch tunnel.Spec.TLS.IssuerKind {
+	case "", "Issuer", "ClusterIssuer":
+		return nil
+	}
+	return fmt.Errorf("tls.issuerKind must be one of Issuer or ClusterIssuer, not %q", tunnel.Spec.TLS.IssuerKind)
+}
+
+// getTLSHostname returns the hostname for the certificate of a tunnel.
+func getTLSHostname(tunnel *inletsv1alpha1.Tunnel) string {
+	if len(tunnel.Spec.TLS.Hostname) > 0 {
+		return tunnel.Spec.TLS.Hostname
+	}
+	return tunnel.Spec.Hostname
+}
+
+// ensureCertificate creates a cert-manager Certificate for the hostname of
+// a tunnel with TLS, unless it already exists.
+func (c *Controller) ensureCertificate(tunnel *inletsv1alpha1.Tunnel) error {
+	issuerKind := tunnel.Spec.TLS.IssuerKind
+	if len(issuerKind) == 0 {
+		issuerKind = "Issuer"
+	}
+
+	ownerRef := metav1.NewControllerRef(tunnel, schema.GroupVersionKind{
+		Group:   inletsv1alpha1.SchemeGroupVersion.Group,
+		Version: inletsv1alpha1.SchemeGroupVersion.Version,
+		Kind:    "Tunnel",
+	})
+
+	certificate := map[string]interface{}{
+		"apiVersion": certificateAPIVersion,
+		"kind":       "Certificate",
+		"metadata": metav1.ObjectMeta{
+			Name:            getCertificateSecretName(tunnel),
+			Namespace:       tunnel.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*ownerRef},
+		},
+		"spec": map[string]interface{}{
+			"secretName": getCertificateSecretName(tunnel),
+			"dnsNames":   []string{getTLSHostname(tunnel)},
+			"issuerRef": map[string]string{
+				"name": tunnel.Spec.TLS.IssuerName,
+				"kind": issuerKind,
+			},
+		},
+	}
+
+	body, err := json.Marshal(certificate)
+	if err != nil {
+		return err
+	}
+
+	err = c.kubeclientset.Discovery().RESTClient().
+		Post().
+		AbsPath("/apis", certificateAPIVersion, "namespaces", tunnel.Namespace, "certificates").
+		SetHeader("Content-Type", "application/json").
+		Body(body).
+		Do().
+		Error()
+
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err == nil {
+		c.tunnelLog(tunnel).Info("Created certificate", "hostname", getTLSHostname(tunnel))
+	}
+	return err
+}
+
+// getTLSUpstream returns the plain-text upstream which the TLS proxy
+// forwards decrypted traffic to.
+func getTLSUpstream(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) (string, int32) {
+	if len(tunnel.Spec.Upstream) > 0 || service == nil {
+		host, port, _ := parseUpstream(tunnel.Spec.Upstream)
+		return host, port
+	}
+	return getServiceHost(service), getUpstreamPort(service)
+}
+
+// addTLSProxy adds a container to the client Pod which terminates TLS on
+// port 443 with the certificate issued by cert-manager, and mounts the
+// Secret of the certificate into it.
+func addTLSProxy(deployment *appsv1.Deployment, tunnel *inletsv1alpha1.Tunnel, upstreamHost string, upstreamPort int32) {
+	podSpec := &deployment.Spec.Template.Spec
+
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "tls",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: getCertificateSecretName(tunnel),
+			},
+		},
+	})
+
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{
+		Name:            "tls-proxy",
+		Image:           tlsProxyImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Args: []string{
+			"server",
+			fmt.Sprintf("--listen=0.0.0.0:%d", tlsProxyPort),
+			fmt.Sprintf("--target=%s:%d", upstreamHost, upstreamPort),
+			"--cert=" + tlsProxyMountPath + "/tls.crt",
+			"--key=" + tlsProxyMountPath + "/tls.key",
+			"--disable-authentication",
+			"--unsafe-target",
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "tls",
+				MountPath: tlsProxyMountPath,
+				ReadOnly:  true,
+			},
+		},
+	})
+}
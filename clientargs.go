@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// allowedClientArgs are the flags of the inlets and inlets-pro clients
+// which can be set with extraArgs. Flags managed by the operator, such as
+// the upstream, remote, token and license, cannot be overridden.
+var allowedClientArgs = map[string]bool{
+	"--auto-tls":          true,
+	"--log-format":        true,
+	"--log-level":         true,
+	"--print-token":       true,
+	"--strict-forwarding": true,
+	"--timeout":           true,
+}
+
+// getClientArgName returns the flag of an argument in the form --flag or
+// --flag=value.
+func getClientArgName(arg string) string {
+	return strings.SplitN(arg, "=", 2)[0]
+}
+
+func validateClientArgs(tunnel *inletsv1alpha1.Tunnel) error {
+	if tunnel.Spec.Client == nil {
+		return nil
+	}
+
+	for _, arg := range tunnel.Spec.Client.ExtraArgs {
+		if !allowedClientArgs[getClientArgName(arg)] {
+			return fmt.Errorf("client.extraArgs cannot contain %q, allowed flags are: %s",
+				arg, strings.Join(getAllowedClientArgs(), ", "))
+		}
+	}
+	return nil
+}
+
+func getAllowedClientArgs() []string {
+	names := []string{}
+	for name := range allowedClientArgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// getExtraClientArgs returns the extraArgs of a tunnel which are allowed,
+// any others are left out.
+func getExtraClientArgs(tunnel *inletsv1alpha1.Tunnel) []string {
+	args := []string{}
+	if tunnel.Spec.Client == nil {
+		return args
+	}
+
+	for _, arg := range tunnel.Spec.Client.ExtraArgs {
+		if allowedClientArgs[getClientArgName(arg)] {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
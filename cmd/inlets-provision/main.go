@@ -0,0 +1,347 @@
+// inlets-provision creates, inspects, lists and deletes exit-nodes with
+// pkg/provision. The operator runs it in a Job for each exit-node when
+// started with --executor=job, so that cloud operations survive restarts of
+// the operator. It can also be run from a laptop to provision an exit-node
+// by hand, check an access key or clean up exit-nodes which were left
+// behind.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "create":
+		err = create(os.Args[2:])
+	case "status":
+		err = status(os.Args[2:])
+	case "logs":
+		err = logs(os.Args[2:])
+	case "delete":
+		err = remove(os.Args[2:])
+	case "list":
+		err = list(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: inlets-provision create|status|logs|delete|list [flags]\n")
+	os.Exit(2)
+}
+
+// getAccessKey reads the access key from a file, or from the ACCESS_KEY
+// environment variable.
+func getAccessKey(file string) (string, error) {
+	if len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	if key := os.Getenv("ACCESS_KEY"); len(key) > 0 {
+		return key, nil
+	}
+	return "", fmt.Errorf("give an access key with --access-key-file or ACCESS_KEY")
+}
+
+// parsePairs parses pairs such as "team=payments,environment=prod"
+func parsePairs(value string) map[string]string {
+	pairs := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) == 2 {
+			pairs[parts[0]] = parts[1]
+		}
+	}
+	return pairs
+}
+
+// providerFlags are the flags of every command which choose the provider
+// and its access key.
+type providerFlags struct {
+	provider      string
+	accessKeyFile string
+	plugins       string
+}
+
+func addProviderFlags(flags *flag.FlagSet) *providerFlags {
+	f := &providerFlags{}
+	flags.StringVar(&f.provider, "provider", "", "The infrastructure provider - 'packet', 'digitalocean', 'fake' or one of --provider-plugins")
+	flags.StringVar(&f.accessKeyFile, "access-key-file", "", "Read the access key from a file instead of ACCESS_KEY")
+	flags.StringVar(&f.plugins, "provider-plugins", "", "Plugins which provision the hosts of providers, by provider, i.e. 'linode=/plugins/inlets-provisioner-linode'")
+	return f
+}
+
+// provisioner returns the provisioner of the provider from the same
+// registry as the operator, so a plugin takes precedence over a built-in
+// provider of the same name. Close it with closeProvisioner.
+func (f *providerFlags) provisioner() (provision.Provisioner, error) {
+	for provider, path := range parsePairs(f.plugins) {
+		provision.RegisterPlugin(provider, path)
+	}
+
+	accessKey, err := getAccessKey(f.accessKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return provision.NewProvisioner(f.provider, accessKey)
+}
+
+// closeProvisioner stops the process of a plugin.
+func closeProvisioner(provisioner provision.Provisioner) {
+	if closer, ok := provisioner.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// create provisions a host and prints its ID. The userdata is read from
+// the USERDATA environment variable, since it holds the token of the tunnel.
+func create(args []string) error {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+
+	providerFlags := addProviderFlags(flags)
+	host := provision.BasicHost{Additional: map[string]string{}}
+	flags.StringVar(&host.Name, "name", "", "The name of the host")
+	flags.StringVar(&host.Region, "region", "", "The region to provision the host into")
+	flags.StringVar(&host.Plan, "plan", "", "The plan or size of the host")
+	flags.StringVar(&host.OS, "os", "", "The OS image of the host")
+	projectID := flags.String("project-id", "", "The project ID if using Packet.com as the provider")
+	tags := flags.String("tags", "", "Tags for the host, i.e. 'team=payments'")
+	monitoring := flags.Bool("monitoring", false, "Install the monitoring agent of the provider, for the memory usage of the host")
+	outputFile := flags.String("output-file", "", "Also write the ID of the host to a file, i.e. /dev/termination-log")
+	wait := flags.Duration("wait", 0, "Wait up to this long for the host to become active, i.e. '5m'")
+	flags.Parse(args)
+
+	provisioner, err := providerFlags.provisioner()
+	if err != nil {
+		return err
+	}
+	defer closeProvisioner(provisioner)
+
+	host.UserData = os.Getenv("USERDATA")
+	host.Tags = parsePairs(*tags)
+	if len(*projectID) > 0 {
+		host.Additional["project_id"] = *projectID
+	}
+	if *monitoring {
+		host.Additional["monitoring"] = "true"
+	}
+
+	res, err := provisioner.Provision(host)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(res.ID)
+
+	if len(*outputFile) > 0 {
+		if err := ioutil.WriteFile(*outputFile, []byte(res.ID), 0644); err != nil {
+			return err
+		}
+	}
+
+	if *wait > 0 {
+		return waitForActive(provisioner, res.ID, *wait)
+	}
+	return nil
+}
+
+// waitForActive polls the status of a host until it is active, and logs
+// its IP.
+func waitForActive(provisioner provision.Provisioner, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	last := ""
+	for {
+		res, err := provisioner.Status(id)
+		if err != nil {
+			return err
+		}
+		if res.Status == "active" {
+			log.Printf("Host %s is active with IP: %s\n", id, res.IP)
+			return nil
+		}
+		if res.Status != last {
+			log.Printf("Host %s is %s\n", id, res.Status)
+			last = res.Status
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("host %s did not become active within %s, is %s", id, timeout, res.Status)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// status prints the status and IP of a host, and its name, region, plan
+// and OS when the provider can inspect it.
+func status(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+
+	providerFlags := addProviderFlags(flags)
+	id := flags.String("id", "", "The ID of the host")
+	flags.Parse(args)
+
+	if len(*id) == 0 {
+		return fmt.Errorf("give the ID of the host with --id")
+	}
+
+	provisioner, err := providerFlags.provisioner()
+	if err != nil {
+		return err
+	}
+	defer closeProvisioner(provisioner)
+
+	res, err := provisioner.Status(*id)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", res.ID)
+	fmt.Fprintf(w, "Status:\t%s\n", res.Status)
+	fmt.Fprintf(w, "IP:\t%s\n", res.IP)
+
+	if inspector, ok := provisioner.(provision.Inspector); ok {
+		host, err := inspector.Inspect(*id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Name:\t%s\n", host.Name)
+		fmt.Fprintf(w, "Region:\t%s\n", host.Region)
+		fmt.Fprintf(w, "Plan:\t%s\n", host.Plan)
+		fmt.Fprintf(w, "OS:\t%s\n", host.OS)
+	}
+	return w.Flush()
+}
+
+// logs prints what the provider did to a host, oldest first, i.e. to see
+// why it did not become active.
+func logs(args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+
+	providerFlags := addProviderFlags(flags)
+	id := flags.String("id", "", "The ID of the host")
+	flags.Parse(args)
+
+	if len(*id) == 0 {
+		return fmt.Errorf("give the ID of the host with --id")
+	}
+
+	provisioner, err := providerFlags.provisioner()
+	if err != nil {
+		return err
+	}
+	defer closeProvisioner(provisioner)
+
+	lister, ok := provisioner.(provision.EventLister)
+	if !ok {
+		return fmt.Errorf("provider %s can't list the events of hosts", providerFlags.provider)
+	}
+
+	events, err := lister.Events(*id)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTYPE\tSTATUS\tMESSAGE")
+	for _, event := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", event.Time.Format(time.RFC3339), event.Type, event.Status, event.Message)
+	}
+	return w.Flush()
+}
+
+// remove deletes a host by its ID.
+func remove(args []string) error {
+	flags := flag.NewFlagSet("delete", flag.ExitOnError)
+
+	providerFlags := addProviderFlags(flags)
+	id := flags.String("id", "", "The ID of the host")
+	flags.Parse(args)
+
+	if len(*id) == 0 {
+		return fmt.Errorf("give the ID of the host with --id")
+	}
+
+	provisioner, err := providerFlags.provisioner()
+	if err != nil {
+		return err
+	}
+	defer closeProvisioner(provisioner)
+
+	if err := provisioner.Delete(*id); err != nil {
+		return err
+	}
+
+	log.Printf("Deleted host: %s\n", *id)
+	return nil
+}
+
+// list prints the hosts with all of the tags, oldest first. By default
+// these are the exit-nodes of every operator which uses the access key, so
+// ones which were left behind can be found by their inlets-tunnel tag and
+// deleted.
+func list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+
+	providerFlags := addProviderFlags(flags)
+	tags := flags.String("tags", "managed-by=inlets-operator", "List the hosts with all of these tags, i.e. 'team=payments'")
+	projectID := flags.String("project-id", "", "The project ID if using Packet.com as the provider")
+	flags.Parse(args)
+
+	provisioner, err := providerFlags.provisioner()
+	if err != nil {
+		return err
+	}
+	defer closeProvisioner(provisioner)
+
+	lister, ok := provisioner.(provision.HostLister)
+	if !ok {
+		return fmt.Errorf("provider %s can't list hosts", providerFlags.provider)
+	}
+
+	filter := provision.HostFilter{Tags: parsePairs(*tags), Additional: map[string]string{}}
+	if len(*projectID) > 0 {
+		filter.Additional["project_id"] = *projectID
+	}
+
+	hosts, err := lister.List(filter)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].Created.Before(hosts[j].Created)
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tSTATUS\tIP\tCREATED\tTAGS")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", host.ID, host.Name, host.Status, host.IP,
+			host.Created.Format(time.RFC3339), strings.Join(host.Tags, ","))
+	}
+	return w.Flush()
+}
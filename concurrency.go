@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// providerBusyRetry is how long a tunnel waits before it asks again for a
+// slot to provision its exit-node, when the provider is at its bound.
+const providerBusyRetry = 5 * time.Second
+
+// pendingExpiry is how long a namespace keeps its turn for a slot after it
+// last asked for one, so that a namespace whose Tunnels were deleted whilst
+// they waited doesn't hold up the others.
+const pendingExpiry = 3 * providerBusyRetry
+
+// errProviderBusy is returned when a provider is at its bound, so the
+// exit-node is provisioned on a later sync instead of holding a worker.
+var errProviderBusy = errors.New("the provider is at its bound of --provider-concurrency")
+
+// fairLimiter bounds the calls to a provider which provision or delete
+// hosts at once. When it is full, deletes wait in a queue for each
+// namespace, and provisions are refused by tryAcquire and asked for again
+// on a later sync. Freed slots go to the namespaces in turn, so that a
+// namespace which creates many Tunnels at once doesn't hold up the others.
+type fairLimiter struct {
+	lock     sync.Mutex
+	capacity int
+	inUse    int
+	waiting  map[string][]chan struct{}
+	order    []string
+
+	// pending are the namespaces which were refused a slot by tryAcquire,
+	// in turn, and asked are when each last asked for one.
+	pending []string
+	asked   map[string]time.Time
+}
+
+func newFairLimiter(capacity int) *fairLimiter {
+	return &fairLimiter{
+		capacity: capacity,
+		waiting:  map[string][]chan struct{}{},
+		asked:    map[string]time.Time{},
+	}
+}
+
+// tryAcquire takes a slot for a call on behalf of a namespace without
+// waiting. It returns false when there is no slot, or when the free slots
+// are the turn of other namespaces, and the namespace then takes its turn
+// for a later call. A nil limiter has no bound.
+func (l *fairLimiter) tryAcquire(namespace string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if !l.hasTurn(namespace, time.Now()) {
+		return false
+	}
+
+	l.inUse++
+	for i, pending := range l.pending {
+		if pending == namespace {
+			l.pending = append(l.pending[:i], l.pending[i+1:]...)
+			delete(l.asked, namespace)
+			break
+		}
+	}
+	return true
+}
+
+// available returns true when tryAcquire would take a slot for the
+// namespace, so that work which comes before the call is only done when it
+// can be made. Otherwise, the namespace takes its turn as tryAcquire does.
+func (l *fairLimiter) available(namespace string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.hasTurn(namespace, time.Now())
+}
+
+// hasTurn returns true when a slot is free for the namespace, or records
+// that the namespace is waiting for one. It is called with the lock held.
+func (l *fairLimiter) hasTurn(namespace string, now time.Time) bool {
+	kept := l.pending[:0]
+	for _, pending := range l.pending {
+		if now.Sub(l.asked[pending]) < pendingExpiry {
+			kept = append(kept, pending)
+		} else {
+			delete(l.asked, pending)
+		}
+	}
+	l.pending = kept
+
+	free := l.capacity - l.inUse
+	if free > 0 && len(l.order) == 0 {
+		if len(l.pending) < free {
+			return true
+		}
+		for _, pending := range l.pending[:free] {
+			if pending == namespace {
+				return true
+			}
+		}
+	}
+
+	if _, ok := l.asked[namespace]; !ok {
+		l.pending = append(l.pending, namespace)
+	}
+	l.asked[namespace] = now
+	return false
+}
+
+// acquire waits for a slot for a call on behalf of a namespace. A nil
+// limiter has no bound.
+func (l *fairLimiter) acquire(namespace string) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	if l.inUse < l.capacity && len(l.order) == 0 {
+		l.inUse++
+		l.lock.Unlock()
+		return
+	}
+
+	ready := make(chan struct{})
+	if len(l.waiting[namespace]) == 0 {
+		l.order = append(l.order, namespace)
+	}
+	l.waiting[namespace] = append(l.waiting[namespace], ready)
+	l.lock.Unlock()
+
+	<-ready
+}
+
+// release frees a slot, or hands it to the next namespace which is
+// waiting.
+func (l *fairLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.order) == 0 {
+		l.inUse--
+		return
+	}
+
+	namespace := l.order[0]
+	l.order = l.order[1:]
+
+	queue := l.waiting[namespace]
+	next := queue[0]
+	if len(queue) > 1 {
+		l.waiting[namespace] = queue[1:]
+		l.order = append(l.order, namespace)
+	} else {
+		delete(l.waiting, namespace)
+	}
+	close(next)
+}
+
+// queued returns how many deletes, and namespaces with provisions, are
+// waiting for a slot.
+func (l *fairLimiter) queued() int {
+	if l == nil {
+		return 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	total := len(l.pending)
+	for _, queue := range l.waiting {
+		total += len(queue)
+	}
+	return total
+}
+
+// getProviderLimiter returns the limiter of the calls to a provider, or nil
+// when --provider-concurrency doesn't bound them.
+func (c *Controller) getProviderLimiter(provider string) *fairLimiter {
+	capacity, ok := c.infra().ProviderConcurrency[provider]
+	if !ok {
+		capacity, ok = c.infra().ProviderConcurrency[""]
+	}
+	if !ok || capacity <= 0 {
+		return nil
+	}
+
+	c.limitersLock.Lock()
+	defer c.limitersLock.Unlock()
+
+	limiter, ok := c.limiters[provider]
+	if !ok || limiter.capacity != capacity {
+		limiter = newFairLimiter(capacity)
+		c.limiters[provider] = limiter
+	}
+	return limiter
+}
+
+// parseProviderConcurrency parses a default bound and bounds per provider
+// such as "4,packet=2".
+func parseProviderConcurrency(value string) (map[string]int, error) {
+	bounds := map[string]int{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		provider := ""
+		if index := strings.Index(entry, "="); index > -1 {
+			provider = entry[:index]
+			entry = entry[index+1:]
+		}
+
+		bound, err := strconv.Atoi(entry)
+		if err != nil || bound < 0 {
+			return nil, fmt.Errorf("concurrency must be a number of 0 or more, not %q", entry)
+		}
+		bounds[provider] = bound
+	}
+	return bounds, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFairLimiterTryAcquire(t *testing.T) {
+	l := newFairLimiter(2)
+
+	if !l.tryAcquire("team-a") || !l.tryAcquire("team-a") {
+		t.Fatalf("want the first two calls to take a slot")
+	}
+	if l.tryAcquire("team-a") {
+		t.Errorf("want a call to be refused when there is no slot")
+	}
+	if l.tryAcquire("team-b") {
+		t.Errorf("want a call to be refused when there is no slot")
+	}
+	if got := l.queued(); got != 2 {
+		t.Errorf("want 2 namespaces queued, got %d", got)
+	}
+
+	// team-a asked first, so the freed slot is its turn
+	l.release()
+	if l.available("team-b") {
+		t.Errorf("want the slot to be the turn of team-a")
+	}
+	if !l.tryAcquire("team-a") {
+		t.Errorf("want team-a to take its turn")
+	}
+
+	// team-a took its turn, so the next slot goes to team-b even though
+	// team-a asks for it first
+	l.release()
+	if l.tryAcquire("team-a") {
+		t.Errorf("want the slot to be the turn of team-b")
+	}
+	if !l.available("team-b") || !l.tryAcquire("team-b") {
+		t.Errorf("want team-b to take its turn")
+	}
+}
+
+func TestFairLimiterPendingExpires(t *testing.T) {
+	l := newFairLimiter(1)
+
+	if !l.tryAcquire("team-a") {
+		t.Fatalf("want the first call to take a slot")
+	}
+	if l.tryAcquire("team-b") {
+		t.Fatalf("want a call to be refused when there is no slot")
+	}
+	l.release()
+
+	// team-b stopped asking, i.e. its Tunnel was deleted
+	l.asked["team-b"] = time.Now().Add(-pendingExpiry)
+
+	if !l.tryAcquire("team-a") {
+		t.Errorf("want team-a to take the slot once the turn of team-b expired")
+	}
+	if got := l.queued(); got != 0 {
+		t.Errorf("want no namespaces queued, got %d", got)
+	}
+}
+
+func TestFairLimiterDeletesComeFirst(t *testing.T) {
+	l := newFairLimiter(1)
+
+	if !l.tryAcquire("team-a") {
+		t.Fatalf("want the first call to take a slot")
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire("team-b")
+		close(acquired)
+	}()
+
+	for l.queued() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	l.release()
+	<-acquired
+
+	if l.tryAcquire("team-a") {
+		t.Errorf("want the slot to be held by the delete of team-b")
+	}
+}
+
+func TestFairLimiterNil(t *testing.T) {
+	var l *fairLimiter
+	if !l.tryAcquire("team-a") || !l.available("team-a") {
+		t.Errorf("want a nil limiter to have no bound")
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// setCondition adds or replaces the condition of the same type, keeping the
+// last transition time when the status has not changed.
+func setCondition(conditions []inletsv1alpha1.TunnelCondition, condition inletsv1alpha1.TunnelCondition) []inletsv1alpha1.TunnelCondition {
+	condition.LastTransitionTime = metav1.Now()
+
+	for i, existing := range conditions {
+		if existing.Type == condition.Type {
+			if existing.Status == condition.Status {
+				condition.LastTransitionTime = existing.LastTransitionTime
+			}
+			conditions[i] = condition
+			return conditions
+		}
+	}
+
+	return append(conditions, condition)
+}
+
+// removeCondition removes the condition with the given type.
+func removeCondition(conditions []inletsv1alpha1.TunnelCondition, conditionType inletsv1alpha1.TunnelConditionType) []inletsv1alpha1.TunnelCondition {
+	var result []inletsv1alpha1.TunnelCondition
+	for _, existing := range conditions {
+		if existing.Type != conditionType {
+			result = append(result, existing)
+		}
+	}
+	return result
+}
+
+// hasCondition returns true when a condition with the same type, status,
+// reason and message is present.
+func hasCondition(conditions []inletsv1alpha1.TunnelCondition, condition inletsv1alpha1.TunnelCondition) bool {
+	for _, existing := range conditions {
+		if existing.Type == condition.Type &&
+			existing.Status == condition.Status &&
+			existing.Reason == condition.Reason &&
+			existing.Message == condition.Message {
+			return true
+		}
+	}
+	return false
+}
+
+// hasConditionType returns true when a condition with the given type is present.
+func hasConditionType(conditions []inletsv1alpha1.TunnelCondition, conditionType inletsv1alpha1.TunnelConditionType) bool {
+	for _, existing := range conditions {
+		if existing.Type == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+// getCondition returns the condition with the given type, or nil.
+func getCondition(conditions []inletsv1alpha1.TunnelCondition, conditionType inletsv1alpha1.TunnelConditionType) *inletsv1alpha1.TunnelCondition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/yaml"
+)
+
+// configReloadInterval is how often the config file is read for changes.
+const configReloadInterval = 10 * time.Second
+
+// OperatorConfig is read from the file given with --config, i.e. a
+// ConfigMap mounted into the operator's Pod. Fields which are set override
+// the flags of the operator, and are applied to Tunnels synced after the
+// file changes.
+type OperatorConfig struct {
+	Provider  string `json:"provider,omitempty"`
+	Region    string `json:"region,omitempty"`
+	ProjectID string `json:"projectID,omitempty"`
+
+	// Failover is a list of providers and regions, i.e. "digitalocean:nyc1"
+	Failover []string `json:"failover,omitempty"`
+
+	MaxExitNodes    *int     `json:"maxExitNodes,omitempty"`
+	MaxMonthlySpend *float64 `json:"maxMonthlySpend,omitempty"`
+
+	ClientImage      string `json:"clientImage,omitempty"`
+	ProClientImage   string `json:"proClientImage,omitempty"`
+	ProvisionerImage string `json:"provisionerImage,omitempty"`
+}
+
+// applyTo returns a copy of the configuration from the flags of the
+// operator with the fields of the config file applied.
+func (o *OperatorConfig) applyTo(base InfraConfig) *InfraConfig {
+	infra := base
+
+	if len(o.Provider) > 0 {
+		infra.Provider = o.Provider
+	}
+	if len(o.Region) > 0 {
+		infra.Region = o.Region
+	}
+	if len(o.ProjectID) > 0 {
+		infra.ProjectID = o.ProjectID
+	}
+	if len(o.Failover) > 0 {
+		infra.Failover = parseFailover(strings.Join(o.Failover, ","))
+	}
+	if o.MaxExitNodes != nil {
+		infra.MaxExitNodes = *o.MaxExitNodes
+	}
+	if o.MaxMonthlySpend != nil {
+		infra.MaxMonthlySpend = *o.MaxMonthlySpend
+	}
+	if len(o.ClientImage) > 0 {
+		infra.InletsClientImage = o.ClientImage
+	}
+	if len(o.ProClientImage) > 0 {
+		infra.ProClientImage = o.ProClientImage
+	}
+	if len(o.ProvisionerImage) > 0 {
+		infra.ProvisionerImage = o.ProvisionerImage
+	}
+
+	return &infra
+}
+
+// loadConfig reads the config file and applies it to the configuration
+// from the flags of the operator.
+func loadConfig(data []byte, base InfraConfig) (*InfraConfig, error) {
+	config := OperatorConfig{}
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	return config.applyTo(base), nil
+}
+
+// infra returns the current configuration of the operator.
+func (c *Controller) infra() *InfraConfig {
+	c.infraLock.RLock()
+	defer c.infraLock.RUnlock()
+
+	return c.infraConfig
+}
+
+func (c *Controller) setInfra(infra *InfraConfig) {
+	c.infraLock.Lock()
+	defer c.infraLock.Unlock()
+
+	c.infraConfig = infra
+}
+
+// watchConfig reloads the config file whenever it changes, until stopCh is
+// closed. A file which cannot be read or parsed is logged, and the last
+// good configuration is kept.
+func (c *Controller) watchConfig(file string, base InfraConfig, last []byte, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			utilruntime.HandleError(err)
+			return
+		}
+
+		if bytes.Equal(data, last) {
+			return
+		}
+
+		infra, err := loadConfig(data, base)
+		if err != nil {
+			logWith("file", file).Error(err, "Error reloading config file")
+			return
+		}
+
+		last = data
+		c.setInfra(infra)
+		logWith("file", file, "provider", infra.Provider, "region", infra.Region).Info("Reloaded config file")
+	}, configReloadInterval, stopCh)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	reasonClientConnected    = "Connected"
+	reasonClientDisconnected = "Disconnected"
+	reasonClientRestarted    = "ClientRestarted"
+)
+
+// checkClientConnections checks that the client of each active tunnel is
+// connected to its exit-node. A client which has been disconnected for
+// longer than the timeout is restarted, and when that does not help the
+// exit-node is replaced.
+func (c *Controller) checkClientConnections() {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		if tunnel.Status.HostStatus != "active" || tunnel.Spec.ClientDeploymentRef == nil {
+			continue
+		}
+
+		// The operator does not own the Pods of sidecar clients
+		if tunnel.Spec.ClientMode == "sidecar" {
+			continue
+		}
+
+		if paused, _ := isPaused(tunnel); paused || !c.ownsObject(tunnel) {
+			continue
+		}
+
+		if err := c.syncClientConnection(tunnel, time.Now()); err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+}
+
+func (c *Controller) syncClientConnection(tunnel *inletsv1alpha1.Tunnel, now time.Time) error {
+	connErr := c.probeClientConnection(tunnel)
+	c.metrics.observeProbe(tunnel, c.getTunnelProvider(tunnel), probeClient, connErr)
+
+	condition := inletsv1alpha1.TunnelCondition{
+		Type:   inletsv1alpha1.TunnelClientConnected,
+		Status: corev1.ConditionTrue,
+		Reason: reasonClientConnected,
+	}
+
+	existing := getCondition(tunnel.Status.Conditions, inletsv1alpha1.TunnelClientConnected)
+
+	if connErr != nil {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = reasonClientDisconnected
+		condition.Message = connErr.Error()
+
+		if existing != nil && existing.Status == corev1.ConditionFalse {
+			condition.Reason = existing.Reason
+			down := now.Sub(existing.LastTransitionTime.Time)
+			timeout := c.infra().ClientDisconnectTimeout
+
+			switch {
+			case existing.Reason == reasonClientDisconnected && down > timeout:
+				c.tunnelLog(tunnel).Info("Restarting client", "disconnectedFor", down.Round(time.Second))
+				c.recorder.Eventf(tunnel, corev1.EventTypeWarning, ErrClientDisconnected,
+					"Restarting client, disconnected from exit-node %s for %s: %s",
+					tunnel.Status.HostIP, down.Round(time.Second), connErr.Error())
+
+				if err := c.restartClient(tunnel); err != nil {
+					return err
+				}
+				condition.Reason = reasonClientRestarted
+
+			case existing.Reason == reasonClientRestarted && down > 2*timeout:
+				c.recorder.Eventf(tunnel, corev1.EventTypeWarning, ErrClientDisconnected,
+					"Replacing exit-node %s, client still disconnected after a restart: %s",
+					tunnel.Status.HostIP, connErr.Error())
+
+				return c.deleteExitNode(tunnel, "client-disconnected")
+			}
+		}
+	}
+
+	if hasCondition(tunnel.Status.Conditions, condition) {
+		return nil
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, condition)
+	_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err
+}
+
+// probeClientConnection returns an error when no client Pod of a tunnel is
+// ready, or when the data-ports of an inlets-pro exit-node are closed,
+// since inlets-pro only opens them whilst a client is connected.
+func (c *Controller) probeClientConnection(tunnel *inletsv1alpha1.Tunnel) error {
+	ready, err := c.getReadyClients(tunnel)
+	if err != nil {
+		return err
+	}
+	if ready == 0 {
+		return fmt.Errorf("no client pods are ready")
+	}
+
+	// The operator may not be allowed to connect to the data-ports
+	if !isProTunnel(tunnel) || len(tunnel.Spec.AllowedSourceCIDRs) > 0 {
+		return nil
+	}
+
+	service, err := c.getTunnelService(tunnel)
+	if err != nil {
+		return err
+	}
+
+	if err := probeTunnel(tunnel, service); err != nil {
+		return fmt.Errorf("data-port of exit-node is closed: %s", err.Error())
+	}
+	return nil
+}
+
+// getReadyClients returns the number of ready Pods of the client
+// Deployment or DaemonSet of a tunnel.
+func (c *Controller) getReadyClients(tunnel *inletsv1alpha1.Tunnel) (int32, error) {
+	name := tunnel.Spec.ClientDeploymentRef.Name
+
+	if tunnel.Spec.ClientMode == "daemonset" {
+		daemonSet, err := c.kubeclientset.AppsV1().DaemonSets(tunnel.Namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return 0, err
+		}
+		return daemonSet.Status.NumberReady, nil
+	}
+
+	deployment, err := c.deploymentsLister.Deployments(tunnel.Namespace).Get(name)
+	if err != nil {
+		return 0, err
+	}
+	return deployment.Status.ReadyReplicas, nil
+}
+
+// restartClient deletes the client Pods of a tunnel, so that they are
+// re-created and dial the exit-node again.
+func (c *Controller) restartClient(tunnel *inletsv1alpha1.Tunnel) error {
+	var selector *metav1.LabelSelector
+
+	if tunnel.Spec.ClientMode == "daemonset" {
+		daemonSet, err := c.kubeclientset.AppsV1().DaemonSets(tunnel.Namespace).Get(tunnel.Spec.ClientDeploymentRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		selector = daemonSet.Spec.Selector
+	} else {
+		deployment, err := c.deploymentsLister.Deployments(tunnel.Namespace).Get(tunnel.Spec.ClientDeploymentRef.Name)
+		if err != nil {
+			return err
+		}
+		selector = deployment.Spec.Selector
+	}
+
+	return c.deleteClientPods(tunnel.Namespace, selector)
+}
+
+func (c *Controller) deleteClientPods(namespace string, labelSelector *metav1.LabelSelector) error {
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return err
+	}
+
+	pods := c.kubeclientset.CoreV1().Pods(namespace)
+	list, err := pods.List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range list.Items {
+		if err := pods.Delete(pod.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	password "github.com/sethvargo/go-password/password"
-
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
@@ -37,10 +41,88 @@ import (
 
 const controllerAgentName = "sample-controller"
 const inletsControlPort = 8080
+const inletsProControlPort = 8123
+
+// hostnameAnnotation can be set on a Service to publish a hostname
+// alongside the IP of the exit-node in the Service's status.
+const hostnameAnnotation = "dev.inlets.hostname"
+
+// nodePortAnnotation can be set to "true" on a Service of type NodePort
+// to tunnel it, with the client forwarding traffic to the node port.
+const nodePortAnnotation = "dev.inlets.nodeport"
+
+// hostIPEnv is the environment variable which holds the IP of the node in
+// the client container.
+const hostIPEnv = "HOST_IP"
+
+// externalDNSHostnameAnnotation and externalDNSTargetAnnotation are set on a
+// Service with a hostname, so that external-dns publishes a record for the
+// hostname with the IPs of its exit-nodes.
+const (
+	externalDNSHostnameAnnotation = "external-dns.alpha.kubernetes.io/hostname"
+	externalDNSTargetAnnotation   = "external-dns.alpha.kubernetes.io/target"
+)
+
+// protocolAnnotation can be set on a Service to "tcp" or "udp" to tunnel
+// its ports at L4 with inlets-pro.
+const protocolAnnotation = "dev.inlets.protocol"
+
+// proxyProtocolAnnotation can be set on a Service to enable the PROXY
+// protocol for its tunnel.
+const proxyProtocolAnnotation = "dev.inlets.proxy-protocol"
+
+// rotationPolicyAnnotation can be set on a Service to replace the exit-node
+// of its tunnel on a schedule.
+const rotationPolicyAnnotation = "dev.inlets.rotation-policy"
+
+// regionsAnnotation can be set on a Service to provision an exit-node and
+// client in each of a comma-separated list of regions.
+const regionsAnnotation = "dev.inlets.regions"
+
+// pausedAnnotation stops a Tunnel from being reconciled when set to "true",
+// or when set to "deprovision" also deletes its exit-node and client until
+// the annotation is removed.
+const pausedAnnotation = "operator.inlets.dev/paused"
 
 const (
 	// SuccessSynced is used as part of the Event 'reason' when a Tunnel is synced
 	SuccessSynced = "Synced"
+	// SuccessPaused is used as part of the Event 'reason' when the exit-node
+	// of a paused Tunnel is deprovisioned
+	SuccessPaused = "Paused"
+	// SuccessReplaced is used as part of the Event 'reason' when the client
+	// of a Tunnel was moved over to a new exit-node
+	SuccessReplaced = "Replaced"
+	// SuccessAdopted is used as part of the Event 'reason' when a Tunnel
+	// takes over the exit-node kept after a Tunnel of the same name was
+	// deleted, or an exit-node from the warm pool
+	SuccessAdopted = "Adopted"
+	// SuccessScaledToZero is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel is deprovisioned since its Service has no endpoints
+	SuccessScaledToZero = "ScaledToZero"
+	// SuccessOutsideSchedule is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel is deprovisioned at the end of its schedule
+	SuccessOutsideSchedule = "OutsideSchedule"
+	// SuccessRotated is used as part of the Event 'reason' when the exit-node
+	// of a Tunnel is replaced due to its rotation policy
+	SuccessRotated = "Rotated"
+	// SuccessSSHKeyRotated is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel is replaced to rotate its SSH key
+	SuccessSSHKeyRotated = "SSHKeyRotated"
+	// SuccessTokenRotated is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel is replaced since another Tunnel has its token
+	SuccessTokenRotated = "TokenRotated"
+	// SuccessTokenChanged is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel is replaced since the token in its
+	// authTokenFrom changed
+	SuccessTokenChanged = "TokenChanged"
+	// SuccessPortsChanged is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel is replaced since the ports of its Service need
+	// another protocol
+	SuccessPortsChanged = "PortsChanged"
+	// AuditRecorded is used as part of the Event 'reason' when an exit-node
+	// is provisioned or deleted for a Tunnel and --audit-events is set
+	AuditRecorded = "AuditRecorded"
 	// ErrResourceExists is used as part of the Event 'reason' when a Tunnel fails
 	// to sync due to a Deployment of the same name already existing.
 	ErrResourceExists = "ErrResourceExists"
@@ -51,6 +133,59 @@ const (
 	// MessageResourceSynced is the message used for an Event fired when a Tunnel
 	// is synced successfully
 	MessageResourceSynced = "Tunnel synced successfully"
+
+	// ErrInvalidSpec is used as part of the Event 'reason' when a Tunnel
+	// cannot be provisioned due to an invalid spec
+	ErrInvalidSpec = "ErrInvalidSpec"
+	// ErrNamespaceDenied is used as part of the Event 'reason' when a
+	// Tunnel or Service is in a namespace of --denied-namespaces
+	ErrNamespaceDenied = "ErrNamespaceDenied"
+	// ErrImageNotVerified is used as part of the Event 'reason' when the
+	// client image of a Tunnel is not signed with the key of --cosign-key
+	ErrImageNotVerified = "ErrImageNotVerified"
+	// ErrReleaseNotVerified is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel would download a release with no checksum in
+	// --release-checksums
+	ErrReleaseNotVerified = "ErrReleaseNotVerified"
+	// ErrLicenseRequired is used as part of the Event 'reason' when a Tunnel
+	// needs inlets-pro, but no license was given to the operator
+	ErrLicenseRequired = "ErrLicenseRequired"
+	// ErrQuotaExceeded is used as part of the Event 'reason' when a Tunnel
+	// is held back as it would exceed the quota of the operator
+	ErrQuotaExceeded = "ErrQuotaExceeded"
+	// ErrProvisionFailover is used as part of the Event 'reason' when an
+	// exit-node is provisioned with the next provider or region due to a
+	// lack of capacity
+	ErrProvisionFailover = "ErrProvisionFailover"
+	// ErrExitNodeUnhealthy is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel fails its health checks and is replaced
+	ErrExitNodeUnhealthy = "ErrExitNodeUnhealthy"
+	// ErrExitNodeDrifted is used as part of the Event 'reason' when the
+	// exit-node of a Tunnel was changed outside of the operator
+	ErrExitNodeDrifted = "ErrExitNodeDrifted"
+	// ErrClientDisconnected is used as part of the Event 'reason' when the
+	// client of a Tunnel has been disconnected from its exit-node for too long
+	ErrClientDisconnected = "ErrClientDisconnected"
+	// ErrProvisionJobFailed is used as part of the Event 'reason' when the
+	// Job which provisions the exit-node of a Tunnel fails
+	ErrProvisionJobFailed = "ErrProvisionJobFailed"
+	// ErrPortsNotForwarded is used as part of the Event 'reason' when some
+	// of the ports of the Service of an HTTP Tunnel are not forwarded
+	ErrPortsNotForwarded = "ErrPortsNotForwarded"
+	// ErrReplacementFailed is used as part of the Event 'reason' when the
+	// client of a Tunnel is moved back to its old exit-node, since the
+	// tunnel could not be verified through the new one
+	ErrReplacementFailed = "ErrReplacementFailed"
+	// ErrTokenNotResolved is used as part of the Event 'reason' when the
+	// token of a Tunnel cannot be read from its authTokenFrom
+	ErrTokenNotResolved = "ErrTokenNotResolved"
+	// MessageLicenseRequired is the message used for Events when a Tunnel
+	// needs inlets-pro, but no license was given to the operator
+	MessageLicenseRequired = "An inlets-pro license is required for TCP and UDP tunnels, TLS and the PROXY protocol, set --license or --license-file"
+	// MessageLicenseNotCopied is the message used for Events when a Tunnel
+	// needs inlets-pro, but its TunnelClass doesn't let the license be
+	// copied into its namespace
+	MessageLicenseNotCopied = "The inlets-pro license is only copied into the namespace of a Tunnel whose TunnelClass sets copyLicense"
 )
 
 // Controller is the controller implementation for Tunnel resources
@@ -64,8 +199,13 @@ type Controller struct {
 	deploymentsSynced cache.InformerSynced
 	tunnelsLister     listers.TunnelLister
 	tunnelsSynced     cache.InformerSynced
+	tunnelClassLister listers.TunnelClassLister
+	tunnelClassSynced cache.InformerSynced
 	serviceLister     corelisters.ServiceLister
+	endpointsLister   corelisters.EndpointsLister
+	endpointsSynced   cache.InformerSynced
 	infraConfig       *InfraConfig
+	infraLock         sync.RWMutex
 
 	// workqueue is a rate limited work queue. This is used to queue work to be
 	// processed instead of performing it as soon as a change happens. This
@@ -76,6 +216,76 @@ type Controller struct {
 	// recorder is an event recorder for recording Event resources to the
 	// Kubernetes API.
 	recorder record.EventRecorder
+
+	// healthFailures counts the consecutive failed health checks of each
+	// exit-node, keyed by the namespace/name of its Tunnel.
+	healthFailures map[string]int
+	healthLock     sync.Mutex
+
+	// inFlight counts the syncs and deletions in progress for each
+	// Tunnel, so that they can finish before the operator exits.
+	inFlight     map[string]int
+	inFlightLock sync.Mutex
+	inFlightWait sync.WaitGroup
+
+	// polls are when the exit-node of each Tunnel which is provisioning is
+	// next due to be polled, keyed by the namespace/name of the Tunnel.
+	polls    map[string]*pollState
+	pollLock sync.Mutex
+
+	// limiters bound the calls to each provider which provision or delete
+	// hosts, with --provider-concurrency.
+	limiters     map[string]*fairLimiter
+	limitersLock sync.Mutex
+
+	// reserved are the exit-nodes which are being created, by the
+	// namespace/name of their Tunnel, so that they count against the quota
+	// before their IDs are recorded.
+	reserved  map[string]bool
+	quotaLock sync.Mutex
+
+	// inFlightSince is when the work in progress for each Tunnel started,
+	// for the diagnostics of --debug-port.
+	inFlightSince map[string]time.Time
+
+	// shard is the shard of Tunnels and Services held by this instance
+	// when there is more than one, or -1 whilst it holds none.
+	shard         int
+	shardLock     sync.Mutex
+	shardIdentity string
+
+	// regions caches the regions of each provider for validating the
+	// region of Tunnels.
+	regions     map[string]cachedRegions
+	regionsLock sync.Mutex
+
+	// egressIP caches the public IP which the cluster connects from, when
+	// --control-plane-sources is auto.
+	egressIP        string
+	egressCheckedAt time.Time
+	egressLock      sync.Mutex
+
+	// preflight has the outcome of the last checks of the permissions of
+	// the operator, which are served on /readyz.
+	preflight preflightResults
+
+	// verifiedImages caches the digests which images were verified at with
+	// --cosign-key.
+	verifiedImages map[string]verifiedImage
+	verifiedLock   sync.Mutex
+
+	// metrics counts the actions of the operator, which are served on
+	// /metrics.
+	metrics *operatorMetrics
+
+	// serviceAccountIssuer caches the issuer of ServiceAccount tokens which
+	// clients with serviceAccountToken authenticate with.
+	serviceAccountIssuer serviceAccountIssuerCache
+
+	// tokens caches the tokens read from the authTokenFrom of each Tunnel,
+	// keyed by its namespace/name, since they are not kept in the Tunnel.
+	tokens     map[string]string
+	tokensLock sync.Mutex
 }
 
 // NewController returns a new sample controller
@@ -84,7 +294,9 @@ func NewController(
 	operatorClient clientset.Interface,
 	deploymentInformer appsinformers.DeploymentInformer,
 	tunnelInformer informers.TunnelInformer,
+	tunnelClassInformer informers.TunnelClassInformer,
 	serviceInformer coreinformers.ServiceInformer,
+	endpointsInformer coreinformers.EndpointsInformer,
 	infra *InfraConfig) *Controller {
 
 	// Create event broadcaster
@@ -104,10 +316,28 @@ func NewController(
 		deploymentsSynced: deploymentInformer.Informer().HasSynced,
 		tunnelsLister:     tunnelInformer.Lister(),
 		tunnelsSynced:     tunnelInformer.Informer().HasSynced,
+		tunnelClassLister: tunnelClassInformer.Lister(),
+		tunnelClassSynced: tunnelClassInformer.Informer().HasSynced,
 		serviceLister:     serviceInformer.Lister(),
+		endpointsLister:   endpointsInformer.Lister(),
+		endpointsSynced:   endpointsInformer.Informer().HasSynced,
 		workqueue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "Tunnels"),
 		recorder:          recorder,
 		infraConfig:       infra,
+		healthFailures:    map[string]int{},
+		inFlight:          map[string]int{},
+		inFlightSince:     map[string]time.Time{},
+		reserved:          map[string]bool{},
+		polls:             map[string]*pollState{},
+		limiters:          map[string]*fairLimiter{},
+		regions:           map[string]cachedRegions{},
+		tokens:            map[string]string{},
+		shardIdentity:     infra.ShardIdentity,
+		metrics:           newOperatorMetrics(),
+	}
+
+	if infra.Shards > 1 {
+		controller.shard = -1
 	}
 
 	klog.Info("Setting up event handlers")
@@ -119,27 +349,36 @@ func NewController(
 		},
 		DeleteFunc: func(old interface{}) {
 			r, ok := checkCustomResourceType(old)
-			if ok {
-				if len(r.Status.HostID) > 0 {
-					var provisioner provision.Provisioner
-
-					switch controller.infraConfig.Provider {
-					case "digitalocean":
-						provisioner, _ = provision.NewDigitalOceanProvisioner(controller.infraConfig.GetAccessKey())
-						break
-					case "packet":
-						provisioner, _ = provision.NewPacketProvisioner(controller.infraConfig.GetAccessKey())
-						break
+			if ok && controller.ownsObject(&r) {
+				controller.forgetPoll(&r)
+				controller.forgetToken(&r)
+				if err := controller.deleteReplacement(&r); err != nil {
+					controller.tunnelLog(&r).Error(err, "Error deleting exit-node of replacement")
+				}
+
+				// The exit-node of a tunnel with a reserved IP is not kept,
+				// since its IP is released along with the tunnel, nor is the
+				// exit-node of a tunnel whose token isn't kept in the Tunnel
+				if len(r.Status.HostID) > 0 && controller.infra().DeletionTTL > 0 && len(r.Status.ReservedIP) == 0 && r.Spec.AuthTokenFrom == nil {
+					err := controller.retainExitNode(&r)
+					if err == nil {
+						return
 					}
+					controller.tunnelLog(&r).Error(err, "Error keeping exit-node")
+				}
 
-					if provisioner != nil {
-						log.Printf("Deleting exit-node: %s, ip: %s\n", r.Status.HostID, r.Status.HostIP)
-						err := provisioner.Delete(r.Status.HostID)
-						if err != nil {
-							log.Println(err)
-						}
+				if len(r.Status.HostID) > 0 {
+					key := r.Namespace + "/" + r.Name
+					controller.startWork(key)
+					defer controller.finishWork(key)
+
+					controller.tunnelLog(&r).Info("Deleting exit-node", "ip", r.Status.HostIP)
+					if err := controller.deleteHost(&r, "tunnel-deleted"); err != nil {
+						controller.tunnelLog(&r).Error(err, "Error deleting exit-node")
 					}
 				}
+
+				controller.releaseReservedIP(&r)
 			}
 		},
 	})
@@ -172,9 +411,178 @@ func NewController(
 		},
 	})
 
+	endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: controller.enqueueEndpoints,
+		UpdateFunc: func(old, new interface{}) {
+			controller.enqueueEndpoints(new)
+		},
+		DeleteFunc: controller.enqueueEndpoints,
+	})
+
 	return controller
 }
 
+// makeExitHost returns the host to provision as the exit-node of a tunnel.
+func (c *Controller) makeExitHost(tunnel *inletsv1alpha1.Tunnel, target ProvisionTarget) provision.BasicHost {
+	// The last known sources are used when they can't be detected, which
+	// makeProvisionedHost checks before an exit-node is provisioned
+	controlSources, _ := c.getControlPlaneSources()
+
+	host := provision.BasicHost{
+		Name:       tunnel.Name,
+		Region:     target.Region,
+		UserData:   makeExitUserdata(tunnel, c.hasFirewall(target.Provider), controlSources, c.infra().ReleaseChecksums),
+		Additional: map[string]string{},
+		Tags:       c.getExitNodeTags(tunnel),
+	}
+
+	switch target.Provider {
+	case "packet":
+		host.OS = "ubuntu_16_04"
+		host.Plan = "t1.small.x86"
+		host.Additional["project_id"] = c.infra().ProjectID
+	case "digitalocean":
+		host.OS = "ubuntu-16-04-x64"
+		host.Plan = "512mb"
+		if c.infra().UsageInterval > 0 {
+			host.Additional["monitoring"] = "true"
+		}
+	}
+
+	class, _ := c.getTunnelClass(tunnel)
+	if class != nil && (len(class.Spec.Provider) == 0 || class.Spec.Provider == target.Provider) {
+		applyTunnelClass(class, nil, &host)
+	}
+
+	return host
+}
+
+// makeProvisionedHost returns the host to provision as the exit-node of a
+// tunnel, with the parts of its userdata which are read from Secrets.
+func (c *Controller) makeProvisionedHost(tunnel *inletsv1alpha1.Tunnel, target ProvisionTarget) (provision.BasicHost, error) {
+	if _, err := c.getControlPlaneSources(); err != nil {
+		return provision.BasicHost{}, err
+	}
+	if err := c.validateReleaseChecksums(tunnel); err != nil {
+		return provision.BasicHost{}, err
+	}
+
+	host := c.makeExitHost(tunnel, target)
+
+	if err := c.addMutualTLSUserdata(tunnel, &host); err != nil {
+		return host, err
+	}
+	if err := c.addServiceAccountTokenUserdata(tunnel, &host); err != nil {
+		return host, err
+	}
+	if err := c.addAuthProxyUserdata(tunnel, &host); err != nil {
+		return host, err
+	}
+	if err := c.addBasicAuthUserdata(tunnel, &host); err != nil {
+		return host, err
+	}
+	if err := c.addSSHKeyUserdata(tunnel, &host); err != nil {
+		return host, err
+	}
+	return host, nil
+}
+
+// getProvisioner returns the provisioner for a provider.
+func (c *Controller) getProvisioner(provider string) (provision.Provisioner, error) {
+	accessKey, err := c.getAccessKey(provider)
+	if err != nil {
+		return nil, err
+	}
+	return provision.GetProvisioner(provider, accessKey)
+}
+
+// getTunnelProvisioner returns the provisioner for the provider which the
+// exit-node of the tunnel was provisioned with.
+func (c *Controller) getTunnelProvisioner(tunnel *inletsv1alpha1.Tunnel) (provision.Provisioner, error) {
+	class, _ := c.getTunnelClass(tunnel)
+
+	if len(tunnel.Status.Provider) > 0 {
+		return c.getClassProvisioner(class, tunnel.Status.Provider)
+	}
+	return c.getClassProvisioner(class, c.infra().Provider)
+}
+
+// provisionExitNode provisions the exit-node of a tunnel with each of the
+// targets in turn, until one succeeds or fails for a reason other than
+// capacity or quota. It returns once the provider has accepted the host,
+// without waiting for it to boot, and the host is then tracked by its ID
+// on the schedule of enqueueTunnelAfterPoll, so a tunnel which is
+// provisioning holds no worker or connection between polls. When the
+// provider is at its bound of --provider-concurrency, it returns
+// errProviderBusy rather than wait for a slot.
+func (c *Controller) provisionExitNode(tunnel *inletsv1alpha1.Tunnel, targets []ProvisionTarget, trigger string) (*provision.ProvisionedHost, ProvisionTarget, error) {
+	var lastErr error
+
+	class, err := c.getTunnelClass(tunnel)
+	if err != nil {
+		return nil, ProvisionTarget{}, err
+	}
+
+	for i, target := range targets {
+		provisioner, err := c.getClassProvisioner(class, target.Provider)
+		if err != nil {
+			return nil, target, err
+		}
+
+		if isProTunnel(tunnel) && !provision.SupportsTCP(provisioner) {
+			return nil, target, fmt.Errorf("provider %s cannot expose TCP and UDP ports for inlets-pro", target.Provider)
+		}
+
+		host, err := c.makeProvisionedHost(tunnel, target)
+		if err != nil {
+			return nil, target, err
+		}
+
+		if found := c.findUntrackedExitNode(tunnel, provisioner, target.Provider); found != nil {
+			c.adoptUntrackedExitNode(tunnel, found, target, trigger)
+			return found, target, nil
+		}
+
+		limiter := c.getProviderLimiter(target.Provider)
+		if !limiter.tryAcquire(tunnel.Namespace) {
+			return nil, target, errProviderBusy
+		}
+
+		started := time.Now()
+		span := c.startSpan(tunnel, "provision", "inlets.provider", target.Provider, "inlets.region", target.Region, "inlets.trigger", trigger)
+		res, err := provisioner.Provision(host)
+		limiter.release()
+		provision.ForgetHosts(provisioner)
+		if res != nil {
+			span.setAttribute("inlets.host.id", res.ID)
+		}
+		span.finish(err)
+		c.metrics.observeOperation("provision", target.Provider, started)
+
+		record := auditRecord{Action: "provision", Trigger: trigger, Provider: target.Provider, Region: target.Region}
+		if res != nil {
+			record.HostID = res.ID
+		}
+		c.audit(tunnel, record, err)
+
+		if err == nil {
+			return res, target, nil
+		}
+
+		if !provision.IsCapacityError(err) {
+			return nil, target, err
+		}
+
+		lastErr = err
+		if i < len(targets)-1 {
+			c.recorder.Eventf(tunnel, corev1.EventTypeWarning, ErrProvisionFailover,
+				"No capacity with %s, trying %s: %s", target, targets[i+1], err.Error())
+		}
+	}
+
+	return nil, ProvisionTarget{}, lastErr
+}
+
 func checkCustomResourceType(obj interface{}) (inletsv1alpha1.Tunnel, bool) {
 	var roll *inletsv1alpha1.Tunnel
 	var ok bool
@@ -203,27 +611,87 @@ func (c *Controller) enqueueService(obj interface{}) {
 // workers to finish processing their current work items.
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
-	defer c.workqueue.ShutDown()
 
 	// Start the informer factories to begin populating the informer caches
 	klog.Info("Starting Tunnel controller")
 
 	// Wait for the caches to be synced before starting workers
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.deploymentsSynced, c.tunnelsSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, c.deploymentsSynced, c.tunnelsSynced, c.tunnelClassSynced, c.endpointsSynced); !ok {
+		c.workqueue.ShutDown()
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	if c.infra().Shards > 1 {
+		klog.Infof("Holding one of %d shards as: %s", c.infra().Shards, c.shardIdentity)
+		go wait.Until(c.syncShardLease, shardRenewInterval, stopCh)
+	}
+
+	go wait.Until(c.runPreflight, preflightInterval, stopCh)
+	go wait.Until(c.checkCredentials, credentialCheckInterval, stopCh)
+
+	if vault, ok := c.infra().KeyEncrypter.(*azureKeyVault); ok {
+		go vault.keepAccessTokenFresh(stopCh)
+	}
+
+	if c.infra().Tracer != nil {
+		go c.infra().Tracer.run(stopCh)
+	}
+
 	klog.Info("Starting workers")
 	// Launch two workers to process Tunnel resources
 	for i := 0; i < threadiness; i++ {
 		go wait.Until(c.runWorker, time.Second, stopCh)
 	}
 
+	if c.infra().HealthCheckInterval > 0 {
+		klog.Infof("Checking the health of exit-nodes every %s", c.infra().HealthCheckInterval)
+		go wait.Until(c.checkExitNodes, c.infra().HealthCheckInterval, stopCh)
+
+		if c.infra().ClientDisconnectTimeout > 0 {
+			go wait.Until(c.checkClientConnections, c.infra().HealthCheckInterval, stopCh)
+		}
+	}
+
+	if c.infra().UsageInterval > 0 {
+		klog.Infof("Reading the usage of exit-nodes every %s", c.infra().UsageInterval)
+		go wait.Until(c.checkUsage, c.infra().UsageInterval, stopCh)
+	}
+
+	if c.infra().DriftCheckInterval > 0 {
+		klog.Infof("Checking exit-nodes for drift every %s", c.infra().DriftCheckInterval)
+		go wait.Until(c.checkDrift, c.infra().DriftCheckInterval, stopCh)
+	}
+
+	if len(c.infra().WarmPool) > 0 {
+		klog.Infof("Keeping a warm pool of exit-nodes: %v", c.infra().WarmPool)
+		go wait.Until(c.syncWarmPool, warmPoolCheckInterval, stopCh)
+	}
+
+	if c.infra().TagSyncInterval > 0 {
+		go wait.Until(c.syncExitNodeTags, c.infra().TagSyncInterval, stopCh)
+	}
+
+	if c.infra().OrphanCheckInterval > 0 {
+		klog.Infof("Checking for orphaned exit-nodes every %s", c.infra().OrphanCheckInterval)
+		go wait.Until(c.checkOrphans, c.infra().OrphanCheckInterval, stopCh)
+	}
+
+	if c.infra().DeletionTTL > 0 {
+		klog.Infof("Keeping the exit-nodes of deleted Tunnels for %s", c.infra().DeletionTTL)
+		go wait.Until(c.deleteExpiredExitNodes, retainedCheckInterval, stopCh)
+	}
+
 	klog.Info("Started workers")
 	<-stopCh
 	klog.Info("Shutting down workers")
 
+	// Workers pick up no more Tunnels once the queue is shut down, but any
+	// exit-node being provisioned or deleted is given time to finish.
+	c.workqueue.ShutDown()
+	c.drain(c.infra().DrainTimeout)
+	c.releaseShardLease()
+
 	return nil
 }
 
@@ -244,6 +712,12 @@ func (c *Controller) processNextWorkItem() bool {
 		return false
 	}
 
+	// Items still queued are left for the next run of the operator
+	if c.workqueue.ShuttingDown() {
+		c.workqueue.Done(obj)
+		return false
+	}
+
 	// We wrap this block in a func so we can defer c.workqueue.Done.
 	err := func(obj interface{}) error {
 		// We call Done here so the workqueue knows we have finished
@@ -268,11 +742,23 @@ func (c *Controller) processNextWorkItem() bool {
 			utilruntime.HandleError(fmt.Errorf("expected string in workqueue but got %#v", obj))
 			return nil
 		}
+		c.startWork(key)
+		defer c.finishWork(key)
+
 		// Run the syncHandler, passing it the namespace/name string of the
 		// Tunnel resource to be synced.
-		if err := c.syncHandler(key); err != nil {
-			// Put the item back on the workqueue to handle any transient errors.
-			c.workqueue.AddRateLimited(key)
+		root := c.infra().Tracer.startSync(key)
+		err := c.syncHandler(key)
+		c.infra().Tracer.finishSync(key, root, err)
+		if err != nil {
+			// Put the item back on the workqueue to handle any transient
+			// errors, after the time a provider which throttled the call
+			// asked for, when it gave one.
+			if after, ok := provision.RetryAfter(err); ok {
+				c.workqueue.AddAfter(key, wait.Jitter(after, 0.1))
+			} else {
+				c.workqueue.AddRateLimited(key)
+			}
 			return fmt.Errorf("error syncing '%s': %s, requeuing", key, err.Error())
 		}
 		// Finally, if no error occurs we Forget this item so it does not
@@ -303,50 +789,22 @@ func (c *Controller) syncHandler(key string) error {
 
 	service, _ := c.serviceLister.Services(namespace).Get(name)
 
-	if service != nil {
-		if service.Spec.Type == "LoadBalancer" &&
-			hasIgnoreAnnotation(service.Annotations) == false {
+	if service != nil && c.ownsObject(service) {
+		if (service.Spec.Type == "LoadBalancer" || usesNodePort(service)) &&
+			hasIgnoreAnnotation(service.Annotations) == false &&
+			c.matchesServiceSelector(service) {
 
-			tunnels := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(service.ObjectMeta.Namespace)
-			ops := metav1.GetOptions{}
-			name := service.Name + "-tunnel"
-			found, err := tunnels.Get(name, ops)
-
-			pwdRes, pwdErr := password.Generate(64, 10, 0, false, true)
-			if pwdErr != nil {
-				log.Fatalf("Error generating password for inlets server %s", pwdErr.Error())
+			if err := c.validateNamespace(service.Namespace); err != nil {
+				c.recorder.Event(service, corev1.EventTypeWarning, ErrNamespaceDenied, err.Error())
+				return nil
 			}
 
-			if errors.IsNotFound(err) {
-				fmt.Printf("Creating tunnel %s\n", name)
-				tunnel := &inletsv1alpha1.Tunnel{
-					Spec: inletsv1alpha1.TunnelSpec{
-						ServiceName: service.Name,
-						AuthToken:   pwdRes,
-					},
-					ObjectMeta: metav1.ObjectMeta{
-						Name:      name,
-						Namespace: service.ObjectMeta.Namespace,
-						OwnerReferences: []metav1.OwnerReference{
-							*metav1.NewControllerRef(service, schema.GroupVersionKind{
-								Group:   inletsv1alpha1.SchemeGroupVersion.Group,
-								Version: inletsv1alpha1.SchemeGroupVersion.Version,
-								Kind:    "Tunnel",
-							}),
-						},
-					},
-				}
-
-				_, err := tunnels.Create(tunnel)
-
-				if err != nil {
-					log.Printf("Error creating tunnel: %s", err.Error())
-				}
-
-			} else {
-				log.Printf("Tunnel exists: %s\n", found.Name)
+			regions := getServiceRegions(service)
+			for _, region := range regions {
+				c.syncServiceTunnel(service, region)
 			}
 
+			c.deleteStaleTunnels(service, regions)
 		}
 	}
 
@@ -363,178 +821,823 @@ func (c *Controller) syncHandler(key string) error {
 		return err
 	}
 
-	switch tunnel.Status.HostStatus {
-	case "":
+	// Another instance of the operator syncs Tunnels in other shards
+	if !c.ownsObject(tunnel) {
+		return nil
+	}
 
-		var id string
+	if paused, deprovision := isPaused(tunnel); paused {
+		return c.syncPaused(tunnel, deprovision)
+	}
 
-		if c.infraConfig.Provider == "packet" {
-			userData := makeUserdata(tunnel.Spec.AuthToken)
+	if tunnel.Spec.AuthTokenFrom != nil {
+		if err := validateAuthTokenFrom(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-			provisioner, _ := provision.NewPacketProvisioner(c.infraConfig.GetAccessKey())
+		tunnel, err = c.syncReferencedToken(tunnel)
+		if err != nil || tunnel == nil {
+			return err
+		}
+	}
 
-			res, err := provisioner.Provision(provision.BasicHost{
-				Name:     tunnel.Name,
-				OS:       "ubuntu_16_04",
-				Plan:     "t1.small.x86",
-				Region:   c.infraConfig.Region,
-				UserData: userData,
-				Additional: map[string]string{
-					"project_id": c.infraConfig.ProjectID,
-				},
-			})
+	tunnel, err = c.syncResumed(tunnel)
+	if err != nil {
+		return err
+	}
 
-			if err != nil {
-				return err
-			}
-			id = res.ID
+	if done, err := c.syncSchedule(tunnel); err != nil || done {
+		return err
+	}
 
-		} else if c.infraConfig.Provider == "digitalocean" {
+	if len(tunnel.Spec.SharedExitNode) > 0 {
+		if done, err := c.syncSharedExitNode(tunnel); err != nil || done {
+			return err
+		}
+	}
 
-			provisioner, _ := provision.NewDigitalOceanProvisioner(c.infraConfig.GetAccessKey())
+	switch tunnel.Status.HostStatus {
+	case "":
 
-			userData := makeUserdata(tunnel.Spec.AuthToken)
+		if err := c.validateNamespace(tunnel.Namespace); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrNamespaceDenied, err.Error())
+			return nil
+		}
 
-			res, err := provisioner.Provision(provision.BasicHost{
-				Name:       tunnel.Name,
-				OS:         "ubuntu-16-04-x64",
-				Plan:       "512mb",
-				Region:     c.infraConfig.Region,
-				UserData:   userData,
-				Additional: map[string]string{},
-			})
+		if err := validateAPIServer(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
+
+		// The tunnel is synced again after its upstream is set
+		if tunnel.Spec.APIServer && len(tunnel.Spec.Upstream) == 0 {
+			return c.setAPIServerUpstream(tunnel)
+		}
 
+		if err := validateUpstream(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
+
+		// Tunnels created by users may not have a token yet
+		if len(tunnel.Spec.AuthToken) == 0 {
+			token, err := c.generateAuthToken()
 			if err != nil {
 				return err
 			}
 
-			id = res.ID
+			tunnelCopy := tunnel.DeepCopy()
+			tunnelCopy.Spec.AuthToken = token
+			_, err = c.updateTunnel(tunnelCopy)
+			return err
+		}
+
+		if err := validateAuthToken(tunnel.Spec.AuthToken); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			c.notifyTunnel(tunnel, notifyTokenInvalid, "WeakToken", err.Error())
+			return nil
 		}
 
-		if err != nil {
-			err = c.updateTunnelProvisioningStatus(tunnel, "error", "", "")
-			if err != nil {
-				return err
+		if len(tunnel.Spec.SharedExitNode) == 0 {
+			if err := c.validateUniqueToken(tunnel); err != nil {
+				c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+				c.notifyTunnel(tunnel, notifyTokenInvalid, "TokenReused", err.Error())
+				return nil
 			}
-		} else {
-			err = c.updateTunnelProvisioningStatus(tunnel, "provisioning", id, "")
 		}
 
-		if err != nil {
+		if hostname := getWildcardHostname(tunnel, tunnel.Spec.WildcardDomain); hostname != tunnel.Spec.Hostname {
+			tunnelCopy := tunnel.DeepCopy()
+			tunnelCopy.Spec.Hostname = hostname
+			_, err = c.updateTunnel(tunnelCopy)
 			return err
 		}
 
-		break
+		if err := validateClientMode(tunnel.Spec.ClientMode); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-	case "provisioning":
+		if err := validateClientArgs(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-		if c.infraConfig.Provider == "packet" {
+		if err := validateTLS(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-			provisioner, _ := provision.NewPacketProvisioner(c.infraConfig.GetAccessKey())
-			host, err := provisioner.Status(tunnel.Status.HostID)
+		if err := validateProtocol(tunnel.Spec.Protocol); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-			if err != nil {
-				fmt.Println(err)
+		if isProTunnel(tunnel) {
+			if err := validateProxyProtocol(tunnel.Spec.ProxyProtocol); err != nil {
+				c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+				return nil
 			}
 
-			if host.Status == "active" {
-				log.Println("Device is now active")
+			if len(c.infra().GetLicense()) == 0 {
+				c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrLicenseRequired, MessageLicenseRequired)
+				return nil
+			}
+			if !c.copiesLicense(tunnel) {
+				c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrLicenseRequired, MessageLicenseNotCopied)
+				return nil
+			}
+		}
 
-				err := c.updateTunnelProvisioningStatus(tunnel, "active", host.ID, host.IP)
-				if err != nil {
-					log.Printf("Error updating tunnel status: %s, %s", tunnel.Name, err.Error())
-				}
+		if _, err := c.getTunnelClass(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-				err = c.updateService(tunnel, host.IP)
-				if err != nil {
-					log.Printf("Error updating service: %s, %s", tunnel.Spec.ServiceName, err.Error())
-				}
+		if err := c.validateRegion(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-			} else {
-				log.Printf("Still provisioning: %s\n", tunnel.Name)
-			}
+		if err := c.validateReservedIP(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-		} else if c.infraConfig.Provider == "digitalocean" {
+		if err := validateMutualTLS(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-			provisioner, _ := provision.NewDigitalOceanProvisioner(c.infraConfig.GetAccessKey())
-			host, err := provisioner.Status(tunnel.Status.HostID)
+		if err := validateServiceAccountToken(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
-			if err != nil {
-				return err
-			}
-			if host.Status == "active" {
+		// The spec records whether the exit-node is provisioned with
+		// control-plane TLS, so that a change of --control-plane-tls only
+		// applies to new exit-nodes
+		if tunnel.Spec.ControlPlaneTLS == nil && isProTunnel(tunnel) {
+			enabled := c.infra().ControlPlaneTLS && canUseControlPlaneTLS(tunnel)
 
-				if host.IP != "" {
-					err := c.updateTunnelProvisioningStatus(tunnel, "active", host.ID, host.IP)
-					if err != nil {
-						return err
-					}
+			tunnelCopy := tunnel.DeepCopy()
+			tunnelCopy.Spec.ControlPlaneTLS = &enabled
+			_, err = c.updateTunnel(tunnelCopy)
+			return err
+		}
 
-					err = c.updateService(tunnel, host.IP)
-					if err != nil {
-						log.Printf("Error updating service: %s, %s", tunnel.Spec.ServiceName, err.Error())
-					}
-				}
-			}
+		if err := validateExitNodeAuth(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
+		}
 
+		if err := validateRateLimit(tunnel.Spec.RateLimit); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return nil
 		}
 
-		break
-	case "active":
-		if tunnel.Spec.ClientDeploymentRef == nil {
-			get := metav1.GetOptions{}
-			service, getServiceErr := c.kubeclientset.CoreV1().Services(tunnel.Namespace).Get(tunnel.Spec.ServiceName, get)
+		if err := c.validateReleaseChecksums(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrReleaseNotVerified, err.Error())
+			return nil
+		}
 
-			if getServiceErr != nil {
-				return getServiceErr
-			}
+		if service, _ := c.getTunnelService(tunnel); service != nil && !isProTunnel(tunnel) && countTCPPorts(service) > 1 {
+			c.recorder.Eventf(tunnel, corev1.EventTypeWarning, ErrPortsNotForwarded,
+				"Only port %d of Service %s is tunnelled over HTTP, set protocol to tcp to forward all of its ports",
+				getUpstreamPort(service), service.Name)
+		}
 
-			firstPort := int32(80)
+		if waiting, err := c.syncScaledToZero(tunnel); err != nil || waiting {
+			return err
+		}
 
-			for _, port := range service.Spec.Ports {
-				if port.Name == "http" {
-					firstPort = port.Port
-					break
-				}
-			}
+		if waiting, err := c.waitForEndpoints(tunnel); err != nil || waiting {
+			return err
+		}
 
-			deployment, createDeployErr := c.kubeclientset.AppsV1().
-				Deployments(tunnel.Namespace).
-				Create(makeClient(tunnel, firstPort, c.infraConfig.GetInletsClientImage()))
+		if adopted, err := c.adoptRetainedExitNode(tunnel); err != nil || adopted {
+			return err
+		}
 
-			if createDeployErr != nil {
-				log.Println(createDeployErr)
-			}
+		if claimed, err := c.claimPooledExitNode(tunnel); err != nil || claimed {
+			return err
+		}
 
-			tunnel.Spec.ClientDeploymentRef = &metav1.ObjectMeta{
-				Name:      deployment.Name,
-				Namespace: deployment.Namespace,
-			}
+		targets := c.getTargets(tunnel)
 
-			_, updateErr := c.operatorclientset.InletsoperatorV1alpha1().
-				Tunnels(tunnel.Namespace).
-				Update(tunnel)
+		release, exceeded, message := c.reserveExitNode(tunnel, c.makeExitHost(tunnel, targets[0]), targets[0].Provider)
+		if exceeded {
+			return c.holdForQuota(tunnel, message)
+		}
+		defer release()
 
-			if updateErr != nil {
-				log.Println(updateErr)
-			}
+		if c.usesJobs(tunnel, targets[0].Provider) {
+			return c.syncProvisionJob(tunnel, targets[0])
 		}
 
-		break
-	}
+		if resumed, err := c.resumeOperation(tunnel, targets); err != nil || resumed {
+			return err
+		}
 
-	// If an error occurs during Update, we'll requeue the item so we can
-	// attempt processing again later. THis could have been caused by a
-	// temporary network failure, or any other transient reason.
-	if err != nil {
-		return err
-	}
+		// The operation is only started once the provider has a slot for
+		// it, so that a tunnel which waits doesn't list hosts to resume it
+		if !c.getProviderLimiter(targets[0].Provider).available(tunnel.Namespace) {
+			c.workqueue.AddAfter(key, wait.Jitter(providerBusyRetry, 0.2))
+			return nil
+		}
 
-	c.recorder.Event(tunnel, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
-	return nil
-}
+		// The operation is recorded before the exit-node is created, so
+		// that it can be found again if the operator restarts before its
+		// ID is recorded
+		tunnel, err = c.startOperation(tunnel, targets[0])
+		if err != nil {
+			return err
+		}
+
+		res, target, err := c.provisionExitNode(tunnel, targets, "tunnel-created")
+		if err == errProviderBusy {
+			c.workqueue.AddAfter(key, wait.Jitter(providerBusyRetry, 0.2))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Status.Operation = nil
+		tunnelCopy.Status.Provider = target.Provider
+		tunnelCopy.Status.Region = target.Region
+		tunnelCopy.Status.EstimatedHourlyCost = c.getHourlyCost(c.makeExitHost(tunnel, target), target.Provider)
+
+		err = c.updateTunnelProvisioningStatus(tunnelCopy, "provisioning", res.ID, "")
+		if err != nil {
+			return err
+		}
+
+		break
+
+	case "provisioning":
+
+		provisioner, err := c.getTunnelProvisioner(tunnel)
+		if err != nil {
+			return err
+		}
+
+		if due, left := c.pollDue(tunnel); !due {
+			c.workqueue.AddAfter(key, left)
+			return nil
+		}
+
+		span := c.startSpan(tunnel, "wait-for-completion", "inlets.provider", c.getTunnelProvider(tunnel), "inlets.host.id", tunnel.Status.HostID)
+		host, err := provisioner.Status(tunnel.Status.HostID)
+		if host != nil {
+			span.setAttribute("inlets.host.status", host.Status)
+		}
+		span.finish(err)
+		if err != nil {
+			return err
+		}
+
+		if host.Status == "active" && host.IP != "" {
+			c.tunnelLog(tunnel).Info("Exit-node is now active", "hostID", host.ID, "ip", host.IP)
+			c.forgetPoll(tunnel)
+
+			// The tunnel is synced again after its IP is reserved
+			ip, updated, err := c.syncReservedIP(tunnel, host.ID, host.IP)
+			if err != nil || updated {
+				return err
+			}
+
+			err = c.updateTunnelProvisioningStatus(tunnel, "active", host.ID, ip)
+			if err != nil {
+				return err
+			}
+		} else {
+			c.tunnelLog(tunnel).Info("Still provisioning", "status", host.Status)
+			c.enqueueTunnelAfterPoll(tunnel, tunnel.Status.Provider, host.Status)
+		}
+
+		break
+	case "active":
+		// The tunnel is synced again after its replacement is updated
+		if replacing, err := c.syncReplacement(tunnel); err != nil || replacing {
+			return err
+		}
+
+		// The tunnel is synced again after its endpoints are recorded
+		if updated, err := c.syncScaleToZero(tunnel); err != nil || updated {
+			return err
+		}
+
+		if err := c.syncFirewall(tunnel); err != nil {
+			return err
+		}
+
+		due, rotationErr := rotationDue(tunnel, time.Now())
+		if rotationErr != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, rotationErr.Error())
+		} else if due {
+			return c.rotateExitNode(tunnel)
+		}
+
+		if rotated, err := c.syncSSHKey(tunnel); err != nil || rotated {
+			return err
+		}
+
+		if rotated, err := c.syncTokenReuse(tunnel); err != nil || rotated {
+			return err
+		}
+
+		if err := c.syncTokenSecret(tunnel); err != nil {
+			return err
+		}
+
+		if tunnel.Spec.TLS != nil {
+			if err := c.ensureCertificate(tunnel); err != nil {
+				return err
+			}
+		}
+
+		// The tunnel is synced again after its condition is updated
+		if published, err := c.publishWhenReady(tunnel); err != nil || published {
+			return err
+		}
+
+		// The client is injected into Pods by the webhook
+		if tunnel.Spec.ClientMode == "sidecar" {
+			break
+		}
+
+		// extraArgs which are not allowed are left out of the client
+		if err := validateClientArgs(tunnel); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+		}
+
+		if err := c.syncClientDisruptionBudget(tunnel); err != nil {
+			return err
+		}
+
+		if err := c.syncClientNetworkPolicy(tunnel); err != nil {
+			return err
+		}
+
+		if tunnel.Spec.ClientMode == "daemonset" {
+			span := c.startSpan(tunnel, "client-rollout", "inlets.client.mode", "daemonset")
+			err := c.syncClientDaemonSet(tunnel)
+			span.finish(err)
+			if err != nil {
+				return err
+			}
+			break
+		}
+
+		if tunnel.Spec.ClientDeploymentRef == nil {
+			service, getServiceErr := c.getTunnelService(tunnel)
+
+			if getServiceErr != nil {
+				return getServiceErr
+			}
+
+			client, err := c.makeClientFor(tunnel, service)
+			if err != nil {
+				return err
+			}
+
+			span := c.startSpan(tunnel, "client-rollout", "inlets.client.mode", "deployment")
+			deployment, createDeployErr := c.kubeclientset.AppsV1().
+				Deployments(tunnel.Namespace).
+				Create(client)
+			span.finish(createDeployErr)
+
+			if createDeployErr != nil {
+				c.tunnelLog(tunnel).Error(createDeployErr, "Error creating client deployment")
+				return createDeployErr
+			}
+
+			tunnel.Spec.ClientDeploymentRef = &metav1.ObjectMeta{
+				Name:      deployment.Name,
+				Namespace: deployment.Namespace,
+			}
+
+			_, updateErr := c.updateTunnel(tunnel)
+
+			if updateErr != nil {
+				c.tunnelLog(tunnel).Error(updateErr, "Error updating tunnel")
+			}
+		} else {
+			span := c.startSpan(tunnel, "client-rollout", "inlets.client.mode", "deployment")
+			err := c.updateClientDeployment(tunnel)
+			span.finish(err)
+			if err != nil {
+				return err
+			}
+		}
+
+		break
+	}
+
+	// If an error occurs during Update, we'll requeue the item so we can
+	// attempt processing again later. THis could have been caused by a
+	// temporary network failure, or any other transient reason.
+	if err != nil {
+		return err
+	}
+
+	c.recorder.Event(tunnel, corev1.EventTypeNormal, SuccessSynced, MessageResourceSynced)
+	return nil
+}
+
+// getServiceRegions returns the regions to provision exit-nodes into for
+// a Service. A single empty region means the default region is used.
+func getServiceRegions(service *corev1.Service) []string {
+	regions := []string{}
+	for _, region := range strings.Split(service.Annotations[regionsAnnotation], ",") {
+		region = strings.TrimSpace(region)
+		if len(region) > 0 {
+			regions = append(regions, region)
+		}
+	}
+
+	if len(regions) == 0 {
+		return []string{""}
+	}
+	return regions
+}
+
+// getTunnelName returns the name of the Tunnel for a Service in a region.
+func getTunnelName(service *corev1.Service, region string) string {
+	if len(region) == 0 {
+		return service.Name + "-tunnel"
+	}
+	return service.Name + "-tunnel-" + region
+}
+
+// syncServiceTunnel creates the Tunnel for a Service in a region, or
+// re-syncs it when it already exists.
+func (c *Controller) syncServiceTunnel(service *corev1.Service, region string) {
+	tunnels := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(service.ObjectMeta.Namespace)
+	ops := metav1.GetOptions{}
+	name := getTunnelName(service, region)
+	found, err := tunnels.Get(name, ops)
+
+	if errors.IsNotFound(err) {
+		token, err := c.generateAuthToken()
+		if err != nil {
+			logWith("service", service.Name, "namespace", service.Namespace).Error(err, "Error generating token for tunnel")
+			return
+		}
+
+		tunnel := &inletsv1alpha1.Tunnel{
+			Spec: inletsv1alpha1.TunnelSpec{
+				ServiceName:    service.Name,
+				AuthToken:      token,
+				Region:         region,
+				Protocol:       c.getServiceProtocol(service),
+				ProxyProtocol:  service.Annotations[proxyProtocolAnnotation],
+				RotationPolicy: service.Annotations[rotationPolicyAnnotation],
+				SharedExitNode: service.Annotations[sharedExitNodeAnnotation],
+				ReservedIP:     service.Annotations[reservedIPAnnotation] == "true",
+
+				AllowedSourceCIDRs: service.Spec.LoadBalancerSourceRanges,
+
+				TunnelClassName: service.Annotations[tunnelClassAnnotation],
+			},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: service.ObjectMeta.Namespace,
+				Labels:    getShardLabels(service, c.infra().ShardLabel),
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(service, schema.GroupVersionKind{
+						Group:   inletsv1alpha1.SchemeGroupVersion.Group,
+						Version: inletsv1alpha1.SchemeGroupVersion.Version,
+						Kind:    "Tunnel",
+					}),
+				},
+			},
+		}
+
+		c.tunnelLog(tunnel).Info("Creating tunnel", "service", service.Name)
+		_, err = tunnels.Create(tunnel)
+
+		if err != nil {
+			c.tunnelLog(tunnel).Error(err, "Error creating tunnel", "service", service.Name)
+		}
+
+	} else if err == nil {
+		c.tunnelLog(found).Debug("Tunnel exists", "service", service.Name)
+
+		if err := c.syncServiceProtocol(service, found); err != nil {
+			c.tunnelLog(found).Error(err, "Error changing the protocol of tunnel", "service", service.Name)
+		}
+
+		// Re-sync the tunnel so that changes to the Service, such as
+		// its ports, are reflected in the client deployment.
+		c.enqueueTunnel(found)
+	}
+}
+
+// syncServiceProtocol changes the protocol of the tunnel of a Service
+// without the protocol annotation when the number of its TCP ports means
+// it is now tunnelled at L4 or over HTTP. The exit-node runs the server of
+// the protocol it was provisioned with, so it is replaced along with the
+// client. The exit-node is deleted first, so that the change is retried
+// on the next sync of the Service when the exit-node can't be deleted.
+func (c *Controller) syncServiceProtocol(service *corev1.Service, tunnel *inletsv1alpha1.Tunnel) error {
+	if _, ok := service.Annotations[protocolAnnotation]; ok {
+		return nil
+	}
+
+	protocol := c.getServiceProtocol(service)
+	if protocol == tunnel.Spec.Protocol || (tunnel.Spec.Protocol != "" && tunnel.Spec.Protocol != "tcp") {
+		return nil
+	}
+
+	if len(tunnel.Status.HostID) > 0 {
+		if err := c.deleteExitNode(tunnel, "ports-changed"); err != nil {
+			return err
+		}
+	}
+
+	latest, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).Get(tunnel.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	tunnelCopy := latest.DeepCopy()
+	tunnelCopy.Spec.Protocol = protocol
+	updated, err := c.updateTunnel(tunnelCopy)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Service %s has %d TCP ports, changing the protocol of the tunnel to %q", service.Name, countTCPPorts(service), protocol)
+	c.recorder.Event(updated, corev1.EventTypeNormal, SuccessPortsChanged, message)
+	return nil
+}
+
+// getServiceProtocol returns the protocol for the tunnel of a Service from
+// its annotation. Without the annotation, a Service with more than one TCP
+// port is tunnelled at L4 when there is a license for inlets-pro which its
+// TunnelClass lets it use, so that all of its ports are forwarded through
+// one exit-node.
+func (c *Controller) getServiceProtocol(service *corev1.Service) string {
+	if protocol, ok := service.Annotations[protocolAnnotation]; ok {
+		return protocol
+	}
+
+	tunnel := &inletsv1alpha1.Tunnel{
+		Spec: inletsv1alpha1.TunnelSpec{TunnelClassName: service.Annotations[tunnelClassAnnotation]},
+	}
+	if countTCPPorts(service) > 1 && len(c.infra().GetLicense()) > 0 && c.copiesLicense(tunnel) {
+		return "tcp"
+	}
+	return ""
+}
+
+// countTCPPorts returns the number of TCP ports of a Service.
+func countTCPPorts(service *corev1.Service) int {
+	count := 0
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != corev1.ProtocolUDP {
+			count++
+		}
+	}
+	return count
+}
+
+// deleteStaleTunnels deletes the Tunnels of a Service which are no longer
+// needed, such as when a region is removed from its list of regions.
+func (c *Controller) deleteStaleTunnels(service *corev1.Service, regions []string) {
+	wanted := map[string]bool{}
+	for _, region := range regions {
+		wanted[getTunnelName(service, region)] = true
+	}
+
+	tunnels, err := c.tunnelsLister.Tunnels(service.Namespace).List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		ownerRef := metav1.GetControllerOf(tunnel)
+		if ownerRef == nil || ownerRef.UID != service.UID || wanted[tunnel.Name] {
+			continue
+		}
+
+		c.tunnelLog(tunnel).Info("Deleting tunnel, no longer needed by service", "service", service.Name)
+		err := c.operatorclientset.InletsoperatorV1alpha1().
+			Tunnels(tunnel.Namespace).
+			Delete(tunnel.Name, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			utilruntime.HandleError(err)
+		}
+	}
+}
+
+// getTargets returns the targets to provision the exit-node of a tunnel
+// into, the region of the tunnel takes precedence over the default region.
+func (c *Controller) getTargets(tunnel *inletsv1alpha1.Tunnel) []ProvisionTarget {
+	targets := c.infra().GetTargets()
+
+	class, _ := c.getTunnelClass(tunnel)
+	applyTunnelClass(class, &targets[0], nil)
+
+	if len(tunnel.Spec.Region) > 0 {
+		targets[0].Region = tunnel.Spec.Region
+	}
+	return targets
+}
+
+// getTunnelService returns the Service of a tunnel, or nil when the tunnel
+// has an upstream instead of a Service.
+func (c *Controller) getTunnelService(tunnel *inletsv1alpha1.Tunnel) (*corev1.Service, error) {
+	if len(tunnel.Spec.ServiceName) == 0 {
+		return nil, nil
+	}
+	return c.serviceLister.Services(tunnel.Namespace).Get(tunnel.Spec.ServiceName)
+}
+
+// parseUpstream parses an upstream in the form host:port.
+func parseUpstream(upstream string) (string, int32, error) {
+	host, portValue, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return "", 0, fmt.Errorf("upstream must be in the form host:port, not %q", upstream)
+	}
+
+	port, err := strconv.ParseInt(portValue, 10, 32)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, fmt.Errorf("upstream must have a valid port, not %q", upstream)
+	}
+
+	return host, int32(port), nil
+}
+
+// validateUpstream checks that the tunnel has either a Service or an upstream.
+func validateUpstream(tunnel *inletsv1alpha1.Tunnel) error {
+	if len(tunnel.Spec.Upstream) > 0 {
+		_, _, err := parseUpstream(tunnel.Spec.Upstream)
+		return err
+	}
+
+	if len(tunnel.Spec.ServiceName) == 0 {
+		return fmt.Errorf("one of serviceName or upstream must be set")
+	}
+	return nil
+}
+
+// getUpstream returns the host and ports for the client to forward
+// traffic to, from the upstream of the tunnel or from its Service.
+func getUpstream(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) (string, []int32) {
+	if len(tunnel.Spec.Upstream) > 0 || service == nil {
+		host, port, _ := parseUpstream(tunnel.Spec.Upstream)
+		if tunnel.Spec.Protocol == "udp" {
+			return host, []int32{}
+		}
+		return host, []int32{port}
+	}
+
+	if isProTunnel(tunnel) {
+		ports := []int32{}
+		for _, port := range service.Spec.Ports {
+			if port.Protocol != corev1.ProtocolUDP {
+				ports = append(ports, getServicePort(service, port))
+			}
+		}
+		return getServiceHost(service), ports
+	}
+
+	return getServiceHost(service), []int32{getUpstreamPort(service)}
+}
+
+// getUDPPorts returns the ports for the client to forward as UDP, which are
+// the UDP ports of the Service, or the port of the upstream for a "udp" tunnel.
+func getUDPPorts(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) []int32 {
+	ports := []int32{}
+
+	if len(tunnel.Spec.Upstream) > 0 || service == nil {
+		if tunnel.Spec.Protocol == "udp" {
+			_, port, _ := parseUpstream(tunnel.Spec.Upstream)
+			ports = append(ports, port)
+		}
+		return ports
+	}
+
+	if isProTunnel(tunnel) {
+		for _, port := range service.Spec.Ports {
+			if port.Protocol == corev1.ProtocolUDP {
+				ports = append(ports, getServicePort(service, port))
+			}
+		}
+	}
+	return ports
+}
+
+// makeClientFor returns the client deployment for a tunnel, using
+// inlets-pro when the tunnel needs it. The image of the client is pinned to
+// its digest once it has been verified with --cosign-key.
+func (c *Controller) makeClientFor(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) (*appsv1.Deployment, error) {
+	deployment := c.makeUpstreamClient(tunnel, service)
+	if isProTunnel(tunnel) {
+		addLicenseEnv(&deployment.Spec.Template, tunnel, c.infra().GetLicense())
+	}
+
+	client := &deployment.Spec.Template.Spec.Containers[0]
+	image, err := c.verifyImage(client.Image)
+	if err != nil {
+		c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrImageNotVerified, err.Error())
+		return nil, err
+	}
+	client.Image = image
+
+	if usesControlPlaneTLS(tunnel) {
+		addMutualTLSProxy(deployment, tunnel)
+	}
+	if usesServiceAccountToken(tunnel) {
+		addServiceAccountTokenVolume(deployment, tunnel)
+	}
+	applyClientSecurityContext(&deployment.Spec.Template, tunnel, c.infra().ClientSecurityContext)
+
+	upstreamHost, _ := getUpstream(tunnel, service)
+	client = &deployment.Spec.Template.Spec.Containers[0]
+	client.Env = append(client.Env, c.infra().Proxy.env(append([]string{upstreamHost}, clientNoProxy...)...)...)
+
+	if service != nil && usesNodePort(service) && len(tunnel.Spec.Upstream) == 0 {
+		addHostIPEnv(deployment)
+	}
+	return deployment, nil
+}
+
+func (c *Controller) makeUpstreamClient(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) *appsv1.Deployment {
+	if tunnel.Spec.TLS != nil {
+		host, port := getTLSUpstream(tunnel, service)
+		deployment := makeProClient(tunnel, "127.0.0.1", []int32{tlsProxyPort}, []int32{}, c.infra().GetProClientImage())
+		addTLSProxy(deployment, tunnel, host, port)
+		return deployment
+	}
+
+	host, ports := getUpstream(tunnel, service)
+
+	if isProTunnel(tunnel) {
+		udpPorts := getUDPPorts(tunnel, service)
+		return makeProClient(tunnel, host, ports, udpPorts, c.infra().GetProClientImage())
+	}
+
+	return makeClient(tunnel, host, ports[0], c.infra().GetInletsClientImage())
+}
+
+func makeClient(tunnel *inletsv1alpha1.Tunnel, upstreamHost string, targetPort int32, clientImage string) *appsv1.Deployment {
+	upstream := fmt.Sprintf("http://%s:%d", upstreamHost, targetPort)
+
+	// The exit-node routes requests for the hostname to this upstream
+	if len(tunnel.Spec.Hostname) > 0 {
+		upstream = tunnel.Spec.Hostname + "=" + upstream
+	}
+
+	args := []string{
+		"client",
+		"--upstream=" + upstream,
+		"--remote=" + getClientControlPlaneURL(tunnel),
+		"--token=$(" + tokenEnv + ")",
+	}
+
+	return makeClientDeployment(tunnel, clientImage, "inlets", args)
+}
+
+func makeProClient(tunnel *inletsv1alpha1.Tunnel, upstreamHost string, ports, udpPorts []int32, clientImage string) *appsv1.Deployment {
+	args := []string{
+		"client",
+		"--upstream=" + upstreamHost,
+		"--connect=" + getClientControlPlaneURL(tunnel),
+	}
+
+	if len(ports) > 0 {
+		args = append(args, "--tcp-ports="+joinPorts(ports))
+	}
+	if len(udpPorts) > 0 {
+		args = append(args, "--udp-ports="+joinPorts(udpPorts))
+	}
+
+	args = append(args,
+		"--token=$("+tokenEnv+")",
+		"--license=$("+licenseEnv+")",
+	)
+
+	return makeClientDeployment(tunnel, clientImage, "inlets-pro", args)
+}
+
+func joinPorts(ports []int32) string {
+	values := []string{}
+	for _, port := range ports {
+		values = append(values, fmt.Sprintf("%d", port))
+	}
+	return strings.Join(values, ",")
+}
+
+func makeClientDeployment(tunnel *inletsv1alpha1.Tunnel, clientImage, command string, args []string) *appsv1.Deployment {
+	args = append(args, getExtraClientArgs(tunnel)...)
 
-func makeClient(tunnel *inletsv1alpha1.Tunnel, targetPort int32, clientImage string) *appsv1.Deployment {
 	replicas := int32(1)
 	name := tunnel.Name + "-client"
 
@@ -568,14 +1671,9 @@ func makeClient(tunnel *inletsv1alpha1.Tunnel, targetPort int32, clientImage str
 						{
 							Name:            "client",
 							Image:           clientImage,
-							Command:         []string{"inlets"},
+							Command:         []string{command},
 							ImagePullPolicy: corev1.PullIfNotPresent,
-							Args: []string{
-								"client",
-								"--upstream=" + fmt.Sprintf("http://%s:%d", tunnel.Spec.ServiceName, targetPort),
-								"--remote=" + fmt.Sprintf("ws://%s:%d", tunnel.Status.HostIP, inletsControlPort),
-								"--token=" + tunnel.Spec.AuthToken,
-							},
+							Args:            args,
 						},
 					},
 				},
@@ -583,9 +1681,209 @@ func makeClient(tunnel *inletsv1alpha1.Tunnel, targetPort int32, clientImage str
 		},
 	}
 
+	applyClientPodSpec(&deployment.Spec.Template.Spec, tunnel)
+	addTokenEnv(&deployment.Spec.Template, tunnel)
+
 	return &deployment
 }
 
+// applyClientPodSpec copies the scheduling constraints, priority and
+// networking options of a tunnel into the Pod spec of its client.
+func applyClientPodSpec(podSpec *corev1.PodSpec, tunnel *inletsv1alpha1.Tunnel) {
+	podSpec.NodeSelector = nil
+	podSpec.Tolerations = nil
+	podSpec.Affinity = nil
+	podSpec.HostNetwork = false
+	podSpec.DNSPolicy = corev1.DNSClusterFirst
+	podSpec.PriorityClassName = ""
+
+	if tunnel.Spec.Client != nil {
+		if tunnel.Spec.Client.HostNetwork {
+			podSpec.HostNetwork = true
+			podSpec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+		}
+		podSpec.PriorityClassName = tunnel.Spec.Client.PriorityClassName
+	}
+
+	if tunnel.Spec.ClientScheduling == nil {
+		return
+	}
+
+	scheduling := tunnel.Spec.ClientScheduling.DeepCopy()
+	podSpec.NodeSelector = scheduling.NodeSelector
+	podSpec.Tolerations = scheduling.Tolerations
+	podSpec.Affinity = scheduling.Affinity
+}
+
+// clientPodSpecChanged returns true when the Pod spec of the client does
+// not match the scheduling constraints, priority and networking options of
+// its tunnel.
+func clientPodSpecChanged(podSpec corev1.PodSpec, tunnel *inletsv1alpha1.Tunnel) bool {
+	want := corev1.PodSpec{}
+	applyClientPodSpec(&want, tunnel)
+
+	return !reflect.DeepEqual(podSpec.NodeSelector, want.NodeSelector) ||
+		!reflect.DeepEqual(podSpec.Tolerations, want.Tolerations) ||
+		!reflect.DeepEqual(podSpec.Affinity, want.Affinity) ||
+		podSpec.HostNetwork != want.HostNetwork ||
+		podSpec.PriorityClassName != want.PriorityClassName
+}
+
+// clientProxiesChanged returns true when the containers which run next to
+// the client, such as the TLS proxy, or their arguments have changed.
+func clientProxiesChanged(podSpec, desired corev1.PodSpec) bool {
+	if len(podSpec.Containers) != len(desired.Containers) {
+		return true
+	}
+	for i := 1; i < len(podSpec.Containers); i++ {
+		if podSpec.Containers[i].Name != desired.Containers[i].Name ||
+			!reflect.DeepEqual(podSpec.Containers[i].Args, desired.Containers[i].Args) {
+			return true
+		}
+	}
+	return false
+}
+
+// getUpstreamPort returns the port of the Service named "http", falling
+// back to its first TCP port, or 80 when it has no TCP ports. The node port
+// is used for a NodePort Service.
+func getUpstreamPort(service *corev1.Service) int32 {
+	for _, port := range service.Spec.Ports {
+		if port.Name == "http" {
+			return getServicePort(service, port)
+		}
+	}
+
+	for _, port := range service.Spec.Ports {
+		if port.Protocol != corev1.ProtocolUDP {
+			return getServicePort(service, port)
+		}
+	}
+	return int32(80)
+}
+
+// usesNodePort returns true when a NodePort Service has opted in to being
+// tunnelled with the nodeport annotation.
+func usesNodePort(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeNodePort &&
+		service.Annotations[nodePortAnnotation] == "true"
+}
+
+// getServiceHost returns the host for the client to forward traffic to for
+// a Service, which is the IP of the node for a NodePort Service.
+func getServiceHost(service *corev1.Service) string {
+	if usesNodePort(service) {
+		return "$(" + hostIPEnv + ")"
+	}
+	return service.Name
+}
+
+// getServicePort returns the node port of a port for a NodePort Service.
+func getServicePort(service *corev1.Service, port corev1.ServicePort) int32 {
+	if usesNodePort(service) {
+		return port.NodePort
+	}
+	return port.Port
+}
+
+// addHostIPEnv exposes the IP of the node to the containers of the client,
+// which is expanded in their arguments.
+func addHostIPEnv(deployment *appsv1.Deployment) {
+	containers := deployment.Spec.Template.Spec.Containers
+	for i := range containers {
+		containers[i].Env = append(containers[i].Env, corev1.EnvVar{
+			Name: hostIPEnv,
+			ValueFrom: &corev1.EnvVarSource{
+				FieldRef: &corev1.ObjectFieldSelector{
+					FieldPath: "status.hostIP",
+				},
+			},
+		})
+	}
+}
+
+// updateClientDeployment updates the arguments and Pod spec of the client
+// deployment when they have changed since it was created.
+func (c *Controller) updateClientDeployment(tunnel *inletsv1alpha1.Tunnel) error {
+	service, err := c.getTunnelService(tunnel)
+	if err != nil {
+		return err
+	}
+
+	deployment, err := c.deploymentsLister.Deployments(tunnel.Namespace).Get(tunnel.Spec.ClientDeploymentRef.Name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	desired, err := c.makeClientFor(tunnel, service)
+	if err != nil {
+		return err
+	}
+	wantArgs := desired.Spec.Template.Spec.Containers[0].Args
+
+	if len(deployment.Spec.Template.Spec.Containers) == 0 {
+		return nil
+	}
+
+	argsChanged := !reflect.DeepEqual(deployment.Spec.Template.Spec.Containers[0].Args, wantArgs)
+	proxiesChanged := clientProxiesChanged(deployment.Spec.Template.Spec, desired.Spec.Template.Spec)
+	tokenChanged := clientTokenChanged(deployment.Spec.Template, desired.Spec.Template)
+	podSpecChanged := clientPodSpecChanged(deployment.Spec.Template.Spec, tunnel) ||
+		clientSecurityContextChanged(deployment.Spec.Template, tunnel, c.infra().ClientSecurityContext)
+
+	if !argsChanged && !proxiesChanged && !tokenChanged && !podSpecChanged {
+		return nil
+	}
+
+	c.tunnelLog(tunnel).Info("Updating client deployment, upstream or pod spec changed", "deployment", deployment.Name)
+
+	deploymentCopy := deployment.DeepCopy()
+	deploymentCopy.Spec.Template.Spec.Containers[0].Args = wantArgs
+	applyClientToken(&deploymentCopy.Spec.Template, desired.Spec.Template)
+	if proxiesChanged {
+		deploymentCopy.Spec.Template.Spec.Containers = append(deploymentCopy.Spec.Template.Spec.Containers[:1],
+			desired.Spec.Template.Spec.Containers[1:]...)
+	}
+	// The client mounts a ServiceAccount token when its args read one
+	if proxiesChanged || argsChanged {
+		deploymentCopy.Spec.Template.Spec.Containers[0].VolumeMounts = desired.Spec.Template.Spec.Containers[0].VolumeMounts
+		deploymentCopy.Spec.Template.Spec.Volumes = desired.Spec.Template.Spec.Volumes
+	}
+	applyClientPodSpec(&deploymentCopy.Spec.Template.Spec, tunnel)
+	applyClientSecurityContext(&deploymentCopy.Spec.Template, tunnel, c.infra().ClientSecurityContext)
+
+	_, err = c.kubeclientset.AppsV1().Deployments(tunnel.Namespace).Update(deploymentCopy)
+	return err
+}
+
+// getServiceIPs returns the IPs of the exit-nodes for the Service of a
+// tunnel, which may have more than one tunnel when it uses many regions.
+func (c *Controller) getServiceIPs(tunnel *inletsv1alpha1.Tunnel, ip string) []string {
+	ips := []string{ip}
+
+	tunnels, err := c.tunnelsLister.Tunnels(tunnel.Namespace).List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return ips
+	}
+
+	for _, t := range tunnels {
+		if t.Name != tunnel.Name &&
+			t.Spec.ServiceName == tunnel.Spec.ServiceName &&
+			t.Status.HostStatus == "active" &&
+			isPublished(t) &&
+			len(t.Status.HostIP) > 0 {
+			ips = append(ips, t.Status.HostIP)
+		}
+	}
+
+	sort.Strings(ips)
+	return ips
+}
+
 func (c *Controller) updateService(tunnel *inletsv1alpha1.Tunnel, ip string) error {
 
 	get := metav1.GetOptions{}
@@ -594,28 +1892,174 @@ func (c *Controller) updateService(tunnel *inletsv1alpha1.Tunnel, ip string) err
 		return err
 	}
 
+	ips := c.getServiceIPs(tunnel, ip)
+
+	hostname := c.getServiceHostname(tunnel, res)
+
 	copy := res.DeepCopy()
-	// copy.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
-	// 	corev1.LoadBalancerIngress{IP: ip},
-	// }
-	copy.Spec.ExternalIPs = []string{ip}
+	copy.Spec.ExternalIPs = ips
+	setExternalDNSAnnotations(copy, hostname, ips)
+
+	updated, err := c.kubeclientset.CoreV1().Services(tunnel.Namespace).Update(copy)
+	if err != nil {
+		return err
+	}
+
+	if updated.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil
+	}
 
-	_, err = c.kubeclientset.CoreV1().Services(tunnel.Namespace).Update(copy)
+	// Publish the address in the status of the Service, just like a cloud
+	// LoadBalancer would, so that tooling such as external-dns can find it.
+	statusCopy := updated.DeepCopy()
+	statusCopy.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{}
+	for _, serviceIP := range ips {
+		statusCopy.Status.LoadBalancer.Ingress = append(statusCopy.Status.LoadBalancer.Ingress,
+			corev1.LoadBalancerIngress{
+				IP:       serviceIP,
+				Hostname: hostname,
+			})
+	}
+
+	_, err = c.kubeclientset.CoreV1().Services(tunnel.Namespace).UpdateStatus(statusCopy)
 	return err
 }
 
+// getServiceHostname returns the hostname to publish for a Service from
+// its tunnel, its annotation, or the domain of the TunnelClass of its tunnel.
+func (c *Controller) getServiceHostname(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) string {
+	if len(tunnel.Spec.Hostname) > 0 {
+		return tunnel.Spec.Hostname
+	}
+	if hostname := service.Annotations[hostnameAnnotation]; len(hostname) > 0 {
+		return hostname
+	}
+
+	class, _ := c.getTunnelClass(tunnel)
+	return getClassHostname(class, service)
+}
+
+// setExternalDNSAnnotations points external-dns at the IPs of the exit-nodes
+// for the hostname of a Service. An explicit target is needed since the
+// ingress of the Service has both an IP and a hostname. A hostname set for
+// external-dns by the user is left alone.
+func setExternalDNSAnnotations(service *corev1.Service, hostname string, ips []string) {
+	if len(hostname) == 0 {
+		return
+	}
+
+	if service.Annotations == nil {
+		service.Annotations = map[string]string{}
+	}
+
+	if existing, ok := service.Annotations[externalDNSHostnameAnnotation]; ok && existing != hostname {
+		return
+	}
+
+	service.Annotations[externalDNSHostnameAnnotation] = hostname
+	service.Annotations[externalDNSTargetAnnotation] = strings.Join(ips, ",")
+}
+
 func (c *Controller) updateTunnelProvisioningStatus(tunnel *inletsv1alpha1.Tunnel, status, id, ip string) error {
-	log.Printf("Status: %s, ID: %s, IP: %s\n", status, id, ip)
+	c.tunnelLog(tunnel).Info("Updating status", "status", status, "hostID", id, "ip", ip)
 
 	tunnelCopy := tunnel.DeepCopy()
 	tunnelCopy.Status.HostStatus = status
 	tunnelCopy.Status.HostID = id
 	tunnelCopy.Status.HostIP = ip
+	tunnelCopy.Status.Address = getTunnelAddress(tunnel, ip)
+	tunnelCopy.Status.ControlPlaneURL = getControlPlaneURL(tunnel, ip)
+	tunnelCopy.Status.ControlPlanePort = getControlPlanePort(tunnel, ip)
+	tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelPublished)
+
+	if status != "" {
+		tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelPending)
+	} else {
+		tunnelCopy.Status.Provider = ""
+		tunnelCopy.Status.Region = ""
+		tunnelCopy.Status.EstimatedHourlyCost = ""
+		tunnelCopy.Status.Replacement = nil
+		tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelClientConnected)
+	}
+
+	if status != tunnel.Status.HostStatus {
+		c.metrics.observeHostStatus(tunnel, c.getTunnelProvider(tunnel), status)
+	}
 
-	_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).Update(tunnelCopy)
+	if status == "active" {
+		now := metav1.Now()
+		tunnelCopy.Status.ProvisionedAt = &now
+	} else if status == "" {
+		tunnelCopy.Status.ProvisionedAt = nil
+	}
+
+	span := c.startSpan(tunnel, "status-update", "inlets.host.status", status, "inlets.host.id", id)
+	_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	span.finish(err)
 	return err
 }
 
+// updateTunnelSpecAndStatus writes the spec of a tunnel, then its status
+// through the status subresource, which is the only way to change it.
+func (c *Controller) updateTunnelSpecAndStatus(tunnel *inletsv1alpha1.Tunnel) error {
+	tunnels := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace)
+
+	updated, err := c.updateTunnel(tunnel)
+	if err != nil {
+		return err
+	}
+
+	updated.Status = *tunnel.Status.DeepCopy()
+	_, err = tunnels.UpdateStatus(updated)
+	return err
+}
+
+// getControlPlaneURL returns the URL which the client of a tunnel connects
+// to on the exit-node with the given IP.
+func getControlPlaneURL(tunnel *inletsv1alpha1.Tunnel, ip string) string {
+	if len(ip) == 0 {
+		return ""
+	}
+	if isProTunnel(tunnel) {
+		return fmt.Sprintf("wss://%s/connect", net.JoinHostPort(ip, fmt.Sprintf("%d", inletsProControlPort)))
+	}
+	return fmt.Sprintf("ws://%s", net.JoinHostPort(ip, fmt.Sprintf("%d", inletsControlPort)))
+}
+
+// getControlPlanePort returns the control-port of the exit-node of a tunnel
+// with the given IP.
+func getControlPlanePort(tunnel *inletsv1alpha1.Tunnel, ip string) int32 {
+	if len(ip) == 0 {
+		return 0
+	}
+	if isProTunnel(tunnel) {
+		return inletsProControlPort
+	}
+	return inletsControlPort
+}
+
+// getClientControlPlaneURL returns the URL for the client of a tunnel from
+// its status, or from the IP of its exit-node for tunnels which were
+// provisioned before the URL was recorded. With mutual TLS, the client
+// connects through the TLS proxy in its Pod.
+func getClientControlPlaneURL(tunnel *inletsv1alpha1.Tunnel) string {
+	if usesControlPlaneTLS(tunnel) {
+		return getControlPlaneURL(tunnel, "127.0.0.1")
+	}
+	if len(tunnel.Status.ControlPlaneURL) > 0 {
+		return tunnel.Status.ControlPlaneURL
+	}
+	return getControlPlaneURL(tunnel, tunnel.Status.HostIP)
+}
+
+// getTunnelAddress returns the address of a tunnel with the given IP.
+func getTunnelAddress(tunnel *inletsv1alpha1.Tunnel, ip string) string {
+	if len(ip) > 0 && len(tunnel.Spec.Hostname) > 0 {
+		return tunnel.Spec.Hostname
+	}
+	return ip
+}
+
 // enqueueTunnel takes a Tunnel resource and converts it into a namespace/name
 // string which is then put onto the work queue. This method should *not* be
 // passed resources of any type other than Tunnel.
@@ -670,22 +2114,145 @@ func (c *Controller) handleObject(obj interface{}) {
 	}
 }
 
-func makeUserdata(authToken string) string {
+func validateClientMode(mode string) error {
+	switch mode {
+	case "", "deployment", "daemonset", "sidecar":
+		return nil
+	}
+	return fmt.Errorf("clientMode must be one of deployment, daemonset or sidecar, not %q", mode)
+}
+
+// isProTunnel returns true when the tunnel needs the L4 features of inlets-pro.
+func isProTunnel(tunnel *inletsv1alpha1.Tunnel) bool {
+	switch tunnel.Spec.Protocol {
+	case "tcp", "udp":
+		return true
+	}
+	return len(tunnel.Spec.ProxyProtocol) > 0 || tunnel.Spec.TLS != nil
+}
+
+func validateProtocol(protocol string) error {
+	switch protocol {
+	case "", "http", "tcp", "udp":
+		return nil
+	}
+	return fmt.Errorf("protocol must be one of http, tcp or udp, not %q", protocol)
+}
+
+func validateProxyProtocol(version string) error {
+	switch version {
+	case "", "v1", "v2":
+		return nil
+	}
+	return fmt.Errorf("proxyProtocol must be one of v1 or v2, not %q", version)
+}
+
+// makeExitUserdata returns the userdata for the exit-node of a tunnel. The
+// allowedSourceCIDRs and control sources are applied with iptables unless
+// the provider has a firewall, which can be changed after the exit-node was
+// provisioned. The releases it downloads are verified with their checksums.
+func makeExitUserdata(tunnel *inletsv1alpha1.Tunnel, hasFirewall bool, controlSources []string, checksums map[string]string) string {
+	cidrs := tunnel.Spec.AllowedSourceCIDRs
+	if hasFirewall {
+		cidrs = nil
+		controlSources = nil
+	}
+
+	if isProTunnel(tunnel) {
+		// With mutual TLS or control-plane TLS, the server listens behind
+		// the TLS proxy, which the client reaches through its own proxy on
+		// 127.0.0.1
+		controlPort, commonName := int32(inletsProControlPort), "$IP"
+		if usesControlPlaneTLS(tunnel) {
+			controlPort, commonName = mutualTLSBackendPort, "127.0.0.1"
+		}
+
+		return makeProUserdata(tunnel.Spec.AuthToken, tunnel.Spec.ProxyProtocol, controlPort, commonName, checksums["inlets-pro"]) +
+			makeFirewallUserdata(inletsProControlPort, controlSources, cidrs) +
+			makeRateLimitUserdata(tunnel.Spec.RateLimit, inletsProControlPort) +
+			makeSandboxUserdata(tunnel, "inlets-pro")
+	}
+	return makeUserdata(tunnel.Spec.AuthToken, checksums["inlets"]) +
+		makeFirewallUserdata(inletsControlPort, controlSources, cidrs) +
+		makeRateLimitUserdata(tunnel.Spec.RateLimit, inletsControlPort) +
+		makeSandboxUserdata(tunnel, "inlets")
+}
+
+func makeProUserdata(authToken, proxyProtocol string, port int32, commonName, checksum string) string {
+	controlPort := fmt.Sprintf("%d", port)
+
+	return `#!/bin/bash
+export AUTHTOKEN="` + authToken + `"
+export CONTROLPORT="` + controlPort + `"
+export PROXYPROTOCOL="` + proxyProtocol + `"
+export IP=$(curl -sfSL https://checkip.amazonaws.com)
+
+` + makeVerifiedDownload(inletsProRelease, "/tmp/inlets-pro", checksum) + ` && \
+	chmod +x /tmp/inlets-pro && \
+	mv /tmp/inlets-pro /usr/local/bin/inlets-pro
+
+cat > /etc/systemd/system/inlets-pro.service <<EOF
+[Unit]
+Description=inlets-pro server
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+ExecStart=/usr/local/bin/inlets-pro server --auto-tls --common-name=` + commonName + ` --control-port=$CONTROLPORT --token=$AUTHTOKEN --proxy-protocol=$PROXYPROTOCOL
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start inlets-pro && \
+	systemctl enable inlets-pro`
+}
+
+func makeUserdata(authToken, checksum string) string {
 	controlPort := fmt.Sprintf("%d", inletsControlPort)
 
 	return `#!/bin/bash
 export INLETSTOKEN="` + authToken + `"
 export CONTROLPORT="` + controlPort + `"
-curl -sLS https://get.inlets.dev | sudo sh
 
-curl -sLO https://raw.githubusercontent.com/alexellis/inlets/master/hack/inlets-operator.service  && \
-	mv inlets-operator.service /etc/systemd/system/inlets.service && \
-	echo "AUTHTOKEN=$INLETSTOKEN" > /etc/default/inlets && \
-	echo "CONTROLPORT=$CONTROLPORT" > /etc/default/inlets && \
-	systemctl start inlets && \
+` + makeVerifiedDownload(inletsRelease, "/tmp/inlets", checksum) + ` && \
+	chmod +x /tmp/inlets && \
+	mv /tmp/inlets /usr/local/bin/inlets
+
+echo "AUTHTOKEN=$INLETSTOKEN" > /etc/default/inlets
+echo "CONTROLPORT=$CONTROLPORT" >> /etc/default/inlets
+
+cat > /etc/systemd/system/inlets.service <<'EOF'
+[Unit]
+Description=inlets server
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+EnvironmentFile=/etc/default/inlets
+ExecStart=/usr/local/bin/inlets server --port=80 --control-port=${CONTROLPORT} --token=${AUTHTOKEN}
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start inlets && \
 	systemctl enable inlets`
 }
 
+// matchesServiceSelector returns true when the Service has the labels of
+// the service selector of the operator, or when there is no selector.
+func (c *Controller) matchesServiceSelector(service *corev1.Service) bool {
+	if c.infra().ServiceSelector == nil {
+		return true
+	}
+	return c.infra().ServiceSelector.Matches(labels.Set(service.Labels))
+}
+
 func hasIgnoreAnnotation(annotations map[string]string) bool {
 	if v, ok := annotations["dev.inlets.manage"]; ok && v == "false" {
 		return true
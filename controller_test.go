@@ -18,296 +18,523 @@ package main
 
 import (
 	"fmt"
-	"reflect"
+	"strings"
 	"testing"
 	"time"
 
-	apps "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/diff"
+	"k8s.io/apimachinery/pkg/types"
 	kubeinformers "k8s.io/client-go/informers"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
-	core "k8s.io/client-go/testing"
-	"k8s.io/client-go/tools/cache"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/record"
 
-	inletsoperator "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
 	"github.com/alexellis/inlets-operator/pkg/generated/clientset/versioned/fake"
 	informers "github.com/alexellis/inlets-operator/pkg/generated/informers/externalversions"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
 )
 
-var (
-	alwaysReady        = func() bool { return true }
-	noResyncPeriodFunc = func() time.Duration { return 0 }
-)
+// fakeReleaseChecksum is the checksum of each release in a fixture, which
+// the fake provisioner never downloads.
+const fakeReleaseChecksum = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// fakeReleaseChecksums returns a checksum for each release, so that tests
+// provision exit-nodes for every kind of tunnel.
+func fakeReleaseChecksums() map[string]string {
+	checksums := map[string]string{}
+	for name := range releases {
+		checksums[name] = fakeReleaseChecksum
+	}
+	return checksums
+}
 
+// fixture is a Controller with fake clients, whose exit-nodes are
+// provisioned by a FakeProvisioner.
 type fixture struct {
 	t *testing.T
 
-	client     *fake.Clientset
-	kubeclient *k8sfake.Clientset
-	// Objects to put in the store.
-	fooLister        []*inletsoperator.Foo
-	deploymentLister []*apps.Deployment
-	// Actions expected to happen on the client.
-	kubeactions []core.Action
-	actions     []core.Action
-	// Objects from here preloaded into NewSimpleFake.
-	kubeobjects []runtime.Object
-	objects     []runtime.Object
+	client        *fake.Clientset
+	kubeclient    *k8sfake.Clientset
+	informers     informers.SharedInformerFactory
+	kubeInformers kubeinformers.SharedInformerFactory
+	controller    *Controller
+	provisioner   *provision.FakeProvisioner
 }
 
-func newFixture(t *testing.T) *fixture {
-	f := &fixture{}
-	f.t = t
-	f.objects = []runtime.Object{}
-	f.kubeobjects = []runtime.Object{}
+// newFixture returns a fixture whose InfraConfig has the defaults of the
+// flags, changed by options, i.e. to give a test a quota or a warm pool.
+func newFixture(t *testing.T, options ...func(*InfraConfig)) *fixture {
+	f := &fixture{t: t}
+	f.client = fake.NewSimpleClientset()
+	f.kubeclient = k8sfake.NewSimpleClientset()
+
+	// The status subresource keeps the spec which is stored, as the API
+	// server does
+	objects := f.client.ReactionChain[0]
+	f.client.PrependReactor("update", "tunnels", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+		tunnel := action.(k8stesting.UpdateAction).GetObject().(*inletsv1alpha1.Tunnel).DeepCopy()
+		_, stored, err := objects.React(k8stesting.NewGetAction(action.GetResource(), tunnel.Namespace, tunnel.Name))
+		if err != nil {
+			return true, nil, err
+		}
+		tunnel.Spec = stored.(*inletsv1alpha1.Tunnel).Spec
+		return objects.React(k8stesting.NewUpdateAction(action.GetResource(), tunnel.Namespace, tunnel))
+	})
+
+	kubeInformers := kubeinformers.NewSharedInformerFactory(f.kubeclient, 0)
+	f.kubeInformers = kubeInformers
+	f.informers = informers.NewSharedInformerFactory(f.client, 0)
+
+	// Each test has its own access key, so that it gets its own
+	// provisioner from the cache of provisioners
+	accessKey := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	infra := &InfraConfig{
+		Provider:          "fake",
+		AccessKey:         accessKey,
+		TokenLength:       64,
+		Executor:          "inline",
+		RetainedNamespace: metav1.NamespaceDefault,
+		ReleaseChecksums:  fakeReleaseChecksums(),
+	}
+	for _, option := range options {
+		option(infra)
+	}
+
+	f.controller = NewController(f.kubeclient, f.client,
+		kubeInformers.Apps().V1().Deployments(),
+		f.informers.Inletsoperator().V1alpha1().Tunnels(),
+		f.informers.Inletsoperator().V1alpha1().TunnelClasses(),
+		kubeInformers.Core().V1().Services(),
+		kubeInformers.Core().V1().Endpoints(),
+		infra)
+	f.controller.recorder = record.NewFakeRecorder(100)
+
+	provisioner, err := provision.GetProvisioner("fake", accessKey)
+	if err != nil {
+		t.Fatalf("error getting provisioner: %s", err.Error())
+	}
+	f.provisioner = provisioner.(*provision.FakeProvisioner)
+	f.provisioner.ProvisionLatency = 0
+	f.provisioner.CallLatency = 0
 	return f
 }
 
-func newFoo(name string, replicas *int32) *inletsoperator.Foo {
-	return &inletsoperator.Foo{
-		TypeMeta: metav1.TypeMeta{APIVersion: inletsoperator.SchemeGroupVersion.String()},
+func newTunnel(name string) *inletsv1alpha1.Tunnel {
+	return &inletsv1alpha1.Tunnel{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: metav1.NamespaceDefault,
+			UID:       types.UID("uid-" + name),
 		},
-		Spec: inletsoperator.FooSpec{
-			DeploymentName: fmt.Sprintf("%s-deployment", name),
-			Replicas:       replicas,
+		Spec: inletsv1alpha1.TunnelSpec{
+			ServiceName: name,
 		},
 	}
 }
 
-func (f *fixture) newController() (*Controller, informers.SharedInformerFactory, kubeinformers.SharedInformerFactory) {
-	f.client = fake.NewSimpleClientset(f.objects...)
-	f.kubeclient = k8sfake.NewSimpleClientset(f.kubeobjects...)
-
-	i := informers.NewSharedInformerFactory(f.client, noResyncPeriodFunc())
-	k8sI := kubeinformers.NewSharedInformerFactory(f.kubeclient, noResyncPeriodFunc())
-
-	c := NewController(f.kubeclient, f.client,
-		k8sI.Apps().V1().Deployments(), i.Samplecontroller().V1alpha1().Foos())
-
-	c.foosSynced = alwaysReady
-	c.deploymentsSynced = alwaysReady
-	c.recorder = &record.FakeRecorder{}
-
-	for _, f := range f.fooLister {
-		i.Samplecontroller().V1alpha1().Foos().Informer().GetIndexer().Add(f)
+// create adds a Tunnel to the client and the cache of the informer.
+func (f *fixture) create(tunnel *inletsv1alpha1.Tunnel) {
+	created, err := f.client.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).Create(tunnel)
+	if err != nil {
+		f.t.Fatalf("error creating tunnel: %s", err.Error())
 	}
+	f.informers.Inletsoperator().V1alpha1().Tunnels().Informer().GetIndexer().Add(created)
+}
 
-	for _, d := range f.deploymentLister {
-		k8sI.Apps().V1().Deployments().Informer().GetIndexer().Add(d)
+// addLicenseClass adds a default TunnelClass which lets the license be
+// copied into the namespaces of inlets-pro tunnels.
+func (f *fixture) addLicenseClass() {
+	class := &inletsv1alpha1.TunnelClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "licensed",
+			Annotations: map[string]string{defaultTunnelClassAnnotation: "true"},
+		},
+		Spec: inletsv1alpha1.TunnelClassSpec{CopyLicense: true},
 	}
-
-	return c, i, k8sI
+	f.informers.Inletsoperator().V1alpha1().TunnelClasses().Informer().GetIndexer().Add(class)
 }
 
-func (f *fixture) run(fooName string) {
-	f.runController(fooName, true, false)
+// get returns a Tunnel from the client.
+func (f *fixture) get(name string) *inletsv1alpha1.Tunnel {
+	tunnel, err := f.client.InletsoperatorV1alpha1().Tunnels(metav1.NamespaceDefault).Get(name, metav1.GetOptions{})
+	if err != nil {
+		f.t.Fatalf("error getting tunnel: %s", err.Error())
+	}
+	return tunnel
 }
 
-func (f *fixture) runExpectError(fooName string) {
-	f.runController(fooName, true, true)
+// sync syncs a Tunnel, then updates the cache of the informer with it, as
+// the informer would.
+func (f *fixture) sync(name string) error {
+	err := f.controller.syncHandler(metav1.NamespaceDefault + "/" + name)
+	f.informers.Inletsoperator().V1alpha1().Tunnels().Informer().GetIndexer().Update(f.get(name))
+	return err
 }
 
-func (f *fixture) runController(fooName string, startInformers bool, expectError bool) {
-	c, i, k8sI := f.newController()
-	if startInformers {
-		stopCh := make(chan struct{})
-		defer close(stopCh)
-		i.Start(stopCh)
-		k8sI.Start(stopCh)
+// syncUntil syncs a Tunnel until it has a host status, or fails the test
+// after a number of syncs.
+func (f *fixture) syncUntil(name, hostStatus string) *inletsv1alpha1.Tunnel {
+	for i := 0; i < 10; i++ {
+		if err := f.sync(name); err != nil {
+			f.t.Fatalf("error syncing tunnel: %s", err.Error())
+		}
+		if tunnel := f.get(name); tunnel.Status.HostStatus == hostStatus {
+			return tunnel
+		}
+		// The poll of an exit-node which is provisioning is due straight
+		// away in the test
+		f.controller.forgetPoll(f.get(name))
 	}
+	f.t.Fatalf("tunnel did not become %q, is %q", hostStatus, f.get(name).Status.HostStatus)
+	return nil
+}
 
-	err := c.syncHandler(fooName)
-	if !expectError && err != nil {
-		f.t.Errorf("error syncing foo: %v", err)
-	} else if expectError && err == nil {
-		f.t.Error("expected error syncing foo, got nil")
-	}
+func TestSyncProvisionsExitNode(t *testing.T) {
+	f := newFixture(t)
+	f.create(newTunnel("app"))
 
-	actions := filterInformerActions(f.client.Actions())
-	for i, action := range actions {
-		if len(f.actions) < i+1 {
-			f.t.Errorf("%d unexpected actions: %+v", len(actions)-len(f.actions), actions[i:])
-			break
-		}
+	tunnel := f.syncUntil("app", "active")
 
-		expectedAction := f.actions[i]
-		checkAction(expectedAction, action, f.t)
+	if got := f.provisioner.Calls("Provision"); got != 1 {
+		t.Errorf("want 1 call to Provision, got %d", got)
+	}
+	if tunnel.Status.HostID != "fake-1" {
+		t.Errorf("want host fake-1, got %q", tunnel.Status.HostID)
+	}
+	if tunnel.Status.HostIP != "203.0.113.1" {
+		t.Errorf("want IP 203.0.113.1, got %q", tunnel.Status.HostIP)
+	}
+	if tunnel.Status.Operation != nil {
+		t.Errorf("want the operation to be cleared, got %v", tunnel.Status.Operation)
 	}
 
-	if len(f.actions) > len(actions) {
-		f.t.Errorf("%d additional expected actions:%+v", len(f.actions)-len(actions), f.actions[len(actions):])
+	host, ok := f.provisioner.Host("fake-1")
+	if !ok {
+		t.Fatalf("want host fake-1 to exist")
 	}
+	if host.Tags[managedByTag] != managedByValue || host.Tags[tunnelTag] != "default.app" {
+		t.Errorf("want the tags of the operator, got %v", host.Tags)
+	}
+}
 
-	k8sActions := filterInformerActions(f.kubeclient.Actions())
-	for i, action := range k8sActions {
-		if len(f.kubeactions) < i+1 {
-			f.t.Errorf("%d unexpected actions: %+v", len(k8sActions)-len(f.kubeactions), k8sActions[i:])
-			break
-		}
+func TestSyncWaitsForExitNodeToBecomeActive(t *testing.T) {
+	f := newFixture(t)
+	f.provisioner.ProvisionLatency = time.Hour
+	f.create(newTunnel("app"))
 
-		expectedAction := f.kubeactions[i]
-		checkAction(expectedAction, action, f.t)
+	tunnel := f.syncUntil("app", "provisioning")
+	if len(tunnel.Status.HostIP) > 0 {
+		t.Errorf("want no IP whilst provisioning, got %q", tunnel.Status.HostIP)
 	}
 
-	if len(f.kubeactions) > len(k8sActions) {
-		f.t.Errorf("%d additional expected actions:%+v", len(f.kubeactions)-len(k8sActions), f.kubeactions[len(k8sActions):])
+	f.controller.forgetPoll(tunnel)
+	if err := f.sync("app"); err != nil {
+		t.Fatalf("error syncing tunnel: %s", err.Error())
+	}
+	if got := f.get("app").Status.HostStatus; got != "provisioning" {
+		t.Errorf("want the tunnel to still be provisioning, got %q", got)
 	}
 }
 
-// checkAction verifies that expected and actual actions are equal and both have
-// same attached resources
-func checkAction(expected, actual core.Action, t *testing.T) {
-	if !(expected.Matches(actual.GetVerb(), actual.GetResource().Resource) && actual.GetSubresource() == expected.GetSubresource()) {
-		t.Errorf("Expected\n\t%#v\ngot\n\t%#v", expected, actual)
-		return
-	}
+func TestSyncRetriesFailedProvision(t *testing.T) {
+	f := newFixture(t)
+	f.provisioner.FailNext("Provision", &provision.PluginError{Message: "boom", Class: "server"})
+	f.create(newTunnel("app"))
 
-	if reflect.TypeOf(actual) != reflect.TypeOf(expected) {
-		t.Errorf("Action has wrong type. Expected: %t. Got: %t", expected, actual)
-		return
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		err = f.sync("app")
+	}
+	if err == nil {
+		t.Fatalf("want the error of Provision")
+	}
+	if got := f.get("app").Status.HostStatus; got != "" {
+		t.Errorf("want no host status after the failure, got %q", got)
 	}
 
-	switch a := actual.(type) {
-	case core.CreateAction:
-		e, _ := expected.(core.CreateAction)
-		expObject := e.GetObject()
-		object := a.GetObject()
+	// The create may have succeeded after all, so the operator only creates
+	// the exit-node again once the operation is old enough to have been listed
+	tunnel := f.get("app")
+	if tunnel.Status.Operation == nil {
+		t.Fatalf("want the operation to be kept after the failure")
+	}
+	tunnel.Status.Operation.StartedAt = metav1.NewTime(time.Now().Add(-operationListDelay))
+	if _, err := f.client.InletsoperatorV1alpha1().Tunnels(metav1.NamespaceDefault).UpdateStatus(tunnel); err != nil {
+		t.Fatalf("error updating tunnel: %s", err.Error())
+	}
+	f.informers.Inletsoperator().V1alpha1().Tunnels().Informer().GetIndexer().Update(f.get("app"))
 
-		if !reflect.DeepEqual(expObject, object) {
-			t.Errorf("Action %s %s has wrong object\nDiff:\n %s",
-				a.GetVerb(), a.GetResource().Resource, diff.ObjectGoPrintDiff(expObject, object))
-		}
-	case core.UpdateAction:
-		e, _ := expected.(core.UpdateAction)
-		expObject := e.GetObject()
-		object := a.GetObject()
-
-		if !reflect.DeepEqual(expObject, object) {
-			t.Errorf("Action %s %s has wrong object\nDiff:\n %s",
-				a.GetVerb(), a.GetResource().Resource, diff.ObjectGoPrintDiff(expObject, object))
-		}
-	case core.PatchAction:
-		e, _ := expected.(core.PatchAction)
-		expPatch := e.GetPatch()
-		patch := a.GetPatch()
-
-		if !reflect.DeepEqual(expPatch, patch) {
-			t.Errorf("Action %s %s has wrong patch\nDiff:\n %s",
-				a.GetVerb(), a.GetResource().Resource, diff.ObjectGoPrintDiff(expPatch, patch))
-		}
+	tunnel = f.syncUntil("app", "active")
+	if got := len(f.provisioner.HostIDs()); got != 1 {
+		t.Errorf("want 1 host, got %d", got)
+	}
+	if tunnel.Status.HostID != "fake-1" {
+		t.Errorf("want host fake-1, got %q", tunnel.Status.HostID)
 	}
 }
 
-// filterInformerActions filters list and watch actions for testing resources.
-// Since list and watch don't change resource state we can filter it to lower
-// nose level in our tests.
-func filterInformerActions(actions []core.Action) []core.Action {
-	ret := []core.Action{}
-	for _, action := range actions {
-		if len(action.GetNamespace()) == 0 &&
-			(action.Matches("list", "foos") ||
-				action.Matches("watch", "foos") ||
-				action.Matches("list", "deployments") ||
-				action.Matches("watch", "deployments")) {
-			continue
-		}
-		ret = append(ret, action)
+func TestSyncResumesOperationAfterRestart(t *testing.T) {
+	f := newFixture(t)
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Status.Operation = &inletsv1alpha1.TunnelOperation{
+		Phase:     operationCreating,
+		ID:        "op1",
+		Provider:  "fake",
+		StartedAt: metav1.Now(),
 	}
+	f.create(tunnel)
 
-	return ret
-}
+	// The exit-node was created before the operator restarted
+	host := f.controller.makeExitHost(tunnel, ProvisionTarget{Provider: "fake"})
+	if _, err := f.provisioner.Provision(host); err != nil {
+		t.Fatalf("error provisioning: %s", err.Error())
+	}
 
-func (f *fixture) expectCreateDeploymentAction(d *apps.Deployment) {
-	f.kubeactions = append(f.kubeactions, core.NewCreateAction(schema.GroupVersionResource{Resource: "deployments"}, d.Namespace, d))
+	resumed := f.syncUntil("app", "active")
+	if got := f.provisioner.Calls("Provision"); got != 1 {
+		t.Errorf("want no second call to Provision, got %d calls", got)
+	}
+	if resumed.Status.HostID != "fake-1" {
+		t.Errorf("want host fake-1, got %q", resumed.Status.HostID)
+	}
 }
 
-func (f *fixture) expectUpdateDeploymentAction(d *apps.Deployment) {
-	f.kubeactions = append(f.kubeactions, core.NewUpdateAction(schema.GroupVersionResource{Resource: "deployments"}, d.Namespace, d))
-}
+func TestGetUpstreamPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		service *corev1.Service
+		want    int32
+	}{
+		{
+			name: "port named http",
+			service: &corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "metrics", Port: 9090},
+				{Name: "http", Port: 8080},
+			}}},
+			want: 8080,
+		},
+		{
+			name: "first TCP port",
+			service: &corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+				{Name: "web", Port: 3000, Protocol: corev1.ProtocolTCP},
+			}}},
+			want: 3000,
+		},
+		{
+			name: "no TCP ports",
+			service: &corev1.Service{Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			}}},
+			want: 80,
+		},
+		{
+			name: "node port",
+			service: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{nodePortAnnotation: "true"}},
+				Spec: corev1.ServiceSpec{
+					Type:  corev1.ServiceTypeNodePort,
+					Ports: []corev1.ServicePort{{Name: "web", Port: 3000, NodePort: 30080}},
+				},
+			},
+			want: 30080,
+		},
+	}
 
-func (f *fixture) expectUpdateFooStatusAction(foo *inletsoperator.Foo) {
-	action := core.NewUpdateAction(schema.GroupVersionResource{Resource: "foos"}, foo.Namespace, foo)
-	// TODO: Until #38113 is merged, we can't use Subresource
-	//action.Subresource = "status"
-	f.actions = append(f.actions, action)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := getUpstreamPort(test.service); got != test.want {
+				t.Errorf("want port %d, got %d", test.want, got)
+			}
+		})
+	}
 }
 
-func getKey(foo *inletsoperator.Foo, t *testing.T) string {
-	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(foo)
-	if err != nil {
-		t.Errorf("Unexpected error getting key for foo %v: %v", foo.Name, err)
-		return ""
+func newPortsService(ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: corev1.ServiceSpec{
+			Type:  corev1.ServiceTypeLoadBalancer,
+			Ports: ports,
+		},
 	}
-	return key
 }
 
-func TestCreatesDeployment(t *testing.T) {
+func TestUpdateClientDeploymentWhenServicePortChanges(t *testing.T) {
 	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
+	services := f.kubeInformers.Core().V1().Services().Informer().GetIndexer()
+	deployments := f.kubeInformers.Apps().V1().Deployments().Informer().GetIndexer()
 
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
+	service := newPortsService(corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP})
+	services.Add(service)
 
-	expDeployment := newDeployment(foo)
-	f.expectCreateDeploymentAction(expDeployment)
-	f.expectUpdateFooStatusAction(foo)
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Spec.ClientDeploymentRef = &metav1.ObjectMeta{Name: "app-client"}
+	tunnel.Status.HostIP = "203.0.113.10"
 
-	f.run(getKey(foo, t))
-}
+	deployment, err := f.controller.makeClientFor(tunnel, service)
+	if err != nil {
+		t.Fatalf("makeClientFor: %s", err.Error())
+	}
+	deployment.Name = "app-client"
+	deployment.Namespace = metav1.NamespaceDefault
+	if _, err := f.kubeclient.AppsV1().Deployments(metav1.NamespaceDefault).Create(deployment); err != nil {
+		t.Fatalf("error creating deployment: %s", err.Error())
+	}
+	deployments.Add(deployment)
 
-func TestDoNothing(t *testing.T) {
-	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
-	d := newDeployment(foo)
+	changed := newPortsService(corev1.ServicePort{Name: "http", Port: 9000, Protocol: corev1.ProtocolTCP})
+	services.Update(changed)
 
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
-	f.deploymentLister = append(f.deploymentLister, d)
-	f.kubeobjects = append(f.kubeobjects, d)
+	if err := f.controller.updateClientDeployment(tunnel); err != nil {
+		t.Fatalf("updateClientDeployment: %s", err.Error())
+	}
 
-	f.expectUpdateFooStatusAction(foo)
-	f.run(getKey(foo, t))
+	updated, err := f.kubeclient.AppsV1().Deployments(metav1.NamespaceDefault).Get("app-client", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting deployment: %s", err.Error())
+	}
+	args := strings.Join(updated.Spec.Template.Spec.Containers[0].Args, " ")
+	if !strings.Contains(args, "app:9000") || strings.Contains(args, "app:8080") {
+		t.Errorf("want the client to forward to the new port of the Service, got args: %s", args)
+	}
 }
 
-func TestUpdateDeployment(t *testing.T) {
+func TestSyncServiceTunnelChangesProtocolWithPorts(t *testing.T) {
 	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
-	d := newDeployment(foo)
-
-	// Update replicas
-	foo.Spec.Replicas = int32Ptr(2)
-	expDeployment := newDeployment(foo)
-
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
-	f.deploymentLister = append(f.deploymentLister, d)
-	f.kubeobjects = append(f.kubeobjects, d)
+	f.controller.infra().License = "license"
+	f.addLicenseClass()
+
+	tunnel := newTunnel("app-tunnel")
+	tunnel.Spec.ServiceName = "app"
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Status.HostStatus = "active"
+	tunnel.Status.HostID = "fake-1"
+	f.create(tunnel)
+
+	service := newPortsService(corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP})
+	f.controller.syncServiceTunnel(service, "")
+	if got := f.get("app-tunnel"); got.Spec.Protocol != "" || got.Status.HostID != "fake-1" {
+		t.Fatalf("want the tunnel to stay on HTTP with its exit-node, got %q %q", got.Spec.Protocol, got.Status.HostID)
+	}
 
-	f.expectUpdateFooStatusAction(foo)
-	f.expectUpdateDeploymentAction(expDeployment)
-	f.run(getKey(foo, t))
+	// A second TCP port is only forwarded at L4, by the server of
+	// inlets-pro on a new exit-node
+	service = newPortsService(
+		corev1.ServicePort{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+		corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+	)
+	f.controller.syncServiceTunnel(service, "")
+
+	got := f.get("app-tunnel")
+	if got.Spec.Protocol != "tcp" {
+		t.Errorf("want the protocol to change to tcp, got %q", got.Spec.Protocol)
+	}
+	if len(got.Status.HostID) > 0 || len(got.Status.HostStatus) > 0 {
+		t.Errorf("want the exit-node to be replaced, got %q which is %q", got.Status.HostID, got.Status.HostStatus)
+	}
 }
 
-func TestNotControlledByUs(t *testing.T) {
-	f := newFixture(t)
-	foo := newFoo("test", int32Ptr(1))
-	d := newDeployment(foo)
-
-	d.ObjectMeta.OwnerReferences = []metav1.OwnerReference{}
-
-	f.fooLister = append(f.fooLister, foo)
-	f.objects = append(f.objects, foo)
-	f.deploymentLister = append(f.deploymentLister, d)
-	f.kubeobjects = append(f.kubeobjects, d)
+func TestSyncHandlerRejectsInvalidSpecs(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*inletsv1alpha1.Tunnel)
+		reason    string
+	}{
+		{
+			name: "upstream without a port",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.ServiceName = ""
+				tunnel.Spec.Upstream = "app.default"
+			},
+			reason: ErrInvalidSpec,
+		},
+		{
+			name: "weak token",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.AuthToken = "password"
+			},
+			reason: ErrInvalidSpec,
+		},
+		{
+			name: "unknown client mode",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.ClientMode = "statefulset"
+			},
+			reason: ErrInvalidSpec,
+		},
+		{
+			name: "unknown protocol",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Protocol = "sctp"
+			},
+			reason: ErrInvalidSpec,
+		},
+		{
+			name: "unknown proxy protocol",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Protocol = "tcp"
+				tunnel.Spec.ProxyProtocol = "v3"
+			},
+			reason: ErrInvalidSpec,
+		},
+		{
+			name: "inlets-pro without a license",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Protocol = "tcp"
+			},
+			reason: ErrLicenseRequired,
+		},
+		{
+			name: "region of another provider",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Region = "lon1"
+			},
+			reason: ErrInvalidSpec,
+		},
+	}
 
-	f.runExpectError(getKey(foo, t))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t)
+			recorder := record.NewFakeRecorder(10)
+			f.controller.recorder = recorder
+
+			tunnel := newTunnel("app")
+			tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+			test.configure(tunnel)
+			f.create(tunnel)
+
+			if err := f.sync("app"); err != nil {
+				t.Fatalf("want an invalid spec to be reported with an event, got %s", err.Error())
+			}
+
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, corev1.EventTypeWarning+" "+test.reason+" ") {
+					t.Errorf("want a warning with reason %s, got %q", test.reason, event)
+				}
+			default:
+				t.Errorf("want a warning with reason %s, got no event", test.reason)
+			}
+
+			if calls := f.provisioner.Calls("Provision"); calls != 0 {
+				t.Errorf("want no exit-node for an invalid spec, got %d", calls)
+			}
+			if got := f.get("app"); len(got.Status.HostStatus) > 0 {
+				t.Errorf("want the tunnel to stay unprovisioned, got %q", got.Status.HostStatus)
+			}
+		})
+	}
 }
-
-func int32Ptr(i int32) *int32 { return &i }
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// cosignSignatureAnnotation is the annotation of a layer of a cosign
+	// signature manifest with the signature of its payload.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// verifiedImageTTL is how long the digest which a tag was verified at
+	// is used for before the tag is resolved and verified again.
+	verifiedImageTTL = time.Hour
+
+	manifestMediaTypes = "application/vnd.oci.image.index.v1+json, " +
+		"application/vnd.docker.distribution.manifest.list.v2+json, " +
+		"application/vnd.oci.image.manifest.v1+json, " +
+		"application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// verifiedImage is the digest which an image was verified at.
+type verifiedImage struct {
+	Digest     string
+	VerifiedAt time.Time
+}
+
+// imageReference is an image split into its registry, repository and tag
+// or digest.
+type imageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseImageReference parses an image such as "alexellis2/inlets:2.4.1",
+// which is on Docker Hub when it has no registry.
+func parseImageReference(image string) (imageReference, error) {
+	ref := imageReference{}
+	name := image
+
+	if index := strings.Index(name, "@"); index > -1 {
+		ref.Digest = name[index+1:]
+		name = name[:index]
+	}
+	if index := strings.LastIndex(name, ":"); index > strings.LastIndex(name, "/") {
+		ref.Tag = name[index+1:]
+		name = name[:index]
+	}
+	if len(ref.Tag) == 0 && len(ref.Digest) == 0 {
+		ref.Tag = "latest"
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		ref.Repository = parts[1]
+	} else {
+		ref.Registry = "registry-1.docker.io"
+		ref.Repository = name
+		if len(parts) == 1 {
+			ref.Repository = "library/" + name
+		}
+	}
+
+	if len(ref.Repository) == 0 {
+		return ref, fmt.Errorf("invalid image: %q", image)
+	}
+	return ref, nil
+}
+
+// parseCosignKey parses the PEM of an ECDSA public key, as written by
+// "cosign generate-key-pair".
+func parseCosignKey(data []byte) (*ecdsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("the public key must be an ECDSA key")
+	}
+	return ecdsaKey, nil
+}
+
+// verifyImage returns an image pinned to the digest which its tag resolves
+// to, once the signature of that digest has been verified with the key of
+// --cosign-key, so that an unsigned or tampered image is never run. The
+// image is returned as it is when --cosign-key is not set.
+func (c *Controller) verifyImage(image string) (string, error) {
+	key := c.infra().CosignKey
+	if key == nil {
+		return image, nil
+	}
+
+	c.verifiedLock.Lock()
+	verified, ok := c.verifiedImages[image]
+	c.verifiedLock.Unlock()
+	if ok && time.Since(verified.VerifiedAt) < verifiedImageTTL {
+		return pinImage(image, verified.Digest), nil
+	}
+
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+
+	registry := &registryClient{
+		ref:    ref,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	digest := ref.Digest
+	if len(digest) == 0 {
+		digest, _, err = registry.getManifest(ref.Tag)
+		if err != nil {
+			return "", fmt.Errorf("error resolving image %s: %s", image, err.Error())
+		}
+	}
+
+	if err := registry.verifySignature(digest, key); err != nil {
+		return "", fmt.Errorf("image %s is not signed with the cosign key: %s", image, err.Error())
+	}
+
+	c.verifiedLock.Lock()
+	if c.verifiedImages == nil {
+		c.verifiedImages = map[string]verifiedImage{}
+	}
+	c.verifiedImages[image] = verifiedImage{Digest: digest, VerifiedAt: time.Now()}
+	c.verifiedLock.Unlock()
+
+	return pinImage(image, digest), nil
+}
+
+// pinImage returns an image with its digest, keeping its tag for reference.
+func pinImage(image, digest string) string {
+	if index := strings.Index(image, "@"); index > -1 {
+		image = image[:index]
+	}
+	return image + "@" + digest
+}
+
+// registryClient reads manifests and blobs of a repository with the
+// Docker Registry HTTP API, since no registry client is vendored.
+type registryClient struct {
+	ref    imageReference
+	client *http.Client
+	token  string
+}
+
+// cosignPayload is the part of the simple signing payload of cosign which
+// is checked.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// verifySignature checks that a layer of the signature manifest of the
+// digest is signed with the key, and is the payload for that digest.
+func (r *registryClient) verifySignature(digest string, key *ecdsa.PublicKey) error {
+	_, body, err := r.getManifest(strings.Replace(digest, ":", "-", 1) + ".sig")
+	if err != nil {
+		return fmt.Errorf("error reading signature: %s", err.Error())
+	}
+
+	manifest := struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}{}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return err
+	}
+
+	for _, layer := range manifest.Layers {
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			continue
+		}
+
+		payload, err := r.getBlob(layer.Digest)
+		if err != nil {
+			return fmt.Errorf("error reading signature payload: %s", err.Error())
+		}
+
+		hash := sha256.Sum256(payload)
+		if "sha256:"+hex.EncodeToString(hash[:]) != layer.Digest || !verifyECDSA(key, hash[:], signature) {
+			continue
+		}
+
+		signed := cosignPayload{}
+		if err := json.Unmarshal(payload, &signed); err != nil {
+			continue
+		}
+		if signed.Critical.Image.DockerManifestDigest == digest {
+			return nil
+		}
+	}
+	return fmt.Errorf("no valid signature for %s", digest)
+}
+
+// verifyECDSA verifies an ASN.1 ECDSA signature of a hash.
+func verifyECDSA(key *ecdsa.PublicKey, hash, signature []byte) bool {
+	values := struct {
+		R, S *big.Int
+	}{}
+	if rest, err := asn1.Unmarshal(signature, &values); err != nil || len(rest) > 0 {
+		return false
+	}
+	return ecdsa.Verify(key, hash, values.R, values.S)
+}
+
+// getManifest returns the digest and body of the manifest of a tag.
+func (r *registryClient) getManifest(tag string) (string, []byte, error) {
+	res, err := r.get("manifests/"+tag, manifestMediaTypes)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if len(digest) == 0 {
+		hash := sha256.Sum256(body)
+		digest = "sha256:" + hex.EncodeToString(hash[:])
+	}
+	return digest, body, nil
+}
+
+func (r *registryClient) getBlob(digest string) ([]byte, error) {
+	res, err := r.get("blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return ioutil.ReadAll(res.Body)
+}
+
+// get requests a path of the repository, getting an anonymous token when
+// the registry asks for one.
+func (r *registryClient) get(path, accept string) (*http.Response, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, "https://"+r.ref.Registry+"/v2/"+r.ref.Repository+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		if len(r.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		}
+
+		res, err := r.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := res.Header.Get("WWW-Authenticate")
+			res.Body.Close()
+			if err := r.authenticate(challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("%s returned %d for %s", r.ref.Registry, res.StatusCode, path)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("%s returned 401 for %s", r.ref.Registry, path)
+}
+
+// authenticate gets an anonymous token to pull from the repository, from
+// the realm of a Bearer challenge.
+func (r *registryClient) authenticate(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("%s needs unsupported authentication: %q", r.ref.Registry, challenge)
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		parts := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(parts) == 2 {
+			params[parts[0]] = strings.Trim(parts[1], `"`)
+		}
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || len(params["realm"]) == 0 {
+		return fmt.Errorf("%s sent an invalid realm: %q", r.ref.Registry, challenge)
+	}
+
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", "repository:"+r.ref.Repository+":pull")
+	realm.RawQuery = query.Encode()
+
+	res, err := r.client.Get(realm.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d for a token", realm.Host, res.StatusCode)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	r.token = token.Token
+	if len(r.token) == 0 {
+		r.token = token.AccessToken
+	}
+	return nil
+}
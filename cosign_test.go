@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image string
+		want  imageReference
+	}{
+		{
+			image: "alexellis2/inlets:2.4.1",
+			want:  imageReference{Registry: "registry-1.docker.io", Repository: "alexellis2/inlets", Tag: "2.4.1"},
+		},
+		{
+			image: "nginx",
+			want:  imageReference{Registry: "registry-1.docker.io", Repository: "library/nginx", Tag: "latest"},
+		},
+		{
+			image: "ghcr.io/inlets/inlets-pro:0.5.1@sha256:abc",
+			want:  imageReference{Registry: "ghcr.io", Repository: "inlets/inlets-pro", Tag: "0.5.1", Digest: "sha256:abc"},
+		},
+		{
+			image: "localhost:5000/inlets@sha256:abc",
+			want:  imageReference{Registry: "localhost:5000", Repository: "inlets", Digest: "sha256:abc"},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := parseImageReference(test.image)
+		if err != nil {
+			t.Errorf("parseImageReference(%q): %s", test.image, err.Error())
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseImageReference(%q): want %+v, got %+v", test.image, test.want, got)
+		}
+	}
+}
+
+// newSignatureRegistry returns a registry which serves a cosign signature
+// of digest, made with key over a payload for signedDigest.
+func newSignatureRegistry(t *testing.T, key *ecdsa.PrivateKey, digest, signedDigest string) *httptest.Server {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"critical": map[string]interface{}{
+			"image": map[string]string{"docker-manifest-digest": signedDigest},
+		},
+	})
+	hash := sha256.Sum256(payload)
+	payloadDigest := "sha256:" + hex.EncodeToString(hash[:])
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("error signing payload: %s", err.Error())
+	}
+	signature, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"layers": []map[string]interface{}{{
+			"digest":      payloadDigest,
+			"annotations": map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature)},
+		}},
+	})
+
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/inlets/manifests/" + strings.Replace(digest, ":", "-", 1) + ".sig":
+			w.Write(manifest)
+		case "/v2/inlets/blobs/" + payloadDigest:
+			w.Write(payload)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestVerifySignature(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		name         string
+		verifyWith   *ecdsa.PublicKey
+		signedDigest string
+		valid        bool
+	}{
+		{name: "signed", verifyWith: &key.PublicKey, signedDigest: digest, valid: true},
+		{name: "another key", verifyWith: &otherKey.PublicKey, signedDigest: digest},
+		{name: "payload of another digest", verifyWith: &key.PublicKey, signedDigest: "sha256:" + strings.Repeat("b", 64)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newSignatureRegistry(t, key, digest, test.signedDigest)
+			defer server.Close()
+
+			registry := &registryClient{
+				ref:    imageReference{Registry: strings.TrimPrefix(server.URL, "https://"), Repository: "inlets"},
+				client: server.Client(),
+			}
+			err := registry.verifySignature(digest, test.verifyWith)
+			if test.valid && err != nil {
+				t.Errorf("want a valid signature, got %s", err.Error())
+			}
+			if !test.valid && err == nil {
+				t.Errorf("want an invalid signature")
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"reflect"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// makeClientDaemonSet returns a DaemonSet which runs the client on every
+// node, using the same Pod template as the client Deployment.
+func makeClientDaemonSet(deployment *appsv1.Deployment) *appsv1.DaemonSet {
+	return &appsv1.DaemonSet{
+		ObjectMeta: deployment.ObjectMeta,
+		Spec: appsv1.DaemonSetSpec{
+			Selector: deployment.Spec.Selector,
+			Template: deployment.Spec.Template,
+		},
+	}
+}
+
+// syncClientDaemonSet creates the client DaemonSet of a tunnel, or updates
+// it when its arguments or Pod spec have changed, then records
+// which client Pod holds the tunnel.
+func (c *Controller) syncClientDaemonSet(tunnel *inletsv1alpha1.Tunnel) error {
+	service, err := c.getTunnelService(tunnel)
+	if err != nil {
+		return err
+	}
+
+	client, err := c.makeClientFor(tunnel, service)
+	if err != nil {
+		return err
+	}
+
+	desired := makeClientDaemonSet(client)
+	daemonSets := c.kubeclientset.AppsV1().DaemonSets(tunnel.Namespace)
+
+	if tunnel.Spec.ClientDeploymentRef == nil {
+		daemonSet, err := daemonSets.Create(desired)
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return err
+		}
+		if err == nil {
+			c.tunnelLog(tunnel).Info("Created client daemonset", "daemonset", daemonSet.Name)
+		}
+
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Spec.ClientDeploymentRef = &metav1.ObjectMeta{
+			Name:      desired.Name,
+			Namespace: desired.Namespace,
+		}
+
+		_, err = c.updateTunnel(tunnelCopy)
+		return err
+	}
+
+	daemonSet, err := daemonSets.Get(tunnel.Spec.ClientDeploymentRef.Name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	wantArgs := desired.Spec.Template.Spec.Containers[0].Args
+	if len(daemonSet.Spec.Template.Spec.Containers) > 0 &&
+		(!reflect.DeepEqual(daemonSet.Spec.Template.Spec.Containers[0].Args, wantArgs) ||
+			clientTokenChanged(daemonSet.Spec.Template, desired.Spec.Template) ||
+			clientPodSpecChanged(daemonSet.Spec.Template.Spec, tunnel) ||
+			clientSecurityContextChanged(daemonSet.Spec.Template, tunnel, c.infra().ClientSecurityContext)) {
+
+		c.tunnelLog(tunnel).Info("Updating client daemonset, upstream or pod spec changed", "daemonset", daemonSet.Name)
+
+		daemonSetCopy := daemonSet.DeepCopy()
+		daemonSetCopy.Spec.Template.Spec.Containers[0].Args = wantArgs
+		applyClientToken(&daemonSetCopy.Spec.Template, desired.Spec.Template)
+		applyClientPodSpec(&daemonSetCopy.Spec.Template.Spec, tunnel)
+		applyClientSecurityContext(&daemonSetCopy.Spec.Template, tunnel, c.infra().ClientSecurityContext)
+
+		if _, err := daemonSets.Update(daemonSetCopy); err != nil {
+			return err
+		}
+	}
+
+	return c.updateActiveClient(tunnel, daemonSet)
+}
+
+// updateActiveClient records the ready client Pod which has been running
+// the longest in the status of the tunnel, since it connected first and
+// holds the tunnel until it goes away.
+func (c *Controller) updateActiveClient(tunnel *inletsv1alpha1.Tunnel, daemonSet *appsv1.DaemonSet) error {
+	selector, err := metav1.LabelSelectorAsSelector(daemonSet.Spec.Selector)
+	if err != nil {
+		return err
+	}
+
+	pods, err := c.kubeclientset.CoreV1().Pods(tunnel.Namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	active := ""
+	var activeSince *metav1.Time
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !isPodReady(pod) || pod.Status.StartTime == nil {
+			continue
+		}
+
+		if activeSince == nil || pod.Status.StartTime.Before(activeSince) {
+			active = pod.Name
+			activeSince = pod.Status.StartTime
+		}
+	}
+
+	if tunnel.Status.ActiveClient == active {
+		return nil
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.ActiveClient = active
+
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err
+}
+
+func isPodReady(pod *corev1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != corev1.PodRunning {
+		return false
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// deleteClient deletes the client Deployment or DaemonSet of a tunnel.
+func (c *Controller) deleteClient(tunnel *inletsv1alpha1.Tunnel) error {
+	if tunnel.Spec.ClientDeploymentRef == nil {
+		return nil
+	}
+
+	var err error
+	if tunnel.Spec.ClientMode == "daemonset" {
+		err = c.kubeclientset.AppsV1().
+			DaemonSets(tunnel.Namespace).
+			Delete(tunnel.Spec.ClientDeploymentRef.Name, &metav1.DeleteOptions{})
+	} else {
+		err = c.kubeclientset.AppsV1().
+			Deployments(tunnel.Namespace).
+			Delete(tunnel.Spec.ClientDeploymentRef.Name, &metav1.DeleteOptions{})
+	}
+
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
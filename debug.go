@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+// diagnostics is a dump of the state of the operator, to debug syncs which
+// are stuck and memory which grows.
+type diagnostics struct {
+	Time       time.Time `json:"time"`
+	Goroutines int       `json:"goroutines"`
+
+	Memory struct {
+		HeapAllocBytes uint64 `json:"heapAllocBytes"`
+		HeapInuseBytes uint64 `json:"heapInuseBytes"`
+		SysBytes       uint64 `json:"sysBytes"`
+		NumGC          uint32 `json:"numGC"`
+	} `json:"memory"`
+
+	// QueueDepth is the number of keys waiting to be synced, and Requeues
+	// the keys which are backing off after failed syncs.
+	QueueDepth int            `json:"queueDepth"`
+	Requeues   map[string]int `json:"requeues,omitempty"`
+
+	// InFlight are the syncs and deletions of Tunnels in progress, with
+	// when they started.
+	InFlight map[string]time.Time `json:"inFlight,omitempty"`
+
+	// Provisioning are the Tunnels whose exit-node is being provisioned,
+	// by the provider.
+	Provisioning map[string][]string `json:"provisioning,omitempty"`
+
+	// Throttled is when each provider last throttled the operator with a
+	// 429, and how many requests it throttled.
+	Throttled map[string]throttleState `json:"throttled,omitempty"`
+
+	// ProviderQueue is how many calls to delete hosts, and namespaces with
+	// hosts to provision, are waiting for --provider-concurrency, by
+	// provider.
+	ProviderQueue map[string]int `json:"providerQueue,omitempty"`
+
+	PendingSpans int `json:"pendingSpans"`
+}
+
+// throttleState is how a provider has throttled the operator.
+type throttleState struct {
+	Requests int       `json:"requests"`
+	Last     time.Time `json:"last"`
+}
+
+// getDiagnostics collects the diagnostics of the operator.
+func (c *Controller) getDiagnostics() (*diagnostics, error) {
+	d := &diagnostics{
+		Time:         time.Now(),
+		Goroutines:   runtime.NumGoroutine(),
+		QueueDepth:   c.workqueue.Len(),
+		Requeues:     map[string]int{},
+		InFlight:     map[string]time.Time{},
+		Provisioning: map[string][]string{},
+	}
+
+	stats := runtime.MemStats{}
+	runtime.ReadMemStats(&stats)
+	d.Memory.HeapAllocBytes = stats.HeapAlloc
+	d.Memory.HeapInuseBytes = stats.HeapInuse
+	d.Memory.SysBytes = stats.Sys
+	d.Memory.NumGC = stats.NumGC
+
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	for _, tunnel := range tunnels {
+		key, err := cache.MetaNamespaceKeyFunc(tunnel)
+		if err != nil {
+			continue
+		}
+		if requeues := c.workqueue.NumRequeues(key); requeues > 0 {
+			d.Requeues[key] = requeues
+		}
+		if tunnel.Status.HostStatus == "provisioning" {
+			provider := c.getTunnelProvider(tunnel)
+			d.Provisioning[provider] = append(d.Provisioning[provider], key)
+		}
+	}
+	for _, keys := range d.Provisioning {
+		sort.Strings(keys)
+	}
+
+	c.inFlightLock.Lock()
+	for key, since := range c.inFlightSince {
+		d.InFlight[key] = since
+	}
+	c.inFlightLock.Unlock()
+
+	d.Throttled = c.metrics.getThrottled()
+
+	d.ProviderQueue = map[string]int{}
+	c.limitersLock.Lock()
+	for provider, limiter := range c.limiters {
+		d.ProviderQueue[provider] = limiter.queued()
+	}
+	c.limitersLock.Unlock()
+
+	if t := c.infra().Tracer; t != nil {
+		t.lock.Lock()
+		d.PendingSpans = len(t.pending)
+		t.lock.Unlock()
+	}
+	return d, nil
+}
+
+func (c *Controller) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	d, err := c.getDiagnostics()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(d)
+}
+
+// serveDebug serves pprof on /debug/pprof/ and the diagnostics of the
+// operator on /debug/diagnostics, on localhost only since profiles and the
+// names of Tunnels are sensitive, until the server fails. Reach it with
+// kubectl port-forward.
+func (c *Controller) serveDebug(port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/diagnostics", c.handleDiagnostics)
+
+	address := net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", port))
+	logWith("address", address).Info("Serving debug endpoints")
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHandleDiagnostics(t *testing.T) {
+	f := newFixture(t)
+
+	for _, name := range []string{"web", "api"} {
+		tunnel := newTunnel(name)
+		tunnel.Status.HostStatus = "provisioning"
+		f.create(tunnel)
+	}
+	active := newTunnel("db")
+	active.Status.HostStatus = "active"
+	f.create(active)
+
+	since := time.Now().Add(-time.Minute).UTC()
+	f.controller.inFlightLock.Lock()
+	f.controller.inFlightSince["default/web"] = since
+	f.controller.inFlightLock.Unlock()
+
+	w := httptest.NewRecorder()
+	f.controller.handleDiagnostics(w, httptest.NewRequest(http.MethodGet, "/debug/diagnostics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	d := diagnostics{}
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatalf("want JSON diagnostics, got %s", w.Body.String())
+	}
+
+	want := map[string][]string{"fake": {"default/api", "default/web"}}
+	if !reflect.DeepEqual(d.Provisioning, want) {
+		t.Errorf("want the provisioning tunnels sorted by provider %v, got %v", want, d.Provisioning)
+	}
+	if got := d.InFlight["default/web"]; !got.Equal(since) {
+		t.Errorf("want the sync in flight since %s, got %s", since, got)
+	}
+	if d.Goroutines == 0 || d.Memory.SysBytes == 0 {
+		t.Errorf("want the goroutines and memory of the operator, got %d and %d", d.Goroutines, d.Memory.SysBytes)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseDeniedNamespaces parses the comma-separated value of
+// --denied-namespaces.
+func parseDeniedNamespaces(value string) map[string]bool {
+	namespaces := map[string]bool{}
+	for _, namespace := range strings.Split(value, ",") {
+		namespace = strings.TrimSpace(namespace)
+		if len(namespace) > 0 {
+			namespaces[namespace] = true
+		}
+	}
+	return namespaces
+}
+
+// validateNamespace returns an error when tunnels may not be provisioned in
+// a namespace, so that Services of the control-plane are never exposed by
+// accident.
+func (c *Controller) validateNamespace(namespace string) error {
+	if c.infra().DeniedNamespaces[namespace] {
+		return fmt.Errorf("tunnels can't be created in namespace %s, which is in --denied-namespaces", namespace)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// deprovisionExitNode takes the IP of the exit-node of a tunnel out of its
+// Service, then deletes the exit-node and that of its replacement, if any.
+// The status of the tunnel is left to the caller, which resets it with
+// clearExitNode once this returns without an error.
+func (c *Controller) deprovisionExitNode(tunnel *inletsv1alpha1.Tunnel, trigger string) error {
+	if err := c.unpublishService(tunnel); err != nil {
+		return err
+	}
+
+	if err := c.deleteReplacement(tunnel); err != nil {
+		return err
+	}
+
+	return c.deleteHost(tunnel, trigger)
+}
+
+// clearExitNode resets the exit-node recorded in the status of a tunnel
+// once it was deprovisioned, so that a new exit-node is provisioned.
+func clearExitNode(status *inletsv1alpha1.TunnelStatus) {
+	status.HostStatus = ""
+	status.HostID = ""
+	status.HostIP = ""
+	status.Address = ""
+	status.ControlPlaneURL = ""
+	status.ControlPlanePort = 0
+	status.Provider = ""
+	status.Region = ""
+	status.EstimatedHourlyCost = ""
+	status.ProvisionedAt = nil
+	status.ActiveClient = ""
+	status.Replacement = nil
+	status.Conditions = removeCondition(status.Conditions, inletsv1alpha1.TunnelPublished)
+	status.Conditions = removeCondition(status.Conditions, inletsv1alpha1.TunnelClientConnected)
+}
+
+// unpublishService removes the IP of the exit-node of a tunnel from the
+// external IPs, the ingress and the external-dns target of its Service,
+// so that nothing points at the IP once the exit-node is deleted and the
+// IP is given to someone else. The IPs of the exit-nodes of other regions
+// are kept.
+func (c *Controller) unpublishService(tunnel *inletsv1alpha1.Tunnel) error {
+	ip := tunnel.Status.HostIP
+	if len(tunnel.Spec.ServiceName) == 0 || len(ip) == 0 {
+		return nil
+	}
+
+	services := c.kubeclientset.CoreV1().Services(tunnel.Namespace)
+	service, err := services.Get(tunnel.Spec.ServiceName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ips := []string{}
+	for _, externalIP := range service.Spec.ExternalIPs {
+		if externalIP != ip {
+			ips = append(ips, externalIP)
+		}
+	}
+
+	serviceCopy := service.DeepCopy()
+	serviceCopy.Spec.ExternalIPs = ips
+
+	hostname := c.getServiceHostname(tunnel, service)
+	if len(hostname) > 0 && serviceCopy.Annotations[externalDNSHostnameAnnotation] == hostname {
+		if len(ips) == 0 {
+			delete(serviceCopy.Annotations, externalDNSHostnameAnnotation)
+			delete(serviceCopy.Annotations, externalDNSTargetAnnotation)
+		} else {
+			serviceCopy.Annotations[externalDNSTargetAnnotation] = strings.Join(ips, ",")
+		}
+	}
+
+	updated, err := services.Update(serviceCopy)
+	if err != nil {
+		return err
+	}
+
+	if updated.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return nil
+	}
+
+	statusCopy := updated.DeepCopy()
+	statusCopy.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{}
+	for _, ingress := range updated.Status.LoadBalancer.Ingress {
+		if ingress.IP != ip {
+			statusCopy.Status.LoadBalancer.Ingress = append(statusCopy.Status.LoadBalancer.Ingress, ingress)
+		}
+	}
+
+	_, err = services.UpdateStatus(statusCopy)
+	return err
+}
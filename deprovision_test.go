@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newPublishedService returns the Service "app" as it is once the IPs of
+// the exit-nodes of two regions were published for app.example.com.
+func newPublishedService() *corev1.Service {
+	service := newPortsService(corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP})
+	service.Annotations = map[string]string{
+		externalDNSHostnameAnnotation: "app.example.com",
+		externalDNSTargetAnnotation:   "203.0.113.1,203.0.113.2",
+	}
+	service.Spec.ExternalIPs = []string{"203.0.113.1", "203.0.113.2"}
+	service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
+		{IP: "203.0.113.1", Hostname: "app.example.com"},
+		{IP: "203.0.113.2", Hostname: "app.example.com"},
+	}
+	return service
+}
+
+func TestUnpublishService(t *testing.T) {
+	f := newFixture(t)
+	services := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault)
+	if _, err := services.Create(newPublishedService()); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Status.HostIP = "203.0.113.1"
+
+	if err := f.controller.unpublishService(tunnel); err != nil {
+		t.Fatalf("error unpublishing service: %s", err.Error())
+	}
+
+	got, _ := services.Get("app", metav1.GetOptions{})
+	if !reflect.DeepEqual(got.Spec.ExternalIPs, []string{"203.0.113.2"}) {
+		t.Errorf("want the IP of the other region to be kept, got %v", got.Spec.ExternalIPs)
+	}
+	if got.Annotations[externalDNSTargetAnnotation] != "203.0.113.2" {
+		t.Errorf("want the target to be the other region, got %q", got.Annotations[externalDNSTargetAnnotation])
+	}
+	if ingress := got.Status.LoadBalancer.Ingress; len(ingress) != 1 || ingress[0].IP != "203.0.113.2" {
+		t.Errorf("want the ingress of the other region to be kept, got %v", ingress)
+	}
+
+	tunnel.Status.HostIP = "203.0.113.2"
+	if err := f.controller.unpublishService(tunnel); err != nil {
+		t.Fatalf("error unpublishing service: %s", err.Error())
+	}
+
+	got, _ = services.Get("app", metav1.GetOptions{})
+	if len(got.Spec.ExternalIPs) > 0 || len(got.Status.LoadBalancer.Ingress) > 0 {
+		t.Errorf("want no IPs to be published, got %v %v", got.Spec.ExternalIPs, got.Status.LoadBalancer.Ingress)
+	}
+	if _, ok := got.Annotations[externalDNSHostnameAnnotation]; ok {
+		t.Errorf("want the external-dns annotations to be removed, got %v", got.Annotations)
+	}
+}
+
+func TestUnpublishServiceKeepsHostnameOfUser(t *testing.T) {
+	f := newFixture(t)
+	services := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault)
+	service := newPublishedService()
+	service.Annotations[externalDNSHostnameAnnotation] = "www.example.com"
+	if _, err := services.Create(service); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Status.HostIP = "203.0.113.1"
+
+	if err := f.controller.unpublishService(tunnel); err != nil {
+		t.Fatalf("error unpublishing service: %s", err.Error())
+	}
+
+	got, _ := services.Get("app", metav1.GetOptions{})
+	if got.Annotations[externalDNSTargetAnnotation] != "203.0.113.1,203.0.113.2" {
+		t.Errorf("want the annotations of the user to be left alone, got %v", got.Annotations)
+	}
+}
+
+func TestUnpublishServiceWithoutService(t *testing.T) {
+	f := newFixture(t)
+
+	if err := f.controller.unpublishService(newActiveTunnel("app")); err != nil {
+		t.Errorf("want no error for a Service which was deleted, got %s", err.Error())
+	}
+}
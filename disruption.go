@@ -0,0 +1,63 @@
+package main
+
+import (
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// makeClientDisruptionBudget returns a PodDisruptionBudget which keeps the
+// client of a tunnel from being evicted.
+func makeClientDisruptionBudget(tunnel *inletsv1alpha1.Tunnel) *policyv1beta1.PodDisruptionBudget {
+	name := tunnel.Name + "-client"
+	minAvailable := intstr.FromInt(1)
+
+	return &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: tunnel.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(tunnel, schema.GroupVersionKind{
+					Group:   inletsv1alpha1.SchemeGroupVersion.Group,
+					Version: inletsv1alpha1.SchemeGroupVersion.Version,
+					Kind:    "Tunnel",
+				}),
+			},
+		},
+		Spec: policyv1beta1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app.kubernetes.io/name": name,
+				},
+			},
+		},
+	}
+}
+
+// syncClientDisruptionBudget creates the PodDisruptionBudget of the client
+// when the tunnel asks for one. It is removed along with the tunnel.
+func (c *Controller) syncClientDisruptionBudget(tunnel *inletsv1alpha1.Tunnel) error {
+	if tunnel.Spec.Client == nil || !tunnel.Spec.Client.DisruptionBudget {
+		return nil
+	}
+
+	budgets := c.kubeclientset.PolicyV1beta1().PodDisruptionBudgets(tunnel.Namespace)
+	budget := makeClientDisruptionBudget(tunnel)
+
+	_, err := budgets.Get(budget.Name, metav1.GetOptions{})
+	if err == nil || !errors.IsNotFound(err) {
+		return err
+	}
+
+	c.tunnelLog(tunnel).Info("Creating disruption budget", "budget", budget.Name)
+	_, err = budgets.Create(budget)
+	if errors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
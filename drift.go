@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// checkDrift compares the exit-node of each active tunnel with the host
+// which was provisioned, and reports or repairs any changes.
+func (c *Controller) checkDrift() {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		if tunnel.Status.HostStatus != "active" || len(tunnel.Status.HostID) == 0 {
+			continue
+		}
+
+		if paused, _ := isPaused(tunnel); paused || !c.ownsObject(tunnel) {
+			continue
+		}
+
+		// The new exit-node is checked once it has replaced the old one
+		if tunnel.Status.Replacement != nil {
+			continue
+		}
+
+		// The exit-node is checked with the token of a tunnel with
+		// authTokenFrom once it was read in a sync
+		tunnel, ok := c.withCachedToken(tunnel)
+		if !ok {
+			continue
+		}
+
+		if err := c.syncDrift(tunnel); err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+}
+
+func (c *Controller) syncDrift(tunnel *inletsv1alpha1.Tunnel) error {
+	provisioner, err := c.getTunnelProvisioner(tunnel)
+	if err != nil {
+		return err
+	}
+
+	inspector, ok := provisioner.(provision.Inspector)
+	if !ok {
+		return nil
+	}
+
+	actual, err := inspector.Inspect(tunnel.Status.HostID)
+	if err != nil {
+		return err
+	}
+
+	target := ProvisionTarget{
+		Provider: tunnel.Status.Provider,
+		Region:   tunnel.Status.Region,
+	}
+	if len(target.Provider) == 0 {
+		target.Provider = c.infra().Provider
+	}
+
+	differences := diffExitHost(c.makeExitHost(tunnel, target), *actual)
+
+	if len(differences) == 0 {
+		if !hasConditionType(tunnel.Status.Conditions, inletsv1alpha1.TunnelDrifted) {
+			return nil
+		}
+
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelDrifted)
+		_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+		return err
+	}
+
+	message := fmt.Sprintf("Exit-node %s changed outside of the operator: %s",
+		tunnel.Status.HostID, strings.Join(differences, ", "))
+
+	if c.infra().RepairDrift {
+		c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrExitNodeDrifted, message+", replacing it")
+
+		if c.usesBlueGreen(tunnel) {
+			return c.startReplacement(tunnel, tunnel.Spec.AuthToken, "Drift")
+		}
+
+		c.tunnelLog(tunnel).Info("Deleting drifted exit-node", "ip", tunnel.Status.HostIP)
+		if err := c.deleteHost(tunnel, "drift"); err != nil {
+			return err
+		}
+		return c.updateTunnelProvisioningStatus(tunnel, "", "", "")
+	}
+
+	condition := inletsv1alpha1.TunnelCondition{
+		Type:    inletsv1alpha1.TunnelDrifted,
+		Status:  corev1.ConditionTrue,
+		Reason:  "CloudResourceChanged",
+		Message: message,
+	}
+
+	if hasCondition(tunnel.Status.Conditions, condition) {
+		return nil
+	}
+
+	c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrExitNodeDrifted, message)
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, condition)
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err
+}
+
+// diffExitHost returns a description of each field of the actual host which
+// does not match the host that was provisioned. The region is only compared
+// when one was requested, since providers pick their own default.
+func diffExitHost(want, actual provision.BasicHost) []string {
+	differences := []string{}
+
+	if len(want.Region) > 0 && want.Region != actual.Region {
+		differences = append(differences, fmt.Sprintf("region is %q, want %q", actual.Region, want.Region))
+	}
+	if want.Plan != actual.Plan {
+		differences = append(differences, fmt.Sprintf("plan is %q, want %q", actual.Plan, want.Plan))
+	}
+	if want.OS != actual.OS {
+		differences = append(differences, fmt.Sprintf("OS is %q, want %q", actual.OS, want.OS))
+	}
+
+	return differences
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// createDriftedTunnel creates an active tunnel whose exit-node has a plan
+// other than the one it was provisioned with.
+func (f *fixture) createDriftedTunnel(name, plan string) *inletsv1alpha1.Tunnel {
+	tunnel := newActiveTunnel(name)
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+
+	host := f.controller.makeExitHost(tunnel, ProvisionTarget{Provider: "fake"})
+	host.Plan = plan
+	res, err := f.provisioner.Provision(host)
+	if err != nil {
+		f.t.Fatalf("error provisioning: %s", err.Error())
+	}
+
+	tunnel.Status.HostID = res.ID
+	tunnel.Status.Provider = "fake"
+	f.create(tunnel)
+	return f.get(name)
+}
+
+func TestDiffExitHost(t *testing.T) {
+	want := provision.BasicHost{Region: "lon1", Plan: "s-1vcpu-1gb", OS: "ubuntu-16-04-x64"}
+
+	cases := []struct {
+		name   string
+		actual provision.BasicHost
+		want   []string
+	}{
+		{"unchanged", want, nil},
+		{"plan", provision.BasicHost{Region: "lon1", Plan: "s-4vcpu-8gb", OS: "ubuntu-16-04-x64"}, []string{`plan is "s-4vcpu-8gb"`}},
+		{"os", provision.BasicHost{Region: "lon1", Plan: "s-1vcpu-1gb", OS: "debian-10-x64"}, []string{`OS is "debian-10-x64"`}},
+		{"region", provision.BasicHost{Region: "ams3", Plan: "s-1vcpu-1gb", OS: "ubuntu-16-04-x64"}, []string{`region is "ams3"`}},
+	}
+
+	for _, c := range cases {
+		got := diffExitHost(want, c.actual)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: want %d differences, got %v", c.name, len(c.want), got)
+			continue
+		}
+		for i := range got {
+			if !strings.HasPrefix(got[i], c.want[i]) {
+				t.Errorf("%s: want %q, got %q", c.name, c.want[i], got[i])
+			}
+		}
+	}
+
+	// The region is only compared when one was requested
+	if got := diffExitHost(provision.BasicHost{Plan: "s-1vcpu-1gb", OS: "ubuntu-16-04-x64"}, want); len(got) > 0 {
+		t.Errorf("want no differences for the default region, got %v", got)
+	}
+}
+
+func TestSyncDriftRecordsCondition(t *testing.T) {
+	f := newFixture(t)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	tunnel := f.createDriftedTunnel("app", "s-8vcpu-16gb")
+
+	if err := f.controller.syncDrift(tunnel); err != nil {
+		t.Fatalf("error checking drift: %s", err.Error())
+	}
+
+	got := f.get("app")
+	condition := getCondition(got.Status.Conditions, inletsv1alpha1.TunnelDrifted)
+	if condition == nil || condition.Status != corev1.ConditionTrue || !strings.Contains(condition.Message, "s-8vcpu-16gb") {
+		t.Fatalf("want a Drifted condition with the change, got %+v", condition)
+	}
+	if _, ok := f.provisioner.Host(got.Status.HostID); !ok {
+		t.Errorf("want the exit-node to be kept without --repair-drift")
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, ErrExitNodeDrifted) {
+			t.Errorf("want a %s event, got %q", ErrExitNodeDrifted, event)
+		}
+	default:
+		t.Errorf("want a %s event", ErrExitNodeDrifted)
+	}
+
+	// The same drift is only reported once
+	if err := f.controller.syncDrift(got); err != nil {
+		t.Fatalf("error checking drift: %s", err.Error())
+	}
+	if len(recorder.Events) > 0 {
+		t.Errorf("want no second event, got %q", <-recorder.Events)
+	}
+}
+
+func TestSyncDriftClearsCondition(t *testing.T) {
+	f := newFixture(t)
+
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	res, err := f.provisioner.Provision(f.controller.makeExitHost(tunnel, ProvisionTarget{Provider: "fake"}))
+	if err != nil {
+		t.Fatalf("error provisioning: %s", err.Error())
+	}
+	tunnel.Status.HostID = res.ID
+	tunnel.Status.Provider = "fake"
+	tunnel.Status.Conditions = []inletsv1alpha1.TunnelCondition{
+		{Type: inletsv1alpha1.TunnelDrifted, Status: corev1.ConditionTrue, Reason: "CloudResourceChanged"},
+	}
+	f.create(tunnel)
+
+	if err := f.controller.syncDrift(f.get("app")); err != nil {
+		t.Fatalf("error checking drift: %s", err.Error())
+	}
+	if got := f.get("app"); hasConditionType(got.Status.Conditions, inletsv1alpha1.TunnelDrifted) {
+		t.Errorf("want the Drifted condition to be removed once the exit-node matches, got %v", got.Status.Conditions)
+	}
+}
+
+func TestSyncDriftRepairsExitNode(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) {
+		infra.RepairDrift = true
+	})
+
+	tunnel := f.createDriftedTunnel("app", "s-8vcpu-16gb")
+
+	if err := f.controller.syncDrift(tunnel); err != nil {
+		t.Fatalf("error checking drift: %s", err.Error())
+	}
+
+	if _, ok := f.provisioner.Host(tunnel.Status.HostID); ok {
+		t.Errorf("want the drifted exit-node to be deleted with --repair-drift")
+	}
+	if got := f.get("app"); len(got.Status.HostStatus) > 0 || len(got.Status.HostID) > 0 {
+		t.Errorf("want the status to be reset so that a new exit-node is provisioned, got %q %q",
+			got.Status.HostStatus, got.Status.HostID)
+	}
+}
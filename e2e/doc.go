@@ -0,0 +1,10 @@
+// Package e2e tests the operator end-to-end in a cluster, which is created
+// with kind by hack/e2e.sh. The tests deploy the operator, then check that
+// the IP of an exit-node is written into the status of a LoadBalancer
+// Service and that traffic flows through the tunnel to the Service.
+//
+// With the fake provider, the default, an inlets server in the cluster
+// stands in for the exit-node, so no account with a provider is needed.
+// Set INLETS_E2E_PROVIDER and INLETS_E2E_ACCESS_KEY_FILE to provision a
+// real exit-node instead, which is billed by the provider.
+package e2e
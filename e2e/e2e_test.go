@@ -0,0 +1,393 @@
+package e2e
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/alexellis/inlets-operator/pkg/generated/clientset/versioned"
+)
+
+const (
+	// namespace has the Service under test and the stand-in exit-node,
+	// and is deleted after the test
+	namespace = "inlets-e2e"
+
+	// operatorNamespace has the ServiceAccount of artifacts/operator-rbac.yaml
+	operatorNamespace = "default"
+
+	operatorName = "inlets-operator"
+	appName      = "e2e-app"
+	exitNodeName = "inlets-exit-node"
+
+	inletsImage = "alexellis2/inlets:2.4.1"
+	appImage    = "nginx:1.17-alpine"
+)
+
+// config is a run of the suite, from the environment
+type config struct {
+	kubeconfig    string
+	image         string
+	provider      string
+	accessKeyFile string
+	region        string
+	timeout       time.Duration
+}
+
+func loadConfig(t *testing.T) config {
+	c := config{
+		kubeconfig:    os.Getenv("INLETS_E2E_KUBECONFIG"),
+		image:         os.Getenv("INLETS_E2E_IMAGE"),
+		provider:      os.Getenv("INLETS_E2E_PROVIDER"),
+		accessKeyFile: os.Getenv("INLETS_E2E_ACCESS_KEY_FILE"),
+		region:        os.Getenv("INLETS_E2E_REGION"),
+		timeout:       5 * time.Minute,
+	}
+
+	// The suite changes the cluster, so it only runs against the cluster
+	// which is given to it
+	if len(c.kubeconfig) == 0 {
+		t.Skip("INLETS_E2E_KUBECONFIG is not set, run hack/e2e.sh")
+	}
+	if len(c.image) == 0 {
+		c.image = "alexellis/inlets-operator:e2e"
+	}
+	if len(c.provider) == 0 {
+		c.provider = "fake"
+	}
+	if c.provider != "fake" {
+		if len(c.accessKeyFile) == 0 {
+			t.Fatalf("INLETS_E2E_ACCESS_KEY_FILE is needed for provider %s", c.provider)
+		}
+		c.timeout = 10 * time.Minute
+	}
+	if value := os.Getenv("INLETS_E2E_TIMEOUT"); len(value) > 0 {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			t.Fatalf("invalid INLETS_E2E_TIMEOUT: %s", err.Error())
+		}
+		c.timeout = timeout
+	}
+	return c
+}
+
+func TestLoadBalancerService(t *testing.T) {
+	c := loadConfig(t)
+
+	cfg, err := clientcmd.BuildConfigFromFlags("", c.kubeconfig)
+	if err != nil {
+		t.Fatalf("error building kubeconfig: %s", err.Error())
+	}
+	kube, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		t.Fatalf("error building kubernetes clientset: %s", err.Error())
+	}
+	operator, err := versioned.NewForConfig(cfg)
+	if err != nil {
+		t.Fatalf("error building operator clientset: %s", err.Error())
+	}
+
+	create(t, func() error {
+		_, err := kube.CoreV1().Namespaces().Create(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}})
+		return err
+	})
+
+	exitNodeIP := ""
+	if c.provider == "fake" {
+		exitNodeIP = createStandInExitNode(t, kube)
+	}
+
+	deployOperator(t, kube, c, exitNodeIP)
+	// The operator is deleted last, since it deletes the exit-nodes of the
+	// Tunnels in the namespace
+	defer deleteOperator(t, kube)
+	defer deleteNamespace(t, kube, c.timeout)
+
+	createApp(t, kube)
+
+	t.Logf("Waiting for the IP of the exit-node in the status of Service %s", appName)
+	ip := ""
+	poll(t, c.timeout, "the IP in the status of the Service", func() (bool, error) {
+		service, err := kube.CoreV1().Services(namespace).Get(appName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if len(service.Status.LoadBalancer.Ingress) == 0 {
+			return false, nil
+		}
+		ip = service.Status.LoadBalancer.Ingress[0].IP
+		return len(ip) > 0, nil
+	})
+	t.Logf("Service %s has the IP %s", appName, ip)
+
+	if len(exitNodeIP) > 0 && ip != exitNodeIP {
+		t.Errorf("want the IP of the stand-in exit-node %s, got %s", exitNodeIP, ip)
+	}
+
+	tunnel, err := operator.InletsoperatorV1alpha1().Tunnels(namespace).Get(appName+"-tunnel", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting tunnel: %s", err.Error())
+	}
+	if tunnel.Status.HostStatus != "active" || tunnel.Status.HostIP != ip {
+		t.Errorf("want the tunnel to be active with IP %s, got %s with IP %s", ip, tunnel.Status.HostStatus, tunnel.Status.HostIP)
+	}
+
+	poll(t, c.timeout, "traffic through the tunnel", func() (bool, error) {
+		body, err := getThroughTunnel(kube, ip, exitNodeIP)
+		if err != nil {
+			t.Logf("Waiting for traffic through the tunnel: %s", err.Error())
+			return false, nil
+		}
+		return strings.Contains(body, "Welcome to nginx"), nil
+	})
+
+	if err := kube.CoreV1().Services(namespace).Delete(appName, &metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("error deleting service: %s", err.Error())
+	}
+	poll(t, c.timeout, "the tunnel to be deleted with the Service", func() (bool, error) {
+		_, err := operator.InletsoperatorV1alpha1().Tunnels(namespace).Get(tunnel.Name, metav1.GetOptions{})
+		return errors.IsNotFound(err), nil
+	})
+}
+
+// createStandInExitNode runs an inlets server in the cluster in place of
+// an exit-node, and returns its IP, which the fake provider gives to every
+// exit-node. The server starts once the operator wrote the token of the
+// Tunnel into its Secret.
+func createStandInExitNode(t *testing.T, kube kubernetes.Interface) string {
+	labels := map[string]string{"app": exitNodeName}
+
+	var service *corev1.Service
+	create(t, func() error {
+		var err error
+		service, err = kube.CoreV1().Services(namespace).Create(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: exitNodeName},
+			Spec: corev1.ServiceSpec{
+				Selector: labels,
+				Ports: []corev1.ServicePort{
+					{Name: "http", Port: 80, TargetPort: intstr.FromInt(80)},
+					{Name: "control", Port: 8080, TargetPort: intstr.FromInt(8080)},
+				},
+			},
+		})
+		return err
+	})
+
+	create(t, func() error {
+		_, err := kube.AppsV1().Deployments(namespace).Create(&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: exitNodeName},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{
+							Name:    "inlets",
+							Image:   inletsImage,
+							Command: []string{"inlets"},
+							Args:    []string{"server", "--port=80", "--control-port=8080", "--token=$(INLETS_TOKEN)"},
+							Env: []corev1.EnvVar{{
+								Name: "INLETS_TOKEN",
+								ValueFrom: &corev1.EnvVarSource{
+									SecretKeyRef: &corev1.SecretKeySelector{
+										LocalObjectReference: corev1.LocalObjectReference{Name: appName + "-tunnel-token"},
+										Key:                  "token",
+									},
+								},
+							}},
+						}},
+					},
+				},
+			},
+		})
+		return err
+	})
+
+	return service.Spec.ClusterIP
+}
+
+// deployOperator runs the image of the operator under test with the
+// provider of the run
+func deployOperator(t *testing.T, kube kubernetes.Interface, c config, exitNodeIP string) {
+	args := []string{
+		"-provider=" + c.provider,
+		"-health-port=8081",
+	}
+	env := []corev1.EnvVar{{Name: "client_image", Value: inletsImage}}
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+
+	if c.provider == "fake" {
+		args = append(args, "-access-key=e2e")
+		env = append(env, corev1.EnvVar{Name: "INLETS_FAKE_EXIT_NODE_IP", Value: exitNodeIP})
+	} else {
+		accessKey, err := ioutil.ReadFile(c.accessKeyFile)
+		if err != nil {
+			t.Fatalf("error reading INLETS_E2E_ACCESS_KEY_FILE: %s", err.Error())
+		}
+		create(t, func() error {
+			_, err := kube.CoreV1().Secrets(operatorNamespace).Create(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: operatorName + "-e2e-access-key"},
+				Data:       map[string][]byte{"inlets-access-key": []byte(strings.TrimSpace(string(accessKey)))},
+			})
+			return err
+		})
+
+		args = append(args, "-access-key-file=/var/secrets/inlets/inlets-access-key")
+		if len(c.region) > 0 {
+			args = append(args, "-region="+c.region)
+		}
+		volumes = []corev1.Volume{{
+			Name:         "inlets-access-key",
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: operatorName + "-e2e-access-key"}},
+		}}
+		mounts = []corev1.VolumeMount{{Name: "inlets-access-key", MountPath: "/var/secrets/inlets/", ReadOnly: true}}
+	}
+
+	labels := map[string]string{"app": operatorName}
+	create(t, func() error {
+		_, err := kube.AppsV1().Deployments(operatorNamespace).Create(&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: operatorName},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: corev1.PodSpec{
+						ServiceAccountName: operatorName,
+						Containers: []corev1.Container{{
+							Name:            "operator",
+							Image:           c.image,
+							ImagePullPolicy: corev1.PullNever,
+							Command:         append([]string{"./inlets-operator"}, args...),
+							Env:             env,
+							VolumeMounts:    mounts,
+						}},
+						Volumes: volumes,
+					},
+				},
+			},
+		})
+		return err
+	})
+
+	poll(t, c.timeout, "the operator to be available", func() (bool, error) {
+		deployment, err := kube.AppsV1().Deployments(operatorNamespace).Get(operatorName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return deployment.Status.AvailableReplicas > 0, nil
+	})
+}
+
+// createApp creates a web server with a LoadBalancer Service
+func createApp(t *testing.T, kube kubernetes.Interface) {
+	labels := map[string]string{"app": appName}
+
+	create(t, func() error {
+		_, err := kube.AppsV1().Deployments(namespace).Create(&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: appName},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: labels},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{
+							Name:  "web",
+							Image: appImage,
+							Ports: []corev1.ContainerPort{{ContainerPort: 80}},
+						}},
+					},
+				},
+			},
+		})
+		return err
+	})
+
+	create(t, func() error {
+		_, err := kube.CoreV1().Services(namespace).Create(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: appName},
+			Spec: corev1.ServiceSpec{
+				Type:     corev1.ServiceTypeLoadBalancer,
+				Selector: labels,
+				Ports:    []corev1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(80)}},
+			},
+		})
+		return err
+	})
+}
+
+// getThroughTunnel gets / through the exit-node. The stand-in exit-node is
+// only reachable in the cluster, so it is reached through the proxy of the
+// API server.
+func getThroughTunnel(kube kubernetes.Interface, ip, exitNodeIP string) (string, error) {
+	if len(exitNodeIP) > 0 {
+		body, err := kube.CoreV1().Services(namespace).ProxyGet("http", exitNodeName, "80", "/", nil).DoRaw()
+		return string(body), err
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(fmt.Sprintf("http://%s/", ip))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("exit-node returned %d", res.StatusCode)
+	}
+	return string(body), nil
+}
+
+func deleteNamespace(t *testing.T, kube kubernetes.Interface, timeout time.Duration) {
+	err := kube.CoreV1().Namespaces().Delete(namespace, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		t.Errorf("error deleting namespace: %s", err.Error())
+		return
+	}
+	poll(t, timeout, "the namespace to be deleted", func() (bool, error) {
+		_, err := kube.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+		return errors.IsNotFound(err), nil
+	})
+}
+
+func deleteOperator(t *testing.T, kube kubernetes.Interface) {
+	err := kube.AppsV1().Deployments(operatorNamespace).Delete(operatorName, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		t.Errorf("error deleting operator: %s", err.Error())
+	}
+	err = kube.CoreV1().Secrets(operatorNamespace).Delete(operatorName+"-e2e-access-key", &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		t.Errorf("error deleting access key: %s", err.Error())
+	}
+}
+
+// create fails the test when an object cannot be created
+func create(t *testing.T, f func() error) {
+	if err := f(); err != nil {
+		t.Fatalf("error creating object: %s", err.Error())
+	}
+}
+
+// poll fails the test when a condition isn't met within the timeout
+func poll(t *testing.T, timeout time.Duration, what string, condition wait.ConditionFunc) {
+	if err := wait.PollImmediate(2*time.Second, timeout, condition); err != nil {
+		t.Fatalf("timed out waiting for %s: %s", what, err.Error())
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// egressIPURL returns the public IP which a request came from.
+	egressIPURL = "https://checkip.amazonaws.com"
+
+	// egressIPTTL is how long the detected egress IP is used for before it
+	// is checked again.
+	egressIPTTL = 10 * time.Minute
+)
+
+// parseControlPlaneSources parses the value of --control-plane-sources,
+// which is "auto" or a comma-separated list of IPs and CIDRs. IPs are
+// returned as CIDRs of a single address.
+func parseControlPlaneSources(value string) ([]string, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	if value == "auto" {
+		return []string{"auto"}, nil
+	}
+
+	sources := []string{}
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		if ip := net.ParseIP(source); ip != nil {
+			source = singleAddressCIDR(ip)
+		}
+		if _, _, err := net.ParseCIDR(source); err != nil {
+			return nil, fmt.Errorf("control-plane-sources must be auto, or IPs and CIDRs such as 203.0.113.0/24, not %q", source)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func singleAddressCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+// getControlPlaneSources returns the sources which may connect to the
+// control-port of exit-nodes, or none when every source may. With "auto",
+// the public IP which the cluster connects from is detected and checked
+// again every 10 minutes. The last IP which was detected is used when it
+// can't be checked.
+func (c *Controller) getControlPlaneSources() ([]string, error) {
+	sources := c.infra().ControlPlaneSources
+	if len(sources) != 1 || sources[0] != "auto" {
+		return sources, nil
+	}
+
+	c.egressLock.Lock()
+	defer c.egressLock.Unlock()
+
+	if len(c.egressIP) > 0 && time.Since(c.egressCheckedAt) < egressIPTTL {
+		return []string{c.egressIP}, nil
+	}
+
+	ip, err := detectEgressIP()
+	if err != nil {
+		if len(c.egressIP) > 0 {
+			logWith("ip", c.egressIP).Error(err, "Error detecting egress ip, using the last one")
+			return []string{c.egressIP}, nil
+		}
+		return nil, fmt.Errorf("error detecting egress ip: %s", err.Error())
+	}
+
+	if ip != c.egressIP {
+		logWith("ip", ip).Info("Detected egress ip")
+	}
+	c.egressIP = ip
+	c.egressCheckedAt = time.Now()
+	return []string{ip}, nil
+}
+
+// detectEgressIP returns the public IP which the operator connects from as
+// a CIDR of a single address.
+func detectEgressIP() (string, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(egressIPURL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %d", egressIPURL, res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("%s returned an invalid ip", egressIPURL)
+	}
+	return singleAddressCIDR(ip), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// countReadyEndpoints returns the number of ready endpoints of the Service
+// of a tunnel, or -1 when the tunnel has an upstream instead of a Service.
+func (c *Controller) countReadyEndpoints(tunnel *inletsv1alpha1.Tunnel) (int, error) {
+	if len(tunnel.Spec.ServiceName) == 0 {
+		return -1, nil
+	}
+
+	endpoints, err := c.endpointsLister.Endpoints(tunnel.Namespace).Get(tunnel.Spec.ServiceName)
+	if errors.IsNotFound(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	ready := 0
+	for _, subset := range endpoints.Subsets {
+		ready += len(subset.Addresses)
+	}
+	return ready, nil
+}
+
+// waitForEndpoints holds a tunnel as pending whilst its Service has no
+// ready endpoints, when --wait-for-endpoints is set, so that no exit-node is
+// provisioned for an app whose Pods are not ready. It returns true when the
+// tunnel should not be synced any further.
+func (c *Controller) waitForEndpoints(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	if !c.infra().WaitForEndpoints {
+		return false, nil
+	}
+
+	ready, err := c.countReadyEndpoints(tunnel)
+	if err != nil {
+		return true, err
+	}
+	if ready != 0 {
+		return false, nil
+	}
+
+	condition := inletsv1alpha1.TunnelCondition{
+		Type:    inletsv1alpha1.TunnelPending,
+		Status:  corev1.ConditionTrue,
+		Reason:  "WaitingForEndpoints",
+		Message: fmt.Sprintf("Service %s has no ready endpoints", tunnel.Spec.ServiceName),
+	}
+
+	if hasCondition(tunnel.Status.Conditions, condition) {
+		return true, nil
+	}
+
+	c.tunnelLog(tunnel).Info("Tunnel is pending", "reason", condition.Reason, "message", condition.Message)
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, condition)
+
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return true, err
+}
+
+// enqueueEndpoints enqueues the Tunnels of the Service which the Endpoints
+// belong to.
+func (c *Controller) enqueueEndpoints(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	tunnels, err := c.tunnelsLister.Tunnels(namespace).List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		if tunnel.Spec.ServiceName == name {
+			c.enqueueTunnel(tunnel)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/alexellis/inlets-operator/pkg/provision"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// validateAllowedSourceCIDRs checks that each source is a CIDR, i.e.
+// "203.0.113.0/24".
+func validateAllowedSourceCIDRs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("allowedSourceCIDRs must be CIDRs such as 203.0.113.0/24, not %q", cidr)
+		}
+	}
+	return nil
+}
+
+// makeFirewallUserdata returns a script which drops connections to the
+// control-port of the exit-node from outside of the control sources, and to
+// its other ports from outside of the CIDRs. Either may be empty to allow
+// every source, and nothing is returned when both are.
+func makeFirewallUserdata(controlPort int, controlSources, cidrs []string) string {
+	if len(cidrs) == 0 && len(controlSources) == 0 {
+		return ""
+	}
+
+	lines := []string{"", ""}
+	for _, command := range []string{"iptables", "ip6tables"} {
+		ipv6 := command == "ip6tables"
+		lines = append(lines,
+			command+" -A INPUT -i lo -j ACCEPT",
+			command+" -A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT",
+		)
+
+		if len(controlSources) == 0 {
+			lines = append(lines, fmt.Sprintf("%s -A INPUT -p tcp --dport %d -j ACCEPT", command, controlPort))
+		} else {
+			for _, source := range controlSources {
+				if strings.Contains(source, ":") == ipv6 {
+					lines = append(lines, fmt.Sprintf("%s -A INPUT -s %s -p tcp --dport %d -j ACCEPT", command, source, controlPort))
+				}
+			}
+			lines = append(lines, fmt.Sprintf("%s -A INPUT -p tcp --dport %d -j DROP", command, controlPort))
+		}
+
+		if len(cidrs) == 0 {
+			continue
+		}
+		for _, cidr := range cidrs {
+			if strings.Contains(cidr, ":") == ipv6 {
+				lines = append(lines, fmt.Sprintf("%s -A INPUT -s %s -j ACCEPT", command, cidr))
+			}
+		}
+
+		lines = append(lines, command+" -A INPUT -j DROP")
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// hasFirewall returns true when the provider can limit the sources of an
+// exit-node with its own firewall, which can be changed after the exit-node
+// was provisioned, instead of with iptables in its userdata.
+func (c *Controller) hasFirewall(provider string) bool {
+	provisioner, err := c.getProvisioner(provider)
+	if err != nil {
+		return false
+	}
+	_, ok := provisioner.(provision.Firewaller)
+	return ok
+}
+
+// setFirewall sets up the firewall of the provider for the exit-node of a
+// tunnel with the given ID, so that only the allowedSourceCIDRs can connect
+// to it, and only the control-plane sources to its control-port. It
+// returns false when the provider has no firewall.
+func (c *Controller) setFirewall(tunnel *inletsv1alpha1.Tunnel, id string) (bool, error) {
+	provisioner, err := c.getTunnelProvisioner(tunnel)
+	if err != nil {
+		return false, err
+	}
+
+	firewaller, ok := provisioner.(provision.Firewaller)
+	if !ok {
+		return false, nil
+	}
+
+	sources, err := c.getControlPlaneSources()
+	if err != nil {
+		return true, err
+	}
+
+	controlPort := int(getControlPlanePort(tunnel, tunnel.Status.HostIP))
+	return true, firewaller.SetAllowedSources(id, []int{controlPort}, sources, tunnel.Spec.AllowedSourceCIDRs)
+}
+
+// syncFirewall updates the firewall of the provider for the exit-node of a
+// tunnel when its allowedSourceCIDRs, the control-plane sources or its
+// exit-node changed since the firewall was last set up, and records what it
+// was set up for.
+func (c *Controller) syncFirewall(tunnel *inletsv1alpha1.Tunnel) error {
+	// Tunnels which share an exit-node use the firewall of its Tunnel
+	if len(tunnel.Status.HostID) == 0 {
+		return nil
+	}
+
+	sources, err := c.getControlPlaneSources()
+	if err != nil {
+		return err
+	}
+
+	applied := tunnel.Status.Firewall
+	if applied == nil && len(tunnel.Spec.AllowedSourceCIDRs) == 0 && len(sources) == 0 {
+		return nil
+	}
+	if applied != nil && applied.HostID == tunnel.Status.HostID &&
+		reflect.DeepEqual(applied.AllowedSourceCIDRs, tunnel.Spec.AllowedSourceCIDRs) &&
+		reflect.DeepEqual(applied.ControlPlaneSources, sources) {
+		return nil
+	}
+
+	supported, err := c.setFirewall(tunnel, tunnel.Status.HostID)
+	if err != nil || !supported {
+		return err
+	}
+
+	c.tunnelLog(tunnel).Info("Allowed sources to exit-node", "sources", strings.Join(tunnel.Spec.AllowedSourceCIDRs, ","))
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Firewall = nil
+	if len(tunnel.Spec.AllowedSourceCIDRs) > 0 || len(sources) > 0 {
+		tunnelCopy.Status.Firewall = &inletsv1alpha1.TunnelFirewall{
+			HostID:              tunnel.Status.HostID,
+			AllowedSourceCIDRs:  tunnel.Spec.AllowedSourceCIDRs,
+			ControlPlaneSources: sources,
+		}
+	}
+
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAllowedSourceCIDRs(t *testing.T) {
+	if err := validateAllowedSourceCIDRs([]string{"203.0.113.0/24", "2001:db8::/32"}); err != nil {
+		t.Errorf("want IPv4 and IPv6 CIDRs to be valid, got %s", err.Error())
+	}
+	if err := validateAllowedSourceCIDRs([]string{"203.0.113.10"}); err == nil {
+		t.Errorf("want an error for an IP without a prefix length")
+	}
+}
+
+func TestMakeFirewallUserdata(t *testing.T) {
+	if got := makeFirewallUserdata(inletsControlPort, nil, nil); got != "" {
+		t.Errorf("want no firewall when every source is allowed, got:\n%s", got)
+	}
+
+	tests := []struct {
+		name           string
+		controlSources []string
+		cidrs          []string
+		want           []string
+		notWant        []string
+	}{
+		{
+			name:  "cidrs",
+			cidrs: []string{"198.51.100.0/24", "2001:db8::/32"},
+			want: []string{
+				"iptables -A INPUT -p tcp --dport 8080 -j ACCEPT",
+				"iptables -A INPUT -s 198.51.100.0/24 -j ACCEPT",
+				"ip6tables -A INPUT -s 2001:db8::/32 -j ACCEPT",
+				"iptables -A INPUT -j DROP",
+				"ip6tables -A INPUT -j DROP",
+			},
+			notWant: []string{
+				"iptables -A INPUT -s 2001:db8::/32",
+				"ip6tables -A INPUT -s 198.51.100.0/24",
+			},
+		},
+		{
+			name:           "control sources",
+			controlSources: []string{"192.0.2.10/32"},
+			want: []string{
+				"iptables -A INPUT -s 192.0.2.10/32 -p tcp --dport 8080 -j ACCEPT",
+				"iptables -A INPUT -p tcp --dport 8080 -j DROP",
+				"ip6tables -A INPUT -p tcp --dport 8080 -j DROP",
+			},
+			notWant: []string{
+				"iptables -A INPUT -j DROP",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := makeFirewallUserdata(inletsControlPort, test.controlSources, test.cidrs)
+			lines := strings.Split(got, "\n")
+
+			for _, want := range test.want {
+				if !containsLine(lines, want) {
+					t.Errorf("want %q in:\n%s", want, got)
+				}
+			}
+			for _, notWant := range test.notWant {
+				for _, line := range lines {
+					if strings.HasPrefix(line, notWant) {
+						t.Errorf("want no %q in:\n%s", notWant, got)
+					}
+				}
+			}
+
+			// Established connections and the loopback are accepted
+			// before anything is dropped
+			if index := strings.Index(got, "-j DROP"); index < strings.Index(got, "--ctstate ESTABLISHED,RELATED -j ACCEPT") {
+				t.Errorf("want established connections accepted before any drop, got:\n%s", got)
+			}
+		})
+	}
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, line := range lines {
+		if line == want {
+			return true
+		}
+	}
+	return false
+}
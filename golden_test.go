@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/yaml"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+var update = flag.Bool("update", false, "Write the golden files in testdata from the output of the tests")
+
+// checkGolden compares got with the golden file at path, or writes it with
+// -update. Review the diff of a golden file as you would the change to the
+// code which caused it.
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading golden file, create it with go test -run %s -update: %s", t.Name(), err.Error())
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s differs from the golden file, update it with go test -run %s -update if this is intended\nwant:\n%s\ngot:\n%s",
+			path, t.Name(), string(want), string(got))
+	}
+}
+
+func newGoldenService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: metav1.NamespaceDefault,
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080), Protocol: corev1.ProtocolTCP},
+				{Name: "https", Port: 443, TargetPort: intstr.FromInt(8443), Protocol: corev1.ProtocolTCP},
+				{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+			},
+		},
+	}
+}
+
+func newGoldenTunnel(configure func(*inletsv1alpha1.Tunnel)) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "golden-token"
+	tunnel.Status.HostIP = "203.0.113.10"
+	tunnel.Status.HostID = "fake-1"
+	if configure != nil {
+		configure(tunnel)
+	}
+	return tunnel
+}
+
+var goldenTunnels = []struct {
+	name      string
+	configure func(*inletsv1alpha1.Tunnel)
+}{
+	{name: "http"},
+	{
+		name: "http-hostname",
+		configure: func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Hostname = "app.example.com"
+		},
+	},
+	{
+		name: "pro-tcp-udp",
+		configure: func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Protocol = "tcp"
+		},
+	},
+	{
+		name: "pro-proxy-protocol",
+		configure: func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Protocol = "tcp"
+			tunnel.Spec.ProxyProtocol = "v2"
+			tunnel.Spec.AllowedSourceCIDRs = []string{"198.51.100.0/24"}
+		},
+	},
+	{
+		name: "tls-proxy",
+		configure: func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Hostname = "app.example.com"
+			tunnel.Spec.TLS = &inletsv1alpha1.TunnelTLS{IssuerName: "letsencrypt", IssuerKind: "ClusterIssuer"}
+		},
+	},
+	{
+		name: "mutual-tls",
+		configure: func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Protocol = "tcp"
+			tunnel.Spec.MutualTLS = true
+		},
+	},
+	{
+		name: "service-account-token",
+		configure: func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Protocol = "tcp"
+			tunnel.Spec.ServiceAccountToken = &inletsv1alpha1.TunnelServiceAccountToken{}
+		},
+	},
+	{
+		name: "client-options",
+		configure: func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.Client = &inletsv1alpha1.TunnelClient{
+				HostNetwork:       true,
+				PriorityClassName: "system-cluster-critical",
+				ExtraArgs:         []string{"--strict-forwarding", "--not-allowed"},
+			}
+			tunnel.Spec.ClientScheduling = &inletsv1alpha1.ClientScheduling{
+				NodeSelector: map[string]string{"kubernetes.io/os": "linux"},
+				Tolerations: []corev1.Toleration{
+					{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "ingress", Effect: corev1.TaintEffectNoSchedule},
+				},
+			}
+		},
+	},
+}
+
+// TestGoldenClientDeployments checks the client Deployment of each kind of
+// tunnel against testdata/client
+func TestGoldenClientDeployments(t *testing.T) {
+	f := newFixture(t)
+
+	for _, test := range goldenTunnels {
+		t.Run(test.name, func(t *testing.T) {
+			deployment, err := f.controller.makeClientFor(newGoldenTunnel(test.configure), newGoldenService())
+			if err != nil {
+				t.Fatalf("makeClientFor: %s", err.Error())
+			}
+
+			got, err := yaml.Marshal(deployment)
+			if err != nil {
+				t.Fatalf("error marshalling deployment: %s", err.Error())
+			}
+			checkGolden(t, filepath.Join("testdata", "client", test.name+".yaml"), got)
+		})
+	}
+}
+
+// TestGoldenExitUserdata checks the userdata of the exit-node of each kind
+// of tunnel against testdata/userdata
+func TestGoldenExitUserdata(t *testing.T) {
+	for _, test := range goldenTunnels {
+		t.Run(test.name, func(t *testing.T) {
+			tunnel := newGoldenTunnel(test.configure)
+			got := makeExitUserdata(tunnel, false, []string{"192.0.2.0/24"}, map[string]string{
+				"inlets":     fakeReleaseChecksum,
+				"inlets-pro": fakeReleaseChecksum,
+			})
+			checkGolden(t, filepath.Join("testdata", "userdata", test.name+".sh"), []byte(got))
+		})
+	}
+}
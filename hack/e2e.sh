@@ -0,0 +1,46 @@
+#!/usr/bin/env bash
+
+# Runs the end-to-end tests in e2e/ in a new kind cluster, which is deleted
+# afterwards unless KEEP_CLUSTER=true.
+#
+# The fake provider is used by default. To provision a real exit-node, which
+# is billed by the provider:
+#
+#   INLETS_E2E_PROVIDER=digitalocean \
+#   INLETS_E2E_ACCESS_KEY_FILE=$HOME/do-access-token \
+#   ./hack/e2e.sh
+
+set -o errexit
+set -o nounset
+set -o pipefail
+
+SCRIPT_ROOT=$(dirname "${BASH_SOURCE[0]}")/..
+
+CLUSTER_NAME=${CLUSTER_NAME:-inlets-e2e}
+KEEP_CLUSTER=${KEEP_CLUSTER:-false}
+IMAGE=${INLETS_E2E_IMAGE:-alexellis/inlets-operator:e2e}
+
+_tmp=$(mktemp -d)
+KUBECONFIG_PATH="${_tmp}/kubeconfig"
+
+cleanup() {
+  if [ "${KEEP_CLUSTER}" != "true" ]; then
+    kind delete cluster --name "${CLUSTER_NAME}" || true
+  else
+    echo "Keeping cluster ${CLUSTER_NAME}, delete it with: kind delete cluster --name ${CLUSTER_NAME}"
+  fi
+  rm -rf "${_tmp}"
+}
+trap "cleanup" EXIT SIGINT
+
+kind create cluster --name "${CLUSTER_NAME}" --kubeconfig "${KUBECONFIG_PATH}" --wait 120s
+
+docker build -t "${IMAGE}" "${SCRIPT_ROOT}" -f "${SCRIPT_ROOT}/Dockerfile"
+kind load docker-image "${IMAGE}" --name "${CLUSTER_NAME}"
+
+kubectl --kubeconfig "${KUBECONFIG_PATH}" apply -f "${SCRIPT_ROOT}/artifacts/crd.yaml"
+kubectl --kubeconfig "${KUBECONFIG_PATH}" apply -f "${SCRIPT_ROOT}/artifacts/operator-rbac.yaml"
+
+cd "${SCRIPT_ROOT}"
+INLETS_E2E_KUBECONFIG="${KUBECONFIG_PATH}" INLETS_E2E_IMAGE="${IMAGE}" \
+  go test ./e2e/ -v -count=1 -timeout 30m
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// checkExitNodes probes the exit-node of each active tunnel and replaces
+// any exit-node which has failed too many consecutive checks.
+func (c *Controller) checkExitNodes() {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		// Tunnels which share an exit-node have no HostID, it is checked
+		// along with its own Tunnel
+		if tunnel.Status.HostStatus != "active" || len(tunnel.Status.HostIP) == 0 || len(tunnel.Status.HostID) == 0 {
+			continue
+		}
+
+		if paused, _ := isPaused(tunnel); paused || !c.ownsObject(tunnel) {
+			continue
+		}
+
+		key, err := cache.MetaNamespaceKeyFunc(tunnel)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+
+		probeErr := probeExitNode(tunnel)
+		c.metrics.observeProbe(tunnel, c.getTunnelProvider(tunnel), probeExitNodePorts, probeErr)
+
+		if probeErr != nil {
+			failures := c.recordHealthFailure(key)
+			c.tunnelLog(tunnel).Warn("Health check failed for exit-node", "ip", tunnel.Status.HostIP,
+				"failures", failures, "threshold", c.infra().HealthCheckFailures, "error", probeErr)
+
+			if failures >= c.infra().HealthCheckFailures {
+				if err := c.replaceExitNode(tunnel, probeErr); err != nil {
+					utilruntime.HandleError(err)
+					continue
+				}
+				c.resetHealthFailures(key)
+			}
+		} else {
+			c.resetHealthFailures(key)
+		}
+	}
+}
+
+// probeExitNode checks that the control-port and data-port of the
+// exit-node accept connections.
+func probeExitNode(tunnel *inletsv1alpha1.Tunnel) error {
+	ports := []int{inletsControlPort, 80}
+	if isProTunnel(tunnel) {
+		// The data-ports of inlets-pro are only open when a client is
+		// connected, so only the control-port is checked.
+		ports = []int{inletsProControlPort}
+	} else if len(tunnel.Spec.AllowedSourceCIDRs) > 0 || hasExitNodeAuth(tunnel) {
+		// The firewall drops connections to the data-port from outside of
+		// allowedSourceCIDRs, and an auth layer rather than inlets listens
+		// on it, so only the control-port is checked. A client which is
+		// not ready is no reason to replace the exit-node.
+		ports = []int{inletsControlPort}
+	}
+
+	for _, port := range ports {
+		address := net.JoinHostPort(tunnel.Status.HostIP, fmt.Sprintf("%d", port))
+		conn, err := net.DialTimeout("tcp", address, healthCheckTimeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+
+	return nil
+}
+
+// replaceExitNode deletes the exit-node of a tunnel and resets its status
+// so that a new exit-node is provisioned. The client deployment is updated
+// with the new IP once the new exit-node is active.
+func (c *Controller) replaceExitNode(tunnel *inletsv1alpha1.Tunnel, reason error) error {
+	c.recorder.Eventf(tunnel, corev1.EventTypeWarning, ErrExitNodeUnhealthy,
+		"Replacing exit-node %s after %d failed health checks: %s",
+		tunnel.Status.HostIP, c.infra().HealthCheckFailures, reason.Error())
+
+	return c.deleteExitNode(tunnel, "unhealthy")
+}
+
+// deleteExitNode deletes the exit-node of a tunnel and resets its status
+// so that a new exit-node is provisioned. The status is kept when the
+// exit-node can't be deleted, so that it is not leaked and the delete is
+// retried.
+func (c *Controller) deleteExitNode(tunnel *inletsv1alpha1.Tunnel, trigger string) error {
+	key := tunnel.Namespace + "/" + tunnel.Name
+	c.startWork(key)
+	defer c.finishWork(key)
+
+	c.tunnelLog(tunnel).Info("Deleting exit-node", "ip", tunnel.Status.HostIP)
+	if err := c.deprovisionExitNode(tunnel, trigger); err != nil {
+		return fmt.Errorf("error deleting exit-node %s: %s", tunnel.Status.HostID, err)
+	}
+
+	return c.updateTunnelProvisioningStatus(tunnel, "", "", "")
+}
+
+func (c *Controller) recordHealthFailure(key string) int {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+
+	c.healthFailures[key]++
+	return c.healthFailures[key]
+}
+
+func (c *Controller) resetHealthFailures(key string) {
+	c.healthLock.Lock()
+	defer c.healthLock.Unlock()
+
+	delete(c.healthFailures, key)
+}
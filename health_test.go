@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// listenControlPort listens on the control-port of inlets on the loopback
+// address, which the exit-nodes of the tests have as their IP.
+func listenControlPort(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", inletsControlPort))
+	if err != nil {
+		t.Skipf("unable to listen on the control-port: %s", err.Error())
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	if conn, err := net.Dial("tcp", "127.0.0.1:80"); err == nil {
+		conn.Close()
+		listener.Close()
+		t.Skip("port 80 is open on the loopback address")
+	}
+	return listener
+}
+
+func newActiveTunnel(name string) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel(name)
+	tunnel.Status.HostStatus = "active"
+	tunnel.Status.HostID = "fake-" + name
+	tunnel.Status.HostIP = "127.0.0.1"
+	return tunnel
+}
+
+func TestProbeExitNode(t *testing.T) {
+	listener := listenControlPort(t)
+	defer listener.Close()
+
+	tests := []struct {
+		name      string
+		configure func(*inletsv1alpha1.Tunnel)
+		wantErr   bool
+	}{
+		{
+			name:    "http checks the data-port",
+			wantErr: true,
+		},
+		{
+			name: "http with allowedSourceCIDRs checks the control-port",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.AllowedSourceCIDRs = []string{"198.51.100.0/24"}
+			},
+		},
+		{
+			name: "http with basic auth checks the control-port",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Auth = &inletsv1alpha1.TunnelAuth{
+					Basic: &inletsv1alpha1.TunnelBasicAuth{SecretName: "app-auth"},
+				}
+			},
+		},
+		{
+			name: "pro checks its own control-port",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Protocol = "tcp"
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tunnel := newActiveTunnel("app")
+			if test.configure != nil {
+				test.configure(tunnel)
+			}
+
+			err := probeExitNode(tunnel)
+			if test.wantErr && err == nil {
+				t.Errorf("want an error for a closed port")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("want no error, got %s", err.Error())
+			}
+		})
+	}
+}
+
+// TestCheckExitNodesKeepsFirewalledExitNode checks that an exit-node whose
+// firewall drops the probe of its data-port isn't replaced over and over.
+func TestCheckExitNodesKeepsFirewalledExitNode(t *testing.T) {
+	listener := listenControlPort(t)
+	defer listener.Close()
+
+	f := newFixture(t)
+	f.controller.infra().HealthCheckFailures = 1
+
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.AllowedSourceCIDRs = []string{"198.51.100.0/24"}
+	f.create(tunnel)
+
+	f.controller.checkExitNodes()
+
+	if got := f.get("app"); got.Status.HostID != tunnel.Status.HostID || got.Status.HostStatus != "active" {
+		t.Errorf("want the exit-node to be kept, got host %q which is %q", got.Status.HostID, got.Status.HostStatus)
+	}
+}
+
+func TestDeleteExitNodeKeepsStatusWhenDeleteFails(t *testing.T) {
+	f := newFixture(t)
+
+	tunnel := newActiveTunnel("app")
+	f.create(tunnel)
+	f.provisioner.FailNext("Delete", fmt.Errorf("unavailable"))
+
+	if err := f.controller.deleteExitNode(tunnel, "test"); err == nil {
+		t.Fatalf("want an error when the exit-node can't be deleted")
+	}
+	if got := f.get("app"); got.Status.HostID != tunnel.Status.HostID {
+		t.Fatalf("want the exit-node to be kept for a retry, got host %q", got.Status.HostID)
+	}
+
+	if err := f.controller.deleteExitNode(f.get("app"), "test"); err != nil {
+		t.Fatalf("want the retry to delete the exit-node, got %s", err.Error())
+	}
+	if got := f.get("app"); len(got.Status.HostID) > 0 {
+		t.Errorf("want the status to be reset, got host %q", got.Status.HostID)
+	}
+}
+
+func TestDeleteExitNodeUnpublishesService(t *testing.T) {
+	f := newFixture(t)
+	if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Create(newPublishedService()); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Status.HostIP = "203.0.113.1"
+	f.create(tunnel)
+
+	if err := f.controller.deleteExitNode(tunnel, "test"); err != nil {
+		t.Fatalf("error deleting exit-node: %s", err.Error())
+	}
+
+	service, _ := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get("app", metav1.GetOptions{})
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "203.0.113.2" {
+		t.Errorf("want the IP of the exit-node to be unpublished, got %v", service.Spec.ExternalIPs)
+	}
+}
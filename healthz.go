@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+const (
+	// credentialCheckInterval is how often the access key of each provider
+	// is used for a call which changes nothing, so that a bad rotation of
+	// credentials fails /readyz soon after.
+	credentialCheckInterval = time.Minute
+
+	webhookCheckTimeout = 2 * time.Second
+)
+
+// checkCredentials checks that the access key of --provider and each
+// failover provider is accepted, by listing the regions of the provider.
+func (c *Controller) checkCredentials() {
+	checks := []preflightCheck{}
+
+	checked := map[string]bool{}
+	for _, target := range c.infra().GetTargets() {
+		if checked[target.Provider] {
+			continue
+		}
+		checked[target.Provider] = true
+
+		check := preflightCheck{Name: "credentials:" + target.Provider}
+		provisioner, err := c.getProvisioner(target.Provider)
+		if err != nil {
+			check.Error = err
+		} else if lister, ok := provisioner.(provision.RegionLister); ok {
+			if _, err := lister.Regions(); err != nil {
+				check.Error = fmt.Errorf("access key was rejected: %s", err.Error())
+			}
+		}
+
+		if check.Error != nil {
+			logWith("provider", target.Provider).Error(check.Error, "Error checking credentials")
+			c.infra().Notifier.Notify(notification{
+				Type:     notifyCredentialsInvalid,
+				Reason:   "CredentialCheckFailed",
+				Provider: target.Provider,
+				Message:  check.Error.Error(),
+			})
+		}
+		checks = append(checks, check)
+	}
+
+	c.preflight.lock.Lock()
+	c.preflight.credentials = checks
+	c.preflight.credentialsCheckedAt = time.Now()
+	c.preflight.lock.Unlock()
+}
+
+// checkWebhook checks that the webhook is serving with a certificate which
+// has not expired, by connecting to it over TLS.
+func (c *Controller) checkWebhook() preflightCheck {
+	check := preflightCheck{Name: "webhook"}
+
+	address := net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", c.infra().WebhookPort))
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: webhookCheckTimeout}, "tcp", address, &tls.Config{
+		// Only the certificate being served is checked, since it is
+		// issued for the name of the Service of the webhook
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		check.Error = fmt.Errorf("not serving: %s", err.Error())
+		return check
+	}
+	defer conn.Close()
+
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) > 0 && time.Now().After(certificates[0].NotAfter) {
+		check.Error = fmt.Errorf("certificate expired at %s", certificates[0].NotAfter.UTC().Format(time.RFC3339))
+	}
+	return check
+}
+
+// handleHealthz reports that the operator is live whilst its workqueue is
+// running, for the liveness probe of its Deployment.
+func (c *Controller) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if c.workqueue.ShuttingDown() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "[-]workqueue failed: shutting down")
+		return
+	}
+	fmt.Fprintln(w, "[+]workqueue ok")
+	fmt.Fprintln(w, "healthz check passed")
+}
+
+// serveHealth serves /healthz and /readyz on their own port, so that the
+// probes of the operator don't need --metrics-port.
+func (c *Controller) serveHealth(port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.handleHealthz)
+	mux.HandleFunc("/readyz", c.handleReadyz)
+
+	logWith("port", port).Info("Serving health checks")
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+}
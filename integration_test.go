@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kubeinformers "k8s.io/client-go/informers"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/generated/clientset/versioned/fake"
+	informers "github.com/alexellis/inlets-operator/pkg/generated/informers/externalversions"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// cluster runs a Controller with its informers and workers against fake
+// clients, as the operator runs against a cluster, with exit-nodes from a
+// FakeProvisioner. Like a test API server, it has no garbage collector, so
+// deleteService deletes the Tunnels of a Service itself.
+type cluster struct {
+	t *testing.T
+
+	client      *fake.Clientset
+	kubeclient  *k8sfake.Clientset
+	controller  *Controller
+	provisioner *provision.FakeProvisioner
+	stopCh      chan struct{}
+	stopped     chan struct{}
+}
+
+// startCluster starts a Controller with an InfraConfig for the fake
+// provider, which configure may change first
+func startCluster(t *testing.T, configure func(*InfraConfig)) *cluster {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	c := &cluster{
+		t:          t,
+		client:     fake.NewSimpleClientset(),
+		kubeclient: k8sfake.NewSimpleClientset(),
+		stopCh:     make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+
+	// The operator has every permission which the preflight checks
+	c.kubeclient.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		review.Status.Allowed = true
+		return true, review, nil
+	})
+
+	// Pending tunnels are only synced again on a resync, as in the
+	// operator, so resyncs are frequent
+	resync := 100 * time.Millisecond
+	kubeInformers := kubeinformers.NewSharedInformerFactory(c.kubeclient, resync)
+	operatorInformers := informers.NewSharedInformerFactory(c.client, resync)
+
+	accessKey := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	infra := &InfraConfig{
+		Provider:               "fake",
+		AccessKey:              accessKey,
+		TokenLength:            64,
+		Executor:               "inline",
+		ProvisionPollIntervals: map[string]time.Duration{"": 50 * time.Millisecond},
+		ReleaseChecksums:       fakeReleaseChecksums(),
+	}
+	if configure != nil {
+		configure(infra)
+	}
+
+	c.controller = NewController(c.kubeclient, c.client,
+		kubeInformers.Apps().V1().Deployments(),
+		operatorInformers.Inletsoperator().V1alpha1().Tunnels(),
+		operatorInformers.Inletsoperator().V1alpha1().TunnelClasses(),
+		kubeInformers.Core().V1().Services(),
+		kubeInformers.Core().V1().Endpoints(),
+		infra)
+	c.controller.recorder = record.NewFakeRecorder(1000)
+
+	provisioner, err := provision.GetProvisioner("fake", accessKey)
+	if err != nil {
+		t.Fatalf("error getting provisioner: %s", err.Error())
+	}
+	c.provisioner = provisioner.(*provision.FakeProvisioner)
+	c.provisioner.ProvisionLatency = 200 * time.Millisecond
+	c.provisioner.CallLatency = 0
+
+	kubeInformers.Start(c.stopCh)
+	operatorInformers.Start(c.stopCh)
+
+	go func() {
+		defer close(c.stopped)
+		if err := c.controller.Run(2, c.stopCh); err != nil {
+			t.Errorf("error running controller: %s", err.Error())
+		}
+	}()
+	return c
+}
+
+// stop stops the Controller and waits for its workers to finish
+func (c *cluster) stop() {
+	close(c.stopCh)
+	<-c.stopped
+}
+
+// eventually fails the test when a condition isn't met within 10 seconds
+func (c *cluster) eventually(what string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (c *cluster) createService(name string) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: metav1.NamespaceDefault,
+			UID:       types.UID(fmt.Sprintf("uid-%s-%d", name, time.Now().UnixNano())),
+		},
+		Spec: corev1.ServiceSpec{
+			Type: corev1.ServiceTypeLoadBalancer,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Protocol: corev1.ProtocolTCP, Port: 80},
+			},
+		},
+	}
+
+	created, err := c.kubeclient.CoreV1().Services(service.Namespace).Create(service)
+	if err != nil {
+		c.t.Fatalf("error creating service: %s", err.Error())
+	}
+	return created
+}
+
+// deleteService deletes a Service, then the Tunnels which it controls and
+// their client Deployments, as the garbage collector would
+func (c *cluster) deleteService(service *corev1.Service) {
+	if err := c.kubeclient.CoreV1().Services(service.Namespace).Delete(service.Name, &metav1.DeleteOptions{}); err != nil {
+		c.t.Fatalf("error deleting service: %s", err.Error())
+	}
+
+	tunnels, err := c.client.InletsoperatorV1alpha1().Tunnels(service.Namespace).List(metav1.ListOptions{})
+	if err != nil {
+		c.t.Fatalf("error listing tunnels: %s", err.Error())
+	}
+	for _, tunnel := range tunnels.Items {
+		if ref := metav1.GetControllerOf(&tunnel); ref != nil && ref.UID == service.UID {
+			if err := c.client.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).Delete(tunnel.Name, &metav1.DeleteOptions{}); err != nil {
+				c.t.Fatalf("error deleting tunnel: %s", err.Error())
+			}
+			c.deleteOwned(tunnel.UID)
+		}
+	}
+}
+
+// deleteOwned deletes the Deployments controlled by an object
+func (c *cluster) deleteOwned(uid types.UID) {
+	deployments, err := c.kubeclient.AppsV1().Deployments(metav1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		c.t.Fatalf("error listing deployments: %s", err.Error())
+	}
+	for _, deployment := range deployments.Items {
+		if ref := metav1.GetControllerOf(&deployment); ref != nil && ref.UID == uid {
+			if err := c.kubeclient.AppsV1().Deployments(deployment.Namespace).Delete(deployment.Name, &metav1.DeleteOptions{}); err != nil {
+				c.t.Fatalf("error deleting deployment: %s", err.Error())
+			}
+		}
+	}
+}
+
+// tunnel returns the Tunnel of a Service, or nil when it doesn't exist
+func (c *cluster) tunnel(service *corev1.Service) *inletsv1alpha1.Tunnel {
+	tunnel, err := c.client.InletsoperatorV1alpha1().Tunnels(service.Namespace).Get(getTunnelName(service, ""), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		c.t.Fatalf("error getting tunnel: %s", err.Error())
+	}
+	return tunnel
+}
+
+// waitForActive waits for the exit-node of the Tunnel of a Service to be
+// active, and returns the Tunnel
+func (c *cluster) waitForActive(service *corev1.Service) *inletsv1alpha1.Tunnel {
+	var tunnel *inletsv1alpha1.Tunnel
+	c.eventually("the tunnel of "+service.Name+" to be active", func() bool {
+		tunnel = c.tunnel(service)
+		return tunnel != nil && tunnel.Status.HostStatus == "active"
+	})
+	return tunnel
+}
+
+func TestIntegrationServiceLifecycle(t *testing.T) {
+	c := startCluster(t, nil)
+	defer c.stop()
+
+	service := c.createService("app")
+
+	tunnel := c.waitForActive(service)
+	if ref := metav1.GetControllerOf(tunnel); ref == nil || ref.UID != service.UID {
+		t.Errorf("want the tunnel to be controlled by the service, got %v", ref)
+	}
+	if len(tunnel.Spec.AuthToken) == 0 {
+		t.Errorf("want the tunnel to have a token")
+	}
+	if tunnel.Status.Operation != nil {
+		t.Errorf("want no operation once active, got %v", tunnel.Status.Operation)
+	}
+	if _, ok := c.provisioner.Host(tunnel.Status.HostID); !ok {
+		t.Fatalf("want exit-node %s to exist", tunnel.Status.HostID)
+	}
+	if tunnel.Status.HostIP != "203.0.113.1" {
+		t.Errorf("want IP 203.0.113.1, got %q", tunnel.Status.HostIP)
+	}
+
+	c.eventually("the client deployment", func() bool {
+		_, err := c.kubeclient.AppsV1().Deployments(service.Namespace).Get(tunnel.Name+"-client", metav1.GetOptions{})
+		return err == nil
+	})
+
+	c.deleteService(service)
+
+	c.eventually("the exit-node to be deleted", func() bool {
+		_, ok := c.provisioner.Host(tunnel.Status.HostID)
+		return !ok
+	})
+	if got := c.provisioner.Calls("Provision"); got != 1 {
+		t.Errorf("want 1 call to Provision, got %d", got)
+	}
+}
+
+func TestIntegrationKeepsExitNodeOfDeletedService(t *testing.T) {
+	c := startCluster(t, func(infra *InfraConfig) {
+		infra.DeletionTTL = time.Hour
+	})
+	defer c.stop()
+
+	service := c.createService("app")
+	tunnel := c.waitForActive(service)
+
+	c.deleteService(service)
+	c.eventually("the exit-node to be kept", func() bool {
+		retained, err := c.controller.listRetained(retainedSecretName)
+		return err == nil && len(retained) == 1
+	})
+	if _, ok := c.provisioner.Host(tunnel.Status.HostID); !ok {
+		t.Fatalf("want exit-node %s to be kept", tunnel.Status.HostID)
+	}
+
+	// The Service comes back with the same exit-node and IP
+	service = c.createService("app")
+	adopted := c.waitForActive(service)
+	if adopted.Status.HostID != tunnel.Status.HostID || adopted.Status.HostIP != tunnel.Status.HostIP {
+		t.Errorf("want exit-node %s with IP %s, got %s with IP %s",
+			tunnel.Status.HostID, tunnel.Status.HostIP, adopted.Status.HostID, adopted.Status.HostIP)
+	}
+	if got := c.provisioner.Calls("Provision"); got != 1 {
+		t.Errorf("want 1 call to Provision, got %d", got)
+	}
+}
+
+func TestIntegrationPendingForQuota(t *testing.T) {
+	c := startCluster(t, func(infra *InfraConfig) {
+		infra.MaxExitNodes = 1
+	})
+	defer c.stop()
+
+	first := c.createService("first")
+	c.waitForActive(first)
+
+	second := c.createService("second")
+	c.eventually("the second tunnel to be pending", func() bool {
+		tunnel := c.tunnel(second)
+		if tunnel == nil {
+			return false
+		}
+		pending := getCondition(tunnel.Status.Conditions, inletsv1alpha1.TunnelPending)
+		return pending != nil && pending.Status == corev1.ConditionTrue && pending.Reason == "QuotaExceeded"
+	})
+	if got := c.provisioner.Calls("Provision"); got != 1 {
+		t.Errorf("want 1 call to Provision whilst pending, got %d", got)
+	}
+
+	c.deleteService(first)
+
+	tunnel := c.waitForActive(second)
+	if hasConditionType(tunnel.Status.Conditions, inletsv1alpha1.TunnelPending) {
+		t.Errorf("want the pending condition to be removed, got %v", tunnel.Status.Conditions)
+	}
+}
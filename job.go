@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// finishedJobTTL is how long finished Jobs to delete exit-nodes are kept
+// for inspection.
+const finishedJobTTL = int32(60 * 60)
+
+// userDataKey is the key of the userdata in the Secret of a Job which
+// creates an exit-node.
+const userDataKey = "userdata"
+
+// usesJobs returns true when the exit-node of a tunnel with the provider is
+// provisioned and deleted by a Job. Jobs only have the access key of the
+// main provider, so failover providers and TunnelClasses with their own
+// access key are provisioned by the operator, as are providers of plugins,
+// which the image of the Jobs doesn't have.
+func (c *Controller) usesJobs(tunnel *inletsv1alpha1.Tunnel, provider string) bool {
+	if c.infra().Executor != "job" || provider != c.infra().Provider {
+		return false
+	}
+	if _, ok := c.infra().ProviderPlugins[provider]; ok {
+		return false
+	}
+
+	class, _ := c.getTunnelClass(tunnel)
+	return class == nil || class.Spec.AccessKeySecret == nil || class.Spec.Provider != provider
+}
+
+// getTunnelProvider returns the provider of the exit-node of a tunnel.
+func (c *Controller) getTunnelProvider(tunnel *inletsv1alpha1.Tunnel) string {
+	if len(tunnel.Status.Provider) > 0 {
+		return tunnel.Status.Provider
+	}
+	return c.infra().Provider
+}
+
+// deleteHost deletes the exit-node of a tunnel, or starts a Job to delete it,
+// and records what triggered it in the audit log.
+func (c *Controller) deleteHost(tunnel *inletsv1alpha1.Tunnel, trigger string) error {
+	provider := c.getTunnelProvider(tunnel)
+	record := auditRecord{
+		Action:   "delete",
+		Trigger:  trigger,
+		Provider: provider,
+		Region:   tunnel.Status.Region,
+		HostID:   tunnel.Status.HostID,
+		HostIP:   tunnel.Status.HostIP,
+	}
+
+	if c.usesJobs(tunnel, provider) {
+		job, err := c.makeProvisionJob("inlets-delete-"+strings.ToLower(tunnel.Status.HostID), []string{
+			"delete",
+			"--provider=" + provider,
+			"--id=" + tunnel.Status.HostID,
+		})
+		if err != nil {
+			c.audit(tunnel, record, err)
+			return err
+		}
+		backoffLimit := int32(3)
+		ttl := finishedJobTTL
+		job.Spec.BackoffLimit = &backoffLimit
+		job.Spec.TTLSecondsAfterFinished = &ttl
+
+		_, err = c.kubeclientset.BatchV1().Jobs(job.Namespace).Create(job)
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+		if err != nil {
+			c.audit(tunnel, record, err)
+			return err
+		}
+		c.tunnelLog(tunnel).Info("Created job to delete exit-node", "job", job.Name)
+
+		record.Outcome = "started"
+		c.audit(tunnel, record, nil)
+		return nil
+	}
+
+	provisioner, err := c.getTunnelProvisioner(tunnel)
+	if err == nil {
+		limiter := c.getProviderLimiter(provider)
+		limiter.acquire(tunnel.Namespace)
+
+		started := time.Now()
+		span := c.startSpan(tunnel, "delete", "inlets.provider", provider, "inlets.host.id", tunnel.Status.HostID, "inlets.trigger", trigger)
+		err = provisioner.Delete(tunnel.Status.HostID)
+		limiter.release()
+		// A host which is already gone has been deleted, so that its
+		// status is reset rather than the delete retried forever.
+		if provision.ErrorClass(err) == "not_found" {
+			err = nil
+		}
+		if err == nil {
+			provision.ForgetDeletedHost(provisioner, tunnel.Status.HostID)
+		}
+		span.finish(err)
+		c.metrics.observeOperation("delete", provider, started)
+	}
+	c.audit(tunnel, record, err)
+	return err
+}
+
+// syncProvisionJob provisions the exit-node of a tunnel with a Job, then
+// records the ID which the Job reports so that its status is polled.
+// A Job which fails is deleted, so that a new one is created on the
+// next sync. Before a Job is created, an exit-node which an earlier Job
+// created for the tunnel without its ID being recorded is looked up by
+// its tags and adopted, so that a second exit-node isn't created.
+func (c *Controller) syncProvisionJob(tunnel *inletsv1alpha1.Tunnel, target ProvisionTarget) error {
+	jobs := c.kubeclientset.BatchV1().Jobs(c.infra().JobNamespace)
+	name := "inlets-create-" + string(tunnel.UID)
+	record := auditRecord{Action: "provision", Trigger: "tunnel-created", Provider: target.Provider, Region: target.Region}
+
+	job, err := jobs.Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		provisioner, err := c.getTunnelProvisioner(tunnel)
+		if err != nil {
+			return err
+		}
+
+		// The hosts are listed again, since an earlier Job, or one which
+		// was deleted by hand, created its host after they were cached
+		provision.ForgetHosts(provisioner)
+		if found := c.findUntrackedExitNode(tunnel, provisioner, target.Provider); found != nil {
+			c.adoptUntrackedExitNode(tunnel, found, target, record.Trigger)
+			return c.recordJobExitNode(tunnel, target, found.ID)
+		}
+
+		job, userData, err := c.makeCreateJob(name, tunnel, target)
+		if err != nil {
+			return err
+		}
+
+		job, err = jobs.Create(job)
+		if err != nil {
+			c.audit(tunnel, record, err)
+			return err
+		}
+
+		// The Pod of the Job can't start until the Secret exists, so the
+		// Job is deleted to be created again when the Secret isn't
+		if err := c.createUserDataSecret(job, userData); err != nil {
+			background := metav1.DeletePropagationBackground
+			if err := jobs.Delete(name, &metav1.DeleteOptions{PropagationPolicy: &background}); err != nil && !errors.IsNotFound(err) {
+				c.tunnelLog(tunnel).Error(err, "Error deleting job", "job", name)
+			}
+			return err
+		}
+
+		c.tunnelLog(tunnel).Info("Created job to provision exit-node", "job", job.Name)
+		record.Outcome = "started"
+		c.audit(tunnel, record, nil)
+		c.enqueueTunnelAfterPoll(tunnel, target.Provider, "")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if job.Status.Succeeded == 0 && job.Status.Failed == 0 {
+		c.enqueueTunnelAfterPoll(tunnel, target.Provider, "")
+		return nil
+	}
+
+	// A Job whose termination message was lost is deleted too, since the
+	// exit-node which it may have created is looked up before the next Job
+	message, messageErr := c.getJobMessage(job)
+
+	background := metav1.DeletePropagationBackground
+	if err := jobs.Delete(name, &metav1.DeleteOptions{PropagationPolicy: &background}); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	if messageErr != nil {
+		c.audit(tunnel, record, messageErr)
+		return messageErr
+	}
+
+	if job.Status.Succeeded == 0 {
+		c.recorder.Eventf(tunnel, corev1.EventTypeWarning, ErrProvisionJobFailed,
+			"Job %s failed to provision exit-node: %s", name, message)
+
+		err := fmt.Errorf("job %s failed: %s", name, message)
+		c.audit(tunnel, record, err)
+		return err
+	}
+
+	record.HostID = message
+	c.audit(tunnel, record, nil)
+
+	return c.recordJobExitNode(tunnel, target, message)
+}
+
+// recordJobExitNode records the ID of the exit-node which a Job created for
+// a tunnel, so that its status is polled.
+func (c *Controller) recordJobExitNode(tunnel *inletsv1alpha1.Tunnel, target ProvisionTarget, id string) error {
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Provider = target.Provider
+	tunnelCopy.Status.Region = target.Region
+	tunnelCopy.Status.EstimatedHourlyCost = c.getHourlyCost(c.makeExitHost(tunnel, target), target.Provider)
+
+	return c.updateTunnelProvisioningStatus(tunnelCopy, "provisioning", id, "")
+}
+
+// createUserDataSecret creates the Secret with the userdata of the exit-node
+// which a Job creates, since the userdata has the token of the tunnel and
+// other secrets. The Secret is owned by the Job, so it is deleted along
+// with the Job.
+func (c *Controller) createUserDataSecret(job *batchv1.Job, userData string) error {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      job.Name,
+			Namespace: job.Namespace,
+			Labels:    job.Labels,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		Data: map[string][]byte{
+			userDataKey: []byte(userData),
+		},
+	}
+
+	secrets := c.kubeclientset.CoreV1().Secrets(job.Namespace)
+	_, err := secrets.Create(secret)
+	if errors.IsAlreadyExists(err) {
+		// The Secret of an earlier Job of the same name may not have been
+		// deleted along with it yet
+		existing, err := secrets.Get(secret.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		existing.OwnerReferences = secret.OwnerReferences
+		existing.Data = secret.Data
+		_, err = secrets.Update(existing)
+		return err
+	}
+	return err
+}
+
+// getJobMessage returns the termination message of the last Pod of a Job,
+// which is the ID of the host when the Job succeeded, or its error.
+func (c *Controller) getJobMessage(job *batchv1.Job) (string, error) {
+	selector := labels.SelectorFromSet(labels.Set{"job-name": job.Name})
+	pods, err := c.kubeclientset.CoreV1().Pods(job.Namespace).List(metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+
+	for i := len(pods.Items) - 1; i >= 0; i-- {
+		for _, status := range pods.Items[i].Status.ContainerStatuses {
+			if status.State.Terminated != nil && len(status.State.Terminated.Message) > 0 {
+				return strings.TrimSpace(status.State.Terminated.Message), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("job %s has no termination message", job.Name)
+}
+
+// makeCreateJob returns a Job which creates the exit-node of a tunnel, and
+// the userdata of the exit-node, which the Job reads from the Secret of
+// the same name.
+func (c *Controller) makeCreateJob(name string, tunnel *inletsv1alpha1.Tunnel, target ProvisionTarget) (*batchv1.Job, string, error) {
+	host, err := c.makeProvisionedHost(tunnel, target)
+	if err != nil {
+		return nil, "", err
+	}
+
+	args := []string{
+		"create",
+		"--provider=" + target.Provider,
+		"--name=" + host.Name,
+		"--region=" + host.Region,
+		"--plan=" + host.Plan,
+		"--os=" + host.OS,
+		"--project-id=" + host.Additional["project_id"],
+		"--tags=" + joinTags(host.Tags),
+		"--output-file=/dev/termination-log",
+	}
+	if host.Additional["monitoring"] == "true" {
+		args = append(args, "--monitoring")
+	}
+
+	job, err := c.makeProvisionJob(name, args)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// A retry could create a second host, so the operator retries with
+	// a new Job instead, once it has looked for the host of this one.
+	backoffLimit := int32(0)
+	job.Spec.BackoffLimit = &backoffLimit
+
+	container := &job.Spec.Template.Spec.Containers[0]
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name: "USERDATA",
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: name},
+				Key:                  userDataKey,
+			},
+		},
+	})
+	container.TerminationMessagePolicy = corev1.TerminationMessageFallbackToLogsOnError
+
+	return job, host.UserData, nil
+}
+
+// makeProvisionJob returns a Job which runs inlets-provision with the
+// access key of the main provider, from an image verified with
+// --cosign-key.
+func (c *Controller) makeProvisionJob(name string, args []string) (*batchv1.Job, error) {
+	image, err := c.verifyImage(c.infra().GetProvisionerImage())
+	if err != nil {
+		return nil, err
+	}
+
+	env := []corev1.EnvVar{
+		{
+			Name: "ACCESS_KEY",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: c.infra().JobAccessKeySecret,
+					},
+					Key: c.infra().JobAccessKeySecret,
+				},
+			},
+		},
+	}
+	env = append(env, c.infra().Proxy.env()...)
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: c.infra().JobNamespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "inlets-provision",
+				"app.kubernetes.io/managed-by": "inlets-operator",
+			},
+		},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:            "provision",
+							Image:           image,
+							ImagePullPolicy: corev1.PullIfNotPresent,
+							Args:            args,
+							Env:             env,
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// joinTags formats tags as "key=value" for inlets-provision.
+func joinTags(tags map[string]string) string {
+	entries := []string{}
+	for key, value := range tags {
+		entries = append(entries, key+"="+value)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
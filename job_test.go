@@ -0,0 +1,188 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+func jobExecutor(infra *InfraConfig) {
+	infra.Executor = "job"
+	infra.JobNamespace = "inlets"
+	infra.JobAccessKeySecret = "inlets-access-key"
+}
+
+// finishJob records the Pod of a Job with a termination message, and the
+// Job as succeeded or failed.
+func (f *fixture) finishJob(name, message string, succeeded bool) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-pod",
+			Namespace: "inlets",
+			Labels:    map[string]string{"job-name": name},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: message}}},
+			},
+		},
+	}
+	if _, err := f.kubeclient.CoreV1().Pods("inlets").Create(pod); err != nil {
+		f.t.Fatalf("error creating pod: %s", err.Error())
+	}
+
+	jobs := f.kubeclient.BatchV1().Jobs("inlets")
+	job, err := jobs.Get(name, metav1.GetOptions{})
+	if err != nil {
+		f.t.Fatalf("error getting job: %s", err.Error())
+	}
+	if succeeded {
+		job.Status.Succeeded = 1
+	} else {
+		job.Status.Failed = 1
+	}
+	if _, err := jobs.UpdateStatus(job); err != nil {
+		f.t.Fatalf("error updating job: %s", err.Error())
+	}
+}
+
+func TestSyncProvisionJobKeepsUserDataInSecret(t *testing.T) {
+	f := newFixture(t, jobExecutor)
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "secret-token"
+	f.create(tunnel)
+
+	if err := f.controller.syncProvisionJob(tunnel, ProvisionTarget{Provider: "fake"}); err != nil {
+		t.Fatalf("error syncing job: %s", err.Error())
+	}
+
+	name := "inlets-create-" + string(tunnel.UID)
+	job, err := f.kubeclient.BatchV1().Jobs("inlets").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("want a job to be created: %s", err.Error())
+	}
+	if *job.Spec.BackoffLimit != 0 {
+		t.Errorf("want the job not to be retried, got a backoffLimit of %d", *job.Spec.BackoffLimit)
+	}
+
+	var userData *corev1.EnvVar
+	for i, env := range job.Spec.Template.Spec.Containers[0].Env {
+		if strings.Contains(env.Value, "secret-token") {
+			t.Errorf("want no token in the spec of the job, got it in %s", env.Name)
+		}
+		if env.Name == "USERDATA" {
+			userData = &job.Spec.Template.Spec.Containers[0].Env[i]
+		}
+	}
+	if userData == nil || userData.ValueFrom == nil || userData.ValueFrom.SecretKeyRef == nil ||
+		userData.ValueFrom.SecretKeyRef.Name != name {
+		t.Fatalf("want the userdata to be read from the secret %s, got %+v", name, userData)
+	}
+
+	secret, err := f.kubeclient.CoreV1().Secrets("inlets").Get(name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("want a secret with the userdata: %s", err.Error())
+	}
+	if !strings.Contains(string(secret.Data[userDataKey]), "secret-token") {
+		t.Errorf("want the userdata in the secret")
+	}
+	if owner := metav1.GetControllerOf(secret); owner == nil || owner.Kind != "Job" || owner.Name != name {
+		t.Errorf("want the secret to be owned by the job, got %+v", owner)
+	}
+}
+
+func TestSyncProvisionJobRecordsExitNode(t *testing.T) {
+	f := newFixture(t, jobExecutor)
+	tunnel := newTunnel("app")
+	f.create(tunnel)
+
+	target := ProvisionTarget{Provider: "fake"}
+	if err := f.controller.syncProvisionJob(tunnel, target); err != nil {
+		t.Fatalf("error syncing job: %s", err.Error())
+	}
+
+	name := "inlets-create-" + string(tunnel.UID)
+	f.finishJob(name, "fake-7\n", true)
+
+	if err := f.controller.syncProvisionJob(tunnel, target); err != nil {
+		t.Fatalf("error syncing job: %s", err.Error())
+	}
+	if got := f.get("app"); got.Status.HostID != "fake-7" || got.Status.HostStatus != "provisioning" {
+		t.Errorf("want the ID from the job to be recorded, got %q which is %q", got.Status.HostID, got.Status.HostStatus)
+	}
+	if _, err := f.kubeclient.BatchV1().Jobs("inlets").Get(name, metav1.GetOptions{}); err == nil {
+		t.Errorf("want the finished job to be deleted")
+	}
+}
+
+func TestSyncProvisionJobAdoptsExitNodeOfLostJob(t *testing.T) {
+	f := newFixture(t, jobExecutor)
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "token"
+	f.create(tunnel)
+
+	target := ProvisionTarget{Provider: "fake"}
+	if err := f.controller.syncProvisionJob(tunnel, target); err != nil {
+		t.Fatalf("error syncing job: %s", err.Error())
+	}
+
+	// The Job created the exit-node, but its ID was lost
+	res, err := f.provisioner.Provision(provision.BasicHost{Name: "app", Tags: getManagedTags(tunnel)})
+	if err != nil {
+		t.Fatalf("error provisioning host: %s", err.Error())
+	}
+	name := "inlets-create-" + string(tunnel.UID)
+	f.finishJob(name, "", false)
+
+	if err := f.controller.syncProvisionJob(tunnel, target); err == nil {
+		t.Fatalf("want an error for the job without a termination message")
+	}
+
+	if err := f.controller.syncProvisionJob(tunnel, target); err != nil {
+		t.Fatalf("error syncing job: %s", err.Error())
+	}
+	if got := f.get("app"); got.Status.HostID != res.ID {
+		t.Errorf("want exit-node %s to be adopted, got %q", res.ID, got.Status.HostID)
+	}
+	if _, err := f.kubeclient.BatchV1().Jobs("inlets").Get(name, metav1.GetOptions{}); err == nil {
+		t.Errorf("want no second job to be created")
+	}
+}
+
+func TestDeleteHostWithJob(t *testing.T) {
+	f := newFixture(t, jobExecutor)
+	tunnel := newActiveTunnel("app")
+
+	for i := 0; i < 2; i++ {
+		if err := f.controller.deleteHost(tunnel, "test"); err != nil {
+			t.Fatalf("error deleting host: %s", err.Error())
+		}
+	}
+
+	jobs, err := f.kubeclient.BatchV1().Jobs("inlets").List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("error listing jobs: %s", err.Error())
+	}
+	if len(jobs.Items) != 1 {
+		t.Fatalf("want one job to delete the exit-node, got %d", len(jobs.Items))
+	}
+
+	job := jobs.Items[0]
+	if job.Name != "inlets-delete-fake-app" {
+		t.Errorf("want the job to be named after the exit-node, got %q", job.Name)
+	}
+	wantArgs := []string{"delete", "--provider=fake", "--id=fake-app"}
+	if got := job.Spec.Template.Spec.Containers[0].Args; strings.Join(got, " ") != strings.Join(wantArgs, " ") {
+		t.Errorf("want args %v, got %v", wantArgs, got)
+	}
+	if job.Spec.TTLSecondsAfterFinished == nil || *job.Spec.TTLSecondsAfterFinished != finishedJobTTL {
+		t.Errorf("want the finished job to be kept for %ds", finishedJobTTL)
+	}
+	if f.provisioner.Calls("Delete") != 0 {
+		t.Errorf("want the exit-node to be deleted by the job, not the operator")
+	}
+}
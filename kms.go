@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyEncrypter wraps and unwraps the data keys which encrypt the values of
+// the Secrets written by the operator, with a key which never leaves a KMS.
+type keyEncrypter interface {
+	WrapKey(key []byte) ([]byte, error)
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// secretReader reads the value of a secret in a KMS from its URL.
+type secretReader interface {
+	GetSecret(secretURL string) (string, error)
+}
+
+// sealedValue is a value of a Secret encrypted with AES-GCM, along with its
+// data key wrapped by the KMS key.
+type sealedValue struct {
+	Key        []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// newKeyEncrypter returns the KMS key to wrap data keys with, from its URL.
+// Only Azure Key Vault keys are supported, i.e.
+// "https://my-vault.vault.azure.net/keys/inlets-operator".
+func newKeyEncrypter(keyURL string) (keyEncrypter, error) {
+	parsed, err := url.Parse(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "https" || !strings.HasSuffix(parsed.Host, ".vault.azure.net") ||
+		!strings.HasPrefix(parsed.Path, "/keys/") {
+		return nil, fmt.Errorf("kms-key must be the URL of an Azure Key Vault key, i.e. https://my-vault.vault.azure.net/keys/inlets-operator, not %q", keyURL)
+	}
+
+	return newAzureKeyVault(strings.TrimSuffix(keyURL, "/")), nil
+}
+
+// newAzureKeyVault returns a client of Azure Key Vault with the identity of
+// the operator, which wraps data keys with the key at keyURL when it is set.
+func newAzureKeyVault(keyURL string) *azureKeyVault {
+	return &azureKeyVault{
+		keyURL:    keyURL,
+		clientID:  os.Getenv("AZURE_CLIENT_ID"),
+		federated: getAzureFederatedIdentity(),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		keys:      map[string][]byte{},
+	}
+}
+
+// parseKeyVaultSecretURL checks that a URL is of an Azure Key Vault secret,
+// with an optional version, i.e.
+// "https://my-vault.vault.azure.net/secrets/inlets-token".
+func parseKeyVaultSecretURL(secretURL string) error {
+	parsed, err := url.Parse(secretURL)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if parsed.Scheme != "https" || !strings.HasSuffix(parsed.Host, ".vault.azure.net") ||
+		len(parts) < 2 || len(parts) > 3 || parts[0] != "secrets" || len(parsed.RawQuery) > 0 {
+		return fmt.Errorf("keyVaultSecret must be the URL of an Azure Key Vault secret, i.e. https://my-vault.vault.azure.net/secrets/inlets-token, not %q", secretURL)
+	}
+	return nil
+}
+
+// sealSecretData encrypts the values of a Secret with a new data key when
+// --kms-key is set, so that tokens are not stored in etcd as plaintext.
+func (c *Controller) sealSecretData(data map[string][]byte) error {
+	kms := c.infra().KeyEncrypter
+	if kms == nil || len(data) == 0 {
+		return nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	wrapped, err := kms.WrapKey(key)
+	if err != nil {
+		return fmt.Errorf("error wrapping data key: %s", err.Error())
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range data {
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+
+		sealed, err := json.Marshal(sealedValue{
+			Key:        wrapped,
+			Nonce:      nonce,
+			Ciphertext: gcm.Seal(nil, nonce, value, []byte(name)),
+		})
+		if err != nil {
+			return err
+		}
+		data[name] = sealed
+	}
+	return nil
+}
+
+// openSecretValue decrypts a value of a Secret which was sealed, or returns
+// it as it is when it was written before --kms-key was set.
+func (c *Controller) openSecretValue(name string, value []byte) ([]byte, error) {
+	sealed := sealedValue{}
+	if err := json.Unmarshal(value, &sealed); err != nil || len(sealed.Ciphertext) == 0 {
+		return value, nil
+	}
+
+	kms := c.infra().KeyEncrypter
+	if kms == nil {
+		return nil, fmt.Errorf("%s is encrypted with a KMS key, set --kms-key to read it", name)
+	}
+
+	key, err := kms.UnwrapKey(sealed.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key of %s: %s", name, err.Error())
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open panics on a nonce of the wrong size
+	if len(sealed.Nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("%s has a nonce of %d bytes, not %d", name, len(sealed.Nonce), gcm.NonceSize())
+	}
+	return gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, []byte(name))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+const (
+	// tokenRefreshWindow is how long before it expires that the access
+	// token for Key Vault is renewed in the background, whilst calls carry
+	// on with the current one.
+	tokenRefreshWindow = 10 * time.Minute
+
+	// tokenExpiryMargin is how long a token must have left to be used, so
+	// that it doesn't expire part way through a call.
+	tokenExpiryMargin = time.Minute
+
+	tokenRetryInterval = 30 * time.Second
+
+	// maxCachedKeys bounds the cache of unwrapped data keys, since each
+	// write of a Secret wraps a new one.
+	maxCachedKeys = 128
+)
+
+// azureKeyVault wraps data keys with an RSA key in Azure Key Vault, with
+// the managed identity of the node or the one given by AZURE_CLIENT_ID, or
+// with workload identity federation when AZURE_FEDERATED_TOKEN_FILE is set.
+// Up to maxCachedKeys unwrapped keys are cached, since every value of a
+// Secret shares the same data key.
+type azureKeyVault struct {
+	keyURL    string
+	clientID  string
+	federated *azureFederatedIdentity
+	client    *http.Client
+
+	lock        sync.Mutex
+	accessToken string
+	expires     time.Time
+	keys        map[string][]byte
+
+	// refreshLock is held whilst a token is fetched, so that a burst of
+	// calls waits for one fetch rather than each making its own.
+	refreshLock sync.Mutex
+}
+
+type keyOperation struct {
+	Algorithm string `json:"alg,omitempty"`
+	Value     string `json:"value"`
+}
+
+func (v *azureKeyVault) WrapKey(key []byte) ([]byte, error) {
+	wrapped, err := v.keyOperation("wrapkey", key)
+	if err != nil {
+		return nil, err
+	}
+
+	v.cacheKey(wrapped, key)
+	return wrapped, nil
+}
+
+func (v *azureKeyVault) UnwrapKey(wrapped []byte) ([]byte, error) {
+	v.lock.Lock()
+	key, ok := v.keys[string(wrapped)]
+	v.lock.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := v.keyOperation("unwrapkey", wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	v.cacheKey(wrapped, key)
+	return key, nil
+}
+
+// cacheKey caches an unwrapped data key, evicting another when the cache
+// is full. The keys of Secrets which were overwritten are never read
+// again, so which one is evicted hardly matters.
+func (v *azureKeyVault) cacheKey(wrapped, key []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if _, ok := v.keys[string(wrapped)]; !ok && len(v.keys) >= maxCachedKeys {
+		for cached := range v.keys {
+			delete(v.keys, cached)
+			break
+		}
+	}
+	v.keys[string(wrapped)] = key
+}
+
+// keyOperation runs the wrapkey or unwrapkey operation of the key.
+func (v *azureKeyVault) keyOperation(operation string, value []byte) ([]byte, error) {
+	token, err := v.getAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(keyOperation{
+		Algorithm: "RSA-OAEP-256",
+		Value:     base64.RawURLEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, v.keyURL+"/"+operation+"?api-version=7.0", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key vault returned %d for %s", res.StatusCode, operation)
+	}
+
+	result := keyOperation{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(result.Value)
+}
+
+// GetSecret reads the value of an Azure Key Vault secret from its URL.
+func (v *azureKeyVault) GetSecret(secretURL string) (string, error) {
+	if err := parseKeyVaultSecretURL(secretURL); err != nil {
+		return "", err
+	}
+
+	token, err := v.getAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(secretURL, "/")+"?api-version=7.0", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("key vault returned %d for secret %s", res.StatusCode, secretURL)
+	}
+
+	result := struct {
+		Value string `json:"value"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	return result.Value, nil
+}
+
+// getAccessToken returns the cached token for Key Vault. A token within
+// tokenRefreshWindow of expiring is still returned whilst it is renewed in
+// the background, and only a token which has all but expired is waited for.
+func (v *azureKeyVault) getAccessToken() (string, error) {
+	v.lock.Lock()
+	token, expires := v.accessToken, v.expires
+	v.lock.Unlock()
+
+	now := time.Now()
+	if len(token) > 0 && now.Add(tokenExpiryMargin).Before(expires) {
+		if !now.Add(tokenRefreshWindow).Before(expires) {
+			go v.refreshAccessToken()
+		}
+		return token, nil
+	}
+	return v.refreshAccessToken()
+}
+
+// refreshAccessToken fetches a new token, unless another call renewed it
+// whilst this one waited.
+func (v *azureKeyVault) refreshAccessToken() (string, error) {
+	v.refreshLock.Lock()
+	defer v.refreshLock.Unlock()
+
+	v.lock.Lock()
+	token, expires := v.accessToken, v.expires
+	v.lock.Unlock()
+	if len(token) > 0 && time.Now().Add(tokenRefreshWindow).Before(expires) {
+		return token, nil
+	}
+
+	token, expires, err := v.fetchAccessToken()
+	if err != nil {
+		return "", err
+	}
+
+	v.lock.Lock()
+	v.accessToken, v.expires = token, expires
+	v.lock.Unlock()
+	return token, nil
+}
+
+// keepAccessTokenFresh renews the token before it enters tokenRefreshWindow
+// until stopCh is closed, so that calls after an idle period don't wait for
+// a token.
+func (v *azureKeyVault) keepAccessTokenFresh(stopCh <-chan struct{}) {
+	for {
+		wait := tokenRetryInterval
+		if _, err := v.refreshAccessToken(); err != nil {
+			logWith("key", v.keyURL).Error(err, "Error renewing the access token for Key Vault")
+		} else {
+			v.lock.Lock()
+			wait = time.Until(v.expires.Add(-tokenRefreshWindow)) + time.Second
+			v.lock.Unlock()
+			if wait < tokenRetryInterval {
+				wait = tokenRetryInterval
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// fetchAccessToken gets a token for Key Vault from the instance metadata
+// service, or from a federated token.
+func (v *azureKeyVault) fetchAccessToken() (string, time.Time, error) {
+	if v.federated != nil {
+		return v.federated.getAccessToken(v.client, "https://vault.azure.net/.default")
+	}
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", "https://vault.azure.net")
+	if len(v.clientID) > 0 {
+		query.Set("client_id", v.clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("instance metadata service returned %d for a Key Vault token", res.StatusCode)
+	}
+
+	result := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresOn, err := strconv.ParseInt(result.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return result.AccessToken, time.Unix(expiresOn, 0), nil
+}
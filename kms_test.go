@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeKMS wraps data keys by reversing them.
+type fakeKMS struct{}
+
+func reverse(value []byte) []byte {
+	reversed := make([]byte, len(value))
+	for i, b := range value {
+		reversed[len(value)-1-i] = b
+	}
+	return reversed
+}
+
+func (k *fakeKMS) WrapKey(key []byte) ([]byte, error) {
+	return reverse(key), nil
+}
+
+func (k *fakeKMS) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return reverse(wrapped), nil
+}
+
+func TestSealSecretData(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.KeyEncrypter = &fakeKMS{} })
+
+	data := map[string][]byte{"first": []byte("token-1"), "second": []byte("token-2")}
+	if err := f.controller.sealSecretData(data); err != nil {
+		t.Fatalf("error sealing: %s", err.Error())
+	}
+
+	for name, want := range map[string]string{"first": "token-1", "second": "token-2"} {
+		if bytes.Contains(data[name], []byte(want)) {
+			t.Errorf("want %s to be sealed, got %s", name, string(data[name]))
+		}
+
+		got, err := f.controller.openSecretValue(name, data[name])
+		if err != nil {
+			t.Fatalf("error opening %s: %s", name, err.Error())
+		}
+		if string(got) != want {
+			t.Errorf("want %s to open to %q, got %q", name, want, string(got))
+		}
+	}
+
+	// A sealed value can't be moved to another key of the Secret
+	if _, err := f.controller.openSecretValue("second", data["first"]); err == nil {
+		t.Errorf("want an error for a value opened under another name")
+	}
+}
+
+func TestOpenSecretValue(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.KeyEncrypter = &fakeKMS{} })
+
+	// Values written before --kms-key was set are read as they are
+	if got, err := f.controller.openSecretValue("first", []byte("token-1")); err != nil || string(got) != "token-1" {
+		t.Errorf("want a plaintext value as it is, got %q %v", string(got), err)
+	}
+
+	data := map[string][]byte{"first": []byte("token-1")}
+	if err := f.controller.sealSecretData(data); err != nil {
+		t.Fatalf("error sealing: %s", err.Error())
+	}
+
+	for _, size := range []int{0, 4, 16} {
+		sealed := sealedValue{}
+		if err := json.Unmarshal(data["first"], &sealed); err != nil {
+			t.Fatalf("error reading sealed value: %s", err.Error())
+		}
+		sealed.Nonce = make([]byte, size)
+		tampered, _ := json.Marshal(sealed)
+
+		if _, err := f.controller.openSecretValue("first", tampered); err == nil {
+			t.Errorf("want an error for a nonce of %d bytes", size)
+		}
+	}
+
+	f.controller.infra().KeyEncrypter = nil
+	if _, err := f.controller.openSecretValue("first", data["first"]); err == nil {
+		t.Errorf("want an error for a sealed value without --kms-key")
+	}
+}
+
+func TestAzureKeyVaultCachesBoundedKeys(t *testing.T) {
+	vault := &azureKeyVault{keys: map[string][]byte{}}
+
+	for i := 0; i < 2*maxCachedKeys; i++ {
+		vault.cacheKey([]byte(fmt.Sprintf("wrapped-%d", i)), []byte("key"))
+	}
+	if len(vault.keys) != maxCachedKeys {
+		t.Errorf("want %d keys to be cached, got %d", maxCachedKeys, len(vault.keys))
+	}
+
+	last := []byte(fmt.Sprintf("wrapped-%d", 2*maxCachedKeys-1))
+	if key, err := vault.UnwrapKey(last); err != nil || string(key) != "key" {
+		t.Errorf("want the last key to be cached, got %q %v", string(key), err)
+	}
+}
+
+// roundTripFunc answers the requests of an http.Client without a server.
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestAzureKeyVaultGetSecret(t *testing.T) {
+	vault := newAzureKeyVault("")
+	vault.accessToken = "access-token"
+	vault.expires = time.Now().Add(time.Hour)
+	vault.client = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		status, body := http.StatusNotFound, `{}`
+		if req.URL.Path == "/secrets/inlets-token" && req.URL.Query().Get("api-version") == "7.0" &&
+			req.Header.Get("Authorization") == "Bearer access-token" {
+			status, body = http.StatusOK, `{"value":"the-token"}`
+		}
+		return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	})}
+
+	token, err := vault.GetSecret("https://my-vault.vault.azure.net/secrets/inlets-token")
+	if err != nil || token != "the-token" {
+		t.Errorf("want the value of the secret, got %q %v", token, err)
+	}
+
+	if _, err := vault.GetSecret("https://my-vault.vault.azure.net/secrets/other"); err == nil {
+		t.Errorf("want an error for a secret which Key Vault didn't return")
+	}
+
+	// The access token for Key Vault is only sent to Key Vault
+	if _, err := vault.GetSecret("https://example.com/secrets/inlets-token"); err == nil {
+		t.Errorf("want an error for a URL which isn't of Key Vault")
+	}
+}
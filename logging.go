@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// The levels of a log line, in order of severity.
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("log-level must be one of %s, not %q", strings.Join(levelNames, ", "), name)
+}
+
+// logger writes leveled log lines with fields, as logfmt text or JSON, since
+// no structured logging library is vendored. The log package and klog are
+// written through it too, so that every line of the operator has the same
+// format.
+type logger struct {
+	lock   sync.Mutex
+	out    io.Writer
+	level  int
+	format string
+}
+
+// operatorLog is the logger of the operator, which is set up from
+// --log-level and --log-format.
+var operatorLog = &logger{out: os.Stderr, level: levelInfo, format: "text"}
+
+// setupLogging sets the level and format of operatorLog, and sends the lines
+// of the log package and klog to it.
+func setupLogging(level, format string) error {
+	parsed, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("log-format must be text or json, not %q", format)
+	}
+
+	operatorLog.lock.Lock()
+	operatorLog.level = parsed
+	operatorLog.format = format
+	operatorLog.lock.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(&stdlogBridge{})
+
+	// klog writes every line to its INFO output, whatever its severity,
+	// so the other outputs are discarded and only fatal lines, which exit,
+	// are also written to stderr.
+	klogFlags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(klogFlags)
+	klogFlags.Set("logtostderr", "false")
+	klogFlags.Set("stderrthreshold", "FATAL")
+	klog.SetOutputBySeverity("INFO", &klogBridge{})
+	for _, severity := range []string{"WARNING", "ERROR", "FATAL"} {
+		klog.SetOutputBySeverity(severity, ioutil.Discard)
+	}
+	return nil
+}
+
+// logEntry is a set of fields which are written with each line, such as the
+// tunnel which the line is about.
+type logEntry struct {
+	fields []interface{}
+}
+
+// logWith returns an entry with fields given as pairs of keys and values.
+func logWith(keysAndValues ...interface{}) logEntry {
+	return logEntry{}.With(keysAndValues...)
+}
+
+// With returns a copy of the entry with more fields.
+func (e logEntry) With(keysAndValues ...interface{}) logEntry {
+	fields := make([]interface{}, 0, len(e.fields)+len(keysAndValues))
+	fields = append(fields, e.fields...)
+	return logEntry{fields: append(fields, keysAndValues...)}
+}
+
+func (e logEntry) Debug(msg string, keysAndValues ...interface{}) {
+	operatorLog.write(levelDebug, msg, append(e.fields, keysAndValues...))
+}
+
+func (e logEntry) Info(msg string, keysAndValues ...interface{}) {
+	operatorLog.write(levelInfo, msg, append(e.fields, keysAndValues...))
+}
+
+func (e logEntry) Warn(msg string, keysAndValues ...interface{}) {
+	operatorLog.write(levelWarn, msg, append(e.fields, keysAndValues...))
+}
+
+// Error writes a line at the error level with the error as the "error"
+// field.
+func (e logEntry) Error(err error, msg string, keysAndValues ...interface{}) {
+	fields := append(e.fields, keysAndValues...)
+	if err != nil {
+		fields = append(fields, "error", err.Error())
+	}
+	operatorLog.write(levelError, msg, fields)
+}
+
+// tunnelLog returns an entry with the fields of a tunnel: its name,
+// namespace, provider and the ID of its exit-node.
+func (c *Controller) tunnelLog(tunnel *inletsv1alpha1.Tunnel) logEntry {
+	entry := logWith("tunnel", tunnel.Name, "namespace", tunnel.Namespace, "provider", c.getTunnelProvider(tunnel))
+	if len(tunnel.Status.HostID) > 0 {
+		entry = entry.With("hostID", tunnel.Status.HostID)
+	}
+	return entry
+}
+
+func (l *logger) write(level int, msg string, keysAndValues []interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	fields := map[string]interface{}{}
+	keys := []string{}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprintf("%v", keysAndValues[i])
+		var value interface{} = "(missing)"
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if _, ok := fields[key]; !ok {
+			keys = append(keys, key)
+		}
+		fields[key] = value
+	}
+	sort.Strings(keys)
+
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	msg = strings.TrimRight(msg, "\n")
+
+	buf := bytes.Buffer{}
+	if l.format == "json" {
+		line := map[string]interface{}{}
+		for key, value := range fields {
+			line[key] = value
+		}
+		line["ts"] = now
+		line["level"] = levelNames[level]
+		line["msg"] = msg
+		body, err := json.Marshal(line)
+		if err != nil {
+			body, _ = json.Marshal(map[string]string{"ts": now, "level": levelNames[level], "msg": msg})
+		}
+		buf.Write(body)
+	} else {
+		fmt.Fprintf(&buf, "ts=%s level=%s msg=%s", now, levelNames[level], logfmtValue(msg))
+		for _, key := range keys {
+			fmt.Fprintf(&buf, " %s=%s", key, logfmtValue(fmt.Sprintf("%v", fields[key])))
+		}
+	}
+	buf.WriteByte('\n')
+	l.out.Write(buf.Bytes())
+}
+
+// logfmtValue quotes a value of a logfmt line when it has spaces, quotes or
+// an equals sign.
+func logfmtValue(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " \t\r\n\"=") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
+
+// stdlogBridge writes the lines of the log package through operatorLog,
+// where lines which start with "Error" are at the error level.
+type stdlogBridge struct{}
+
+func (b *stdlogBridge) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	level := levelInfo
+	if strings.HasPrefix(msg, "Error") {
+		level = levelError
+	}
+	operatorLog.write(level, msg, nil)
+	return len(p), nil
+}
+
+// klogBridge writes the lines of klog through operatorLog, with the level
+// taken from the first letter of the header of the line, i.e.
+// "I0102 15:04:05.000000 1 controller.go:100] msg".
+type klogBridge struct{}
+
+func (b *klogBridge) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+
+	level := levelInfo
+	if len(line) > 0 {
+		switch line[0] {
+		case 'W':
+			level = levelWarn
+		case 'E', 'F':
+			level = levelError
+		}
+	}
+
+	var fields []interface{}
+	if i := strings.Index(line, "] "); i > 0 {
+		header := strings.Fields(line[:i])
+		if len(header) > 0 {
+			fields = append(fields, "caller", header[len(header)-1])
+		}
+		line = line[i+2:]
+	}
+
+	operatorLog.write(level, line, fields)
+	return len(p), nil
+}
@@ -17,12 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"crypto/ecdsa"
 	"flag"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"strings"
 	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
@@ -33,6 +36,7 @@ import (
 
 	clientset "github.com/alexellis/inlets-operator/pkg/generated/clientset/versioned"
 	informers "github.com/alexellis/inlets-operator/pkg/generated/informers/externalversions"
+	"github.com/alexellis/inlets-operator/pkg/provision"
 	"github.com/alexellis/inlets-operator/pkg/signals"
 )
 
@@ -50,6 +54,334 @@ type InfraConfig struct {
 	AccessKeyFile     string
 	ProjectID         string
 	InletsClientImage string
+
+	ProClientImage string
+	License        string
+	LicenseFile    string
+
+	// Executor is "inline" to provision and delete exit-nodes from the
+	// operator, or "job" to run inlets-provision in a Job for each one
+	Executor           string
+	ProvisionerImage   string
+	JobNamespace       string
+	JobAccessKeySecret string
+
+	HealthCheckInterval time.Duration
+	HealthCheckFailures int
+
+	// ClientDisconnectTimeout is how long a client may be disconnected
+	// before it is restarted, and twice that before its exit-node is replaced
+	ClientDisconnectTimeout time.Duration
+
+	DriftCheckInterval time.Duration
+	RepairDrift        bool
+
+	// OrphanCheckInterval is how often the exit-nodes tagged by the
+	// operator are listed to find those it has no record of, which are
+	// deleted with DeleteOrphans.
+	OrphanCheckInterval time.Duration
+	DeleteOrphans       bool
+
+	// ReadySLO is the time within which exit-nodes should become ready,
+	// and ReadySLOTarget the fraction of them which should
+	ReadySLO       time.Duration
+	ReadySLOTarget float64
+
+	// UsageInterval is how often the usage of exit-nodes is read from the
+	// monitoring API of their provider, and the window it is averaged over.
+	UsageInterval time.Duration
+
+	// ReplacementStrategy is "bluegreen" to provision a new exit-node before
+	// deleting the old one when rotating or repairing drift, or "recreate"
+	ReplacementStrategy string
+
+	MaxExitNodes    int
+	MaxMonthlySpend float64
+
+	// Failover is tried in order when there is no capacity with the
+	// Provider and Region
+	Failover               []ProvisionTarget
+	FailoverAccessKeyFiles map[string]string
+
+	// ProviderPlugins are the paths of the plugins of providers, which
+	// are started to provision their exit-nodes
+	ProviderPlugins map[string]string
+
+	// ReleaseChecksums are the SHA256 checksums of the releases which
+	// exit-nodes download, by name, which they are verified with. A tunnel
+	// whose exit-node needs a release with no checksum isn't provisioned.
+	ReleaseChecksums map[string]string
+
+	// DeniedNamespaces are the namespaces which tunnels are never
+	// provisioned for
+	DeniedNamespaces map[string]bool
+
+	// ServiceSelector limits the Services which get a tunnel to those
+	// with matching labels
+	ServiceSelector labels.Selector
+
+	// TagLabels maps the labels and annotations of Tunnels and Services
+	// to the tags of their exit-nodes
+	TagLabels map[string]string
+
+	// TagSyncInterval is how often the tags of active exit-nodes are
+	// brought in line with the labels of their Tunnels and Services
+	TagSyncInterval time.Duration
+
+	// Shards splits Tunnels and Services between instances of the operator
+	// by the hash of their namespace, or of the value of ShardLabel
+	Shards              int
+	ShardLabel          string
+	ShardLeaseNamespace string
+	ShardIdentity       string
+
+	// DeletionTTL is how long the exit-node of a deleted Tunnel is kept, so
+	// that a Tunnel created again with the same name takes it over
+	DeletionTTL       time.Duration
+	RetainedNamespace string
+
+	// ScaleToZeroAfter is how long the Service of a tunnel may have no
+	// ready endpoints before its exit-node is deprovisioned
+	ScaleToZeroAfter time.Duration
+
+	// WaitForEndpoints defers provisioning until the Service of a tunnel
+	// has a ready endpoint
+	WaitForEndpoints bool
+
+	// TokenLength is the number of random bytes in generated tokens
+	TokenLength int
+
+	// ClientNetworkPolicy limits the egress of client Pods with a
+	// NetworkPolicy for each tunnel
+	ClientNetworkPolicy bool
+
+	// SSHKeys authorizes an SSH key for each exit-node, which is stored in
+	// a Secret for its Tunnel
+	SSHKeys bool
+
+	// SSHKeyMaxAge is how old an SSH key may get before it is rotated, 0
+	// to only rotate it on request
+	SSHKeyMaxAge time.Duration
+
+	// ControlPlaneTLS has the exit-nodes of new inlets-pro tunnels serve
+	// their control-port with certificates generated by the operator
+	ControlPlaneTLS bool
+
+	// ControlPlaneSources are the only sources which may connect to the
+	// control-port of exit-nodes, or "auto" to detect the egress IP of the
+	// cluster
+	ControlPlaneSources []string
+
+	// ClientSecurityContext is restricted to harden the client Pods so that
+	// they pass the restricted Pod Security Standard, or none
+	ClientSecurityContext string
+
+	// KeyEncrypter wraps the data keys which encrypt the Secrets written by
+	// the operator, when --kms-key is set
+	KeyEncrypter keyEncrypter
+
+	// KeyVaultSecrets reads the tokens of Tunnels with
+	// authTokenFrom.keyVaultSecret.
+	KeyVaultSecrets secretReader
+
+	// CosignKey verifies the signatures of the images of the client and of
+	// inlets-provision, when --cosign-key is set
+	CosignKey *ecdsa.PublicKey
+
+	// VaultCredentials reads the access keys of providers from Vault, when
+	// --vault-credentials is set
+	VaultCredentials *vaultCredentials
+
+	// AuditLog records each action on a cloud resource when --audit-log is
+	// set
+	AuditLog *auditLog
+
+	// ServiceAccountIssuer and ServiceAccountJWKSURL override the issuer of
+	// ServiceAccount tokens and the URL of its keys, which are otherwise
+	// discovered from the API server
+	ServiceAccountIssuer  string
+	ServiceAccountJWKSURL string
+
+	// WebhookPort is the port which the webhook is served on, which /readyz
+	// checks, or 0 when it is not served
+	WebhookPort int
+
+	// Proxy is the HTTP proxy for calls to the APIs of providers, which is
+	// also given to the clients and Jobs
+	Proxy egressProxy
+
+	// ProviderClient is the User-Agent and retries of the clients of the
+	// APIs of providers
+	ProviderClient provision.ClientOptions
+
+	// Faults are injected into the calls to providers by the --fault-*
+	// flags, to test how the operator copes with failures
+	Faults provision.Faults
+
+	// Tracer sends spans of each sync to an OpenTelemetry collector, when
+	// --otlp-endpoint is set
+	Tracer *tracer
+
+	// Notifier sends a signed notification to a hook when a token or
+	// credential is rotated or fails validation, when --notify-url is set
+	Notifier *notifier
+
+	// AuditEvents also records each action on a cloud resource as an Event
+	// on its Tunnel
+	AuditEvents bool
+
+	// WarmPool is the number of exit-nodes to keep ready for each target,
+	// which HTTP tunnels claim instead of waiting for one to be provisioned
+	WarmPool map[ProvisionTarget]int
+
+	// DrainTimeout is how long to wait for exit-nodes being provisioned or
+	// deleted when shutting down
+	DrainTimeout time.Duration
+
+	// ResyncInterval is how often every Tunnel and Service is synced again
+	ResyncInterval time.Duration
+	// ProvisionPollIntervals is how often the status of exit-nodes is polled
+	// whilst they are provisioning, per provider, with the default under ""
+	ProvisionPollIntervals map[string]time.Duration
+
+	// ProvisionPollMaxInterval is the longest that the status of an
+	// exit-node which is slow to provision is left without being polled
+	ProvisionPollMaxInterval time.Duration
+
+	// ProviderConcurrency bounds the calls to provision or delete hosts
+	// which are made to each provider at once, with the default under ""
+	ProviderConcurrency map[string]int
+}
+
+// ProvisionTarget is a provider and region to provision exit-nodes into
+type ProvisionTarget struct {
+	Provider string
+	Region   string
+}
+
+func (t ProvisionTarget) String() string {
+	if len(t.Region) == 0 {
+		return t.Provider
+	}
+	return t.Provider + ":" + t.Region
+}
+
+// GetTargets returns the provider and region, followed by the failover targets
+func (i *InfraConfig) GetTargets() []ProvisionTarget {
+	targets := []ProvisionTarget{{Provider: i.Provider, Region: i.Region}}
+	return append(targets, i.Failover...)
+}
+
+// GetAccessKeyFor returns the access key for a provider, the failover access
+// key files are used for any provider other than the main provider
+func (i *InfraConfig) GetAccessKeyFor(provider string) string {
+	if provider == i.Provider {
+		return i.GetAccessKey()
+	}
+
+	if file, ok := i.FailoverAccessKeyFiles[provider]; ok {
+		data, err := ioutil.ReadFile(file)
+
+		if err != nil {
+			logWith("provider", provider, "file", file).Error(err, "Error reading access key file")
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	return ""
+}
+
+// GetProvisionPollInterval returns how often to poll the status of an
+// exit-node of a provider whilst it is provisioning
+func (i *InfraConfig) GetProvisionPollInterval(provider string) time.Duration {
+	if interval, ok := i.ProvisionPollIntervals[provider]; ok {
+		return interval
+	}
+	if interval, ok := i.ProvisionPollIntervals[""]; ok {
+		return interval
+	}
+	return 10 * time.Second
+}
+
+// parseFailover parses a list of targets such as "digitalocean:nyc1,packet"
+func parseFailover(value string) []ProvisionTarget {
+	targets := []ProvisionTarget{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		target := ProvisionTarget{Provider: entry}
+		if index := strings.Index(entry, ":"); index > -1 {
+			target.Provider = entry[:index]
+			target.Region = entry[index+1:]
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// parseAccessKeyFiles parses a list of files per provider such as
+// "packet=/var/secrets/packet-access-key"
+func parseAccessKeyFiles(value string) map[string]string {
+	files := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) == 2 {
+			files[parts[0]] = parts[1]
+		}
+	}
+	return files
+}
+
+// parseTagLabels parses a list of labels to copy into tags, with an
+// optional name for the tag, such as "team,example.com/cost-center=costcenter"
+func parseTagLabels(value string) map[string]string {
+	tagLabels := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 {
+			tagLabels[parts[0]] = parts[1]
+		} else {
+			tagLabels[entry] = entry
+		}
+	}
+	return tagLabels
+}
+
+// parsePollIntervals parses a default interval and intervals per provider
+// such as "10s,packet=30s"
+func parsePollIntervals(value string) (map[string]time.Duration, error) {
+	intervals := map[string]time.Duration{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		provider := ""
+		if index := strings.Index(entry, "="); index > -1 {
+			provider = entry[:index]
+			entry = entry[index+1:]
+		}
+
+		interval, err := time.ParseDuration(entry)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, fmt.Errorf("poll interval must be greater than 0, not %q", entry)
+		}
+		intervals[provider] = interval
+	}
+	return intervals, nil
 }
 
 // GetInletsClientImage returns the image for the client-side tunnel
@@ -60,13 +392,45 @@ func (i *InfraConfig) GetInletsClientImage() string {
 	return i.InletsClientImage
 }
 
+// GetProClientImage returns the image for the client-side of an inlets-pro tunnel
+func (i *InfraConfig) GetProClientImage() string {
+	if i.ProClientImage == "" {
+		return "inlets/inlets-pro:0.5.1"
+	}
+	return i.ProClientImage
+}
+
+// GetProvisionerImage returns the image for the Jobs which provision exit-nodes
+func (i *InfraConfig) GetProvisionerImage() string {
+	if i.ProvisionerImage == "" {
+		return "alexellis/inlets-provision:latest"
+	}
+	return i.ProvisionerImage
+}
+
+// GetLicense returns the inlets-pro license from parameter or file
+func (i *InfraConfig) GetLicense() string {
+	if len(i.LicenseFile) > 0 {
+		data, err := ioutil.ReadFile(i.LicenseFile)
+
+		if err != nil {
+			logWith("file", i.LicenseFile).Error(err, "Error reading license file")
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	return i.License
+}
+
 // GetAccessKey from parameter or file
 func (i *InfraConfig) GetAccessKey() string {
 	if len(i.AccessKeyFile) > 0 {
 		data, err := ioutil.ReadFile(i.AccessKeyFile)
 
 		if err != nil {
-			log.Fatalln(err)
+			logWith("file", i.AccessKeyFile).Error(err, "Error reading access key file")
+			return ""
 		}
 		return string(data)
 	}
@@ -76,18 +440,332 @@ func (i *InfraConfig) GetAccessKey() string {
 
 func main() {
 	infra := &InfraConfig{}
-	flag.StringVar(&infra.Provider, "provider", "packet", "Your infrastructure provider - 'packet' or 'digitalocean'")
+	flag.StringVar(&infra.Provider, "provider", "packet", "Your infrastructure provider - 'packet', 'digitalocean' or 'fake'")
 	flag.StringVar(&infra.Region, "region", "", "The region to provision hosts into")
 	flag.StringVar(&infra.AccessKey, "access-key", "", "The access key for your infrastructure provider")
 	flag.StringVar(&infra.AccessKeyFile, "access-key-file", "", "Read the access key for your infrastructure provider from a file (recommended)")
 
 	flag.StringVar(&infra.ProjectID, "project-id", "", "The project ID if using Packet.com as the provider")
+	flag.StringVar(&infra.License, "license", "", "The license for inlets-pro, required for TCP and UDP tunnels, TLS and the PROXY protocol")
+	flag.StringVar(&infra.LicenseFile, "license-file", "", "Read the license for inlets-pro from a file")
+
+	flag.DurationVar(&infra.HealthCheckInterval, "health-check-interval", time.Minute, "How often to check the health of exit-nodes, 0 to disable")
+	flag.IntVar(&infra.HealthCheckFailures, "health-check-failures", 3, "Consecutive failed health checks before an exit-node is replaced")
+	flag.DurationVar(&infra.ClientDisconnectTimeout, "client-disconnect-timeout", 5*time.Minute, "How long a client may be disconnected before it is restarted, and twice that before its exit-node is replaced, 0 to disable")
+
+	flag.DurationVar(&infra.DriftCheckInterval, "drift-check-interval", 10*time.Minute, "How often to compare exit-nodes with the provider for changes made outside of the operator, 0 to disable")
+	flag.DurationVar(&infra.UsageInterval, "usage-interval", 0, "How often to read the CPU, memory and network usage of exit-nodes from the monitoring API of their provider, i.e. 5m, 0 to disable")
+	flag.BoolVar(&infra.RepairDrift, "repair-drift", false, "Replace exit-nodes which were changed outside of the operator, instead of only reporting them")
+	flag.DurationVar(&infra.OrphanCheckInterval, "orphan-check-interval", 10*time.Minute, "How often to list the exit-nodes tagged by the operator for those it has no record of, 0 to disable")
+	flag.DurationVar(&infra.ReadySLO, "ready-slo", 90*time.Second, "The time within which exit-nodes should become ready, for the SLO metrics, 0 to disable them")
+	flag.Float64Var(&infra.ReadySLOTarget, "ready-slo-target", 0.99, "The fraction of exit-nodes which should become ready within --ready-slo")
+	flag.BoolVar(&infra.DeleteOrphans, "delete-orphans", false, "Delete orphaned exit-nodes, instead of only reporting them")
+	flag.StringVar(&infra.ReplacementStrategy, "replacement-strategy", "bluegreen", "Replace exit-nodes for rotation and drift with a 'bluegreen' swap, or 'recreate' to delete the old exit-node first")
+
+	flag.IntVar(&infra.MaxExitNodes, "max-exit-nodes", 0, "The maximum number of exit-nodes to provision, 0 for no limit")
+	flag.Float64Var(&infra.MaxMonthlySpend, "max-monthly-spend", 0, "The maximum estimated monthly spend on exit-nodes in USD, 0 for no limit")
+
+	var failover, failoverAccessKeyFiles string
+	flag.StringVar(&failover, "failover", "", "Providers and regions to try in order when there is no capacity, i.e. 'digitalocean:nyc1,packet:ams1'")
+	var providerPlugins string
+	flag.StringVar(&providerPlugins, "provider-plugins", "", "Plugins which provision the exit-nodes of providers, by provider, i.e. 'linode=/plugins/inlets-provisioner-linode'")
+	flag.StringVar(&failoverAccessKeyFiles, "failover-access-key-file", "", "Read the access keys of failover providers from files, i.e. 'packet=/var/secrets/packet-access-key'")
+
+	var releaseChecksums string
+	flag.StringVar(&releaseChecksums, "release-checksums", "", "The SHA256 checksums which exit-nodes verify the releases they download with, from inlets, inlets-pro, ghostunnel, caddy, caddy-jwt and oauth2-proxy, i.e. 'inlets-pro=<sha256>,ghostunnel=<sha256>'")
+
+	var webhookCertFile, webhookKeyFile string
+	flag.IntVar(&infra.WebhookPort, "webhook-port", 0, "The port to serve the webhook which injects clients as sidecars, 0 to disable")
+	flag.StringVar(&webhookCertFile, "webhook-cert-file", "", "The TLS certificate for the webhook")
+	flag.StringVar(&webhookKeyFile, "webhook-key-file", "", "The TLS key for the webhook")
+
+	var workers int
+	flag.IntVar(&workers, "workers", 2, "How many Tunnels to sync at once, which bounds the exit-nodes provisioned or deleted in parallel")
+
+	var metricsPort, healthPort, debugPort int
+	flag.IntVar(&metricsPort, "metrics-port", 0, "The port to serve Prometheus metrics on /metrics, 0 to disable")
+	flag.IntVar(&healthPort, "health-port", 0, "The port to serve /healthz and /readyz on for the probes of the operator, which are also served on --metrics-port, 0 to disable")
+	flag.IntVar(&debugPort, "debug-port", 0, "The port to serve pprof and a dump of the state of the operator on, on localhost only, 0 to disable")
+
+	flag.StringVar(&infra.Executor, "executor", "inline", "Provision and delete exit-nodes 'inline' from the operator, or with a 'job' for each one")
+	flag.StringVar(&infra.JobNamespace, "job-namespace", "default", "The namespace to run Jobs in when using the job executor")
+	flag.StringVar(&infra.JobAccessKeySecret, "job-access-key-secret", "inlets-access-key", "The Secret in the job namespace with the access key for Jobs, under a key of the same name")
+
+	flag.IntVar(&infra.Shards, "shards", 1, "The number of shards to split Tunnels and Services into, each instance of the operator holds one")
+	flag.StringVar(&infra.ShardLabel, "shard-label", "", "Shard by the value of this label instead of by namespace")
+	flag.DurationVar(&infra.DeletionTTL, "deletion-ttl", 0, "How long to keep the exit-node of a deleted Tunnel for a Tunnel of the same name to take over, 0 to delete it straight away")
+	flag.StringVar(&infra.RetainedNamespace, "retained-namespace", "default", "The namespace of the Secrets which record the exit-nodes kept by --deletion-ttl and --warm-pool")
+
+	flag.DurationVar(&infra.ScaleToZeroAfter, "scale-to-zero-after", 0, "Deprovision the exit-node of a Service which has had no ready endpoints for this long, and provision it again when they return, 0 to disable")
+
+	flag.BoolVar(&infra.WaitForEndpoints, "wait-for-endpoints", false, "Only provision an exit-node once the Service has a ready endpoint")
+
+	flag.IntVar(&infra.TokenLength, "token-length", minTokenLength, "The number of random bytes in the tokens generated for tunnels, from 32 to 64")
+
+	flag.BoolVar(&infra.ClientNetworkPolicy, "client-network-policy", false, "Create a NetworkPolicy for each client which only allows egress to its exit-node, DNS and its upstream")
+
+	flag.StringVar(&infra.ClientSecurityContext, "client-security-context", "restricted", "The security context of client Pods, restricted to run them as non-root with a read-only root filesystem, no capabilities and the default seccomp profile, or none")
+
+	flag.BoolVar(&infra.SSHKeys, "ssh-keys", false, "Generate an SSH key for each exit-node, stored in the Secret NAME-ssh of its Tunnel")
+	flag.DurationVar(&infra.SSHKeyMaxAge, "ssh-key-max-age", 0, "Rotate the SSH key of an exit-node and replace it when the key is older than this, 0 to only rotate keys on request")
+
+	flag.BoolVar(&infra.ControlPlaneTLS, "control-plane-tls", true, "Serve the control-port of the exit-nodes of new inlets-pro tunnels with a certificate from a CA generated for each tunnel, which the client validates")
+
+	var controlPlaneSources string
+	flag.StringVar(&controlPlaneSources, "control-plane-sources", "", "Only let these IPs or CIDRs connect to the control-port of exit-nodes, comma-separated, or 'auto' to detect the public IP which the cluster connects from")
+
+	var auditLogPath string
+	flag.StringVar(&auditLogPath, "audit-log", "", "Append a JSON record of each exit-node provisioned or deleted to this file, or to stdout for '-'")
+	flag.BoolVar(&infra.AuditEvents, "audit-events", false, "Record each exit-node provisioned or deleted as an Event on its Tunnel")
+
+	flag.StringVar(&infra.ProviderClient.UserAgent, "provider-user-agent", "inlets-operator", "Added to the User-Agent of requests to the APIs of providers, empty to send that of their SDK alone")
+	flag.IntVar(&infra.ProviderClient.Retries, "provider-retries", 2, "How many times to retry a read from the API of a provider which failed to connect or returned a 502, 503 or 504")
+
+	var faultClasses string
+	flag.Float64Var(&infra.Faults.Rate, "fault-rate", 0, "For testing only: the fraction of calls to providers, from 0 to 1, which fail with an injected error of one of --fault-classes")
+	flag.StringVar(&faultClasses, "fault-classes", "server", "The classes of the injected errors, comma-separated, from capacity, forbidden, not_found, other, rate_limited and server")
+	flag.Float64Var(&infra.Faults.DelayRate, "fault-delay-rate", 0, "For testing only: the fraction of calls to providers, from 0 to 1, which are delayed by up to --fault-max-delay")
+	flag.DurationVar(&infra.Faults.MaxDelay, "fault-max-delay", 10*time.Second, "The longest delay injected into a call to a provider")
+
+	flag.StringVar(&infra.Proxy.HTTPProxy, "http-proxy", getEnv("HTTP_PROXY", "http_proxy"), "The proxy for HTTP requests of the operator, its Jobs and the clients, i.e. 'http://proxy.example.com:3128'")
+	flag.StringVar(&infra.Proxy.HTTPSProxy, "https-proxy", getEnv("HTTPS_PROXY", "https_proxy"), "The proxy for HTTPS requests, such as to the APIs of providers, of the operator, its Jobs and the clients")
+	flag.StringVar(&infra.Proxy.NoProxy, "no-proxy", getEnv("NO_PROXY", "no_proxy"), "Hosts, domains and CIDRs to reach without the proxy, comma-separated")
+
+	flag.StringVar(&infra.ServiceAccountIssuer, "service-account-issuer", "", "The issuer of ServiceAccount tokens for clients with serviceAccountToken, discovered from the API server when empty")
+	flag.StringVar(&infra.ServiceAccountJWKSURL, "service-account-jwks-url", "", "The public URL of the keys of the ServiceAccount issuer, which exit-nodes validate the tokens of clients with, discovered from the API server when empty")
+
+	var logLevel, logFormat string
+	flag.StringVar(&logLevel, "log-level", "info", "The lowest level of log line to write: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "Write log lines as logfmt 'text' or as 'json', with fields such as the tunnel, namespace, provider and hostID")
+
+	var otlpEndpoint, otlpHeaders string
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "Send traces of each sync to this OpenTelemetry collector with OTLP over HTTP, i.e. 'http://otel-collector:4318'")
+	flag.StringVar(&otlpHeaders, "otlp-headers", os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), "Headers to send traces with, i.e. 'x-honeycomb-team=KEY'")
+
+	var notifyURL, notifySecretFile string
+	flag.StringVar(&notifyURL, "notify-url", "", "POST a JSON notification to this URL when a token, SSH key or access key is rotated or fails validation, i.e. to feed a SIEM")
+	flag.StringVar(&notifySecretFile, "notify-secret-file", "", "Sign notifications with HMAC-SHA256 using the secret in this file, sent in the X-Inlets-Signature-256 header")
+
+	var kmsKey string
+	flag.StringVar(&kmsKey, "kms-key", "", "Encrypt the tokens in Secrets written by the operator with data keys wrapped by this Azure Key Vault key, i.e. 'https://my-vault.vault.azure.net/keys/inlets-operator'")
+
+	var vaultAddr, vaultAuthPath, vaultRole, vaultPaths, vaultTokenFile string
+	flag.StringVar(&vaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "The address of HashiCorp Vault to read credentials from, i.e. 'https://vault.example.com:8200'")
+	flag.StringVar(&vaultAuthPath, "vault-auth-path", "kubernetes", "The path of the Kubernetes auth method in Vault")
+	flag.StringVar(&vaultRole, "vault-role", "", "The role of the Kubernetes auth method to sign in to Vault with")
+	flag.StringVar(&vaultTokenFile, "vault-token-file", vaultServiceAccountToken, "The ServiceAccount token to sign in to Vault with, i.e. a projected token with an audience for the JWT auth method")
+	flag.StringVar(&vaultPaths, "vault-credentials", "", "Read the access keys of providers from these Vault secrets, with an optional field which defaults to token, i.e. 'digitalocean=digitalocean/creds/inlets,packet=secret/data/packet#api-key'")
+
+	var cosignKeyFile string
+	flag.StringVar(&cosignKeyFile, "cosign-key", "", "Only run client and provisioner images signed with this cosign public key, pinned to the digest which was verified")
+
+	var warmPool string
+	flag.StringVar(&warmPool, "warm-pool", "", "Exit-nodes to keep ready for HTTP tunnels, per provider and region, i.e. 'digitalocean:lon1=2'")
+	flag.StringVar(&infra.ShardLeaseNamespace, "shard-lease-namespace", "default", "The namespace of the Leases which record the holder of each shard")
+
+	flag.DurationVar(&infra.DrainTimeout, "drain-timeout", 30*time.Second, "How long to wait for exit-nodes being provisioned or deleted when shutting down")
+	flag.DurationVar(&infra.ResyncInterval, "resync-interval", 30*time.Second, "How often every Tunnel and Service is synced again")
+
+	var provisionPollIntervals string
+	flag.StringVar(&provisionPollIntervals, "provision-poll-interval", "10s", "How often to poll the status of exit-nodes whilst provisioning, with optional intervals per provider, i.e. '10s,packet=30s'")
+	var providerConcurrency string
+	flag.StringVar(&providerConcurrency, "provider-concurrency", "", "How many calls to provision or delete hosts to make to a provider at once, with optional bounds per provider, i.e. '4,packet=2', empty for no bound")
+	flag.DurationVar(&infra.ProvisionPollMaxInterval, "provision-poll-max-interval", time.Minute, "The longest interval to poll the status of an exit-node which is slow to provision, which backs off from --provision-poll-interval, 0 for no limit")
+
+	var tagLabels string
+	flag.DurationVar(&infra.TagSyncInterval, "tag-sync-interval", 5*time.Minute, "How often to update the tags of exit-nodes after the labels of their Tunnels and Services change, 0 to disable")
+	flag.StringVar(&tagLabels, "tag-labels", "", "Labels or annotations of Tunnels and Services to copy into the tags of exit-nodes, with an optional tag name, i.e. 'team,example.com/cost-center=costcenter'")
+
+	var configFile string
+	flag.StringVar(&configFile, "config", "", "Read the provider, region, limits and images from a YAML file, which is reloaded when it changes, i.e. a mounted ConfigMap")
+
+	var deniedNamespaces string
+	flag.StringVar(&deniedNamespaces, "denied-namespaces", "kube-system,kube-public", "Never provision tunnels for Services and Tunnels in these namespaces, comma-separated")
+
+	var serviceSelector string
+	flag.StringVar(&serviceSelector, "service-selector", "", "Only manage Services matching this label selector, i.e. 'inlets=true'")
 
 	flag.Parse()
 
+	if err := setupLogging(logLevel, logFormat); err != nil {
+		klog.Fatalf("Error setting up logging: %s", err.Error())
+	}
+
+	infra.Proxy.apply()
+
+	if workers < 1 {
+		klog.Fatalf("Error parsing workers: must be at least 1, got %d", workers)
+	}
+
+	if infra.ProviderClient.Retries < 0 {
+		klog.Fatalf("Error parsing provider retries: must not be negative, got %d", infra.ProviderClient.Retries)
+	}
+
+	for _, class := range strings.Split(faultClasses, ",") {
+		if class = strings.TrimSpace(class); len(class) > 0 {
+			infra.Faults.Classes = append(infra.Faults.Classes, class)
+		}
+	}
+	if err := infra.Faults.Validate(); err != nil {
+		klog.Fatalf("Error parsing faults: %s", err.Error())
+	}
+	if infra.Faults.Enabled() {
+		klog.Warningf("Injecting faults into calls to providers, which is for testing only: %.0f%% fail with %s, %.0f%% are delayed by up to %s",
+			infra.Faults.Rate*100, strings.Join(infra.Faults.Classes, ", "), infra.Faults.DelayRate*100, infra.Faults.MaxDelay)
+	}
+
+	selector, err := labels.Parse(serviceSelector)
+	if err != nil {
+		klog.Fatalf("Error parsing service selector: %s", err.Error())
+	}
+	infra.ServiceSelector = selector
+
+	infra.ProvisionPollIntervals, err = parsePollIntervals(provisionPollIntervals)
+	if err != nil {
+		klog.Fatalf("Error parsing provision poll interval: %s", err.Error())
+	}
+
+	infra.ProviderConcurrency, err = parseProviderConcurrency(providerConcurrency)
+	if err != nil {
+		klog.Fatalf("Error parsing provider concurrency: %s", err.Error())
+	}
+
+	infra.WarmPool, err = parseWarmPool(warmPool)
+	if err != nil {
+		klog.Fatalf("Error parsing warm pool: %s", err.Error())
+	}
+
+	infra.ControlPlaneSources, err = parseControlPlaneSources(controlPlaneSources)
+	if err != nil {
+		klog.Fatalf("Error parsing control plane sources: %s", err.Error())
+	}
+
+	if len(auditLogPath) > 0 {
+		infra.AuditLog, err = openAuditLog(auditLogPath)
+		if err != nil {
+			klog.Fatalf("Error opening audit log: %s", err.Error())
+		}
+	}
+
+	infra.KeyVaultSecrets = newAzureKeyVault("")
+	if len(kmsKey) > 0 {
+		infra.KeyEncrypter, err = newKeyEncrypter(kmsKey)
+		if err != nil {
+			klog.Fatalf("Error parsing KMS key: %s", err.Error())
+		}
+		infra.KeyVaultSecrets = infra.KeyEncrypter.(*azureKeyVault)
+
+		// Clients and Jobs read these Secrets themselves, so only
+		// encryption at rest in etcd can cover them
+		logWith("key", kmsKey).Warn("The token Secrets of Tunnels, their spec.authToken and the userdata of Jobs are not encrypted with --kms-key, enable encryption at rest for secrets and tunnels in the API server to encrypt them, or keep tokens out of Tunnels with authTokenFrom")
+	}
+
+	if len(cosignKeyFile) > 0 {
+		data, err := ioutil.ReadFile(cosignKeyFile)
+		if err != nil {
+			klog.Fatalf("Error reading cosign key: %s", err.Error())
+		}
+
+		infra.CosignKey, err = parseCosignKey(data)
+		if err != nil {
+			klog.Fatalf("Error parsing cosign key: %s", err.Error())
+		}
+	}
+
+	if len(vaultPaths) > 0 {
+		paths, err := parseVaultPaths(vaultPaths)
+		if err != nil {
+			klog.Fatalf("Error parsing vault credentials: %s", err.Error())
+		}
+
+		infra.VaultCredentials, err = newVaultCredentials(vaultAddr, vaultAuthPath, vaultRole, paths)
+		if err != nil {
+			klog.Fatalf("Error configuring vault: %s", err.Error())
+		}
+		infra.VaultCredentials.tokenFile = vaultTokenFile
+	}
+
+	infra.Failover = parseFailover(failover)
+	infra.FailoverAccessKeyFiles = parseAccessKeyFiles(failoverAccessKeyFiles)
+	infra.ProviderPlugins = parseAccessKeyFiles(providerPlugins)
+	for provider, path := range infra.ProviderPlugins {
+		if _, err := os.Stat(path); err != nil {
+			klog.Fatalf("Error reading plugin of provider %s: %s", provider, err.Error())
+		}
+	}
+	infra.ReleaseChecksums, err = parseReleaseChecksums(releaseChecksums)
+	if err != nil {
+		klog.Fatalf("Error parsing release checksums: %s", err.Error())
+	}
+	infra.TagLabels = parseTagLabels(tagLabels)
+	infra.DeniedNamespaces = parseDeniedNamespaces(deniedNamespaces)
+
 	infra.InletsClientImage = os.Getenv("client_image")
+	infra.ProClientImage = os.Getenv("pro_client_image")
+	infra.ProvisionerImage = os.Getenv("provisioner_image")
+
+	infra.ShardIdentity, err = os.Hostname()
+	if err != nil {
+		klog.Fatalf("Error getting hostname: %s", err.Error())
+	}
 
-	log.Printf("Inlets client: %s\n", infra.GetInletsClientImage())
+	if len(otlpEndpoint) > 0 {
+		serviceName := getEnv("OTEL_SERVICE_NAME")
+		if len(serviceName) == 0 {
+			serviceName = "inlets-operator"
+		}
+
+		infra.Tracer, err = newTracer(otlpEndpoint, otlpHeaders, serviceName)
+		if err != nil {
+			klog.Fatalf("Error configuring tracing: %s", err.Error())
+		}
+	}
+
+	if len(notifyURL) > 0 {
+		infra.Notifier, err = newNotifier(notifyURL, notifySecretFile, infra.ShardIdentity)
+		if err != nil {
+			klog.Fatalf("Error reading notify secret: %s", err.Error())
+		}
+		if infra.VaultCredentials != nil {
+			infra.VaultCredentials.notifier = infra.Notifier
+		}
+	}
+
+	if infra.ReadySLOTarget <= 0 || infra.ReadySLOTarget > 1 {
+		klog.Fatalf("ready-slo-target must be more than 0 and at most 1, not %v", infra.ReadySLOTarget)
+	}
+
+	if infra.Executor != "inline" && infra.Executor != "job" {
+		klog.Fatalf("executor must be one of inline or job, not %q", infra.Executor)
+	}
+
+	if infra.ReplacementStrategy != "bluegreen" && infra.ReplacementStrategy != "recreate" {
+		klog.Fatalf("replacement-strategy must be one of bluegreen or recreate, not %q", infra.ReplacementStrategy)
+	}
+
+	if infra.TokenLength < minTokenLength || infra.TokenLength > maxTokenLength {
+		klog.Fatalf("token-length must be from %d to %d, not %d", minTokenLength, maxTokenLength, infra.TokenLength)
+	}
+
+	if infra.ClientSecurityContext != "restricted" && infra.ClientSecurityContext != "none" {
+		klog.Fatalf("client-security-context must be one of restricted or none, not %q", infra.ClientSecurityContext)
+	}
+
+	base := *infra
+	var config []byte
+	if len(configFile) > 0 {
+		config, err = ioutil.ReadFile(configFile)
+		if err != nil {
+			klog.Fatalf("Error reading config file: %s", err.Error())
+		}
+
+		infra, err = loadConfig(config, base)
+		if err != nil {
+			klog.Fatalf("Error parsing config file: %s", err.Error())
+		}
+	}
+
+	logWith("image", infra.GetInletsClientImage()).Info("Inlets client")
 
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
@@ -107,21 +785,66 @@ func main() {
 		klog.Fatalf("Error building example clientset: %s", err.Error())
 	}
 
-	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
-	exampleInformerFactory := informers.NewSharedInformerFactory(operatorClient, time.Second*30)
+	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, infra.ResyncInterval)
+	exampleInformerFactory := informers.NewSharedInformerFactory(operatorClient, infra.ResyncInterval)
 
 	controller := NewController(kubeClient, operatorClient,
 		kubeInformerFactory.Apps().V1().Deployments(),
 		exampleInformerFactory.Inletsoperator().V1alpha1().Tunnels(),
+		exampleInformerFactory.Inletsoperator().V1alpha1().TunnelClasses(),
 		kubeInformerFactory.Core().V1().Services(),
+		kubeInformerFactory.Core().V1().Endpoints(),
 		infra)
 
+	provision.SetAPIObserver(controller.metrics)
+	provision.SetClientOptions(infra.ProviderClient)
+	provision.SetFaults(infra.Faults)
+	for provider, path := range infra.ProviderPlugins {
+		provision.RegisterPlugin(provider, path)
+	}
+
 	// notice that there is no need to run Start methods in a separate goroutine. (i.e. go kubeInformerFactory.Start(stopCh)
 	// Start method is non-blocking and runs all registered informers in a dedicated goroutine.
 	kubeInformerFactory.Start(stopCh)
 	exampleInformerFactory.Start(stopCh)
 
-	if err = controller.Run(2, stopCh); err != nil {
+	if len(configFile) > 0 {
+		go controller.watchConfig(configFile, base, config, stopCh)
+	}
+
+	if infra.WebhookPort > 0 {
+		go func() {
+			if err := controller.serveWebhook(infra.WebhookPort, webhookCertFile, webhookKeyFile); err != nil {
+				klog.Fatalf("Error serving webhook: %s", err.Error())
+			}
+		}()
+	}
+
+	if metricsPort > 0 {
+		go func() {
+			if err := controller.serveMetrics(metricsPort); err != nil {
+				klog.Fatalf("Error serving metrics: %s", err.Error())
+			}
+		}()
+	}
+
+	if debugPort > 0 {
+		go func() {
+			if err := controller.serveDebug(debugPort); err != nil {
+				klog.Fatalf("Error serving debug endpoints: %s", err.Error())
+			}
+		}()
+	}
+
+	if healthPort > 0 {
+		go func() {
+			if err := controller.serveHealth(healthPort); err != nil {
+				klog.Fatalf("Error serving health checks: %s", err.Error())
+			}
+		}()
+	}
+
+	if err = controller.Run(workers, stopCh); err != nil {
 		klog.Fatalf("Error running controller: %s", err.Error())
 	}
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// metricSample is a value of a metric with its labels, which are written
+// in the Prometheus text format, since the Prometheus client is not vendored.
+type metricSample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// writeGauge writes a gauge and its samples in the Prometheus text format.
+func writeGauge(w io.Writer, name, help string, samples []metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(sample.Labels), strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	}
+}
+
+// writeCounter writes a counter and its samples in the Prometheus text
+// format.
+func writeCounter(w io.Writer, name, help string, samples []metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(sample.Labels), strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	}
+}
+
+// counterVec is a counter with a value for each set of labels.
+type counterVec struct {
+	lock   sync.Mutex
+	labels []string
+	values map[string]*metricSample
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: map[string]*metricSample{}}
+}
+
+// Inc adds one to the counter with the values of its labels, in order.
+func (v *counterVec) Inc(values ...string) {
+	key, labels := makeLabels(v.labels, values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	sample, ok := v.values[key]
+	if !ok {
+		sample = &metricSample{Labels: labels}
+		v.values[key] = sample
+	}
+	sample.Value++
+}
+
+func (v *counterVec) write(w io.Writer, name, help string) {
+	v.lock.Lock()
+	keys := []string{}
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	samples := []metricSample{}
+	for _, key := range keys {
+		samples = append(samples, *v.values[key])
+	}
+	v.lock.Unlock()
+
+	writeCounter(w, name, help, samples)
+}
+
+// histogramVec is a histogram with buckets for each set of labels.
+type histogramVec struct {
+	lock    sync.Mutex
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramSample
+}
+
+type histogramSample struct {
+	Labels map[string]string
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{labels: labels, buckets: buckets, values: map[string]*histogramSample{}}
+}
+
+// Observe records a value in the histogram with the values of its labels,
+// in order.
+func (v *histogramVec) Observe(value float64, values ...string) {
+	key, labels := makeLabels(v.labels, values)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	sample, ok := v.values[key]
+	if !ok {
+		sample = &histogramSample{Labels: labels, Counts: make([]uint64, len(v.buckets))}
+		v.values[key] = sample
+	}
+	for i, bucket := range v.buckets {
+		if value <= bucket {
+			sample.Counts[i]++
+		}
+	}
+	sample.Count++
+	sample.Sum += value
+}
+
+func (v *histogramVec) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	keys := []string{}
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		sample := v.values[key]
+		for i, bucket := range v.buckets {
+			labels := map[string]string{"le": strconv.FormatFloat(bucket, 'f', -1, 64)}
+			for k, value := range sample.Labels {
+				labels[k] = value
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labels), sample.Counts[i])
+		}
+
+		labels := map[string]string{"le": "+Inf"}
+		for k, value := range sample.Labels {
+			labels[k] = value
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(labels), sample.Count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, formatLabels(sample.Labels), strconv.FormatFloat(sample.Sum, 'f', -1, 64))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, formatLabels(sample.Labels), sample.Count)
+	}
+}
+
+// makeLabels returns the labels with their values, and a key for them.
+func makeLabels(names, values []string) (string, map[string]string) {
+	labels := map[string]string{}
+	for i, name := range names {
+		if i < len(values) {
+			labels[name] = values[i]
+		} else {
+			labels[name] = ""
+		}
+	}
+	return formatLabels(labels), labels
+}
+
+// formatLabels formats labels as {key="value"}, sorted by key.
+func formatLabels(values map[string]string) string {
+	if len(values) == 0 {
+		return ""
+	}
+
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	formatted := "{"
+	for i, key := range keys {
+		if i > 0 {
+			formatted += ","
+		}
+		formatted += fmt.Sprintf("%s=%s", key, strconv.Quote(values[key]))
+	}
+	return formatted + "}"
+}
+
+// serveMetrics serves the metrics of the operator on /metrics, and its
+// health checks on /healthz and /readyz, until the server fails.
+func (c *Controller) serveMetrics(port int) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", c.handleMetrics)
+	mux.HandleFunc("/healthz", c.handleHealthz)
+	mux.HandleFunc("/readyz", c.handleReadyz)
+
+	logWith("port", port).Info("Serving metrics")
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+}
+
+func (c *Controller) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	costs, err := c.getMonthlyCosts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeGauge(w, "inlets_operator_estimated_monthly_cost",
+		"Estimated cost in USD per month of the exit-nodes of all Tunnels, by provider.", costs)
+
+	if err := c.writeExitNodes(w); err != nil {
+		logWith().Error(err, "Error writing exit-node metrics")
+	}
+	if err := c.writeTunnelUp(w); err != nil {
+		logWith().Error(err, "Error writing tunnel metrics")
+	}
+	if err := c.writeUsage(w); err != nil {
+		logWith().Error(err, "Error writing usage metrics")
+	}
+	c.writeOrphans(w)
+	c.writeReadySLO(w)
+	c.metrics.write(w)
+}
+
+// getMonthlyCosts adds up the estimated hourly cost of the exit-nodes of
+// all Tunnels, including replacements, as a monthly cost for each provider.
+func (c *Controller) getMonthlyCosts() ([]metricSample, error) {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	totals := map[string]float64{}
+	add := func(provider, cost string) {
+		hourly, err := strconv.ParseFloat(cost, 64)
+		if err != nil {
+			return
+		}
+		if len(provider) == 0 {
+			provider = c.infra().Provider
+		}
+		totals[provider] += hourly * provision.HoursPerMonth
+	}
+
+	for _, tunnel := range tunnels {
+		add(tunnel.Status.Provider, tunnel.Status.EstimatedHourlyCost)
+		if replacement := tunnel.Status.Replacement; replacement != nil {
+			add(replacement.Provider, replacement.EstimatedHourlyCost)
+		}
+	}
+
+	providers := []string{}
+	for provider := range totals {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	samples := []metricSample{}
+	for _, provider := range providers {
+		samples = append(samples, metricSample{
+			Labels: map[string]string{"provider": provider},
+			Value:  totals[provider],
+		})
+	}
+	return samples, nil
+}
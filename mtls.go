@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+const (
+	mutualTLSMountPath = "/etc/inlets/mtls"
+
+	// mutualTLSBackendPort is the port inlets-pro listens on behind the TLS
+	// proxy of the exit-node, which is only reachable from the exit-node.
+	mutualTLSBackendPort = inletsProControlPort + 1
+
+	mutualTLSServerName = "inlets-exit-node"
+	mutualTLSClientName = "inlets-client"
+
+	// mutualTLSValidity is how long the CA and certificates of a tunnel are
+	// valid for, since they are not renewed.
+	mutualTLSValidity = 10 * 365 * 24 * time.Hour
+)
+
+// getMutualTLSSecretName returns the name of the Secret with the CA and
+// certificates of a tunnel.
+func getMutualTLSSecretName(tunnel *inletsv1alpha1.Tunnel) string {
+	return tunnel.Name + "-mtls"
+}
+
+// usesControlPlaneTLS returns true when the exit-node of a tunnel serves
+// its control-port with the certificates of the operator, with or without
+// a client certificate. A ServiceAccount token is only sent over TLS.
+func usesControlPlaneTLS(tunnel *inletsv1alpha1.Tunnel) bool {
+	return tunnel.Spec.MutualTLS || usesServiceAccountToken(tunnel) ||
+		(tunnel.Spec.ControlPlaneTLS != nil && *tunnel.Spec.ControlPlaneTLS)
+}
+
+// canUseControlPlaneTLS returns true when the client of a tunnel can run
+// the TLS proxy, which connects to an exit-node of its own.
+func canUseControlPlaneTLS(tunnel *inletsv1alpha1.Tunnel) bool {
+	return isProTunnel(tunnel) && len(tunnel.Spec.SharedExitNode) == 0 && tunnel.Spec.ClientMode != "sidecar"
+}
+
+func validateMutualTLS(tunnel *inletsv1alpha1.Tunnel) error {
+	if !usesControlPlaneTLS(tunnel) {
+		return nil
+	}
+	if !isProTunnel(tunnel) {
+		return fmt.Errorf("mutualTLS and controlPlaneTLS need inlets-pro, set protocol to tcp")
+	}
+	if len(tunnel.Spec.SharedExitNode) > 0 {
+		return fmt.Errorf("mutualTLS and controlPlaneTLS cannot be set on a tunnel which shares an exit-node")
+	}
+	if tunnel.Spec.ClientMode == "sidecar" {
+		return fmt.Errorf("mutualTLS and controlPlaneTLS cannot be set with clientMode sidecar")
+	}
+	return nil
+}
+
+// ensureMutualTLS returns the Secret with the CA and certificates of a
+// tunnel, and generates them the first time. The key of the CA is not
+// kept, so no further certificates can be issued from it.
+func (c *Controller) ensureMutualTLS(tunnel *inletsv1alpha1.Tunnel) (*corev1.Secret, error) {
+	secrets := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace)
+	name := getMutualTLSSecretName(tunnel)
+
+	secret, err := secrets.Get(name, metav1.GetOptions{})
+	if err == nil || !errors.IsNotFound(err) {
+		return secret, err
+	}
+
+	data, err := generateMutualTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err = secrets.Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: tunnel.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(tunnel, schema.GroupVersionKind{
+					Group:   inletsv1alpha1.SchemeGroupVersion.Group,
+					Version: inletsv1alpha1.SchemeGroupVersion.Version,
+					Kind:    "Tunnel",
+				}),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	})
+	if errors.IsAlreadyExists(err) {
+		return secrets.Get(name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.tunnelLog(tunnel).Info("Created mutual TLS certificates")
+	return secret, nil
+}
+
+// generateMutualTLS generates a CA, and a server and client certificate
+// signed by it, as PEM.
+func generateMutualTLS() (map[string][]byte, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "inlets-operator"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caCert, _, err := signCertificate(ca, nil, caKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedCA, err := x509.ParseCertificate(caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: mutualTLSServerName},
+		DNSNames:    []string{mutualTLSServerName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	serverCert, serverKey, err := signCertificate(server, parsedCA, nil, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: mutualTLSClientName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientCert, clientKey, err := signCertificate(client, parsedCA, nil, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		"ca.crt":     encodePEM("CERTIFICATE", caCert),
+		"server.crt": encodePEM("CERTIFICATE", serverCert),
+		"server.key": encodePEM("EC PRIVATE KEY", serverKey),
+		"client.crt": encodePEM("CERTIFICATE", clientCert),
+		"client.key": encodePEM("EC PRIVATE KEY", clientKey),
+	}, nil
+}
+
+// signCertificate signs a certificate with the key of its parent, or by
+// itself when parent is nil, and returns it along with its key. A new key
+// is generated when none is given.
+func signCertificate(template, parent *x509.Certificate, key, parentKey *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	if key == nil {
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, nil, err
+		}
+	}
+	if parent == nil {
+		parent = template
+	}
+
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(mutualTLSValidity)
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, keyBytes, nil
+}
+
+func encodePEM(blockType string, value []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: value})
+}
+
+// addMutualTLSUserdata adds the server certificate of a tunnel with mutual
+// TLS or control-plane TLS to the userdata of its exit-node, along with a
+// TLS proxy on the control-port, which only accepts the client certificate
+// with mutual TLS. inlets-pro listens behind it on a port which is closed
+// to other hosts.
+func (c *Controller) addMutualTLSUserdata(tunnel *inletsv1alpha1.Tunnel, host *provision.BasicHost) error {
+	if !usesControlPlaneTLS(tunnel) {
+		return nil
+	}
+
+	authentication := "--disable-authentication"
+	if tunnel.Spec.MutualTLS {
+		authentication = "--cacert=" + mutualTLSMountPath + "/ca.crt --allow-cn=" + mutualTLSClientName
+	}
+
+	secret, err := c.ensureMutualTLS(tunnel)
+	if err != nil {
+		return err
+	}
+
+	host.UserData += `
+
+mkdir -p ` + mutualTLSMountPath + `
+cat > ` + mutualTLSMountPath + `/ca.crt <<EOF
+` + string(secret.Data["ca.crt"]) + `EOF
+cat > ` + mutualTLSMountPath + `/server.crt <<EOF
+` + string(secret.Data["server.crt"]) + `EOF
+cat > ` + mutualTLSMountPath + `/server.key <<EOF
+` + string(secret.Data["server.key"]) + `EOF
+chmod 600 ` + mutualTLSMountPath + `/server.key
+
+iptables -I INPUT -p tcp --dport ` + fmt.Sprintf("%d", mutualTLSBackendPort) + ` ! -i lo -j DROP
+
+` + makeVerifiedDownload(ghostunnelRelease, "/tmp/ghostunnel", c.infra().ReleaseChecksums["ghostunnel"]) + ` && \
+	chmod +x /tmp/ghostunnel && \
+	mv /tmp/ghostunnel /usr/local/bin/ghostunnel
+
+cat > /etc/systemd/system/ghostunnel.service <<EOF
+[Unit]
+Description=TLS proxy for inlets-pro
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+ExecStart=/usr/local/bin/ghostunnel server --listen=0.0.0.0:` + fmt.Sprintf("%d", inletsProControlPort) +
+		` --target=127.0.0.1:` + fmt.Sprintf("%d", getControlPlaneTarget(tunnel)) +
+		` --cert=` + mutualTLSMountPath + `/server.crt --key=` + mutualTLSMountPath + `/server.key ` + authentication + `
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start ghostunnel && \
+	systemctl enable ghostunnel`
+
+	return nil
+}
+
+// addMutualTLSProxy adds a container to the client Pod which connects to
+// the exit-node, validating its certificate with the CA of the tunnel, and
+// which the client connects to on 127.0.0.1. Only the CA is mounted, and
+// the client certificate with mutual TLS.
+func addMutualTLSProxy(deployment *appsv1.Deployment, tunnel *inletsv1alpha1.Tunnel) {
+	podSpec := &deployment.Spec.Template.Spec
+
+	items := []corev1.KeyToPath{{Key: "ca.crt", Path: "ca.crt"}}
+	args := []string{
+		"client",
+		fmt.Sprintf("--listen=127.0.0.1:%d", inletsProControlPort),
+		fmt.Sprintf("--target=%s:%d", tunnel.Status.HostIP, inletsProControlPort),
+		"--cacert=" + mutualTLSMountPath + "/ca.crt",
+		"--override-server-name=" + mutualTLSServerName,
+	}
+	if tunnel.Spec.MutualTLS {
+		items = append(items,
+			corev1.KeyToPath{Key: "client.crt", Path: "client.crt"},
+			corev1.KeyToPath{Key: "client.key", Path: "client.key"})
+		args = append(args,
+			"--cert="+mutualTLSMountPath+"/client.crt",
+			"--key="+mutualTLSMountPath+"/client.key")
+	} else {
+		args = append(args, "--disable-authentication")
+	}
+
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "mtls",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: getMutualTLSSecretName(tunnel),
+				Items:      items,
+			},
+		},
+	})
+
+	podSpec.Containers = append(podSpec.Containers, corev1.Container{
+		Name:            "mtls-proxy",
+		Image:           tlsProxyImage,
+		ImagePullPolicy: corev1.PullIfNotPresent,
+		Args:            args,
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      "mtls",
+				MountPath: mutualTLSMountPath,
+				ReadOnly:  true,
+			},
+		},
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+func newMutualTLSTunnel(name string) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel(name)
+	tunnel.Spec.Protocol = "tcp"
+	tunnel.Spec.MutualTLS = true
+	tunnel.Status.HostIP = "203.0.113.1"
+	return tunnel
+}
+
+func parseCertificate(t *testing.T, value []byte) *x509.Certificate {
+	block, _ := pem.Decode(value)
+	if block == nil {
+		t.Fatalf("want a PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("error parsing certificate: %s", err.Error())
+	}
+	return cert
+}
+
+func TestValidateMutualTLS(t *testing.T) {
+	enabled := true
+	cases := []struct {
+		name    string
+		change  func(tunnel *inletsv1alpha1.Tunnel)
+		wantErr bool
+	}{
+		{"mutual TLS", func(tunnel *inletsv1alpha1.Tunnel) {}, false},
+		{"control-plane TLS", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.MutualTLS = false
+			tunnel.Spec.ControlPlaneTLS = &enabled
+		}, false},
+		{"http", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.Protocol = "http" }, true},
+		{"shared exit-node", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.SharedExitNode = "other" }, true},
+		{"sidecar", func(tunnel *inletsv1alpha1.Tunnel) { tunnel.Spec.ClientMode = "sidecar" }, true},
+		{"disabled", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.MutualTLS = false
+			tunnel.Spec.Protocol = "http"
+		}, false},
+	}
+
+	for _, c := range cases {
+		tunnel := newMutualTLSTunnel("app")
+		c.change(tunnel)
+		if err := validateMutualTLS(tunnel); (err != nil) != c.wantErr {
+			t.Errorf("%s: want error %v, got %v", c.name, c.wantErr, err)
+		}
+	}
+}
+
+func TestGenerateMutualTLS(t *testing.T) {
+	data, err := generateMutualTLS()
+	if err != nil {
+		t.Fatalf("error generating certificates: %s", err.Error())
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(parseCertificate(t, data["ca.crt"]))
+
+	server := parseCertificate(t, data["server.crt"])
+	if _, err := server.Verify(x509.VerifyOptions{
+		DNSName:   mutualTLSServerName,
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		t.Errorf("want the server certificate to be signed by the CA for %s: %s", mutualTLSServerName, err.Error())
+	}
+
+	client := parseCertificate(t, data["client.crt"])
+	if _, err := client.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		t.Errorf("want the client certificate to be signed by the CA: %s", err.Error())
+	}
+	if client.Subject.CommonName != mutualTLSClientName {
+		t.Errorf("want the client certificate for %s, got %s", mutualTLSClientName, client.Subject.CommonName)
+	}
+
+	// The server certificate can't be used by a client
+	if _, err := server.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err == nil {
+		t.Errorf("want the server certificate not to be valid for clients")
+	}
+
+	if _, ok := data["ca.key"]; ok {
+		t.Errorf("want the key of the CA not to be kept")
+	}
+}
+
+func TestEnsureMutualTLSKeepsCertificates(t *testing.T) {
+	f := newFixture(t)
+	tunnel := newMutualTLSTunnel("app")
+
+	first, err := f.controller.ensureMutualTLS(tunnel)
+	if err != nil {
+		t.Fatalf("error creating certificates: %s", err.Error())
+	}
+	if len(first.OwnerReferences) != 1 || first.OwnerReferences[0].Name != "app" {
+		t.Errorf("want the Secret to be owned by the Tunnel, got %v", first.OwnerReferences)
+	}
+
+	second, err := f.controller.ensureMutualTLS(tunnel)
+	if err != nil {
+		t.Fatalf("error getting certificates: %s", err.Error())
+	}
+	if !bytes.Equal(first.Data["ca.crt"], second.Data["ca.crt"]) {
+		t.Errorf("want the certificates to be kept, so that the exit-node and client keep matching")
+	}
+
+	if _, err := f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Get("app-mtls", metav1.GetOptions{}); err != nil {
+		t.Errorf("want the Secret app-mtls, got %s", err.Error())
+	}
+}
+
+func TestAddMutualTLSUserdata(t *testing.T) {
+	f := newFixture(t)
+
+	tunnel := newMutualTLSTunnel("app")
+	host := provision.BasicHost{}
+	if err := f.controller.addMutualTLSUserdata(tunnel, &host); err != nil {
+		t.Fatalf("error adding userdata: %s", err.Error())
+	}
+
+	secret, _ := f.controller.ensureMutualTLS(tunnel)
+	if !strings.Contains(host.UserData, string(secret.Data["server.key"])) {
+		t.Errorf("want the key of the server in the userdata")
+	}
+	if strings.Contains(host.UserData, string(secret.Data["client.key"])) {
+		t.Errorf("want the key of the client not to be in the userdata")
+	}
+	if !strings.Contains(host.UserData, "--allow-cn="+mutualTLSClientName) {
+		t.Errorf("want the exit-node to only accept the client certificate")
+	}
+
+	// Without mutual TLS, any client can connect over TLS
+	enabled := true
+	tunnel = newMutualTLSTunnel("other")
+	tunnel.Spec.MutualTLS = false
+	tunnel.Spec.ControlPlaneTLS = &enabled
+	host = provision.BasicHost{}
+	if err := f.controller.addMutualTLSUserdata(tunnel, &host); err != nil {
+		t.Fatalf("error adding userdata: %s", err.Error())
+	}
+	if !strings.Contains(host.UserData, "--disable-authentication") || strings.Contains(host.UserData, "--allow-cn") {
+		t.Errorf("want the exit-node not to ask for a client certificate without mutualTLS")
+	}
+}
+
+func TestAddMutualTLSProxy(t *testing.T) {
+	tunnel := newMutualTLSTunnel("app")
+	deployment := &appsv1.Deployment{}
+	addMutualTLSProxy(deployment, tunnel)
+
+	podSpec := deployment.Spec.Template.Spec
+	if len(podSpec.Containers) != 1 || podSpec.Containers[0].Name != "mtls-proxy" {
+		t.Fatalf("want the mtls-proxy container, got %v", podSpec.Containers)
+	}
+	if len(podSpec.Volumes) != 1 || len(podSpec.Volumes[0].Secret.Items) != 3 {
+		t.Errorf("want the CA and client certificate to be mounted, got %v", podSpec.Volumes)
+	}
+	args := strings.Join(podSpec.Containers[0].Args, " ")
+	if !strings.Contains(args, "--target=203.0.113.1:") || !strings.Contains(args, "--cert=") {
+		t.Errorf("want the proxy to connect to the exit-node with the client certificate, got %q", args)
+	}
+
+	// Only the CA is mounted without mutual TLS
+	tunnel.Spec.MutualTLS = false
+	deployment = &appsv1.Deployment{}
+	addMutualTLSProxy(deployment, tunnel)
+
+	items := deployment.Spec.Template.Spec.Volumes[0].Secret.Items
+	if len(items) != 1 || items[0].Key != "ca.crt" {
+		t.Errorf("want only the CA to be mounted, got %v", items)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// dnsPort is opened for the client to look up its upstream.
+const dnsPort = 53
+
+// makeClientNetworkPolicy returns a NetworkPolicy which only lets the client
+// of a tunnel connect to the control-port of its exit-node, to DNS, and to
+// its upstream. The upstream is the Pods selected by its Service, or any
+// address on the ports of the upstream when it has no selector, such as an
+// upstream given as host:port or a NodePort Service.
+func makeClientNetworkPolicy(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) *networkingv1.NetworkPolicy {
+	name := tunnel.Name + "-client"
+	tcp := corev1.ProtocolTCP
+	udp := corev1.ProtocolUDP
+
+	controlPort := intstr.FromInt(int(getControlPlanePort(tunnel, tunnel.Status.HostIP)))
+	dns := intstr.FromInt(dnsPort)
+
+	egress := []networkingv1.NetworkPolicyEgressRule{
+		{
+			To: []networkingv1.NetworkPolicyPeer{
+				{IPBlock: &networkingv1.IPBlock{CIDR: tunnel.Status.HostIP + "/32"}},
+			},
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &tcp, Port: &controlPort},
+			},
+		},
+		{
+			Ports: []networkingv1.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dns},
+				{Protocol: &tcp, Port: &dns},
+			},
+		},
+	}
+
+	if service != nil && len(tunnel.Spec.Upstream) == 0 && !usesNodePort(service) && len(service.Spec.Selector) > 0 {
+		rule := networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{
+				{PodSelector: &metav1.LabelSelector{MatchLabels: service.Spec.Selector}},
+			},
+		}
+		for _, port := range service.Spec.Ports {
+			protocol := port.Protocol
+			if len(protocol) == 0 {
+				protocol = corev1.ProtocolTCP
+			}
+			targetPort := port.TargetPort
+			if targetPort.Type == intstr.Int && targetPort.IntVal == 0 {
+				targetPort = intstr.FromInt(int(port.Port))
+			}
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &targetPort})
+		}
+		egress = append(egress, rule)
+	} else {
+		rule := networkingv1.NetworkPolicyEgressRule{}
+
+		_, ports := getUpstream(tunnel, service)
+		if tunnel.Spec.TLS != nil {
+			_, port := getTLSUpstream(tunnel, service)
+			ports = []int32{port}
+		}
+		for _, port := range ports {
+			value := intstr.FromInt(int(port))
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &value})
+		}
+		for _, port := range getUDPPorts(tunnel, service) {
+			value := intstr.FromInt(int(port))
+			rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &udp, Port: &value})
+		}
+
+		if len(rule.Ports) > 0 {
+			egress = append(egress, rule)
+		}
+	}
+
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: tunnel.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(tunnel, schema.GroupVersionKind{
+					Group:   inletsv1alpha1.SchemeGroupVersion.Group,
+					Version: inletsv1alpha1.SchemeGroupVersion.Version,
+					Kind:    "Tunnel",
+				}),
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app.kubernetes.io/name": name,
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      egress,
+		},
+	}
+}
+
+// syncClientNetworkPolicy creates the NetworkPolicy of the client of a
+// tunnel when --client-network-policy is set, or updates it when the IP of
+// the exit-node or the upstream changed. It is removed along with the tunnel.
+func (c *Controller) syncClientNetworkPolicy(tunnel *inletsv1alpha1.Tunnel) error {
+	if !c.infra().ClientNetworkPolicy || len(tunnel.Status.HostIP) == 0 {
+		return nil
+	}
+
+	service, err := c.getTunnelService(tunnel)
+	if err != nil {
+		return err
+	}
+
+	policies := c.kubeclientset.NetworkingV1().NetworkPolicies(tunnel.Namespace)
+	desired := makeClientNetworkPolicy(tunnel, service)
+
+	policy, err := policies.Get(desired.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		c.tunnelLog(tunnel).Info("Creating client network policy", "policy", desired.Name)
+		_, err = policies.Create(desired)
+		if errors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(policy.Spec, desired.Spec) {
+		return nil
+	}
+
+	c.tunnelLog(tunnel).Info("Updating client network policy", "policy", desired.Name)
+	policyCopy := policy.DeepCopy()
+	policyCopy.Spec = desired.Spec
+	_, err = policies.Update(policyCopy)
+	return err
+}
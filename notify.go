@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	// notifySignatureHeader has the HMAC-SHA256 of the body of a
+	// notification, signed with the secret of --notify-secret-file.
+	notifySignatureHeader = "X-Inlets-Signature-256"
+
+	// notifyRepeatInterval is how long an identical notification is held
+	// back for, so that a failure which is retried doesn't flood the hook.
+	notifyRepeatInterval = time.Hour
+
+	notifyAttempts = 3
+)
+
+// The types of notification.
+const (
+	notifyTokenRotated       = "token-rotated"
+	notifyTokenInvalid       = "token-invalid"
+	notifySSHKeyRotated      = "ssh-key-rotated"
+	notifyCredentialsRotated = "credentials-rotated"
+	notifyCredentialsInvalid = "credentials-invalid"
+)
+
+// notification is sent to the hook of --notify-url when a token, SSH key or
+// cloud credential is rotated, or fails validation.
+type notification struct {
+	Time      time.Time `json:"time"`
+	Operator  string    `json:"operator"`
+	Type      string    `json:"type"`
+	Reason    string    `json:"reason,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Tunnel    string    `json:"tunnel,omitempty"`
+	Provider  string    `json:"provider,omitempty"`
+	Message   string    `json:"message"`
+}
+
+// notifier posts notifications to an HTTP hook as JSON, signed with HMAC,
+// in the background.
+type notifier struct {
+	url      string
+	secret   []byte
+	operator string
+	client   *http.Client
+
+	lock sync.Mutex
+	sent map[string]time.Time
+}
+
+func newNotifier(url, secretFile, operator string) (*notifier, error) {
+	n := &notifier{
+		url:      url,
+		operator: operator,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		sent:     map[string]time.Time{},
+	}
+
+	if len(secretFile) > 0 {
+		secret, err := ioutil.ReadFile(secretFile)
+		if err != nil {
+			return nil, err
+		}
+		n.secret = bytes.TrimSpace(secret)
+	}
+	return n, nil
+}
+
+// Notify sends a notification in the background, unless an identical one
+// was sent within the last hour. It does nothing on a nil notifier.
+func (n *notifier) Notify(notice notification) {
+	if n == nil {
+		return
+	}
+
+	key := notice.Type + "/" + notice.Reason + "/" + notice.Namespace + "/" + notice.Tunnel + "/" + notice.Provider + "/" + notice.Message
+	n.lock.Lock()
+	if sentAt, ok := n.sent[key]; ok && time.Since(sentAt) < notifyRepeatInterval {
+		n.lock.Unlock()
+		return
+	}
+	n.sent[key] = time.Now()
+	for sentKey, sentAt := range n.sent {
+		if time.Since(sentAt) >= notifyRepeatInterval {
+			delete(n.sent, sentKey)
+		}
+	}
+	n.lock.Unlock()
+
+	notice.Time = time.Now().UTC()
+	notice.Operator = n.operator
+
+	go func() {
+		if err := n.send(notice); err != nil {
+			logWith("type", notice.Type, "tunnel", notice.Tunnel, "namespace", notice.Namespace).Error(err, "Error sending notification")
+		}
+	}()
+}
+
+// send posts a notification, retrying with a backoff when it fails.
+func (n *notifier) send(notice notification) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+
+	signature := ""
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = n.post(body, signature)
+		if err == nil || attempt == notifyAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt*attempt) * time.Second)
+	}
+}
+
+func (n *notifier) post(body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(signature) > 0 {
+		req.Header.Set(notifySignatureHeader, signature)
+	}
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d", n.url, res.StatusCode)
+	}
+	return nil
+}
+
+// notifyTunnel sends a notification about the token or SSH key of a tunnel.
+func (c *Controller) notifyTunnel(tunnel *inletsv1alpha1.Tunnel, noticeType, reason, message string) {
+	c.infra().Notifier.Notify(notification{
+		Type:      noticeType,
+		Reason:    reason,
+		Namespace: tunnel.Namespace,
+		Tunnel:    tunnel.Name,
+		Provider:  c.getTunnelProvider(tunnel),
+		Message:   message,
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+	password "github.com/sethvargo/go-password/password"
+)
+
+// operationTag is the tag of an exit-node with the ID of the operation
+// which created it.
+const operationTag = "inlets-operation"
+
+// operationCreating is the phase of an operation whilst the exit-node is
+// being created.
+const operationCreating = "Creating"
+
+// operationListDelay is how long after an operation started that its
+// exit-node may not be listed by the provider yet, so one which isn't
+// listed is only given up on after this long.
+const operationListDelay = 30 * time.Second
+
+// startOperation records that the exit-node of a tunnel is about to be
+// created with a target, and returns the updated tunnel, whose exit-node
+// is tagged with the ID of the operation.
+func (c *Controller) startOperation(tunnel *inletsv1alpha1.Tunnel, target ProvisionTarget) (*inletsv1alpha1.Tunnel, error) {
+	id, err := password.Generate(16, 4, 0, true, true)
+	if err != nil {
+		return nil, err
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Operation = &inletsv1alpha1.TunnelOperation{
+		Phase:     operationCreating,
+		ID:        id,
+		Provider:  target.Provider,
+		Region:    target.Region,
+		StartedAt: metav1.Now(),
+	}
+
+	updated, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token of a tunnel with authTokenFrom is not in the stored spec
+	updated.Spec.AuthToken = tunnel.Spec.AuthToken
+	return updated, nil
+}
+
+// resumeOperation looks for the exit-node created by the operation of a
+// tunnel which has no exit-node, i.e. when the operator restarted before
+// the ID of the exit-node was recorded, and records it as the exit-node of
+// the tunnel. Each provider of the targets of the tunnel is looked at,
+// since the operation may have failed over. It returns true when the
+// tunnel should not be synced any further, and false when a new exit-node
+// should be provisioned.
+func (c *Controller) resumeOperation(tunnel *inletsv1alpha1.Tunnel, targets []ProvisionTarget) (bool, error) {
+	operation := tunnel.Status.Operation
+	if operation == nil || operation.Phase != operationCreating {
+		return false, nil
+	}
+
+	class, err := c.getTunnelClass(tunnel)
+	if err != nil {
+		return true, err
+	}
+
+	checked := map[string]bool{}
+	for _, target := range targets {
+		if checked[target.Provider] {
+			continue
+		}
+		checked[target.Provider] = true
+
+		provisioner, err := c.getClassProvisioner(class, target.Provider)
+		if err != nil {
+			return true, err
+		}
+		if _, ok := provisioner.(provision.HostLister); !ok {
+			c.tunnelLog(tunnel).Debug("Unable to resume operation, the provider cannot list exit-nodes", "operation", operation.ID)
+			continue
+		}
+
+		hosts, err := provision.ListHosts(provisioner, c.getManagedFilter(target.Provider))
+		if err != nil {
+			return true, err
+		}
+
+		for _, host := range hosts {
+			if !host.HasTags(map[string]string{operationTag: operation.ID}) {
+				continue
+			}
+
+			c.tunnelLog(tunnel).Info("Resuming operation", "operation", operation.ID, "hostID", host.ID)
+			c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessAdopted,
+				"Resumed tracking exit-node %s which was being created when the operator restarted", host.ID)
+
+			tunnelCopy := tunnel.DeepCopy()
+			tunnelCopy.Status.Provider = target.Provider
+			tunnelCopy.Status.Region = target.Region
+			tunnelCopy.Status.EstimatedHourlyCost = c.getHourlyCost(c.makeExitHost(tunnel, target), target.Provider)
+			tunnelCopy.Status.Operation = nil
+			return true, c.updateTunnelProvisioningStatus(tunnelCopy, "provisioning", host.ID, "")
+		}
+	}
+
+	if left := operationListDelay - time.Since(operation.StartedAt.Time); left > 0 {
+		c.workqueue.AddAfter(tunnel.Namespace+"/"+tunnel.Name, left)
+		return true, nil
+	}
+
+	// The operation failed before the exit-node was created, so a new
+	// operation replaces it
+	return false, nil
+}
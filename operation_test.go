@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func newOperationTunnel(name, id string, started time.Time) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel(name)
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Status.Operation = &inletsv1alpha1.TunnelOperation{
+		Phase:     operationCreating,
+		ID:        id,
+		Provider:  "fake",
+		StartedAt: metav1.NewTime(started),
+	}
+	return tunnel
+}
+
+func TestStartOperationRecordsTarget(t *testing.T) {
+	f := newFixture(t)
+	f.create(newTunnel("app"))
+
+	started, err := f.controller.startOperation(f.get("app"), ProvisionTarget{Provider: "fake", Region: "lon1"})
+	if err != nil {
+		t.Fatalf("error starting operation: %s", err.Error())
+	}
+
+	operation := f.get("app").Status.Operation
+	if operation == nil || len(operation.ID) == 0 || operation.Phase != operationCreating {
+		t.Fatalf("want a create operation to be recorded before the exit-node is created, got %+v", operation)
+	}
+	if operation.Provider != "fake" || operation.Region != "lon1" {
+		t.Errorf("want the target of the operation, got %s %s", operation.Provider, operation.Region)
+	}
+
+	// The exit-node is tagged with the operation, so that it can be found
+	// after a restart
+	host := f.controller.makeExitHost(started, ProvisionTarget{Provider: "fake"})
+	if host.Tags[operationTag] != operation.ID {
+		t.Errorf("want the exit-node to be tagged with the operation, got %v", host.Tags)
+	}
+}
+
+func TestResumeOperationWaitsForExitNodeToBeListed(t *testing.T) {
+	f := newFixture(t)
+	tunnel := newOperationTunnel("app", "op1", time.Now())
+	f.create(tunnel)
+
+	stop, err := f.controller.resumeOperation(tunnel, f.controller.getTargets(tunnel))
+	if err != nil || !stop {
+		t.Fatalf("want the sync to wait until the exit-node would be listed, got %v %v", stop, err)
+	}
+	if got := f.provisioner.Calls("Provision"); got != 0 {
+		t.Errorf("want no exit-node to be created whilst waiting, got %d calls to Provision", got)
+	}
+}
+
+func TestResumeOperationIgnoresOtherOperations(t *testing.T) {
+	f := newFixture(t)
+
+	// An exit-node created by the operation of another Tunnel
+	other := newOperationTunnel("other", "op2", time.Now())
+	if _, err := f.provisioner.Provision(f.controller.makeExitHost(other, ProvisionTarget{Provider: "fake"})); err != nil {
+		t.Fatalf("error provisioning: %s", err.Error())
+	}
+
+	tunnel := newOperationTunnel("app", "op1", time.Now().Add(-operationListDelay))
+	f.create(tunnel)
+
+	stop, err := f.controller.resumeOperation(tunnel, f.controller.getTargets(tunnel))
+	if err != nil || stop {
+		t.Fatalf("want a new exit-node once the operation is old enough to have been listed, got %v %v", stop, err)
+	}
+	if got := f.get("app").Status.HostID; len(got) > 0 {
+		t.Errorf("want the exit-node of another operation not to be adopted, got %q", got)
+	}
+}
+
+func TestSyncReplacesOperationWhichCreatedNothing(t *testing.T) {
+	f := newFixture(t)
+	f.create(newOperationTunnel("app", "op1", time.Now().Add(-operationListDelay)))
+
+	tunnel := f.syncUntil("app", "active")
+
+	if got := f.provisioner.Calls("Provision"); got != 1 {
+		t.Errorf("want 1 call to Provision, got %d", got)
+	}
+	host, ok := f.provisioner.Host(tunnel.Status.HostID)
+	if !ok {
+		t.Fatalf("want the exit-node to be recorded")
+	}
+	if host.Tags[operationTag] == "op1" {
+		t.Errorf("want a new operation for the new exit-node, got tags %v", host.Tags)
+	}
+	if tunnel.Status.Operation != nil {
+		t.Errorf("want the operation to be cleared, got %+v", tunnel.Status.Operation)
+	}
+}
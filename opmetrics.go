@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// operationBuckets are the buckets in seconds of the durations of calls to
+// provision or delete a host.
+var operationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// apiBuckets are the buckets in seconds of the latency of calls to the APIs
+// of providers.
+var apiBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// readyBuckets are the buckets in seconds of the time which exit-nodes take
+// to become active.
+var readyBuckets = []float64{15, 30, 60, 90, 120, 180, 300, 600, 1200}
+
+// operatorMetrics counts the actions on cloud resources of the operator and
+// how long exit-nodes take to become active.
+type operatorMetrics struct {
+	operations  *counterVec
+	failures    *counterVec
+	durations   *histogramVec
+	timeToReady *histogramVec
+
+	apiRequests  *counterVec
+	apiLatency   *histogramVec
+	apiThrottled *counterVec
+	throttled    map[string]throttleState
+
+	lock              sync.Mutex
+	provisioningSince map[string]provisioningStart
+	readyEvents       map[string][]readyEvent
+	tunnelUp          map[string]*tunnelUpState
+	usage             map[string]*exitNodeUsage
+
+	// orphans is the number of orphaned exit-nodes of each provider
+	orphans map[string]int
+}
+
+func newOperatorMetrics() *operatorMetrics {
+	return &operatorMetrics{
+		operations:        newCounterVec("action", "provider", "outcome"),
+		failures:          newCounterVec("action", "provider", "class"),
+		durations:         newHistogramVec(operationBuckets, "action", "provider"),
+		timeToReady:       newHistogramVec(readyBuckets, "provider"),
+		apiRequests:       newCounterVec("provider", "operation", "code"),
+		apiLatency:        newHistogramVec(apiBuckets, "provider", "operation"),
+		apiThrottled:      newCounterVec("provider", "operation"),
+		throttled:         map[string]throttleState{},
+		provisioningSince: map[string]provisioningStart{},
+		readyEvents:       map[string][]readyEvent{},
+		tunnelUp:          map[string]*tunnelUpState{},
+		usage:             map[string]*exitNodeUsage{},
+	}
+}
+
+// recordOperation counts an action on a cloud resource by its outcome, and
+// its failure by the class of its error.
+func (m *operatorMetrics) recordOperation(record auditRecord, err error) {
+	outcome := record.Outcome
+	if len(outcome) == 0 {
+		outcome = "success"
+	}
+	if err != nil {
+		outcome = "failure"
+		m.failures.Inc(record.Action, record.Provider, provision.ErrorClass(err))
+	}
+	m.operations.Inc(record.Action, record.Provider, outcome)
+}
+
+// ObserveAPICall counts a call of a provisioner to the API of its provider,
+// by the status code it returned, or "error" when it failed, and whether it
+// was throttled.
+func (m *operatorMetrics) ObserveAPICall(provider, operation string, statusCode int, duration time.Duration) {
+	code := "error"
+	if statusCode > 0 {
+		code = strconv.Itoa(statusCode)
+	}
+
+	m.apiRequests.Inc(provider, operation, code)
+	m.apiLatency.Observe(duration.Seconds(), provider, operation)
+	if statusCode == http.StatusTooManyRequests {
+		m.apiThrottled.Inc(provider, operation)
+
+		m.lock.Lock()
+		state := m.throttled[provider]
+		state.Requests++
+		state.Last = time.Now()
+		m.throttled[provider] = state
+		m.lock.Unlock()
+	}
+}
+
+// getThrottled returns how each provider has throttled the operator.
+func (m *operatorMetrics) getThrottled() map[string]throttleState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	throttled := map[string]throttleState{}
+	for provider, state := range m.throttled {
+		throttled[provider] = state
+	}
+	return throttled
+}
+
+// observeOperation records how long a call to the API of a provider took.
+func (m *operatorMetrics) observeOperation(action, provider string, started time.Time) {
+	m.durations.Observe(time.Since(started).Seconds(), action, provider)
+}
+
+// observeHostStatus records when the exit-node of a tunnel starts to
+// provision, then how long it took once it becomes active. Exit-nodes which
+// were provisioning when the operator started are not observed.
+func (m *operatorMetrics) observeHostStatus(tunnel *inletsv1alpha1.Tunnel, provider, status string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := string(tunnel.UID)
+	switch status {
+	case "provisioning":
+		if _, ok := m.provisioningSince[key]; !ok {
+			m.provisioningSince[key] = provisioningStart{since: time.Now(), provider: provider}
+		}
+	case "active":
+		if start, ok := m.provisioningSince[key]; ok {
+			took := time.Since(start.since)
+			m.timeToReady.Observe(took.Seconds(), provider)
+			m.observeReady(provider, took)
+		}
+		delete(m.provisioningSince, key)
+	default:
+		delete(m.provisioningSince, key)
+	}
+}
+
+// writeExitNodes writes the number of exit-nodes of Tunnels by provider and
+// status, including replacements.
+func (c *Controller) writeExitNodes(w io.Writer) error {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	counts := map[[2]string]float64{}
+	add := func(provider, status string) {
+		if len(status) == 0 {
+			return
+		}
+		if len(provider) == 0 {
+			provider = c.infra().Provider
+		}
+		counts[[2]string{provider, status}]++
+	}
+
+	for _, tunnel := range tunnels {
+		add(tunnel.Status.Provider, tunnel.Status.HostStatus)
+		if replacement := tunnel.Status.Replacement; replacement != nil {
+			add(replacement.Provider, replacement.HostStatus)
+		}
+	}
+
+	keys := [][2]string{}
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0]+"/"+keys[i][1] < keys[j][0]+"/"+keys[j][1]
+	})
+
+	samples := []metricSample{}
+	for _, key := range keys {
+		samples = append(samples, metricSample{
+			Labels: map[string]string{"provider": key[0], "status": key[1]},
+			Value:  counts[key],
+		})
+	}
+
+	writeGauge(w, "inlets_operator_exit_nodes",
+		"Number of exit-nodes of Tunnels, by provider and status, i.e. active.", samples)
+	return nil
+}
+
+// write writes the counters and histograms of the actions of
+// the operator.
+func (m *operatorMetrics) write(w io.Writer) {
+	m.operations.write(w, "inlets_operator_cloud_operations_total",
+		"Actions on cloud resources, by action, provider and outcome.")
+	m.failures.write(w, "inlets_operator_cloud_operation_failures_total",
+		"Failed actions on cloud resources, by action, provider and class of error.")
+	m.durations.write(w, "inlets_operator_cloud_operation_duration_seconds",
+		"Duration of calls to provision or delete a host, by action and provider.")
+	m.timeToReady.write(w, "inlets_operator_exit_node_ready_seconds",
+		"Time from provisioning an exit-node until it is active, by provider.")
+	m.apiRequests.write(w, "inlets_operator_provider_api_requests_total",
+		"Requests to the APIs of providers, by provider, operation and status code.")
+	m.apiLatency.write(w, "inlets_operator_provider_api_request_duration_seconds",
+		"Latency of requests to the APIs of providers, by provider and operation.")
+	m.apiThrottled.write(w, "inlets_operator_provider_api_throttled_total",
+		"Requests to the APIs of providers which were throttled with a 429, by provider and operation.")
+}
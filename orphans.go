@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// orphanGracePeriod is how old an exit-node must be before it is an
+// orphan, since one which was just provisioned may not be recorded in the
+// status of its Tunnel yet.
+const orphanGracePeriod = 15 * time.Minute
+
+// getManagedFilter returns the filter for the exit-nodes of the operator
+// with a provider. It is the same for the orphan check and adoption, so
+// that they share the hosts cached by provision.ListHosts.
+func (c *Controller) getManagedFilter(provider string) provision.HostFilter {
+	filter := provision.HostFilter{
+		Tags:       map[string]string{managedByTag: managedByValue},
+		Additional: map[string]string{},
+	}
+	if provider == "packet" {
+		filter.Additional["project_id"] = c.infra().ProjectID
+	}
+	return filter
+}
+
+// getKnownHostIDs returns the IDs of every exit-node which the operator
+// has a record of: those of Tunnels and their replacements, those kept
+// after their Tunnel was deleted and those of the warm pool.
+func (c *Controller) getKnownHostIDs() (map[string]bool, error) {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	known := map[string]bool{}
+	for _, tunnel := range tunnels {
+		if len(tunnel.Status.HostID) > 0 {
+			known[tunnel.Status.HostID] = true
+		}
+		if replacement := tunnel.Status.Replacement; replacement != nil && len(replacement.HostID) > 0 {
+			known[replacement.HostID] = true
+		}
+	}
+
+	for _, name := range []string{retainedSecretName, warmPoolSecretName} {
+		entries, err := c.listRetained(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			known[entry.HostID] = true
+		}
+	}
+	return known, nil
+}
+
+// findUntrackedExitNode returns an exit-node which was provisioned for a
+// tunnel with its token, but which the operator has no record of, i.e.
+// since the operator restarted before the status of the tunnel was
+// updated. It is adopted instead of provisioning a second exit-node.
+func (c *Controller) findUntrackedExitNode(tunnel *inletsv1alpha1.Tunnel, provisioner provision.Provisioner, provider string) *provision.ProvisionedHost {
+	if _, ok := provisioner.(provision.HostLister); !ok {
+		return nil
+	}
+
+	hosts, err := provision.ListHosts(provisioner, c.getManagedFilter(provider))
+	if err != nil {
+		c.tunnelLog(tunnel).Warn("Unable to list exit-nodes to adopt", "error", err)
+		return nil
+	}
+
+	var known map[string]bool
+	tags := getManagedTags(tunnel)
+	for _, host := range hosts {
+		if !host.HasTags(tags) {
+			continue
+		}
+
+		if known == nil {
+			if known, err = c.getKnownHostIDs(); err != nil {
+				c.tunnelLog(tunnel).Warn("Unable to list known exit-nodes", "error", err)
+				return nil
+			}
+		}
+		if known[host.ID] {
+			continue
+		}
+
+		found := host.ProvisionedHost
+		return &found
+	}
+	return nil
+}
+
+// checkOrphans lists the exit-nodes tagged by the operator with each
+// provider, and reports those which the operator has no record of, which
+// are deleted with --delete-orphans. Only the first shard checks, since
+// every instance sees every Tunnel.
+func (c *Controller) checkOrphans() {
+	if c.infra().Shards > 1 && c.getShard() != 0 {
+		return
+	}
+
+	known, err := c.getKnownHostIDs()
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	orphans := map[string]int{}
+	checked := map[string]bool{}
+	for _, target := range c.infra().GetTargets() {
+		if checked[target.Provider] {
+			continue
+		}
+		checked[target.Provider] = true
+
+		provisioner, err := c.getProvisioner(target.Provider)
+		if err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+		if _, ok := provisioner.(provision.HostLister); !ok {
+			continue
+		}
+
+		hosts, err := provision.ListHosts(provisioner, c.getManagedFilter(target.Provider))
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("error listing exit-nodes of %s: %s", target.Provider, err.Error()))
+			continue
+		}
+
+		orphans[target.Provider] = 0
+		for _, host := range hosts {
+			if known[host.ID] || host.Created.IsZero() || time.Since(host.Created) < orphanGracePeriod {
+				continue
+			}
+			orphans[target.Provider]++
+
+			entry := logWith("provider", target.Provider, "hostID", host.ID, "name", host.Name, "ip", host.IP)
+			if !c.infra().DeleteOrphans {
+				entry.Warn("Found orphaned exit-node")
+				continue
+			}
+
+			entry.Info("Deleting orphaned exit-node")
+			orphan := getRetainedTunnel("", retainedExitNode{HostID: host.ID, Provider: target.Provider})
+			if err := c.deleteHost(orphan, "orphaned"); err != nil {
+				entry.Error(err, "Error deleting orphaned exit-node")
+			}
+		}
+	}
+
+	c.metrics.lock.Lock()
+	c.metrics.orphans = orphans
+	c.metrics.lock.Unlock()
+}
+
+// writeOrphans writes the number of orphaned exit-nodes found by the last
+// check, for each provider.
+func (c *Controller) writeOrphans(w io.Writer) {
+	c.metrics.lock.Lock()
+	providers := []string{}
+	for provider := range c.metrics.orphans {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	samples := []metricSample{}
+	for _, provider := range providers {
+		samples = append(samples, metricSample{
+			Labels: map[string]string{"provider": provider},
+			Value:  float64(c.metrics.orphans[provider]),
+		})
+	}
+	c.metrics.lock.Unlock()
+
+	writeGauge(w, "inlets_operator_orphaned_exit_nodes",
+		"Exit-nodes tagged by the operator which it has no record of, older than 15 minutes, by provider.", samples)
+}
+
+// adoptUntrackedExitNode records that an exit-node which was found by
+// findUntrackedExitNode is the exit-node of a tunnel.
+func (c *Controller) adoptUntrackedExitNode(tunnel *inletsv1alpha1.Tunnel, host *provision.ProvisionedHost, target ProvisionTarget, trigger string) {
+	c.tunnelLog(tunnel).Info("Adopting untracked exit-node", "hostID", host.ID, "ip", host.IP)
+	c.audit(tunnel, auditRecord{Action: "adopt", Trigger: trigger, Provider: target.Provider, Region: target.Region, HostID: host.ID, HostIP: host.IP}, nil)
+	c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessAdopted,
+		"Took over exit-node %s which was provisioned for the tunnel but not recorded", host.ID)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// isPaused returns whether the tunnel is paused, and whether its exit-node
+// should be deprovisioned whilst it is paused.
+func isPaused(tunnel *inletsv1alpha1.Tunnel) (bool, bool) {
+	switch tunnel.Annotations[pausedAnnotation] {
+	case "true":
+		return true, false
+	case "deprovision":
+		return true, true
+	}
+	return false, false
+}
+
+// syncPaused records that the tunnel is paused, and deprovisions its
+// exit-node and client when requested.
+func (c *Controller) syncPaused(tunnel *inletsv1alpha1.Tunnel, deprovision bool) error {
+	tunnelCopy := tunnel.DeepCopy()
+
+	if deprovision && len(tunnel.Status.HostID) > 0 {
+		c.tunnelLog(tunnel).Info("Deprovisioning paused exit-node", "ip", tunnel.Status.HostIP)
+		if err := c.deprovisionExitNode(tunnel, "paused"); err != nil {
+			return err
+		}
+
+		if err := c.deleteClient(tunnel); err != nil {
+			return err
+		}
+
+		tunnelCopy.Spec.ClientDeploymentRef = nil
+		clearExitNode(&tunnelCopy.Status)
+
+		c.recorder.Event(tunnel, corev1.EventTypeNormal, SuccessPaused, "Exit-node deprovisioned whilst paused")
+	}
+
+	condition := inletsv1alpha1.TunnelCondition{
+		Type:   inletsv1alpha1.TunnelPaused,
+		Status: corev1.ConditionTrue,
+		Reason: "Annotated",
+	}
+
+	if hasCondition(tunnel.Status.Conditions, condition) && tunnelCopy.Status.HostID == tunnel.Status.HostID {
+		return nil
+	}
+
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, condition)
+
+	return c.updateTunnelSpecAndStatus(tunnelCopy)
+}
+
+// syncResumed removes the paused condition from a tunnel which is no
+// longer paused.
+func (c *Controller) syncResumed(tunnel *inletsv1alpha1.Tunnel) (*inletsv1alpha1.Tunnel, error) {
+	for _, condition := range tunnel.Status.Conditions {
+		if condition.Type == inletsv1alpha1.TunnelPaused {
+			tunnelCopy := tunnel.DeepCopy()
+			tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelPaused)
+
+			return c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+		}
+	}
+	return tunnel, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func TestSyncPausedDeprovisionsExitNode(t *testing.T) {
+	f := newFixture(t)
+	if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Create(newPublishedService()); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+
+	tunnel := newActiveTunnel("app")
+	tunnel.Annotations = map[string]string{pausedAnnotation: "deprovision"}
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Status.HostIP = "203.0.113.1"
+	tunnel.Status.ActiveClient = "app-client-0"
+	f.create(tunnel)
+
+	if err := f.sync("app"); err != nil {
+		t.Fatalf("error syncing tunnel: %s", err.Error())
+	}
+
+	got := f.get("app")
+	if len(got.Status.HostID) > 0 || len(got.Status.ActiveClient) > 0 {
+		t.Errorf("want the exit-node to be cleared from the status, got %q %q", got.Status.HostID, got.Status.ActiveClient)
+	}
+	if condition := getCondition(got.Status.Conditions, inletsv1alpha1.TunnelPaused); condition == nil {
+		t.Errorf("want the tunnel to be recorded as paused")
+	}
+
+	service, _ := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get("app", metav1.GetOptions{})
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "203.0.113.2" {
+		t.Errorf("want the IP of the paused exit-node to be unpublished, got %v", service.Spec.ExternalIPs)
+	}
+}
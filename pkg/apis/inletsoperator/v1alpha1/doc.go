@@ -15,7 +15,7 @@ limitations under the License.
 */
 
 // +k8s:deepcopy-gen=package
-// +groupName=inletsoperator.k8s.io
+// +groupName=inlets.alexellis.io
 
 // Package v1alpha1 is the v1alpha1 version of the API.
 package v1alpha1
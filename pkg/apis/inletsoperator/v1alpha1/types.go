@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -36,8 +37,243 @@ type Tunnel struct {
 type TunnelSpec struct {
 	ServiceName string `json:"serviceName"`
 
+	// TunnelClassName is the TunnelClass to provision the exit-node with,
+	// the default TunnelClass is used when empty, if there is one.
+	TunnelClassName string `json:"tunnelClassName,omitempty"`
+
+	// Upstream is used instead of a Service to forward traffic to any
+	// in-cluster address in the form host:port, i.e. a Pod of a StatefulSet.
+	Upstream string `json:"upstream,omitempty"`
+
 	ClientDeploymentRef *metav1.ObjectMeta `json:"client_deployment"`
 	AuthToken           string             `json:"auth_token"`
+
+	// AuthTokenFrom reads the token from a Secret or Azure Key Vault
+	// instead of authToken, so that it is never written into the Tunnel.
+	AuthTokenFrom *TunnelTokenSource `json:"authTokenFrom,omitempty"`
+
+	// Hostname is published for external-dns, used for the certificate when
+	// TLS is enabled, and routed to this tunnel by the Host header.
+	Hostname string `json:"hostname,omitempty"`
+
+	// SharedExitNode is the name of a Tunnel in the same namespace whose
+	// exit-node is used instead of provisioning one. Only HTTP tunnels can
+	// share an exit-node, which routes requests by their Host header.
+	SharedExitNode string `json:"sharedExitNode,omitempty"`
+
+	// WildcardDomain assigns this tunnel, and each Tunnel sharing its
+	// exit-node, a subdomain such as name.tunnels.example.com when it has
+	// no hostname. A wildcard DNS record must point at the exit-node.
+	WildcardDomain string `json:"wildcardDomain,omitempty"`
+
+	// Region to provision the exit-node into, the region of the operator
+	// is used when empty.
+	Region string `json:"region,omitempty"`
+
+	// Protocol is "http" to tunnel HTTP traffic at L7, or "tcp" or "udp" to
+	// tunnel traffic at L4 with inlets-pro, "http" is used when empty. The
+	// ports of a Service are forwarded with their own protocol at L4, whilst
+	// the port of an upstream is forwarded with this protocol.
+	Protocol string `json:"protocol,omitempty"`
+
+	// ProxyProtocol enables the PROXY protocol, "v1" or "v2", so that the
+	// upstream sees the real IP of the client. It requires inlets-pro.
+	ProxyProtocol string `json:"proxyProtocol,omitempty"`
+
+	// RotationPolicy replaces the exit-node on a schedule, with a new IP
+	// and token, i.e. "daily", "weekly" or a duration such as "12h".
+	RotationPolicy string `json:"rotationPolicy,omitempty"`
+
+	// TLS serves the tunnel over HTTPS with a certificate from cert-manager.
+	// It requires inlets-pro.
+	TLS *TunnelTLS `json:"tls,omitempty"`
+
+	// ClientMode is "deployment" to run the client in its own Deployment,
+	// "daemonset" to run a client on every node for faster reconnection when
+	// a node fails, or "sidecar" to inject it into the Pods of a workload
+	// annotated with dev.inlets.sidecar, "deployment" is used when empty.
+	ClientMode string `json:"clientMode,omitempty"`
+
+	// Client configures the client Pod.
+	Client *TunnelClient `json:"client,omitempty"`
+
+	// ClientScheduling constrains the nodes that the client Pod can run on,
+	// i.e. nodes with egress to the Internet.
+	ClientScheduling *ClientScheduling `json:"clientScheduling,omitempty"`
+
+	// APIServer tunnels the Kubernetes API server of the cluster at L4 with
+	// inlets-pro, on the port it listens on, i.e. 6443. AllowedSourceCIDRs
+	// must be set, and serviceName and upstream must be empty.
+	APIServer bool `json:"apiServer,omitempty"`
+
+	// AllowedSourceCIDRs limits the sources which can connect to the
+	// data-ports of the exit-node, i.e. "203.0.113.0/24". The control-port
+	// stays open for the client.
+	AllowedSourceCIDRs []string `json:"allowedSourceCIDRs,omitempty"`
+
+	// ReservedIP reserves a public IP from the provider for the tunnel, which
+	// is moved to each new exit-node and only released when the Tunnel is
+	// deleted.
+	ReservedIP bool `json:"reservedIP,omitempty"`
+
+	// MutualTLS has the client and exit-node of an inlets-pro tunnel
+	// authenticate each other with certificates from a CA generated for
+	// the tunnel, so that its token alone cannot be used to connect.
+	MutualTLS bool `json:"mutualTLS,omitempty"`
+
+	// ControlPlaneTLS has the exit-node of an inlets-pro tunnel serve its
+	// control-port with a certificate signed by a CA of the operator,
+	// which the client validates. It is set from --control-plane-tls
+	// before the exit-node is provisioned, when it is not set.
+	ControlPlaneTLS *bool `json:"controlPlaneTLS,omitempty"`
+
+	// Sandbox confines the inlets server on the exit-node with a seccomp
+	// filter, an AppArmor profile and a read-only filesystem.
+	Sandbox bool `json:"sandbox,omitempty"`
+
+	// AuthProxy puts oauth2-proxy in front of an HTTP tunnel on its
+	// exit-node, so that visitors have to sign in with an OAuth2 or OIDC
+	// provider before they reach the upstream.
+	AuthProxy *TunnelAuthProxy `json:"authProxy,omitempty"`
+
+	// Auth puts a simpler auth layer than authProxy in front of an HTTP
+	// tunnel on its exit-node.
+	Auth *TunnelAuth `json:"auth,omitempty"`
+
+	// Schedule limits when the tunnel has an exit-node to a window of time,
+	// i.e. business hours. The exit-node is provisioned when the window
+	// starts and deprovisioned when it ends.
+	Schedule *TunnelSchedule `json:"schedule,omitempty"`
+
+	// RateLimit caps the connections which each source can make to the
+	// data-ports of the exit-node, to protect small exit-nodes from
+	// trivial floods.
+	RateLimit *TunnelRateLimit `json:"rateLimit,omitempty"`
+
+	// ServiceAccountToken has the client of an inlets-pro tunnel present a
+	// projected ServiceAccount token, which its exit-node validates
+	// against the keys of the cluster's issuer, instead of the token of
+	// the tunnel. Experimental.
+	ServiceAccountToken *TunnelServiceAccountToken `json:"serviceAccountToken,omitempty"`
+}
+
+// TunnelServiceAccountToken is the projected ServiceAccount token of a
+// client
+type TunnelServiceAccountToken struct {
+	// Audience of the token, "inlets:NAMESPACE:NAME" when empty.
+	Audience string `json:"audience,omitempty"`
+
+	// ExpirationSeconds of the token, which the kubelet renews, or 3600
+	// when 0.
+	ExpirationSeconds int64 `json:"expirationSeconds,omitempty"`
+}
+
+// TunnelRateLimit limits the connections of each source IP to the
+// data-ports of an exit-node with iptables
+type TunnelRateLimit struct {
+	// ConnectionsPerSource is how many connections a source can have open
+	// at once, or no limit when 0.
+	ConnectionsPerSource int32 `json:"connectionsPerSource,omitempty"`
+
+	// NewConnectionsPerMinute is how many new connections a source can
+	// make per minute, with bursts of as many, or no limit when 0.
+	NewConnectionsPerMinute int32 `json:"newConnectionsPerMinute,omitempty"`
+
+	// BanDuration is how long a source which goes over
+	// newConnectionsPerMinute is dropped for, i.e. "10m", or only its
+	// excess connections are dropped when empty.
+	BanDuration string `json:"banDuration,omitempty"`
+}
+
+// TunnelSchedule is a daily window of time in which a tunnel is exposed
+type TunnelSchedule struct {
+	// Start and End of the window as "15:04", i.e. "09:00" and "17:30". A
+	// window which ends before it starts runs overnight.
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Days which the window starts on, i.e. ["Mon", "Tue"], or every day
+	// when empty.
+	Days []string `json:"days,omitempty"`
+
+	// TimeZone of the window, i.e. "Europe/London", or UTC when empty.
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// TunnelTokenSource refers to the token of a tunnel, with one of its
+// fields set.
+type TunnelTokenSource struct {
+	// SecretKeyRef is a key of a Secret in the namespace of the Tunnel.
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+
+	// KeyVaultSecret is the URL of an Azure Key Vault secret, such as
+	// "https://my-vault.vault.azure.net/secrets/inlets-token", which is
+	// read with the identity of the operator.
+	KeyVaultSecret string `json:"keyVaultSecret,omitempty"`
+}
+
+// TunnelTLS is used to create a cert-manager Certificate for the hostname
+// of a tunnel, which is served by a TLS-terminating proxy in the client Pod.
+type TunnelTLS struct {
+	// Hostname of the certificate, spec.hostname is used when empty.
+	Hostname string `json:"hostname,omitempty"`
+
+	// IssuerName and IssuerKind refer to the cert-manager Issuer or
+	// ClusterIssuer, "Issuer" is used when IssuerKind is empty.
+	IssuerName string `json:"issuerName"`
+	IssuerKind string `json:"issuerKind,omitempty"`
+}
+
+// TunnelAuth configures the auth layer on the exit-node of a tunnel.
+type TunnelAuth struct {
+	// Basic requires a username and password with HTTP basic auth.
+	Basic *TunnelBasicAuth `json:"basic,omitempty"`
+}
+
+// TunnelBasicAuth configures HTTP basic auth on the exit-node of a tunnel.
+type TunnelBasicAuth struct {
+	// SecretName is a Secret in the namespace of the Tunnel with the
+	// username and password keys of a kubernetes.io/basic-auth Secret.
+	SecretName string `json:"secretName"`
+}
+
+// TunnelAuthProxy configures oauth2-proxy on the exit-node of a tunnel.
+type TunnelAuthProxy struct {
+	// SecretName is the Secret in the namespace of the Tunnel with the
+	// client-id, client-secret and cookie-secret of oauth2-proxy, and
+	// optionally its provider, oidc-issuer-url and email-domain.
+	SecretName string `json:"secretName"`
+}
+
+// TunnelClient configures the client Pod of a tunnel.
+type TunnelClient struct {
+	// HostNetwork runs the client in the network of its node, so that the
+	// upstream can be a workload bound to the node, i.e. 127.0.0.1:80 for an
+	// ingress controller with a hostPort.
+	HostNetwork bool `json:"hostNetwork,omitempty"`
+
+	// PriorityClassName is set on the client Pod, so that it is not one of
+	// the first Pods to be evicted when a node is under pressure.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// DisruptionBudget creates a PodDisruptionBudget with a minAvailable of
+	// 1 for the client, so that it is not evicted by a voluntary disruption
+	// such as draining a node.
+	DisruptionBudget bool `json:"disruptionBudget,omitempty"`
+
+	// ExtraArgs are added to the arguments of the client, i.e.
+	// "--strict-forwarding". Only flags which are on the allowlist of the
+	// operator can be used.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+}
+
+// ClientScheduling is copied into the Pod spec of the client Deployment.
+// topologySpreadConstraints is not available in the Kubernetes API version
+// used by the operator.
+type ClientScheduling struct {
+	NodeSelector map[string]string   `json:"nodeSelector,omitempty"`
+	Tolerations  []corev1.Toleration `json:"tolerations,omitempty"`
+	Affinity     *corev1.Affinity    `json:"affinity,omitempty"`
 }
 
 // TunnelStatus is the status for a Tunnel resource
@@ -45,6 +281,155 @@ type TunnelStatus struct {
 	HostStatus string `json:"hostStatus"`
 	HostIP     string `json:"hostIP"`
 	HostID     string `json:"hostId"`
+
+	// Address is the hostname of the tunnel when it has one, otherwise the
+	// IP of its exit-node. It is where the data-plane is reached.
+	Address string `json:"address,omitempty"`
+
+	// ControlPlaneURL is the URL which the client connects to on the
+	// exit-node, i.e. "wss://203.0.113.10:8123/connect" for inlets-pro, and
+	// ControlPlanePort is its port.
+	ControlPlaneURL  string `json:"controlPlaneURL,omitempty"`
+	ControlPlanePort int32  `json:"controlPlanePort,omitempty"`
+
+	// ReservedIP is the IP reserved for the tunnel when spec.reservedIP is
+	// set. It is kept while the tunnel has no exit-node.
+	ReservedIP string `json:"reservedIP,omitempty"`
+
+	// Provider and Region record where the exit-node was provisioned.
+	Provider string `json:"provider,omitempty"`
+	Region   string `json:"region,omitempty"`
+
+	// EstimatedHourlyCost is the estimated cost of the exit-node in USD per
+	// hour, from the list price of its plan.
+	EstimatedHourlyCost string `json:"estimatedHourlyCost,omitempty"`
+
+	// ProvisionedAt is the time when the exit-node became active.
+	ProvisionedAt *metav1.Time `json:"provisionedAt,omitempty"`
+
+	// ActiveClient is the client Pod which holds the tunnel when the client
+	// runs as a DaemonSet.
+	ActiveClient string `json:"activeClient,omitempty"`
+
+	// Replacement is the exit-node which is being provisioned to replace
+	// the exit-node of the tunnel, or the old exit-node whilst the client
+	// moves over to the new one.
+	Replacement *TunnelReplacement `json:"replacement,omitempty"`
+
+	// Firewall records the exit-node and the allowedSourceCIDRs which the
+	// firewall of the provider was last set up for, so that it is updated
+	// when either changes.
+	Firewall *TunnelFirewall `json:"firewall,omitempty"`
+
+	// Usage is the CPU, memory and network usage of the exit-node, from the
+	// monitoring API of its provider, when --usage-interval is set.
+	Usage *TunnelUsage `json:"usage,omitempty"`
+
+	// Operation is the call to the provider to create the exit-node which
+	// is in flight, which is recorded before the call is made, so that
+	// the exit-node can be found again when the operator restarts before
+	// its ID is recorded.
+	Operation *TunnelOperation `json:"operation,omitempty"`
+
+	Conditions []TunnelCondition `json:"conditions,omitempty"`
+}
+
+// TunnelOperation is a call to a provider whose outcome is not recorded yet
+type TunnelOperation struct {
+	// Phase is "Creating" whilst the exit-node is being created.
+	Phase string `json:"phase"`
+
+	// ID is unique to the operation, and is a tag of the exit-node which
+	// it creates.
+	ID        string      `json:"id"`
+	Provider  string      `json:"provider,omitempty"`
+	Region    string      `json:"region,omitempty"`
+	StartedAt metav1.Time `json:"startedAt"`
+}
+
+// TunnelFirewall is the firewall of the provider for an exit-node
+type TunnelFirewall struct {
+	HostID              string   `json:"hostId"`
+	AllowedSourceCIDRs  []string `json:"allowedSourceCIDRs,omitempty"`
+	ControlPlaneSources []string `json:"controlPlaneSources,omitempty"`
+}
+
+// TunnelUsage is the average usage of an exit-node over the last interval
+// that it was observed for. Values are strings, as with EstimatedHourlyCost,
+// i.e. "12.5".
+type TunnelUsage struct {
+	CPUPercent    string `json:"cpuPercent,omitempty"`
+	MemoryPercent string `json:"memoryPercent,omitempty"`
+
+	// NetworkReceiveBytesPerSecond and NetworkTransmitBytesPerSecond are
+	// the traffic of the public interface of the exit-node.
+	NetworkReceiveBytesPerSecond  string `json:"networkReceiveBytesPerSecond,omitempty"`
+	NetworkTransmitBytesPerSecond string `json:"networkTransmitBytesPerSecond,omitempty"`
+
+	ObservedAt metav1.Time `json:"observedAt"`
+}
+
+// TunnelReplacement is an exit-node taking part in a blue/green replacement
+type TunnelReplacement struct {
+	// HostStatus is "provisioning" for the new exit-node, then "draining"
+	// for the old exit-node once the client was moved over.
+	HostStatus          string `json:"hostStatus"`
+	HostID              string `json:"hostId"`
+	HostIP              string `json:"hostIP,omitempty"`
+	Provider            string `json:"provider,omitempty"`
+	Region              string `json:"region,omitempty"`
+	EstimatedHourlyCost string `json:"estimatedHourlyCost,omitempty"`
+
+	// AuthToken is the token of the new exit-node, which becomes the token
+	// of the tunnel when the client is moved over. Whilst draining, it is
+	// the token of the old exit-node, so that the client can be moved back.
+	AuthToken string `json:"authToken,omitempty"`
+
+	// ProvisionedAt is when the old exit-node was provisioned, whilst it is
+	// draining.
+	ProvisionedAt *metav1.Time `json:"provisionedAt,omitempty"`
+
+	// Reason is why the exit-node is being replaced.
+	Reason string `json:"reason,omitempty"`
+}
+
+// TunnelConditionType is the type of a TunnelCondition
+type TunnelConditionType string
+
+const (
+	// TunnelPending is true when an exit-node cannot be provisioned yet,
+	// i.e. due to the quota of the operator
+	TunnelPending TunnelConditionType = "Pending"
+	// TunnelPaused is true when the Tunnel is not being reconciled due to
+	// its paused annotation
+	TunnelPaused TunnelConditionType = "Paused"
+	// TunnelDrifted is true when the exit-node was changed outside of the
+	// operator, i.e. resized or rebuilt from the console of the provider
+	TunnelDrifted TunnelConditionType = "Drifted"
+	// TunnelClientConnected is true when the client is connected to the
+	// exit-node
+	TunnelClientConnected TunnelConditionType = "ClientConnected"
+	// TunnelPublished is true when the IP of the exit-node was written into
+	// the Service, after traffic was seen to flow through the tunnel
+	TunnelPublished TunnelConditionType = "Published"
+	// TunnelEndpointsReady is true when the Service of the Tunnel has at
+	// least one ready endpoint
+	TunnelEndpointsReady TunnelConditionType = "EndpointsReady"
+	// TunnelScaledToZero is true when the exit-node was deprovisioned since
+	// the Service had no ready endpoints
+	TunnelScaledToZero TunnelConditionType = "ScaledToZero"
+	// TunnelOutsideSchedule is true when the exit-node was deprovisioned,
+	// or is not provisioned, since it is outside the Tunnel's schedule.
+	TunnelOutsideSchedule TunnelConditionType = "OutsideSchedule"
+)
+
+// TunnelCondition describes the state of a Tunnel at a certain point
+type TunnelCondition struct {
+	Type               TunnelConditionType    `json:"type"`
+	Status             corev1.ConditionStatus `json:"status"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -56,3 +441,62 @@ type TunnelList struct {
 
 	Items []Tunnel `json:"items"`
 }
+
+// +genclient
+// +genclient:nonNamespaced
+// +genclient:noStatus
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// TunnelClass is a cluster-wide set of settings for the exit-nodes of
+// Tunnels, which Tunnels refer to by name
+type TunnelClass struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TunnelClassSpec `json:"spec"`
+}
+
+// TunnelClassSpec is the spec for a TunnelClass resource, the settings of
+// the operator are used for any field which is empty
+type TunnelClassSpec struct {
+	Provider  string `json:"provider,omitempty"`
+	Region    string `json:"region,omitempty"`
+	ProjectID string `json:"projectId,omitempty"`
+
+	// AccessKeySecret refers to the Secret with the access key for the
+	// provider.
+	AccessKeySecret *SecretKeyReference `json:"accessKeySecret,omitempty"`
+
+	// Plan and OS are the size and image of the exit-node, such as
+	// "s-1vcpu-1gb" and "ubuntu-18-04-x64".
+	Plan string `json:"plan,omitempty"`
+	OS   string `json:"os,omitempty"`
+
+	// Domain is used to publish a hostname for the Services of Tunnels
+	// without a hostname annotation, in the form service.namespace.domain.
+	Domain string `json:"domain,omitempty"`
+
+	// CopyLicense copies the inlets-pro license of the operator into the
+	// token Secret of each inlets-pro Tunnel of the class, in the namespace
+	// of the Tunnel, for its client. Without it, inlets-pro Tunnels of the
+	// class aren't provisioned, so the license isn't given to namespaces
+	// which weren't meant to have it.
+	CopyLicense bool `json:"copyLicense,omitempty"`
+}
+
+// SecretKeyReference refers to a key in a Secret
+type SecretKeyReference struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Key       string `json:"key"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// TunnelClassList is a list of TunnelClass resources
+type TunnelClassList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []TunnelClass `json:"items"`
+}
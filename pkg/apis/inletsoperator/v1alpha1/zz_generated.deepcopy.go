@@ -21,17 +21,69 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClientScheduling) DeepCopyInto(out *ClientScheduling) {
+	*out = *in
+	if in.NodeSelector != nil {
+		in, out := &in.NodeSelector, &out.NodeSelector
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Tolerations != nil {
+		in, out := &in.Tolerations, &out.Tolerations
+		*out = make([]corev1.Toleration, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Affinity != nil {
+		in, out := &in.Affinity, &out.Affinity
+		*out = new(corev1.Affinity)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClientScheduling.
+func (in *ClientScheduling) DeepCopy() *ClientScheduling {
+	if in == nil {
+		return nil
+	}
+	out := new(ClientScheduling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretKeyReference) DeepCopyInto(out *SecretKeyReference) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretKeyReference.
+func (in *SecretKeyReference) DeepCopy() *SecretKeyReference {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretKeyReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Tunnel) DeepCopyInto(out *Tunnel) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -53,6 +105,204 @@ func (in *Tunnel) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelAuth) DeepCopyInto(out *TunnelAuth) {
+	*out = *in
+	if in.Basic != nil {
+		in, out := &in.Basic, &out.Basic
+		*out = new(TunnelBasicAuth)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelAuth.
+func (in *TunnelAuth) DeepCopy() *TunnelAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelAuthProxy) DeepCopyInto(out *TunnelAuthProxy) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelAuthProxy.
+func (in *TunnelAuthProxy) DeepCopy() *TunnelAuthProxy {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelAuthProxy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelBasicAuth) DeepCopyInto(out *TunnelBasicAuth) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelBasicAuth.
+func (in *TunnelBasicAuth) DeepCopy() *TunnelBasicAuth {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelBasicAuth)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelClass) DeepCopyInto(out *TunnelClass) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelClass.
+func (in *TunnelClass) DeepCopy() *TunnelClass {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelClass)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TunnelClass) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelClassList) DeepCopyInto(out *TunnelClassList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	out.ListMeta = in.ListMeta
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]TunnelClass, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelClassList.
+func (in *TunnelClassList) DeepCopy() *TunnelClassList {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelClassList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *TunnelClassList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelClassSpec) DeepCopyInto(out *TunnelClassSpec) {
+	*out = *in
+	if in.AccessKeySecret != nil {
+		in, out := &in.AccessKeySecret, &out.AccessKeySecret
+		*out = new(SecretKeyReference)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelClassSpec.
+func (in *TunnelClassSpec) DeepCopy() *TunnelClassSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelClassSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelClient) DeepCopyInto(out *TunnelClient) {
+	*out = *in
+	if in.ExtraArgs != nil {
+		in, out := &in.ExtraArgs, &out.ExtraArgs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelClient.
+func (in *TunnelClient) DeepCopy() *TunnelClient {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelClient)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelCondition) DeepCopyInto(out *TunnelCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelCondition.
+func (in *TunnelCondition) DeepCopy() *TunnelCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelFirewall) DeepCopyInto(out *TunnelFirewall) {
+	*out = *in
+	if in.AllowedSourceCIDRs != nil {
+		in, out := &in.AllowedSourceCIDRs, &out.AllowedSourceCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ControlPlaneSources != nil {
+		in, out := &in.ControlPlaneSources, &out.ControlPlaneSources
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelFirewall.
+func (in *TunnelFirewall) DeepCopy() *TunnelFirewall {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelFirewall)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TunnelList) DeepCopyInto(out *TunnelList) {
 	*out = *in
@@ -86,6 +336,59 @@ func (in *TunnelList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelRateLimit) DeepCopyInto(out *TunnelRateLimit) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelRateLimit.
+func (in *TunnelRateLimit) DeepCopy() *TunnelRateLimit {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelRateLimit)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelSchedule) DeepCopyInto(out *TunnelSchedule) {
+	*out = *in
+	if in.Days != nil {
+		in, out := &in.Days, &out.Days
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelSchedule.
+func (in *TunnelSchedule) DeepCopy() *TunnelSchedule {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelSchedule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelServiceAccountToken) DeepCopyInto(out *TunnelServiceAccountToken) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelServiceAccountToken.
+func (in *TunnelServiceAccountToken) DeepCopy() *TunnelServiceAccountToken {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelServiceAccountToken)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TunnelSpec) DeepCopyInto(out *TunnelSpec) {
 	*out = *in
@@ -94,6 +397,61 @@ func (in *TunnelSpec) DeepCopyInto(out *TunnelSpec) {
 		*out = new(v1.ObjectMeta)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(TunnelTLS)
+		**out = **in
+	}
+	if in.Client != nil {
+		in, out := &in.Client, &out.Client
+		*out = new(TunnelClient)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ClientScheduling != nil {
+		in, out := &in.ClientScheduling, &out.ClientScheduling
+		*out = new(ClientScheduling)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.AllowedSourceCIDRs != nil {
+		in, out := &in.AllowedSourceCIDRs, &out.AllowedSourceCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ControlPlaneTLS != nil {
+		in, out := &in.ControlPlaneTLS, &out.ControlPlaneTLS
+		*out = new(bool)
+		**out = **in
+	}
+	if in.AuthProxy != nil {
+		in, out := &in.AuthProxy, &out.AuthProxy
+		*out = new(TunnelAuthProxy)
+		**out = **in
+	}
+	if in.Auth != nil {
+		in, out := &in.Auth, &out.Auth
+		*out = new(TunnelAuth)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Schedule != nil {
+		in, out := &in.Schedule, &out.Schedule
+		*out = new(TunnelSchedule)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RateLimit != nil {
+		in, out := &in.RateLimit, &out.RateLimit
+		*out = new(TunnelRateLimit)
+		**out = **in
+	}
+	if in.ServiceAccountToken != nil {
+		in, out := &in.ServiceAccountToken, &out.ServiceAccountToken
+		*out = new(TunnelServiceAccountToken)
+		**out = **in
+	}
+	if in.AuthTokenFrom != nil {
+		in, out := &in.AuthTokenFrom, &out.AuthTokenFrom
+		*out = new(TunnelTokenSource)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -107,9 +465,77 @@ func (in *TunnelSpec) DeepCopy() *TunnelSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelOperation) DeepCopyInto(out *TunnelOperation) {
+	*out = *in
+	in.StartedAt.DeepCopyInto(&out.StartedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelOperation.
+func (in *TunnelOperation) DeepCopy() *TunnelOperation {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelOperation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelReplacement) DeepCopyInto(out *TunnelReplacement) {
+	*out = *in
+	if in.ProvisionedAt != nil {
+		in, out := &in.ProvisionedAt, &out.ProvisionedAt
+		*out = (*in).DeepCopy()
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelReplacement.
+func (in *TunnelReplacement) DeepCopy() *TunnelReplacement {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelReplacement)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *TunnelStatus) DeepCopyInto(out *TunnelStatus) {
 	*out = *in
+	if in.ProvisionedAt != nil {
+		in, out := &in.ProvisionedAt, &out.ProvisionedAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Replacement != nil {
+		in, out := &in.Replacement, &out.Replacement
+		*out = new(TunnelReplacement)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Firewall != nil {
+		in, out := &in.Firewall, &out.Firewall
+		*out = new(TunnelFirewall)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Usage != nil {
+		in, out := &in.Usage, &out.Usage
+		*out = new(TunnelUsage)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Operation != nil {
+		in, out := &in.Operation, &out.Operation
+		*out = new(TunnelOperation)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]TunnelCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -122,3 +548,57 @@ func (in *TunnelStatus) DeepCopy() *TunnelStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelUsage) DeepCopyInto(out *TunnelUsage) {
+	*out = *in
+	in.ObservedAt.DeepCopyInto(&out.ObservedAt)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelUsage.
+func (in *TunnelUsage) DeepCopy() *TunnelUsage {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelUsage)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelTLS) DeepCopyInto(out *TunnelTLS) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelTLS.
+func (in *TunnelTLS) DeepCopy() *TunnelTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TunnelTokenSource) DeepCopyInto(out *TunnelTokenSource) {
+	*out = *in
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(corev1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TunnelTokenSource.
+func (in *TunnelTokenSource) DeepCopy() *TunnelTokenSource {
+	if in == nil {
+		return nil
+	}
+	out := new(TunnelTokenSource)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -32,6 +32,10 @@ func (c *FakeInletsoperatorV1alpha1) Tunnels(namespace string) v1alpha1.TunnelIn
 	return &FakeTunnels{c, namespace}
 }
 
+func (c *FakeInletsoperatorV1alpha1) TunnelClasses() v1alpha1.TunnelClassInterface {
+	return &FakeTunnelClasses{c}
+}
+
 // RESTClient returns a RESTClient that is used to communicate
 // with API server by this client implementation.
 func (c *FakeInletsoperatorV1alpha1) RESTClient() rest.Interface {
@@ -28,9 +28,10 @@ import (
 type InletsoperatorV1alpha1Interface interface {
 	RESTClient() rest.Interface
 	TunnelsGetter
+	TunnelClassesGetter
 }
 
-// InletsoperatorV1alpha1Client is used to interact with features provided by the inletsoperator.k8s.io group.
+// InletsoperatorV1alpha1Client is used to interact with features provided by the inlets.alexellis.io group.
 type InletsoperatorV1alpha1Client struct {
 	restClient rest.Interface
 }
@@ -39,6 +40,10 @@ func (c *InletsoperatorV1alpha1Client) Tunnels(namespace string) TunnelInterface
 	return newTunnels(c, namespace)
 }
 
+func (c *InletsoperatorV1alpha1Client) TunnelClasses() TunnelClassInterface {
+	return newTunnelClasses(c)
+}
+
 // NewForConfig creates a new InletsoperatorV1alpha1Client for the given config.
 func NewForConfig(c *rest.Config) (*InletsoperatorV1alpha1Client, error) {
 	config := *c
@@ -52,9 +52,11 @@ func (f *genericInformer) Lister() cache.GenericLister {
 // TODO extend this to unknown resources with a client pool
 func (f *sharedInformerFactory) ForResource(resource schema.GroupVersionResource) (GenericInformer, error) {
 	switch resource {
-	// Group=inletsoperator.k8s.io, Version=v1alpha1
+	// Group=inlets.alexellis.io, Version=v1alpha1
 	case v1alpha1.SchemeGroupVersion.WithResource("tunnels"):
 		return &genericInformer{resource: resource.GroupResource(), informer: f.Inletsoperator().V1alpha1().Tunnels().Informer()}, nil
+	case v1alpha1.SchemeGroupVersion.WithResource("tunnelclasses"):
+		return &genericInformer{resource: resource.GroupResource(), informer: f.Inletsoperator().V1alpha1().TunnelClasses().Informer()}, nil
 
 	}
 
@@ -26,6 +26,8 @@ import (
 type Interface interface {
 	// Tunnels returns a TunnelInformer.
 	Tunnels() TunnelInformer
+	// TunnelClasses returns a TunnelClassInformer.
+	TunnelClasses() TunnelClassInformer
 }
 
 type version struct {
@@ -43,3 +45,8 @@ func New(f internalinterfaces.SharedInformerFactory, namespace string, tweakList
 func (v *version) Tunnels() TunnelInformer {
 	return &tunnelInformer{factory: v.factory, namespace: v.namespace, tweakListOptions: v.tweakListOptions}
 }
+
+// TunnelClasses returns a TunnelClassInformer.
+func (v *version) TunnelClasses() TunnelClassInformer {
+	return &tunnelClassInformer{factory: v.factory, tweakListOptions: v.tweakListOptions}
+}
@@ -22,6 +22,10 @@ package v1alpha1
 // TunnelLister.
 type TunnelListerExpansion interface{}
 
+// TunnelClassListerExpansion allows custom methods to be added to
+// TunnelClassLister.
+type TunnelClassListerExpansion interface{}
+
 // TunnelNamespaceListerExpansion allows custom methods to be added to
 // TunnelNamespaceLister.
 type TunnelNamespaceListerExpansion interface{}
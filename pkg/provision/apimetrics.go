@@ -0,0 +1,231 @@
+package provision
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// ClientOptions are the options of the HTTP clients of all provisioners
+type ClientOptions struct {
+	// UserAgent is added to the User-Agent of each request, i.e.
+	// "inlets-operator", so that the operator can be told apart in the
+	// audit log of the account
+	UserAgent string
+
+	// Retries is how many times a GET which failed to connect, or which
+	// returned a 502, 503 or 504, is retried, with an exponential backoff
+	Retries int
+
+	// Transport sends the requests, and is http.DefaultTransport when nil,
+	// i.e. a cassette.Recorder which records or replays them in tests
+	Transport http.RoundTripper
+}
+
+// retryBackoff is the wait before the first retry of a request, which
+// doubles for each retry after
+const retryBackoff = 500 * time.Millisecond
+
+// maxRetryWait is the longest a request is held back for a retry when the
+// provider sends Retry-After. When it asks for longer, the response is
+// returned, so that the controller requeues the tunnel for that long
+// instead of blocking a worker.
+const maxRetryWait = 30 * time.Second
+
+var (
+	clientOptions     = ClientOptions{Retries: 2}
+	clientOptionsLock sync.RWMutex
+)
+
+// SetClientOptions sets the options of the HTTP clients of all
+// provisioners
+func SetClientOptions(options ClientOptions) {
+	clientOptionsLock.Lock()
+	defer clientOptionsLock.Unlock()
+	clientOptions = options
+}
+
+func getClientOptions() ClientOptions {
+	clientOptionsLock.RLock()
+	defer clientOptionsLock.RUnlock()
+	return clientOptions
+}
+
+// APIObserver is told of each call which a provisioner makes to the API of
+// its provider, i.e. to count requests and throttling in metrics
+type APIObserver interface {
+	ObserveAPICall(provider, operation string, statusCode int, duration time.Duration)
+}
+
+var (
+	apiObserver     APIObserver
+	apiObserverLock sync.RWMutex
+)
+
+// SetAPIObserver sets the observer of the calls of all provisioners to the
+// APIs of their providers, or none when nil
+func SetAPIObserver(observer APIObserver) {
+	apiObserverLock.Lock()
+	defer apiObserverLock.Unlock()
+	apiObserver = observer
+}
+
+func getAPIObserver() APIObserver {
+	apiObserverLock.RLock()
+	defer apiObserverLock.RUnlock()
+	return apiObserver
+}
+
+// observedTransport tells the APIObserver of each request to the API of a
+// provider, with a status code of 0 when the request failed, and retries
+// idempotent requests which failed with the ClientOptions
+type observedTransport struct {
+	provider string
+	next     http.RoundTripper
+}
+
+func newObservedClient(provider string) *http.Client {
+	return &http.Client{
+		Transport: &observedTransport{provider: provider, next: http.DefaultTransport},
+	}
+}
+
+func (t *observedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	options := getClientOptions()
+
+	if len(options.UserAgent) > 0 {
+		userAgent := options.UserAgent
+		if existing := req.UserAgent(); len(existing) > 0 {
+			userAgent += " " + existing
+		}
+		req = cloneRequest(req)
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	retries := 0
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		retries = options.Retries
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, err := t.roundTrip(options.Transport, req)
+		if attempt >= retries || !shouldRetry(res, err) {
+			return res, err
+		}
+
+		wait := retryBackoff << uint(attempt)
+		if res != nil {
+			if after, ok := retryAfter(res, time.Now()); ok {
+				if after > maxRetryWait {
+					return res, err
+				}
+				if after > wait {
+					wait = after
+				}
+			}
+			res.Body.Close()
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func (t *observedTransport) roundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	if transport == nil {
+		transport = t.next
+	}
+
+	started := time.Now()
+
+	var res *http.Response
+	var err error
+	if delay, class := injectFault(); delay > 0 || len(class) > 0 {
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			err = req.Context().Err()
+		}
+		if err == nil && len(class) > 0 {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			res = faultResponse(req, class)
+		} else if err == nil {
+			res, err = transport.RoundTrip(req)
+		}
+	} else {
+		res, err = transport.RoundTrip(req)
+	}
+
+	if observer := getAPIObserver(); observer != nil {
+		statusCode := 0
+		if res != nil {
+			statusCode = res.StatusCode
+		}
+		observer.ObserveAPICall(t.provider, apiOperation(req.Method, req.URL.Path), statusCode, time.Since(started))
+	}
+	return res, err
+}
+
+// shouldRetry returns true when a request failed to connect, the provider
+// was briefly unavailable or it throttled the request
+func shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cloneRequest copies a request and its headers, since a RoundTripper must
+// not change the request it is given
+func cloneRequest(req *http.Request) *http.Request {
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = http.Header{}
+	for key, values := range req.Header {
+		clone.Header[key] = append([]string{}, values...)
+	}
+	return clone
+}
+
+// apiOperation returns the method and path of a request with its IDs
+// replaced by ":id", i.e. "GET /v2/droplets/:id", so that operations are
+// counted without a label for each resource
+func apiOperation(method, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		if isAPIIdentifier(segment) {
+			segments[i] = ":id"
+		}
+	}
+	return method + " /" + strings.Join(segments, "/")
+}
+
+// isAPIIdentifier returns true for numeric IDs, UUIDs and IPs
+func isAPIIdentifier(segment string) bool {
+	if len(segment) == 0 {
+		return false
+	}
+
+	digits := 0
+	for _, r := range segment {
+		switch {
+		case unicode.IsDigit(r):
+			digits++
+		case r == '-' || r == '.' || r == ':' || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F'):
+		default:
+			return false
+		}
+	}
+	return digits > 0
+}
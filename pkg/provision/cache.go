@@ -0,0 +1,58 @@
+package provision
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+)
+
+// provisionerIdleTimeout is how long a cached provisioner is kept without
+// being used, i.e. after its access key was rotated
+const provisionerIdleTimeout = time.Hour
+
+type cachedProvisioner struct {
+	provisioner Provisioner
+	lastUsed    time.Time
+}
+
+var (
+	provisioners     = map[string]*cachedProvisioner{}
+	provisionersLock sync.Mutex
+)
+
+// GetProvisioner returns the provisioner for a provider and access key,
+// which is created once and then reused, so that its client and the
+// connections of its transport are kept between calls. A new provisioner
+// is created when the access key changes.
+func GetProvisioner(provider, accessKey string) (Provisioner, error) {
+	sum := sha256.Sum256([]byte(accessKey))
+	key := provider + "/" + hex.EncodeToString(sum[:])
+
+	provisionersLock.Lock()
+	defer provisionersLock.Unlock()
+
+	now := time.Now()
+	if cached, ok := provisioners[key]; ok {
+		cached.lastUsed = now
+		return cached.provisioner, nil
+	}
+
+	for k, cached := range provisioners {
+		if now.Sub(cached.lastUsed) > provisionerIdleTimeout {
+			// Plugins are stopped once they are no longer used
+			if closer, ok := cached.provisioner.(io.Closer); ok {
+				closer.Close()
+			}
+			delete(provisioners, k)
+		}
+	}
+
+	provisioner, err := NewProvisioner(provider, accessKey)
+	if err != nil {
+		return nil, err
+	}
+	provisioners[key] = &cachedProvisioner{provisioner: provisioner, lastUsed: now}
+	return provisioner, nil
+}
@@ -0,0 +1,253 @@
+// Package cassette records the requests which provisioners send to the APIs
+// of their providers, and the responses, into a file called a cassette, then
+// replays them without the provider. A test which has run once against a
+// real provider can then run in CI with no account, and fails when a change
+// to a provisioner or to the SDK of its provider changes what it sends.
+//
+//	recorder, err := cassette.New("testdata/digitalocean.json", cassette.Replaying)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	provision.SetClientOptions(provision.ClientOptions{Transport: recorder})
+//	...
+//	if err := recorder.Stop(); err != nil {
+//		t.Error(err)
+//	}
+//
+// The headers of requests are not recorded, since they hold the access key
+// of the account.
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Mode is whether a Recorder records or replays
+type Mode int
+
+const (
+	// Recording sends requests to the provider and records them
+	Recording Mode = iota
+
+	// Replaying answers requests with the responses of a cassette, in the
+	// order in which they were recorded
+	Replaying
+)
+
+// Interaction is a request and the response which the provider sent
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is a recorded request, without its headers
+type Request struct {
+	Method string `json:"method"`
+	// URL is the path and the query, i.e. "/v2/droplets?tag_name=inlets"
+	URL  string `json:"url"`
+	Body string `json:"body,omitempty"`
+}
+
+// Response is a recorded response
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// Cassette is the file which a Recorder saves and loads
+type Cassette struct {
+	// Meta is how the cassette was recorded, i.e. the provider and the
+	// region of its hosts, so that a test can replay it the same way
+	Meta         map[string]string `json:"meta,omitempty"`
+	Interactions []Interaction     `json:"interactions"`
+}
+
+// Recorder is an http.RoundTripper which records or replays a cassette
+type Recorder struct {
+	// Meta is saved with the cassette when recording, and is loaded from
+	// it when replaying
+	Meta map[string]string
+
+	path string
+	mode Mode
+	next http.RoundTripper
+
+	lock         sync.Mutex
+	interactions []Interaction
+	replayed     []bool
+}
+
+// New returns a Recorder of the cassette at path, which is loaded when
+// replaying and written by Stop when recording
+func New(path string, mode Mode) (*Recorder, error) {
+	r := &Recorder{
+		Meta: map[string]string{},
+		path: path,
+		mode: mode,
+		next: http.DefaultTransport,
+	}
+
+	if mode == Replaying {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading cassette: %s", err.Error())
+		}
+		var cassette Cassette
+		if err := json.Unmarshal(data, &cassette); err != nil {
+			return nil, fmt.Errorf("error parsing cassette %s: %s", path, err.Error())
+		}
+		if cassette.Meta != nil {
+			r.Meta = cassette.Meta
+		}
+		r.interactions = cassette.Interactions
+		r.replayed = make([]bool, len(cassette.Interactions))
+	}
+	return r, nil
+}
+
+// RoundTrip records a request and its response, or answers it with the
+// first response in the cassette which was not yet replayed for the same
+// method and URL. When the body of the request differs from the one which
+// was recorded, it returns an error instead.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	recorded := Request{
+		Method: req.Method,
+		URL:    req.URL.RequestURI(),
+		Body:   string(body),
+	}
+
+	if r.mode == Replaying {
+		return r.replay(req, recorded)
+	}
+	return r.record(req, recorded, body)
+}
+
+func (r *Recorder) record(req *http.Request, recorded Request, body []byte) (*http.Response, error) {
+	clone := new(http.Request)
+	*clone = *req
+	clone.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	res, err := r.next.RoundTrip(clone)
+	if err != nil {
+		return nil, err
+	}
+
+	resBody, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(resBody))
+
+	header := http.Header{}
+	for key, values := range res.Header {
+		if key != "Set-Cookie" {
+			header[key] = values
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.interactions = append(r.interactions, Interaction{
+		Request: recorded,
+		Response: Response{
+			StatusCode: res.StatusCode,
+			Header:     header,
+			Body:       string(resBody),
+		},
+	})
+	return res, nil
+}
+
+func (r *Recorder) replay(req *http.Request, recorded Request) (*http.Response, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, interaction := range r.interactions {
+		if r.replayed[i] || interaction.Request.Method != recorded.Method || interaction.Request.URL != recorded.URL {
+			continue
+		}
+		if !sameBody(interaction.Request.Body, recorded.Body) {
+			return nil, fmt.Errorf("cassette: body of %s %s differs from the recording, want %s, got %s",
+				recorded.Method, recorded.URL, interaction.Request.Body, recorded.Body)
+		}
+		r.replayed[i] = true
+
+		header := http.Header{}
+		for key, values := range interaction.Response.Header {
+			header[key] = append([]string{}, values...)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", interaction.Response.StatusCode, http.StatusText(interaction.Response.StatusCode)),
+			StatusCode:    interaction.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          ioutil.NopCloser(strings.NewReader(interaction.Response.Body)),
+			ContentLength: int64(len(interaction.Response.Body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("cassette: no recording of %s %s is left to replay", recorded.Method, recorded.URL)
+}
+
+// sameBody returns true when two bodies are equal, or are the same JSON
+// with keys in another order
+func sameBody(want, got string) bool {
+	if want == got {
+		return true
+	}
+	var wantJSON, gotJSON interface{}
+	if json.Unmarshal([]byte(want), &wantJSON) != nil || json.Unmarshal([]byte(got), &gotJSON) != nil {
+		return false
+	}
+	return reflect.DeepEqual(wantJSON, gotJSON)
+}
+
+// Stop writes the cassette when recording. When replaying, it returns an
+// error when requests which were recorded were not sent again.
+func (r *Recorder) Stop() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.mode == Replaying {
+		var missing []string
+		for i, interaction := range r.interactions {
+			if !r.replayed[i] {
+				missing = append(missing, interaction.Request.Method+" "+interaction.Request.URL)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("cassette: %d recorded requests were not sent: %s", len(missing), strings.Join(missing, ", "))
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(Cassette{Meta: r.Meta, Interactions: r.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(r.path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing cassette: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package cassette
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestServer() *httptest.Server {
+	polls := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /v2/droplets":
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`{"droplet": {"id": 123, "status": "new"}}`))
+		case "GET /v2/droplets/123":
+			polls++
+			if polls < 2 {
+				w.Write([]byte(`{"droplet": {"id": 123, "status": "new"}}`))
+				return
+			}
+			w.Write([]byte(`{"droplet": {"id": 123, "status": "active"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func send(t *testing.T, client *http.Client, baseURL, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, baseURL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("error creating request: %s", err.Error())
+	}
+	req.Header.Set("Authorization", "Bearer secret-token")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %s", method, path, err.Error())
+	}
+	defer res.Body.Close()
+
+	data, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(data)
+}
+
+func record(t *testing.T, path string) {
+	server := newTestServer()
+	defer server.Close()
+
+	r, err := New(path, Recording)
+	if err != nil {
+		t.Fatalf("New: %s", err.Error())
+	}
+	r.Meta["provider"] = "digitalocean"
+
+	client := &http.Client{Transport: r}
+	send(t, client, server.URL, http.MethodPost, "/v2/droplets", `{"name": "inlets-app", "region": "lon1"}`)
+	send(t, client, server.URL, http.MethodGet, "/v2/droplets/123", "")
+	send(t, client, server.URL, http.MethodGet, "/v2/droplets/123", "")
+
+	if err := r.Stop(); err != nil {
+		t.Fatalf("Stop: %s", err.Error())
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "digitalocean.json")
+	record(t, path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading cassette: %s", err.Error())
+	}
+	if strings.Contains(string(data), "secret-token") {
+		t.Errorf("want the access key to be left out of the cassette, got:\n%s", string(data))
+	}
+
+	r, err := New(path, Replaying)
+	if err != nil {
+		t.Fatalf("New: %s", err.Error())
+	}
+	if r.Meta["provider"] != "digitalocean" {
+		t.Errorf("want the meta of the recording, got %v", r.Meta)
+	}
+
+	// The server is gone, so the responses come from the cassette
+	client := &http.Client{Transport: r}
+	baseURL := "http://provider.invalid"
+
+	// The same JSON with its keys in another order matches
+	status, body := send(t, client, baseURL, http.MethodPost, "/v2/droplets", `{"region": "lon1", "name": "inlets-app"}`)
+	if status != http.StatusAccepted || !strings.Contains(body, `"new"`) {
+		t.Errorf("POST: want 202 with a new droplet, got %d %s", status, body)
+	}
+
+	_, body = send(t, client, baseURL, http.MethodGet, "/v2/droplets/123", "")
+	if !strings.Contains(body, `"new"`) {
+		t.Errorf("first GET: want a new droplet, got %s", body)
+	}
+	_, body = send(t, client, baseURL, http.MethodGet, "/v2/droplets/123", "")
+	if !strings.Contains(body, `"active"`) {
+		t.Errorf("second GET: want an active droplet, got %s", body)
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Errorf("Stop: %s", err.Error())
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "digitalocean.json")
+	record(t, path)
+
+	r, err := New(path, Replaying)
+	if err != nil {
+		t.Fatalf("New: %s", err.Error())
+	}
+	client := &http.Client{Transport: r}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://provider.invalid/v2/droplets", strings.NewReader(`{"name": "inlets-app", "region": "ams3"}`))
+	if _, err := client.Do(req); err == nil || !strings.Contains(err.Error(), "differs from the recording") {
+		t.Errorf("want an error for a body which differs, got %v", err)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, "http://provider.invalid/v2/droplets/123", nil)
+	if _, err := client.Do(req); err == nil || !strings.Contains(err.Error(), "no recording") {
+		t.Errorf("want an error for a request which was not recorded, got %v", err)
+	}
+
+	if err := r.Stop(); err == nil || !strings.Contains(err.Error(), "3 recorded requests were not sent") {
+		t.Errorf("Stop: want an error for the requests which were not sent, got %v", err)
+	}
+}
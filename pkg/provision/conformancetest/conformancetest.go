@@ -0,0 +1,278 @@
+// Package conformancetest checks that a provision.Provisioner behaves as the
+// operator expects, so that every provider, built in or a plugin, is held to
+// the same bar. Call Run from a test of the provider:
+//
+//	func TestConformance(t *testing.T) {
+//		conformancetest.Run(t, provisioner, conformancetest.Config{
+//			Host: provision.BasicHost{Region: "lon1", Plan: "s-1vcpu-1gb", OS: "ubuntu-16-04-x64"},
+//		})
+//	}
+//
+// The suite provisions real hosts when it is given a real provider, and
+// deletes them before it returns.
+package conformancetest
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// Config is the host which the suite provisions and how long it waits for it
+type Config struct {
+	// Host is provisioned by the suite, with a name and tags of its own
+	Host provision.BasicHost
+
+	// Timeout is how long a host may take to become active or to disappear
+	// from a listing, and is 5 minutes when 0
+	Timeout time.Duration
+
+	// PollInterval is the interval of calls to Status and List whilst
+	// waiting, and is 5 seconds when 0
+	PollInterval time.Duration
+
+	// MissingID is the ID of a host which does not exist, and is
+	// "999999999" when empty
+	MissingID string
+
+	// Run is in the name and a tag of the host, and is the current time
+	// when empty. A cassette is replayed with the Run which it was recorded
+	// with, so that the requests match.
+	Run string
+}
+
+func (c Config) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return 5 * time.Minute
+}
+
+func (c Config) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return c.PollInterval
+	}
+	return 5 * time.Second
+}
+
+func (c Config) missingID() string {
+	if len(c.MissingID) > 0 {
+		return c.MissingID
+	}
+	return "999999999"
+}
+
+// host returns the host to provision with a name and a tag which are unique
+// to the run, so that it can be told apart in a listing
+func (c Config) host(run string) provision.BasicHost {
+	host := c.Host
+	host.Name = "inlets-conformance-" + run
+
+	host.Tags = map[string]string{}
+	for key, value := range c.Host.Tags {
+		host.Tags[key] = value
+	}
+	host.Tags["inlets-conformance"] = run
+	return host
+}
+
+// Run checks a provisioner's Provision, Status, Delete and, when it is a
+// provision.HostLister, List. Errors for hosts which do not exist must
+// have the class "not_found" from provision.ErrorClass.
+func Run(t *testing.T, p provision.Provisioner, config Config) {
+	t.Run("MissingHost", func(t *testing.T) {
+		testMissingHost(t, p, config)
+	})
+
+	run := config.Run
+	if len(run) == 0 {
+		run = fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	host := config.host(run)
+
+	res, err := p.Provision(host)
+	if err != nil {
+		t.Fatalf("Provision: %s", err.Error())
+	}
+	if res == nil || len(res.ID) == 0 {
+		t.Fatalf("Provision: want the ID of the host, got %v", res)
+	}
+	id := res.ID
+
+	deleted := false
+	defer func() {
+		if !deleted {
+			if err := p.Delete(id); err != nil {
+				t.Errorf("Delete of host %s after the suite: %s", id, err.Error())
+			}
+		}
+	}()
+
+	t.Run("Status", func(t *testing.T) {
+		testStatus(t, p, config, id)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		testList(t, p, config, host, id)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		deleted = true
+		testDelete(t, p, config, host, id)
+	})
+}
+
+// testMissingHost checks the errors for a host which does not exist
+func testMissingHost(t *testing.T, p provision.Provisioner, config Config) {
+	id := config.missingID()
+
+	res, err := p.Status(id)
+	if err == nil {
+		t.Errorf("Status of a missing host: want an error, got %v", res)
+	} else if class := provision.ErrorClass(err); class != "not_found" {
+		t.Errorf("Status of a missing host: want class not_found, got %s: %s", class, err.Error())
+	}
+
+	// A host which is already gone may be deleted again
+	if err := p.Delete(id); err != nil {
+		if class := provision.ErrorClass(err); class != "not_found" {
+			t.Errorf("Delete of a missing host: want no error or class not_found, got %s: %s", class, err.Error())
+		}
+	}
+}
+
+// testStatus waits for a host to become active and checks that it keeps its
+// ID and IP from then on
+func testStatus(t *testing.T, p provision.Provisioner, config Config, id string) {
+	var active *provision.ProvisionedHost
+	deadline := time.Now().Add(config.timeout())
+
+	for active == nil {
+		res, err := p.Status(id)
+		if err != nil {
+			t.Fatalf("Status: %s", err.Error())
+		}
+		if res.ID != id {
+			t.Fatalf("Status: want ID %s, got %s", id, res.ID)
+		}
+		if res.Status == "active" {
+			active = res
+			break
+		}
+		if len(res.Status) == 0 {
+			t.Fatalf("Status: want the status of the host, got none")
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Status: host %s did not become active within %s, is %s", id, config.timeout(), res.Status)
+		}
+		time.Sleep(config.pollInterval())
+	}
+
+	if net.ParseIP(active.IP) == nil {
+		t.Fatalf("Status: want the IP of an active host, got %q", active.IP)
+	}
+
+	// Status is read by every sync of a tunnel, so it must not change the host
+	for i := 0; i < 2; i++ {
+		res, err := p.Status(id)
+		if err != nil {
+			t.Fatalf("Status of an active host: %s", err.Error())
+		}
+		if res.Status != "active" || res.IP != active.IP {
+			t.Errorf("Status of an active host: want active with IP %s, got %s with IP %s", active.IP, res.Status, res.IP)
+		}
+	}
+}
+
+// testList checks that a host is listed by each of its tags, with its name
+// and tags
+func testList(t *testing.T, p provision.Provisioner, config Config, host provision.BasicHost, id string) {
+	lister, ok := p.(provision.HostLister)
+	if !ok {
+		t.Skip("the provisioner is not a HostLister")
+	}
+
+	keys := []string{}
+	for key := range host.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	filter := provision.HostFilter{Tags: host.Tags, Additional: host.Additional}
+	listed, err := findListed(lister, filter, id)
+	if err != nil {
+		t.Fatalf("List: %s", err.Error())
+	}
+	if listed == nil {
+		t.Fatalf("List: want host %s with the tags %v", id, keys)
+	}
+	if listed.Name != host.Name {
+		t.Errorf("List: want the name %s, got %s", host.Name, listed.Name)
+	}
+	if !listed.HasTags(host.Tags) {
+		t.Errorf("List: want the tags %v, got %v", host.Tags, listed.Tags)
+	}
+
+	other := provision.HostFilter{
+		Tags:       map[string]string{"inlets-conformance": "not-" + host.Tags["inlets-conformance"]},
+		Additional: host.Additional,
+	}
+	if listed, err := findListed(lister, other, id); err != nil {
+		t.Fatalf("List: %s", err.Error())
+	} else if listed != nil {
+		t.Errorf("List: want host %s not to be listed with tags it does not have", id)
+	}
+}
+
+// testDelete deletes a host and waits for it to be gone
+func testDelete(t *testing.T, p provision.Provisioner, config Config, host provision.BasicHost, id string) {
+	if err := p.Delete(id); err != nil {
+		t.Fatalf("Delete: %s", err.Error())
+	}
+
+	// Deletes are retried by the controller, so deleting again must not fail
+	if err := p.Delete(id); err != nil {
+		if class := provision.ErrorClass(err); class != "not_found" {
+			t.Errorf("Delete of a deleted host: want no error or class not_found, got %s: %s", class, err.Error())
+		}
+	}
+
+	lister, ok := p.(provision.HostLister)
+	if !ok {
+		return
+	}
+
+	// Hosts may be listed for a while after they were deleted
+	filter := provision.HostFilter{Tags: host.Tags, Additional: host.Additional}
+	deadline := time.Now().Add(config.timeout())
+	for {
+		listed, err := findListed(lister, filter, id)
+		if err != nil {
+			t.Fatalf("List after Delete: %s", err.Error())
+		}
+		if listed == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("List after Delete: host %s was still listed after %s", id, config.timeout())
+		}
+		time.Sleep(config.pollInterval())
+	}
+}
+
+func findListed(lister provision.HostLister, filter provision.HostFilter, id string) (*provision.ListedHost, error) {
+	hosts, err := lister.List(filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hosts {
+		if hosts[i].ID == id {
+			return &hosts[i], nil
+		}
+	}
+	return nil, nil
+}
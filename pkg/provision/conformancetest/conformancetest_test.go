@@ -0,0 +1,150 @@
+package conformancetest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+	"github.com/alexellis/inlets-operator/pkg/provision/cassette"
+)
+
+func TestFakeProvisioner(t *testing.T) {
+	p := provision.NewFakeProvisioner()
+	p.ProvisionLatency = 50 * time.Millisecond
+
+	Run(t, p, Config{
+		Host:         provision.BasicHost{Region: "fake-1", Plan: "small", OS: "ubuntu"},
+		Timeout:      time.Second,
+		PollInterval: 10 * time.Millisecond,
+	})
+}
+
+// TestProvider runs the suite against a real provider, and only runs when
+// INLETS_CONFORMANCE_PROVIDER is set, i.e.
+//
+//	INLETS_CONFORMANCE_PROVIDER=digitalocean \
+//	INLETS_CONFORMANCE_ACCESS_KEY_FILE=$HOME/do-access-token \
+//	INLETS_CONFORMANCE_REGION=lon1 \
+//	INLETS_CONFORMANCE_PLAN=s-1vcpu-1gb \
+//	INLETS_CONFORMANCE_OS=ubuntu-16-04-x64 \
+//	go test ./pkg/provision/conformancetest/ -run TestProvider -v
+//
+// Packet also needs INLETS_CONFORMANCE_PROJECT_ID. The hosts which it
+// provisions are billed by the provider.
+//
+// With INLETS_CONFORMANCE_CASSETTE=testdata/digitalocean.json, the calls to
+// the API of the provider are recorded into a cassette, which
+// TestCassettes then replays without an account.
+func TestProvider(t *testing.T) {
+	provider := os.Getenv("INLETS_CONFORMANCE_PROVIDER")
+	if len(provider) == 0 {
+		t.Skip("INLETS_CONFORMANCE_PROVIDER is not set")
+	}
+
+	accessKey, err := ioutil.ReadFile(os.Getenv("INLETS_CONFORMANCE_ACCESS_KEY_FILE"))
+	if err != nil {
+		t.Fatalf("error reading INLETS_CONFORMANCE_ACCESS_KEY_FILE: %s", err.Error())
+	}
+
+	meta := map[string]string{
+		"provider":   provider,
+		"region":     os.Getenv("INLETS_CONFORMANCE_REGION"),
+		"plan":       os.Getenv("INLETS_CONFORMANCE_PLAN"),
+		"os":         os.Getenv("INLETS_CONFORMANCE_OS"),
+		"project_id": os.Getenv("INLETS_CONFORMANCE_PROJECT_ID"),
+	}
+
+	if path := os.Getenv("INLETS_CONFORMANCE_CASSETTE"); len(path) > 0 {
+		recorder, err := cassette.New(path, cassette.Recording)
+		if err != nil {
+			t.Fatalf("error creating recorder: %s", err.Error())
+		}
+		// The run must be the same when the cassette is replayed
+		meta["run"] = "cassette"
+		recorder.Meta = meta
+
+		provision.SetClientOptions(provision.ClientOptions{Retries: clientRetries, Transport: recorder})
+		defer provision.SetClientOptions(provision.ClientOptions{Retries: clientRetries})
+		defer func() {
+			if err := recorder.Stop(); err != nil {
+				t.Errorf("error saving cassette: %s", err.Error())
+			}
+		}()
+	}
+
+	p, err := provision.NewProvisioner(provider, strings.TrimSpace(string(accessKey)))
+	if err != nil {
+		t.Fatalf("error creating provisioner: %s", err.Error())
+	}
+	Run(t, p, providerConfig(meta))
+}
+
+// TestCassettes replays each cassette in testdata which TestProvider
+// recorded, so that a change to a provisioner or to the SDK of its provider
+// which changes the calls to its API fails in CI
+func TestCassettes(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatalf("error finding cassettes: %s", err.Error())
+	}
+	if len(paths) == 0 {
+		t.Skip("no cassettes in testdata, record one with TestProvider")
+	}
+
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			recorder, err := cassette.New(path, cassette.Replaying)
+			if err != nil {
+				t.Fatalf("error loading cassette: %s", err.Error())
+			}
+
+			provision.SetClientOptions(provision.ClientOptions{Retries: clientRetries, Transport: recorder})
+			defer provision.SetClientOptions(provision.ClientOptions{Retries: clientRetries})
+
+			// The access key of each run is unique, so that the provisioner
+			// is not cached from another cassette
+			p, err := provision.NewProvisioner(recorder.Meta["provider"], "cassette-"+path)
+			if err != nil {
+				t.Fatalf("error creating provisioner: %s", err.Error())
+			}
+
+			config := providerConfig(recorder.Meta)
+			// The hosts become active as fast as the recording says
+			config.PollInterval = time.Millisecond
+			Run(t, p, config)
+
+			if err := recorder.Stop(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// clientRetries is the default of ClientOptions.Retries, so that the retries
+// of a recording are replayed
+const clientRetries = 2
+
+// providerConfig returns the Config of a provider from the meta of a
+// cassette
+func providerConfig(meta map[string]string) Config {
+	host := provision.BasicHost{
+		Region:     meta["region"],
+		Plan:       meta["plan"],
+		OS:         meta["os"],
+		Additional: map[string]string{},
+	}
+	if len(meta["project_id"]) > 0 {
+		host.Additional["project_id"] = meta["project_id"]
+	}
+
+	config := Config{Host: host, Run: meta["run"]}
+	if meta["provider"] == "packet" {
+		// Packet looks up devices by UUID
+		config.MissingID = "00000000-0000-0000-0000-000000000000"
+	}
+	return config
+}
@@ -0,0 +1,35 @@
+package provision
+
+import "fmt"
+
+// HoursPerMonth is used to turn an hourly cost into a monthly estimate
+const HoursPerMonth = 730
+
+// CostEstimator is implemented by provisioners which can estimate the
+// cost of a host before it is provisioned
+type CostEstimator interface {
+	// HourlyCost returns the estimated cost in USD per hour of a host
+	HourlyCost(host BasicHost) (float64, error)
+}
+
+var digitalOceanHourlyCosts = map[string]float64{
+	"512mb":       0.00744,
+	"s-1vcpu-1gb": 0.00744,
+	"s-1vcpu-2gb": 0.01488,
+}
+
+var packetHourlyCosts = map[string]float64{
+	"t1.small.x86":  0.07,
+	"c1.small.x86":  0.40,
+	"baremetal_0":   0.07,
+	"baremetal_1":   0.40,
+	"c2.medium.x86": 1.00,
+}
+
+func lookupHourlyCost(costs map[string]float64, plan string) (float64, error) {
+	cost, ok := costs[plan]
+	if !ok {
+		return 0, fmt.Errorf("no cost known for plan: %s", plan)
+	}
+	return cost, nil
+}
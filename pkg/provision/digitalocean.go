@@ -3,7 +3,11 @@ package provision
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"time"
 
 	"github.com/digitalocean/godo"
 	"golang.org/x/oauth2"
@@ -20,7 +24,8 @@ func NewDigitalOceanProvisioner(accessKey string) (*DigitalOceanProvisioner, err
 	tokenSource := &TokenSource{
 		AccessToken: accessKey,
 	}
-	oauthClient := oauth2.NewClient(context.Background(), tokenSource)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, newObservedClient("digitalocean"))
+	oauthClient := oauth2.NewClient(ctx, tokenSource)
 	client := godo.NewClient(oauthClient)
 
 	return &DigitalOceanProvisioner{
@@ -29,7 +34,10 @@ func NewDigitalOceanProvisioner(accessKey string) (*DigitalOceanProvisioner, err
 }
 
 func (p *DigitalOceanProvisioner) Status(id string) (*ProvisionedHost, error) {
-	sid, _ := strconv.Atoi(id)
+	sid, err := parseDropletID(id)
+	if err != nil {
+		return nil, err
+	}
 
 	droplet, _, err := p.client.Droplets.Get(context.Background(), sid)
 
@@ -37,28 +45,242 @@ func (p *DigitalOceanProvisioner) Status(id string) (*ProvisionedHost, error) {
 		return nil, err
 	}
 
-	state := droplet.Status
+	return &ProvisionedHost{
+		ID:     id,
+		Status: droplet.Status,
+		IP:     getDropletIP(droplet),
+	}, nil
+}
 
+func getDropletIP(droplet *godo.Droplet) string {
 	ip := ""
+	if droplet.Networks == nil {
+		return ip
+	}
 	for _, network := range droplet.Networks.V4 {
 		if network.Type == "public" {
 			ip = network.IPAddress
 		}
 	}
+	return ip
+}
 
-	return &ProvisionedHost{
-		ID:     id,
-		Status: state,
-		IP:     ip,
-	}, nil
+// List returns the droplets with all of the tags, a page at a time. The
+// API filters the droplets by one of the tags, and the rest are checked
+// here.
+func (p *DigitalOceanProvisioner) List(filter HostFilter) ([]ListedHost, error) {
+	tags := tagList(filter.Tags, formatDigitalOceanTag)
+
+	hosts := []ListedHost{}
+	opt := &godo.ListOptions{Page: 1, PerPage: 200}
+	for {
+		var droplets []godo.Droplet
+		var res *godo.Response
+		var err error
+		if len(tags) > 0 {
+			droplets, res, err = p.client.Droplets.ListByTag(context.Background(), tags[0], opt)
+		} else {
+			droplets, res, err = p.client.Droplets.List(context.Background(), opt)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range droplets {
+			droplet := &droplets[i]
+			if !hasTags(droplet.Tags, tags) {
+				continue
+			}
+			created, _ := time.Parse(time.RFC3339, droplet.Created)
+			hosts = append(hosts, ListedHost{
+				ProvisionedHost: ProvisionedHost{
+					ID:     fmt.Sprintf("%d", droplet.ID),
+					Status: droplet.Status,
+					IP:     getDropletIP(droplet),
+				},
+				Name:    droplet.Name,
+				Tags:    droplet.Tags,
+				Created: created,
+				format:  formatDigitalOceanTag,
+			})
+		}
+
+		if res.Links == nil || res.Links.IsLastPage() {
+			return hosts, nil
+		}
+		page, err := res.Links.CurrentPage()
+		if err != nil {
+			return nil, err
+		}
+		opt.Page = page + 1
+	}
+}
+
+// Regions returns the slugs of the regions where droplets can be created
+func (p *DigitalOceanProvisioner) Regions() ([]string, error) {
+	regions, _, err := p.client.Regions.List(context.Background(), &godo.ListOptions{PerPage: 200})
+	if err != nil {
+		return nil, err
+	}
+
+	slugs := []string{}
+	for _, region := range regions {
+		if region.Available {
+			slugs = append(slugs, region.Slug)
+		}
+	}
+	return slugs, nil
+}
+
+// CheckPermissions lists the resources which the operator reads, since a
+// token is either read-only or read-write and its scope can't be read
+func (p *DigitalOceanProvisioner) CheckPermissions(host BasicHost) ([]string, error) {
+	ctx := context.Background()
+	if _, _, err := p.client.Account.Get(ctx); err != nil {
+		if isForbidden(err) {
+			return []string{"account:read (the token is invalid or revoked)"}, nil
+		}
+		return nil, err
+	}
+
+	missing := []string{}
+	checks := map[string]func() error{
+		"droplet:read": func() error {
+			_, _, err := p.client.Droplets.List(ctx, &godo.ListOptions{PerPage: 1})
+			return err
+		},
+		"firewall:read": func() error {
+			_, _, err := p.client.Firewalls.List(ctx, &godo.ListOptions{PerPage: 1})
+			return err
+		},
+		"floating_ip:read": func() error {
+			_, _, err := p.client.FloatingIPs.List(ctx, &godo.ListOptions{PerPage: 1})
+			return err
+		},
+	}
+	for permission, check := range checks {
+		if err := check(); err != nil {
+			if !isForbidden(err) {
+				return nil, err
+			}
+			missing = append(missing, permission)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
 }
 
 func (p *DigitalOceanProvisioner) Delete(id string) error {
-	sid, _ := strconv.Atoi(id)
-	_, err := p.client.Droplets.Delete(context.Background(), sid)
+	// The firewall of the droplet is deleted first, since it is looked up by the droplet
+	if err := p.SetAllowedSources(id, nil, nil, nil); err != nil && !isNotFound(err) {
+		return err
+	}
+
+	sid, err := parseDropletID(id)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.Droplets.Delete(context.Background(), sid)
+	return err
+}
+
+// SetAllowedSources creates, updates or deletes the cloud firewall of a
+// droplet, which is named after it. Outbound traffic is always allowed.
+func (p *DigitalOceanProvisioner) SetAllowedSources(id string, openPorts []int, openSources, cidrs []string) error {
+	sid, err := parseDropletID(id)
+	if err != nil {
+		return err
+	}
+	name := "inlets-" + id
+
+	firewalls, _, err := p.client.Firewalls.ListByDroplet(context.Background(), sid, &godo.ListOptions{PerPage: 200})
+	if err != nil {
+		return err
+	}
+
+	var existing *godo.Firewall
+	for i := range firewalls {
+		if firewalls[i].Name == name {
+			existing = &firewalls[i]
+		}
+	}
+
+	if len(cidrs) == 0 && len(openSources) == 0 {
+		if existing == nil {
+			return nil
+		}
+		_, err := p.client.Firewalls.Delete(context.Background(), existing.ID)
+		return err
+	}
+
+	everywhere := []string{"0.0.0.0/0", "::/0"}
+	if len(cidrs) == 0 {
+		cidrs = everywhere
+	}
+	if len(openSources) == 0 {
+		openSources = everywhere
+	}
+
+	// Rules only allow traffic, so the open ports are left out of the TCP
+	// ranges of the CIDRs
+	request := &godo.FirewallRequest{
+		Name:       name,
+		DropletIDs: []int{sid},
+		OutboundRules: []godo.OutboundRule{
+			{Protocol: "tcp", PortRange: "all", Destinations: &godo.Destinations{Addresses: everywhere}},
+			{Protocol: "udp", PortRange: "all", Destinations: &godo.Destinations{Addresses: everywhere}},
+			{Protocol: "icmp", Destinations: &godo.Destinations{Addresses: everywhere}},
+		},
+	}
+	for _, portRange := range portRangesExcept(openPorts) {
+		request.InboundRules = append(request.InboundRules, godo.InboundRule{
+			Protocol:  "tcp",
+			PortRange: portRange,
+			Sources:   &godo.Sources{Addresses: cidrs},
+		})
+	}
+	request.InboundRules = append(request.InboundRules,
+		godo.InboundRule{Protocol: "udp", PortRange: "all", Sources: &godo.Sources{Addresses: cidrs}},
+		godo.InboundRule{Protocol: "icmp", Sources: &godo.Sources{Addresses: cidrs}},
+	)
+	for _, port := range openPorts {
+		request.InboundRules = append(request.InboundRules, godo.InboundRule{
+			Protocol:  "tcp",
+			PortRange: strconv.Itoa(port),
+			Sources:   &godo.Sources{Addresses: openSources},
+		})
+	}
+
+	if existing == nil {
+		_, _, err = p.client.Firewalls.Create(context.Background(), request)
+		return err
+	}
+	_, _, err = p.client.Firewalls.Update(context.Background(), existing.ID, request)
 	return err
 }
 
+// portRangesExcept returns the ranges of ports from 1 to 65535 without the
+// given ports, i.e. "1-8122" and "8124-65535".
+func portRangesExcept(ports []int) []string {
+	sorted := append([]int{}, ports...)
+	sort.Ints(sorted)
+
+	ranges := []string{}
+	start := 1
+	for _, port := range sorted {
+		if port > start {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, port-1))
+		}
+		if port >= start {
+			start = port + 1
+		}
+	}
+	if start <= 65535 {
+		ranges = append(ranges, fmt.Sprintf("%d-65535", start))
+	}
+	return ranges
+}
+
 func (p *DigitalOceanProvisioner) Provision(host BasicHost) (*ProvisionedHost, error) {
 
 	if host.Region == "" {
@@ -73,6 +295,10 @@ func (p *DigitalOceanProvisioner) Provision(host BasicHost) (*ProvisionedHost, e
 			Slug: host.OS,
 		},
 		UserData: host.UserData,
+		Tags:     tagList(host.Tags, formatDigitalOceanTag),
+
+		// The agent is needed for the memory usage of the droplet
+		Monitoring: host.Additional["monitoring"] == "true",
 	}
 
 	droplet, _, err := p.client.Droplets.Create(context.Background(), createReq)
@@ -86,6 +312,188 @@ func (p *DigitalOceanProvisioner) Provision(host BasicHost) (*ProvisionedHost, e
 	}, nil
 }
 
+// Events returns the actions of a droplet, i.e. "create" and "power_on"
+func (p *DigitalOceanProvisioner) Events(id string) ([]HostEvent, error) {
+	sid, err := parseDropletID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	actions, _, err := p.client.Droplets.Actions(context.Background(), sid, &godo.ListOptions{PerPage: 200})
+	if err != nil {
+		return nil, err
+	}
+
+	events := []HostEvent{}
+	for _, action := range actions {
+		event := HostEvent{Type: action.Type, Status: action.Status}
+		if action.StartedAt != nil {
+			event.Time = action.StartedAt.Time
+		}
+		events = append(events, event)
+	}
+	sortEvents(events)
+	return events, nil
+}
+
+// Inspect returns the actual region, size, image and name of a droplet
+func (p *DigitalOceanProvisioner) Inspect(id string) (*BasicHost, error) {
+	sid, err := parseDropletID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	droplet, _, err := p.client.Droplets.Get(context.Background(), sid)
+	if err != nil {
+		return nil, err
+	}
+
+	host := &BasicHost{
+		Name: droplet.Name,
+		Plan: droplet.SizeSlug,
+	}
+	if droplet.Region != nil {
+		host.Region = droplet.Region.Slug
+	}
+	if droplet.Image != nil {
+		host.OS = droplet.Image.Slug
+	}
+
+	return host, nil
+}
+
+// SetTags adds and removes each tag on all of the droplets which need it
+// at once, a batch at a time, rather than updating each droplet
+func (p *DigitalOceanProvisioner) SetTags(hosts []ListedHost, tags map[string]map[string]string, keys []string) error {
+	add := map[string][]string{}
+	remove := map[string][]string{}
+	for _, host := range hosts {
+		want, ok := tags[host.ID]
+		if !ok {
+			continue
+		}
+		missing, extra := diffTags(host, want, keys)
+		for _, tag := range missing {
+			add[tag] = append(add[tag], host.ID)
+		}
+		for _, tag := range extra {
+			remove[tag] = append(remove[tag], host.ID)
+		}
+	}
+
+	ctx := context.Background()
+	for _, tag := range sortedKeys(add) {
+		// Droplets can only be tagged with a tag which exists, and
+		// creating a tag which exists changes nothing
+		if _, _, err := p.client.Tags.Create(ctx, &godo.TagCreateRequest{Name: tag}); err != nil {
+			return err
+		}
+		for _, ids := range batchIDs(add[tag]) {
+			req := &godo.TagResourcesRequest{Resources: dropletResources(ids)}
+			if _, err := p.client.Tags.TagResources(ctx, tag, req); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, tag := range sortedKeys(remove) {
+		for _, ids := range batchIDs(remove[tag]) {
+			req := &godo.UntagResourcesRequest{Resources: dropletResources(ids)}
+			if _, err := p.client.Tags.UntagResources(ctx, tag, req); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dropletResources(ids []string) []godo.Resource {
+	resources := []godo.Resource{}
+	for _, id := range ids {
+		resources = append(resources, godo.Resource{ID: id, Type: godo.DropletResourceType})
+	}
+	return resources
+}
+
+func sortedKeys(values map[string][]string) []string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatDigitalOceanTag replaces the characters which are not allowed in
+// the tags of a droplet, and truncates it to the maximum length of a tag
+func formatDigitalOceanTag(tag string) string {
+	formatted := []rune{}
+	for _, r := range tag {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '_' || r == '-' || r == ':' {
+			formatted = append(formatted, r)
+		} else {
+			formatted = append(formatted, '_')
+		}
+	}
+
+	if len(formatted) > 255 {
+		formatted = formatted[:255]
+	}
+	return string(formatted)
+}
+
+// SupportsTCP is true since droplets have no firewall by default
+func (p *DigitalOceanProvisioner) SupportsTCP() bool {
+	return true
+}
+
+// HourlyCost returns the estimated cost of a droplet from the list price of its size
+func (p *DigitalOceanProvisioner) HourlyCost(host BasicHost) (float64, error) {
+	return lookupHourlyCost(digitalOceanHourlyCosts, host.Plan)
+}
+
+// ReserveIP creates a floating IP which is assigned to a droplet
+func (p *DigitalOceanProvisioner) ReserveIP(id string) (string, error) {
+	sid, err := parseDropletID(id)
+	if err != nil {
+		return "", err
+	}
+
+	floatingIP, _, err := p.client.FloatingIPs.Create(context.Background(), &godo.FloatingIPCreateRequest{
+		DropletID: sid,
+	})
+	if err != nil {
+		return "", err
+	}
+	return floatingIP.IP, nil
+}
+
+// AssignIP assigns a floating IP to a droplet, unless it is assigned to it already
+func (p *DigitalOceanProvisioner) AssignIP(ip, id string) error {
+	sid, err := parseDropletID(id)
+	if err != nil {
+		return err
+	}
+
+	floatingIP, _, err := p.client.FloatingIPs.Get(context.Background(), ip)
+	if err != nil {
+		return err
+	}
+	if floatingIP.Droplet != nil && floatingIP.Droplet.ID == sid {
+		return nil
+	}
+
+	_, _, err = p.client.FloatingIPActions.Assign(context.Background(), ip, sid)
+	return err
+}
+
+// ReleaseIP deletes a floating IP
+func (p *DigitalOceanProvisioner) ReleaseIP(ip string) error {
+	_, err := p.client.FloatingIPs.Delete(context.Background(), ip)
+	return err
+}
+
 type TokenSource struct {
 	AccessToken string
 }
@@ -96,3 +504,160 @@ func (t *TokenSource) Token() (*oauth2.Token, error) {
 	}
 	return token, nil
 }
+
+// megabitBytes is the bytes in a megabit, since the monitoring API reports
+// the bandwidth of a droplet in megabits per second
+const megabitBytes = 1000 * 1000 / 8
+
+// doMetricsResponse is a range query of the monitoring API, which has the
+// format of the Prometheus HTTP API
+type doMetricsResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Result []struct {
+			Metric map[string]string `json:"metric"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// queryMetric runs a range query of a metric of a droplet over the window
+// before now
+func (p *DigitalOceanProvisioner) queryMetric(metric, id string, window time.Duration, extra url.Values) (*doMetricsResponse, error) {
+	now := time.Now()
+	query := url.Values{}
+	for key, values := range extra {
+		query[key] = values
+	}
+	query.Set("host_id", id)
+	query.Set("start", strconv.FormatInt(now.Add(-window).Unix(), 10))
+	query.Set("end", strconv.FormatInt(now.Unix(), 10))
+
+	req, err := p.client.NewRequest(context.Background(), http.MethodGet,
+		"v2/monitoring/metrics/droplet/"+metric+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &doMetricsResponse{}
+	if _, err := p.client.Do(context.Background(), req, res); err != nil {
+		return nil, err
+	}
+	if res.Status != "success" {
+		return nil, fmt.Errorf("monitoring query for %s of droplet %s returned %q", metric, id, res.Status)
+	}
+	return res, nil
+}
+
+// sampleValue returns the number of a sample of [timestamp, "value"]
+func sampleValue(sample []interface{}) (float64, bool) {
+	if len(sample) != 2 {
+		return 0, false
+	}
+	value, ok := sample[1].(string)
+	if !ok {
+		return 0, false
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	return parsed, err == nil
+}
+
+// lastValue returns the last sample of the first series of a query, or -1
+// when it has none
+func (r *doMetricsResponse) lastValue() float64 {
+	if len(r.Data.Result) == 0 || len(r.Data.Result[0].Values) == 0 {
+		return -1
+	}
+	values := r.Data.Result[0].Values
+	value, ok := sampleValue(values[len(values)-1])
+	if !ok {
+		return -1
+	}
+	return value
+}
+
+// averageValue returns the average of the samples of the first series of a
+// query, or -1 when it has none
+func (r *doMetricsResponse) averageValue() float64 {
+	if len(r.Data.Result) == 0 {
+		return -1
+	}
+
+	sum, count := 0.0, 0
+	for _, sample := range r.Data.Result[0].Values {
+		if value, ok := sampleValue(sample); ok {
+			sum += value
+			count++
+		}
+	}
+	if count == 0 {
+		return -1
+	}
+	return sum / float64(count)
+}
+
+// Usage returns the usage of a droplet from the monitoring API. The CPU is
+// reported as seconds spent in each mode, so its usage is the share of the
+// seconds over the window which were not idle. Memory needs the monitoring
+// agent, which is installed when the droplet is provisioned with the
+// "monitoring" option.
+func (p *DigitalOceanProvisioner) Usage(id string, window time.Duration) (*HostUsage, error) {
+	usage := &HostUsage{CPUPercent: -1, MemoryPercent: -1}
+
+	cpu, err := p.queryMetric("cpu", id, window, nil)
+	if err != nil {
+		return nil, err
+	}
+	idle, total := 0.0, 0.0
+	for _, series := range cpu.Data.Result {
+		if len(series.Values) < 2 {
+			continue
+		}
+		first, ok1 := sampleValue(series.Values[0])
+		last, ok2 := sampleValue(series.Values[len(series.Values)-1])
+		if !ok1 || !ok2 || last < first {
+			continue
+		}
+		total += last - first
+		if series.Metric["mode"] == "idle" {
+			idle += last - first
+		}
+	}
+	if total > 0 {
+		usage.CPUPercent = 100 * (total - idle) / total
+	}
+
+	available, err := p.queryMetric("memory_available", id, window, nil)
+	if err != nil {
+		return nil, err
+	}
+	memoryTotal, err := p.queryMetric("memory_total", id, window, nil)
+	if err != nil {
+		return nil, err
+	}
+	if free, size := available.lastValue(), memoryTotal.lastValue(); free >= 0 && size > 0 {
+		usage.MemoryPercent = 100 * (size - free) / size
+	}
+
+	for _, direction := range []string{"inbound", "outbound"} {
+		bandwidth, err := p.queryMetric("bandwidth", id, window, url.Values{
+			"interface": []string{"public"},
+			"direction": []string{direction},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		value := bandwidth.averageValue()
+		if value >= 0 {
+			value *= megabitBytes
+		}
+		if direction == "inbound" {
+			usage.ReceiveBytesPerSecond = value
+		} else {
+			usage.TransmitBytesPerSecond = value
+		}
+	}
+
+	return usage, nil
+}
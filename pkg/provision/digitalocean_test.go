@@ -0,0 +1,359 @@
+package provision
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alexellis/inlets-operator/pkg/provision/cassette"
+)
+
+const digitalOceanNotFound = `{"id": "not_found", "message": "The resource you were accessing could not be found."}`
+
+func newTestDigitalOceanProvisioner(t *testing.T) (*DigitalOceanProvisioner, *fakeAPI) {
+	api := newFakeAPI(t, digitalOceanNotFound)
+
+	p, err := NewDigitalOceanProvisioner("token")
+	if err != nil {
+		t.Fatalf("error creating provisioner: %s", err.Error())
+	}
+	p.client.BaseURL, _ = url.Parse(api.server.URL + "/")
+	return p, api
+}
+
+func digitalOceanDroplet(id int, status, ip string) map[string]interface{} {
+	droplet := map[string]interface{}{
+		"id":     id,
+		"name":   "inlets-app",
+		"status": status,
+		"networks": map[string]interface{}{
+			"v4": []map[string]interface{}{},
+		},
+	}
+	if len(ip) > 0 {
+		droplet["networks"] = map[string]interface{}{
+			"v4": []map[string]interface{}{
+				{"ip_address": "10.0.0.2", "type": "private"},
+				{"ip_address": ip, "type": "public"},
+			},
+		}
+	}
+	return map[string]interface{}{"droplet": droplet}
+}
+
+func TestDigitalOceanProvisionThenPoll(t *testing.T) {
+	p, api := newTestDigitalOceanProvisioner(t)
+	defer api.close()
+
+	var created map[string]interface{}
+	api.handle("POST /v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		created = readJSON(t, r)
+		writeJSON(w, http.StatusAccepted, digitalOceanDroplet(123, "new", ""))
+	})
+
+	polls := 0
+	api.handle("GET /v2/droplets/123", func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 3 {
+			writeJSON(w, http.StatusOK, digitalOceanDroplet(123, "new", ""))
+			return
+		}
+		writeJSON(w, http.StatusOK, digitalOceanDroplet(123, "active", "203.0.113.10"))
+	})
+
+	res, err := p.Provision(BasicHost{
+		Name: "inlets-app",
+		Plan: "s-1vcpu-1gb",
+		OS:   "ubuntu-16-04-x64",
+		Tags: map[string]string{"team": "web apps"},
+	})
+	if err != nil {
+		t.Fatalf("Provision: %s", err.Error())
+	}
+	if res.ID != "123" {
+		t.Errorf("want ID 123, got %q", res.ID)
+	}
+
+	if created["region"] != "lon1" {
+		t.Errorf("want the default region lon1, got %v", created["region"])
+	}
+	if created["image"] != "ubuntu-16-04-x64" {
+		t.Errorf("want the image ubuntu-16-04-x64, got %v", created["image"])
+	}
+	if want := []interface{}{"team:web_apps"}; !reflect.DeepEqual(created["tags"], want) {
+		t.Errorf("want the tags %v, got %v", want, created["tags"])
+	}
+
+	var status *ProvisionedHost
+	for i := 0; i < 5; i++ {
+		status, err = p.Status(res.ID)
+		if err != nil {
+			t.Fatalf("Status: %s", err.Error())
+		}
+		if status.Status == "active" {
+			break
+		}
+		if len(status.IP) > 0 {
+			t.Errorf("want no IP whilst %s, got %s", status.Status, status.IP)
+		}
+	}
+	if status.Status != "active" || status.IP != "203.0.113.10" {
+		t.Errorf("want active with the public IP 203.0.113.10, got %s with %q", status.Status, status.IP)
+	}
+	if polls != 3 {
+		t.Errorf("want 3 polls, got %d", polls)
+	}
+}
+
+func TestDigitalOceanNotFound(t *testing.T) {
+	p, api := newTestDigitalOceanProvisioner(t)
+	defer api.close()
+
+	_, err := p.Status("123")
+	if err == nil {
+		t.Fatalf("Status: want an error for a missing droplet")
+	}
+	if class := ErrorClass(err); class != "not_found" {
+		t.Errorf("Status: want class not_found, got %s", class)
+	}
+
+	// The firewall is looked up by the droplet, which is gone
+	err = p.Delete("123")
+	if class := ErrorClass(err); class != "not_found" {
+		t.Errorf("Delete: want class not_found, got %s: %v", class, err)
+	}
+	if got := api.requested("GET /v2/droplets/123/firewalls"); got != 1 {
+		t.Errorf("Delete: want 1 lookup of the firewall, got %d", got)
+	}
+	if got := api.requested("DELETE /v2/droplets/123"); got != 1 {
+		t.Errorf("Delete: want 1 delete of the droplet, got %d", got)
+	}
+}
+
+func TestDigitalOceanDelete(t *testing.T) {
+	p, api := newTestDigitalOceanProvisioner(t)
+	defer api.close()
+
+	api.handle("GET /v2/droplets/123/firewalls", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"firewalls": []map[string]interface{}{
+				{"id": "fw-other", "name": "web"},
+				{"id": "fw-123", "name": "inlets-123"},
+			},
+		})
+	})
+	api.handle("DELETE /v2/firewalls/fw-123", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	api.handle("DELETE /v2/droplets/123", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if err := p.Delete("123"); err != nil {
+		t.Fatalf("Delete: %s", err.Error())
+	}
+	if got := api.requested("DELETE /v2/firewalls/fw-other"); got != 0 {
+		t.Errorf("want the firewalls of others to be kept, got %d deletes", got)
+	}
+	if got := api.requested("DELETE /v2/firewalls/fw-123"); got != 1 {
+		t.Errorf("want the firewall of the droplet to be deleted, got %d deletes", got)
+	}
+}
+
+func TestDigitalOceanErrorClasses(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		header     []string
+		class      string
+		retryAfter time.Duration
+	}{
+		{
+			name:   "invalid token",
+			status: http.StatusUnauthorized,
+			body:   `{"id": "unauthorized", "message": "Unable to authenticate you."}`,
+			class:  "forbidden",
+		},
+		{
+			name:   "missing scope",
+			status: http.StatusForbidden,
+			body:   `{"id": "forbidden", "message": "You do not have access for the attempted action."}`,
+			class:  "forbidden",
+		},
+		{
+			name:   "conflict",
+			status: http.StatusConflict,
+			body:   `{"id": "conflict", "message": "The droplet is already being created."}`,
+			class:  "other",
+		},
+		{
+			name:       "rate limited",
+			status:     http.StatusTooManyRequests,
+			body:       `{"id": "too_many_requests", "message": "API Rate limit exceeded."}`,
+			header:     []string{"Retry-After", "120"},
+			class:      "rate_limited",
+			retryAfter: 120 * time.Second,
+		},
+		{
+			name:   "no capacity",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"id": "unprocessable_entity", "message": "Size is not available in this region."}`,
+			class:  "capacity",
+		},
+		{
+			name:   "invalid size",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"id": "unprocessable_entity", "message": "You specified an invalid size for Droplet creation."}`,
+			class:  "other",
+		},
+		{
+			name:   "server error",
+			status: http.StatusInternalServerError,
+			body:   `{"id": "server_error", "message": "Server was unable to give you a response."}`,
+			class:  "server",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, api := newTestDigitalOceanProvisioner(t)
+			defer api.close()
+
+			api.failNext("POST /v2/droplets", test.status, test.body, test.header...)
+
+			_, err := p.Provision(BasicHost{Name: "inlets-app", Plan: "s-1vcpu-1gb", OS: "ubuntu-16-04-x64"})
+			if err == nil {
+				t.Fatalf("want an error")
+			}
+			if class := ErrorClass(err); class != test.class {
+				t.Errorf("want class %s, got %s: %s", test.class, class, err.Error())
+			}
+			if after, ok := RetryAfter(err); after != test.retryAfter || ok != (test.retryAfter > 0) {
+				t.Errorf("want to retry after %s, got %s (%t)", test.retryAfter, after, ok)
+			}
+
+			// Creates are never retried, since a retry could create a
+			// second droplet
+			if got := api.requested("POST /v2/droplets"); got != 1 {
+				t.Errorf("want 1 create, got %d", got)
+			}
+		})
+	}
+}
+
+func TestDigitalOceanRetriesReads(t *testing.T) {
+	p, api := newTestDigitalOceanProvisioner(t)
+	defer api.close()
+
+	api.handle("GET /v2/droplets/123", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, digitalOceanDroplet(123, "active", "203.0.113.10"))
+	})
+	api.failNext("GET /v2/droplets/123", http.StatusServiceUnavailable, `{"id": "service_unavailable", "message": "Try again."}`)
+
+	status, err := p.Status("123")
+	if err != nil {
+		t.Fatalf("Status: %s", err.Error())
+	}
+	if status.IP != "203.0.113.10" {
+		t.Errorf("want the IP 203.0.113.10, got %q", status.IP)
+	}
+	if got := api.requested("GET /v2/droplets/123"); got != 2 {
+		t.Errorf("want 2 requests, got %d", got)
+	}
+}
+
+func TestDigitalOceanReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "digitalocean.json")
+
+	host := BasicHost{Name: "inlets-app", Plan: "s-1vcpu-1gb", OS: "ubuntu-16-04-x64", Tags: map[string]string{"team": "web"}}
+
+	p, api := newTestDigitalOceanProvisioner(t)
+	api.handle("POST /v2/droplets", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusAccepted, digitalOceanDroplet(123, "new", ""))
+	})
+	api.handle("GET /v2/droplets/123", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, digitalOceanDroplet(123, "active", "203.0.113.10"))
+	})
+
+	recorder, err := cassette.New(path, cassette.Recording)
+	if err != nil {
+		t.Fatalf("error creating recorder: %s", err.Error())
+	}
+	SetClientOptions(ClientOptions{Retries: 2, Transport: recorder})
+	defer SetClientOptions(ClientOptions{Retries: 2})
+
+	if _, err := p.Provision(host); err != nil {
+		t.Fatalf("Provision: %s", err.Error())
+	}
+	if _, err := p.Status("123"); err != nil {
+		t.Fatalf("Status: %s", err.Error())
+	}
+	if err := recorder.Stop(); err != nil {
+		t.Fatalf("Stop: %s", err.Error())
+	}
+	api.close()
+
+	recorder, err = cassette.New(path, cassette.Replaying)
+	if err != nil {
+		t.Fatalf("error loading cassette: %s", err.Error())
+	}
+	SetClientOptions(ClientOptions{Retries: 2, Transport: recorder})
+
+	status, err := p.Status("123")
+	if err != nil {
+		t.Fatalf("Status from the cassette: %s", err.Error())
+	}
+	if status.IP != "203.0.113.10" {
+		t.Errorf("want the recorded IP 203.0.113.10, got %q", status.IP)
+	}
+
+	// A droplet with other tags is a different request
+	host.Tags = map[string]string{"team": "api"}
+	if _, err := p.Provision(host); err == nil {
+		t.Errorf("want an error for a create which differs from the recording")
+	}
+
+	host.Tags = map[string]string{"team": "web"}
+	if _, err := p.Provision(host); err != nil {
+		t.Errorf("Provision from the cassette: %s", err.Error())
+	}
+	if err := recorder.Stop(); err != nil {
+		t.Errorf("Stop: %s", err.Error())
+	}
+}
+
+func TestDigitalOceanEvents(t *testing.T) {
+	p, api := newTestDigitalOceanProvisioner(t)
+	defer api.close()
+
+	api.handle("GET /v2/droplets/123/actions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"actions": []map[string]interface{}{
+				{"id": 2, "type": "power_on", "status": "in-progress", "started_at": "2019-10-14T10:01:00Z"},
+				{"id": 1, "type": "create", "status": "completed", "started_at": "2019-10-14T10:00:00Z"},
+			},
+		})
+	})
+
+	events, err := p.Events("123")
+	if err != nil {
+		t.Fatalf("Events: %s", err.Error())
+	}
+	if len(events) != 2 || events[0].Type != "create" || events[1].Type != "power_on" {
+		t.Fatalf("want create then power_on, got %v", events)
+	}
+	if events[1].Status != "in-progress" || events[1].Time.Format(time.RFC3339) != "2019-10-14T10:01:00Z" {
+		t.Errorf("want power_on in-progress at 10:01, got %v", events[1])
+	}
+}
@@ -0,0 +1,199 @@
+package provision
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/godo"
+	"github.com/packethost/packngo"
+)
+
+// isNotFound returns true when a DigitalOcean, Packet or plugin call failed
+// since the resource does not exist
+func isNotFound(err error) bool {
+	switch e := err.(type) {
+	case *invalidIDError:
+		return true
+	case *PluginError:
+		return e.Class == "not_found"
+	case *godo.ErrorResponse:
+		return e.Response != nil && e.Response.StatusCode == http.StatusNotFound
+	case *packngo.ErrorResponse:
+		return e.Response != nil && e.Response.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// invalidIDError is returned for an ID which no host of a provider can
+// have, so it is classed as "not_found": the host which a stale or
+// hand-edited status names is not there to be read or deleted
+type invalidIDError struct {
+	provider string
+	id       string
+}
+
+func (e *invalidIDError) Error() string {
+	return fmt.Sprintf("invalid %s host ID %q", e.provider, e.id)
+}
+
+// isForbidden returns true when a DigitalOcean or Packet API call failed
+// since the access key is invalid or lacks a permission
+func isForbidden(err error) bool {
+	var statusCode int
+	switch e := err.(type) {
+	case *godo.ErrorResponse:
+		if e.Response != nil {
+			statusCode = e.Response.StatusCode
+		}
+	case *packngo.ErrorResponse:
+		if e.Response != nil {
+			statusCode = e.Response.StatusCode
+		}
+	}
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// ErrorClass returns the class of an error of a provider for metrics, being
+// one of "capacity", "forbidden", "not_found", "rate_limited", "server" or
+// "other"
+func ErrorClass(err error) string {
+	if pluginErr, ok := err.(*PluginError); ok && len(pluginErr.Class) > 0 {
+		return pluginErr.Class
+	}
+
+	var statusCode int
+	switch e := err.(type) {
+	case *godo.ErrorResponse:
+		if e.Response != nil {
+			statusCode = e.Response.StatusCode
+		}
+	case *packngo.ErrorResponse:
+		if e.Response != nil {
+			statusCode = e.Response.StatusCode
+		}
+	}
+
+	switch {
+	case IsCapacityError(err):
+		return "capacity"
+	case isForbidden(err):
+		return "forbidden"
+	case isNotFound(err):
+		return "not_found"
+	case statusCode == http.StatusTooManyRequests:
+		return "rate_limited"
+	case statusCode >= 500:
+		return "server"
+	}
+	return "other"
+}
+
+var capacityMessages = []string{
+	"capacity",
+	"limit",
+	"quota",
+	"not available",
+	"unavailable",
+}
+
+// IsCapacityError returns true when a host could not be provisioned due to
+// a lack of capacity or quota, so another region or provider may succeed
+func IsCapacityError(err error) bool {
+	var statusCode int
+	var message string
+
+	switch e := err.(type) {
+	case *godo.ErrorResponse:
+		if e.Response != nil {
+			statusCode = e.Response.StatusCode
+		}
+		message = e.Message
+	case *packngo.ErrorResponse:
+		if e.Response != nil {
+			statusCode = e.Response.StatusCode
+		}
+		message = strings.Join(append(e.Errors, e.SingleError), " ")
+	case *PluginError:
+		return e.Class == "capacity"
+	default:
+		return false
+	}
+
+	if statusCode == http.StatusServiceUnavailable {
+		return true
+	}
+
+	if statusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+
+	message = strings.ToLower(message)
+	for _, m := range capacityMessages {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxRetryAfter bounds how long a provider can ask for calls to be held
+// back, in case it sends a time which is far off
+const maxRetryAfter = 15 * time.Minute
+
+// RetryAfter returns how long a provider asked for a call which it
+// throttled to be held back, from the Retry-After header of the response,
+// or the time its rate limit resets
+func RetryAfter(err error) (time.Duration, bool) {
+	var res *http.Response
+	switch e := err.(type) {
+	case *godo.ErrorResponse:
+		res = e.Response
+	case *packngo.ErrorResponse:
+		res = e.Response
+	}
+	if res == nil {
+		return 0, false
+	}
+	if res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return retryAfter(res, time.Now())
+}
+
+// retryAfter reads Retry-After, as seconds or an HTTP date, or else the
+// time at which the rate limit resets, as a Unix time, which is what
+// DigitalOcean and Packet send with a 429
+func retryAfter(res *http.Response, now time.Time) (time.Duration, bool) {
+	var wait time.Duration
+
+	if value := strings.TrimSpace(res.Header.Get("Retry-After")); len(value) > 0 {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(value); err == nil {
+			wait = date.Sub(now)
+		} else {
+			return 0, false
+		}
+	} else {
+		value := res.Header.Get("RateLimit-Reset")
+		if len(value) == 0 {
+			value = res.Header.Get("X-RateLimit-Reset")
+		}
+		reset, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		wait = time.Unix(reset, 0).Sub(now)
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait, true
+}
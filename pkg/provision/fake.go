@@ -0,0 +1,403 @@
+package provision
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeProvisioner provisions hosts in memory, for tests of the controller
+// and for trying the operator out with --provider=fake without an account
+// with a provider. It implements every interface of a provisioner. Hosts
+// are "new" until ProvisionLatency has passed, then "active" with an IP
+// from 203.0.113.0/24, which is reserved for documentation, in the order
+// they were provisioned.
+type FakeProvisioner struct {
+	// ProvisionLatency is how long a host takes to become active
+	ProvisionLatency time.Duration
+
+	// CallLatency is added to every call, as the latency of the API
+	CallLatency time.Duration
+
+	// FailureRate is the fraction of calls which fail at random, with an
+	// error which ErrorClass reports as "server"
+	FailureRate float64
+
+	// Clock returns the current time, and is time.Now when nil
+	Clock func() time.Time
+
+	// ExitNodeIP is the IP of every host when set, i.e. of an inlets server
+	// which stands in for the exit-nodes in an end-to-end test
+	ExitNodeIP string
+
+	// CostPerHour is the estimated cost in USD of every host, which is 0
+	// since fake hosts are free
+	CostPerHour float64
+
+	lock     sync.Mutex
+	random   *rand.Rand
+	nextID   int
+	hosts    map[string]*fakeHost
+	ips      map[string]string
+	failures map[string][]error
+	calls    map[string]int
+}
+
+type fakeHost struct {
+	host      BasicHost
+	ip        string
+	created   time.Time
+	tags      []string
+	sources   []string
+	openPorts []int
+}
+
+// NewFakeProvisioner returns a FakeProvisioner without latency or failures,
+// whose random failures are the same on each run
+func NewFakeProvisioner() *FakeProvisioner {
+	return &FakeProvisioner{
+		random:   rand.New(rand.NewSource(1)),
+		hosts:    map[string]*fakeHost{},
+		ips:      map[string]string{},
+		failures: map[string][]error{},
+		calls:    map[string]int{},
+	}
+}
+
+// FailNext makes the next call of a method, i.e. "Provision", fail with an
+// error. Each call of FailNext fails one more call.
+func (p *FakeProvisioner) FailNext(method string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failures[method] = append(p.failures[method], err)
+}
+
+// Calls returns how many times a method was called
+func (p *FakeProvisioner) Calls(method string) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.calls[method]
+}
+
+// HostIDs returns the IDs of the hosts which exist, in order
+func (p *FakeProvisioner) HostIDs() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ids := []string{}
+	for id := range p.hosts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return p.hosts[ids[i]].created.Before(p.hosts[ids[j]].created) ||
+			(p.hosts[ids[i]].created.Equal(p.hosts[ids[j]].created) && ids[i] < ids[j])
+	})
+	return ids
+}
+
+// Host returns a host as it was provisioned, and whether it exists
+func (p *FakeProvisioner) Host(id string) (BasicHost, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	host, ok := p.hosts[id]
+	if !ok {
+		return BasicHost{}, false
+	}
+	return host.host, true
+}
+
+func (p *FakeProvisioner) now() time.Time {
+	if p.Clock != nil {
+		return p.Clock()
+	}
+	return time.Now()
+}
+
+// call waits for CallLatency, counts the call of a method and returns the
+// error injected for it by FailNext or SetFaults, if any. The lock is held once it returns.
+func (p *FakeProvisioner) call(method string) error {
+	if p.CallLatency > 0 {
+		time.Sleep(p.CallLatency)
+	}
+	injected := injectCallFault("fake", method)
+
+	p.lock.Lock()
+	p.calls[method]++
+
+	if queue := p.failures[method]; len(queue) > 0 {
+		p.failures[method] = queue[1:]
+		return queue[0]
+	}
+	if injected != nil {
+		return injected
+	}
+	if p.FailureRate > 0 && p.random.Float64() < p.FailureRate {
+		return &PluginError{Message: fmt.Sprintf("fake: %s failed", method), Class: "server"}
+	}
+	return nil
+}
+
+func fakeNotFound(id string) error {
+	return &PluginError{Message: fmt.Sprintf("fake: host %s not found", id), Class: "not_found"}
+}
+
+func (p *FakeProvisioner) Provision(host BasicHost) (*ProvisionedHost, error) {
+	err := p.call("Provision")
+	defer p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	p.nextID++
+	id := fmt.Sprintf("fake-%d", p.nextID)
+	ip := fmt.Sprintf("203.0.113.%d", (p.nextID-1)%254+1)
+	if len(p.ExitNodeIP) > 0 {
+		ip = p.ExitNodeIP
+	}
+	p.hosts[id] = &fakeHost{
+		host:    host,
+		ip:      ip,
+		created: p.now(),
+		tags:    tagList(host.Tags, func(tag string) string { return tag }),
+	}
+	return &ProvisionedHost{ID: id, Status: "new"}, nil
+}
+
+func (p *FakeProvisioner) status(id string, host *fakeHost) *ProvisionedHost {
+	if p.now().Sub(host.created) < p.ProvisionLatency {
+		return &ProvisionedHost{ID: id, Status: "new"}
+	}
+	return &ProvisionedHost{ID: id, Status: "active", IP: host.ip}
+}
+
+func (p *FakeProvisioner) Status(id string) (*ProvisionedHost, error) {
+	err := p.call("Status")
+	defer p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	host, ok := p.hosts[id]
+	if !ok {
+		return nil, fakeNotFound(id)
+	}
+	return p.status(id, host), nil
+}
+
+// Events returns the creation of a host, and when it became active
+func (p *FakeProvisioner) Events(id string) ([]HostEvent, error) {
+	err := p.call("Events")
+	defer p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	host, ok := p.hosts[id]
+	if !ok {
+		return nil, fakeNotFound(id)
+	}
+
+	events := []HostEvent{{Time: host.created, Type: "create", Status: "completed", Message: "created " + host.host.Name}}
+	if active := host.created.Add(p.ProvisionLatency); !p.now().Before(active) {
+		events = append(events, HostEvent{Time: active, Type: "active", Status: "completed", Message: "assigned " + host.ip})
+	}
+	return events, nil
+}
+
+func (p *FakeProvisioner) Delete(id string) error {
+	err := p.call("Delete")
+	defer p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := p.hosts[id]; !ok {
+		return fakeNotFound(id)
+	}
+	delete(p.hosts, id)
+	for ip, assigned := range p.ips {
+		if assigned == id {
+			p.ips[ip] = ""
+		}
+	}
+	return nil
+}
+
+// SupportsTCP is true, since fake hosts have no firewall
+func (p *FakeProvisioner) SupportsTCP() bool {
+	return true
+}
+
+// Inspect returns a host as it was provisioned
+func (p *FakeProvisioner) Inspect(id string) (*BasicHost, error) {
+	err := p.call("Inspect")
+	defer p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	host, ok := p.hosts[id]
+	if !ok {
+		return nil, fakeNotFound(id)
+	}
+	inspected := BasicHost{Region: host.host.Region, Plan: host.host.Plan, OS: host.host.OS, Name: host.host.Name}
+	return &inspected, nil
+}
+
+// Regions returns the regions of the fake provider
+func (p *FakeProvisioner) Regions() ([]string, error) {
+	err := p.call("Regions")
+	defer p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"fake-1", "fake-2"}, nil
+}
+
+// ReserveIP reserves an IP from 198.51.100.0/24 for a host
+func (p *FakeProvisioner) ReserveIP(id string) (string, error) {
+	err := p.call("ReserveIP")
+	defer p.lock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if _, ok := p.hosts[id]; !ok {
+		return "", fakeNotFound(id)
+	}
+	ip := fmt.Sprintf("198.51.100.%d", len(p.ips)%254+1)
+	p.ips[ip] = id
+	return ip, nil
+}
+
+func (p *FakeProvisioner) AssignIP(ip, id string) error {
+	err := p.call("AssignIP")
+	defer p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := p.ips[ip]; !ok {
+		return fakeNotFound(ip)
+	}
+	if _, ok := p.hosts[id]; !ok {
+		return fakeNotFound(id)
+	}
+	p.ips[ip] = id
+	return nil
+}
+
+func (p *FakeProvisioner) ReleaseIP(ip string) error {
+	err := p.call("ReleaseIP")
+	defer p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	delete(p.ips, ip)
+	return nil
+}
+
+// SetAllowedSources records the sources which may connect to a host
+func (p *FakeProvisioner) SetAllowedSources(id string, openPorts []int, openSources, cidrs []string) error {
+	err := p.call("SetAllowedSources")
+	defer p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	host, ok := p.hosts[id]
+	if !ok {
+		return fakeNotFound(id)
+	}
+	host.openPorts = openPorts
+	host.sources = append(append([]string{}, openSources...), cidrs...)
+	return nil
+}
+
+// CheckPermissions finds no missing permissions
+func (p *FakeProvisioner) CheckPermissions(host BasicHost) ([]string, error) {
+	err := p.call("CheckPermissions")
+	defer p.lock.Unlock()
+	return nil, err
+}
+
+// Usage returns the same usage for every host
+func (p *FakeProvisioner) Usage(id string, window time.Duration) (*HostUsage, error) {
+	err := p.call("Usage")
+	defer p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := p.hosts[id]; !ok {
+		return nil, fakeNotFound(id)
+	}
+	return &HostUsage{CPUPercent: 5, MemoryPercent: 20, ReceiveBytesPerSecond: 1024, TransmitBytesPerSecond: 2048}, nil
+}
+
+// List returns the hosts with all of the tags
+func (p *FakeProvisioner) List(filter HostFilter) ([]ListedHost, error) {
+	err := p.call("List")
+	defer p.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	format := func(tag string) string { return tag }
+	tags := tagList(filter.Tags, format)
+
+	hosts := []ListedHost{}
+	for id, host := range p.hosts {
+		if !hasTags(host.tags, tags) {
+			continue
+		}
+		hosts = append(hosts, ListedHost{
+			ProvisionedHost: *p.status(id, host),
+			Name:            host.host.Name,
+			Tags:            append([]string{}, host.tags...),
+			Created:         host.created,
+			format:          format,
+		})
+	}
+	sort.Slice(hosts, func(i, j int) bool { return hosts[i].ID < hosts[j].ID })
+	return hosts, nil
+}
+
+// SetTags sets the tags of the listed hosts
+func (p *FakeProvisioner) SetTags(hosts []ListedHost, tags map[string]map[string]string, keys []string) error {
+	err := p.call("SetTags")
+	defer p.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, listed := range hosts {
+		want, ok := tags[listed.ID]
+		host, exists := p.hosts[listed.ID]
+		if !ok || !exists {
+			continue
+		}
+		add, remove := diffTags(listed, want, keys)
+		updated := append([]string{}, add...)
+		for _, tag := range host.tags {
+			if !hasTags(remove, []string{tag}) {
+				updated = append(updated, tag)
+			}
+		}
+		host.tags = updated
+	}
+	return nil
+}
+
+// HourlyCost returns CostPerHour, or the error injected by FailNext
+func (p *FakeProvisioner) HourlyCost(host BasicHost) (float64, error) {
+	err := p.call("HourlyCost")
+	defer p.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return p.CostPerHour, nil
+}
@@ -0,0 +1,122 @@
+package provision
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeAPI is an HTTP server which stands in for the API of a provider, so
+// that a provisioner can be tested without an account. Each route is a
+// method and a path, i.e. "GET /v2/droplets/123", and routes which aren't
+// handled return notFound with a 404.
+type fakeAPI struct {
+	t        *testing.T
+	server   *httptest.Server
+	notFound string
+
+	lock     sync.Mutex
+	routes   map[string]http.HandlerFunc
+	failures map[string][]fakeFailure
+	requests map[string]int
+}
+
+// fakeFailure is a response which a route returns instead of calling its
+// handler
+type fakeFailure struct {
+	status int
+	body   string
+	header http.Header
+}
+
+func newFakeAPI(t *testing.T, notFound string) *fakeAPI {
+	api := &fakeAPI{
+		t:        t,
+		notFound: notFound,
+		routes:   map[string]http.HandlerFunc{},
+		failures: map[string][]fakeFailure{},
+		requests: map[string]int{},
+	}
+	api.server = httptest.NewServer(http.HandlerFunc(api.serve))
+	return api
+}
+
+func (api *fakeAPI) close() {
+	api.server.Close()
+}
+
+// handle serves a route with a handler
+func (api *fakeAPI) handle(route string, handler http.HandlerFunc) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	api.routes[route] = handler
+}
+
+// failNext makes the next request of a route fail with a status, a body
+// and headers given as pairs, i.e. "Retry-After", "60"
+func (api *fakeAPI) failNext(route string, status int, body string, header ...string) {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+
+	failure := fakeFailure{status: status, body: body, header: http.Header{}}
+	for i := 0; i+1 < len(header); i += 2 {
+		failure.header.Set(header[i], header[i+1])
+	}
+	api.failures[route] = append(api.failures[route], failure)
+}
+
+// requested returns how many requests were made for a route
+func (api *fakeAPI) requested(route string) int {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	return api.requests[route]
+}
+
+func (api *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	route := r.Method + " " + r.URL.Path
+
+	api.lock.Lock()
+	api.requests[route]++
+	handler := api.routes[route]
+	var failure *fakeFailure
+	if queue := api.failures[route]; len(queue) > 0 {
+		failure = &queue[0]
+		api.failures[route] = queue[1:]
+	}
+	api.lock.Unlock()
+
+	switch {
+	case failure != nil:
+		for key, values := range failure.header {
+			w.Header()[key] = values
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(failure.status)
+		fmt.Fprint(w, failure.body)
+	case handler != nil:
+		handler(w, r)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, api.notFound)
+	}
+}
+
+// writeJSON writes a response with a status and a value as JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// readJSON reads the JSON body of a request into a map
+func readJSON(t *testing.T, r *http.Request) map[string]interface{} {
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		t.Errorf("error decoding request of %s %s: %s", r.Method, r.URL.Path, err.Error())
+	}
+	return body
+}
@@ -0,0 +1,156 @@
+package provision
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Faults are injected into the calls of all provisioners to their
+// providers, so that the retries of the operator, its failover to other
+// regions and its adoption of hosts can be exercised in end-to-end and soak
+// tests. They must not be enabled in production.
+type Faults struct {
+	// Rate is the fraction of calls which fail, from 0 to 1
+	Rate float64
+
+	// Classes are the classes of ErrorClass which calls fail with, one
+	// picked at random for each failure, or "server" when empty
+	Classes []string
+
+	// DelayRate is the fraction of calls which are delayed, from 0 to 1,
+	// by a random time up to MaxDelay
+	DelayRate float64
+	MaxDelay  time.Duration
+}
+
+// faultClasses are the classes which faults can be injected with
+var faultClasses = []string{"capacity", "forbidden", "not_found", "other", "rate_limited", "server"}
+
+// Enabled returns true when any call may fail or be delayed
+func (f Faults) Enabled() bool {
+	return f.Rate > 0 || (f.DelayRate > 0 && f.MaxDelay > 0)
+}
+
+// Validate returns an error when a rate is not a fraction or a class can't
+// be injected
+func (f Faults) Validate() error {
+	if f.Rate < 0 || f.Rate > 1 {
+		return fmt.Errorf("rate must be from 0 to 1, got %g", f.Rate)
+	}
+	if f.DelayRate < 0 || f.DelayRate > 1 {
+		return fmt.Errorf("delay rate must be from 0 to 1, got %g", f.DelayRate)
+	}
+	if f.MaxDelay < 0 {
+		return fmt.Errorf("max delay must not be negative, got %s", f.MaxDelay)
+	}
+	for _, class := range f.Classes {
+		valid := false
+		for _, faultClass := range faultClasses {
+			valid = valid || class == faultClass
+		}
+		if !valid {
+			return fmt.Errorf("class must be one of %s, got %q", strings.Join(faultClasses, ", "), class)
+		}
+	}
+	return nil
+}
+
+var (
+	faults     Faults
+	faultsLock sync.Mutex
+	faultsRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// SetFaults sets the faults which are injected into the calls of all
+// provisioners, or none with a zero Faults
+func SetFaults(f Faults) {
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+	faults = f
+}
+
+// injectFault returns how long to delay a call, and the class of the error
+// which it must fail with, if any
+func injectFault() (time.Duration, string) {
+	faultsLock.Lock()
+	defer faultsLock.Unlock()
+
+	if !faults.Enabled() {
+		return 0, ""
+	}
+
+	var delay time.Duration
+	if faults.DelayRate > 0 && faults.MaxDelay > 0 && faultsRand.Float64() < faults.DelayRate {
+		delay = time.Duration(faultsRand.Int63n(int64(faults.MaxDelay)))
+	}
+
+	class := ""
+	if faults.Rate > 0 && faultsRand.Float64() < faults.Rate {
+		class = "server"
+		if len(faults.Classes) > 0 {
+			class = faults.Classes[faultsRand.Intn(len(faults.Classes))]
+		}
+	}
+	return delay, class
+}
+
+// injectCallFault delays a call of the fake provisioner or of a plugin, and
+// returns the error which it must fail with, if any
+func injectCallFault(provider, method string) error {
+	delay, class := injectFault()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if len(class) == 0 {
+		return nil
+	}
+	return &PluginError{Message: fmt.Sprintf("%s: injected %s fault in %s", provider, class, method), Class: class}
+}
+
+// faultResponse returns a response of the API of a provider which fails
+// with a class. Its body is read as an error by the SDKs of both
+// DigitalOcean and Packet.
+func faultResponse(req *http.Request, class string) *http.Response {
+	// A 503 is read as a lack of capacity, so servers fail with a 502,
+	// which reads are retried after as well
+	statusCode := http.StatusBadGateway
+	message := "injected server fault"
+	header := http.Header{"Content-Type": []string{"application/json"}}
+
+	switch class {
+	case "capacity":
+		statusCode = http.StatusUnprocessableEntity
+		message = "injected fault: not enough capacity"
+	case "forbidden":
+		statusCode = http.StatusForbidden
+		message = "injected forbidden fault"
+	case "not_found":
+		statusCode = http.StatusNotFound
+		message = "injected not_found fault"
+	case "other":
+		statusCode = http.StatusConflict
+		message = "injected fault"
+	case "rate_limited":
+		statusCode = http.StatusTooManyRequests
+		message = "injected rate_limited fault"
+		header.Set("Retry-After", "1")
+	}
+
+	body := fmt.Sprintf(`{"id": %q, "message": %q, "errors": [%q]}`, class, message, message)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
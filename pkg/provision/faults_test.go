@@ -0,0 +1,119 @@
+package provision
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultsValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults Faults
+		valid  bool
+	}{
+		{name: "none", faults: Faults{}, valid: true},
+		{name: "classes", faults: Faults{Rate: 0.1, Classes: []string{"capacity", "rate_limited"}}, valid: true},
+		{name: "delays", faults: Faults{DelayRate: 1, MaxDelay: time.Second}, valid: true},
+		{name: "rate above 1", faults: Faults{Rate: 1.5}},
+		{name: "negative delay rate", faults: Faults{DelayRate: -0.1}},
+		{name: "negative delay", faults: Faults{DelayRate: 0.5, MaxDelay: -time.Second}},
+		{name: "unknown class", faults: Faults{Rate: 0.1, Classes: []string{"timeout"}}},
+	}
+
+	for _, test := range tests {
+		err := test.faults.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: want valid, got %s", test.name, err.Error())
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: want an error", test.name)
+		}
+	}
+}
+
+func TestFaultsInHTTPProviders(t *testing.T) {
+	// Reads which fail with "server" or "rate_limited" are not retried, so
+	// that each call sees the injected class
+	SetClientOptions(ClientOptions{Retries: 0})
+	defer SetClientOptions(ClientOptions{Retries: 2})
+	defer SetFaults(Faults{})
+
+	for _, class := range faultClasses {
+		t.Run(class, func(t *testing.T) {
+			SetFaults(Faults{Rate: 1, Classes: []string{class}})
+
+			do, doAPI := newTestDigitalOceanProvisioner(t)
+			defer doAPI.close()
+
+			_, err := do.Status("123")
+			if got := ErrorClass(err); got != class {
+				t.Errorf("DigitalOcean: want class %s, got %s: %v", class, got, err)
+			}
+			if got := doAPI.requested("GET /v2/droplets/123"); got != 0 {
+				t.Errorf("DigitalOcean: want the request not to be sent, got %d", got)
+			}
+
+			packet, packetAPI := newTestPacketProvisioner(t)
+			defer packetAPI.close()
+
+			_, err = packet.Status(packetDeviceID)
+			if got := ErrorClass(err); got != class {
+				t.Errorf("Packet: want class %s, got %s: %v", class, got, err)
+			}
+		})
+	}
+
+	SetFaults(Faults{Rate: 1, Classes: []string{"rate_limited"}})
+	do, api := newTestDigitalOceanProvisioner(t)
+	defer api.close()
+	_, err := do.Status("123")
+	if after, ok := RetryAfter(err); !ok || after != time.Second {
+		t.Errorf("want to retry an injected rate_limited fault after 1s, got %s (%t)", after, ok)
+	}
+}
+
+func TestFaultsRetried(t *testing.T) {
+	defer SetFaults(Faults{})
+	SetFaults(Faults{Rate: 0.3})
+
+	p, api := newTestDigitalOceanProvisioner(t)
+	defer api.close()
+
+	// A third of the reads fail with a 502, so the retries of the transport
+	// recover most of them
+	succeeded := 0
+	for i := 0; i < 3; i++ {
+		if _, err := p.Status("123"); ErrorClass(err) == "not_found" {
+			succeeded++
+		}
+	}
+	if succeeded == 0 {
+		t.Errorf("want reads to be retried past injected faults, got none through")
+	}
+}
+
+func TestFaultsInFakeProvisioner(t *testing.T) {
+	defer SetFaults(Faults{})
+	SetFaults(Faults{Rate: 1, Classes: []string{"capacity"}, DelayRate: 1, MaxDelay: 20 * time.Millisecond})
+
+	p := NewFakeProvisioner()
+	started := time.Now()
+	_, err := p.Provision(BasicHost{Name: "inlets-app"})
+	if class := ErrorClass(err); class != "capacity" {
+		t.Errorf("want class capacity, got %s: %v", class, err)
+	}
+	if !IsCapacityError(err) {
+		t.Errorf("want a capacity error, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("want a delay of up to 20ms, took %s", elapsed)
+	}
+	if len(p.HostIDs()) != 0 {
+		t.Errorf("want no host to be provisioned, got %v", p.HostIDs())
+	}
+
+	SetFaults(Faults{})
+	if _, err := p.Provision(BasicHost{Name: "inlets-app"}); err != nil {
+		t.Errorf("want no faults once they are disabled, got %s", err.Error())
+	}
+}
@@ -0,0 +1,31 @@
+//go:build gofuzz
+// +build gofuzz
+
+package provision
+
+import "strconv"
+
+// Fuzz is the entry point of go-fuzz for the parsers of the IDs of hosts,
+// which are read back from the status of tunnels:
+//
+//	go-fuzz-build github.com/alexellis/inlets-operator/pkg/provision
+//	go-fuzz -bin provision-fuzz.zip -workdir /tmp/fuzz
+func Fuzz(data []byte) int {
+	id := string(data)
+	interesting := 0
+
+	if sid, err := parseDropletID(id); err == nil {
+		if strconv.Itoa(sid) != id {
+			panic("droplet ID " + id + " was parsed as " + strconv.Itoa(sid))
+		}
+		interesting = 1
+	}
+
+	if device, err := parsePacketDeviceID(id); err == nil {
+		if again, err := parsePacketDeviceID(device); err != nil || again != device {
+			panic("device ID " + id + " does not parse again as " + device)
+		}
+		interesting = 1
+	}
+	return interesting
+}
@@ -0,0 +1,123 @@
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "Write the golden files in testdata from the output of the tests")
+
+// checkGolden compares got with the golden file at path, or writes it with
+// -update
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading golden file, create it with go test -run %s -update: %s", t.Name(), err.Error())
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s differs from the golden file, update it with go test -run %s -update if this is intended\nwant:\n%s\ngot:\n%s",
+			path, t.Name(), string(want), string(got))
+	}
+}
+
+// captureCreate returns the indented body of the request which creates a
+// host
+func captureCreate(t *testing.T, api *fakeAPI, route string, response interface{}) func() []byte {
+	var body []byte
+	api.handle(route, func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, data, "", "  "); err != nil {
+			t.Errorf("the body of the create is not JSON: %s", err.Error())
+		}
+		body = append(indented.Bytes(), '\n')
+		writeJSON(w, http.StatusCreated, response)
+	})
+	return func() []byte {
+		return body
+	}
+}
+
+var goldenHosts = []struct {
+	name string
+	host BasicHost
+}{
+	{
+		name: "defaults",
+		host: BasicHost{Name: "inlets-app", Plan: "small", OS: "ubuntu"},
+	},
+	{
+		name: "region-userdata-tags",
+		host: BasicHost{
+			Name:     "inlets-app",
+			Region:   "region-1",
+			Plan:     "small",
+			OS:       "ubuntu",
+			UserData: "#!/bin/bash\nexport AUTHTOKEN=\"golden-token\"\n",
+			Tags: map[string]string{
+				"inlets-operator": "default",
+				"team":            "web apps",
+				"tunnel":          "default.app",
+			},
+			Additional: map[string]string{"project_id": "project1"},
+		},
+	},
+}
+
+// TestGoldenDigitalOceanCreate checks the request which creates a droplet
+// against testdata/create
+func TestGoldenDigitalOceanCreate(t *testing.T) {
+	for _, test := range goldenHosts {
+		t.Run(test.name, func(t *testing.T) {
+			p, api := newTestDigitalOceanProvisioner(t)
+			defer api.close()
+
+			body := captureCreate(t, api, "POST /v2/droplets", digitalOceanDroplet(123, "new", ""))
+			if _, err := p.Provision(test.host); err != nil {
+				t.Fatalf("Provision: %s", err.Error())
+			}
+			checkGolden(t, filepath.Join("testdata", "create", "digitalocean-"+test.name+".json"), body())
+		})
+	}
+}
+
+// TestGoldenPacketCreate checks the request which creates a device against
+// testdata/create
+func TestGoldenPacketCreate(t *testing.T) {
+	for _, test := range goldenHosts {
+		t.Run(test.name, func(t *testing.T) {
+			p, api := newTestPacketProvisioner(t)
+			defer api.close()
+
+			host := test.host
+			if len(host.Additional["project_id"]) == 0 {
+				host.Additional = map[string]string{"project_id": "project1"}
+			}
+
+			body := captureCreate(t, api, "POST /projects/project1/devices", packetDevice("queued", ""))
+			if _, err := p.Provision(host); err != nil {
+				t.Fatalf("Provision: %s", err.Error())
+			}
+			checkGolden(t, filepath.Join("testdata", "create", "packet-"+test.name+".json"), body())
+		})
+	}
+}
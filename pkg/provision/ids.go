@@ -0,0 +1,42 @@
+package provision
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// parseDropletID returns the number of a droplet from its ID, which is read
+// back from the status of a tunnel, so may be stale or hand-edited. Only
+// positive decimal numbers are droplet IDs; anything else, even "+1" or
+// " 1", would otherwise have been read as droplet 0.
+func parseDropletID(id string) (int, error) {
+	if len(id) == 0 || len(id) > 19 {
+		return 0, &invalidIDError{provider: "digitalocean", id: id}
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return 0, &invalidIDError{provider: "digitalocean", id: id}
+		}
+	}
+
+	sid, err := strconv.Atoi(id)
+	if err != nil || sid < 1 {
+		return 0, &invalidIDError{provider: "digitalocean", id: id}
+	}
+	return sid, nil
+}
+
+var deviceIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// parsePacketDeviceID returns the ID of a device in lower case, as Packet
+// returns it, or an error when it is not a UUID. The ID is put into the
+// path of each request, so one such as "../projects" must never reach the
+// API.
+func parsePacketDeviceID(id string) (string, error) {
+	lower := strings.ToLower(id)
+	if !deviceIDPattern.MatchString(lower) {
+		return "", &invalidIDError{provider: "packet", id: id}
+	}
+	return lower, nil
+}
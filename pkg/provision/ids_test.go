@@ -0,0 +1,134 @@
+package provision
+
+import (
+	"strconv"
+	"testing"
+	"testing/quick"
+)
+
+func TestParseDropletID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{id: "123", want: 123},
+		{id: "999999999", want: 999999999},
+		{id: ""},
+		{id: "0"},
+		{id: "-1"},
+		{id: "+1"},
+		{id: " 1"},
+		{id: "1 "},
+		{id: "0x1f"},
+		{id: "1e3"},
+		{id: "abc"},
+		{id: "123/firewalls"},
+		{id: "99999999999999999999999"},
+		{id: "0e5d7a1b-7c47-4a3c-9c0b-2a8f6d3e1f42"},
+	}
+
+	for _, test := range tests {
+		sid, err := parseDropletID(test.id)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("%q: want an error, got %d", test.id, sid)
+			} else if class := ErrorClass(err); class != "not_found" {
+				t.Errorf("%q: want class not_found, got %s", test.id, class)
+			}
+			continue
+		}
+		if err != nil || sid != test.want {
+			t.Errorf("%q: want %d, got %d with error %v", test.id, test.want, sid, err)
+		}
+	}
+}
+
+func TestParsePacketDeviceID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{id: packetDeviceID, want: packetDeviceID},
+		{id: "0E5D7A1B-7C47-4A3C-9C0B-2A8F6D3E1F42", want: packetDeviceID},
+		{id: "00000000-0000-0000-0000-000000000000", want: "00000000-0000-0000-0000-000000000000"},
+		{id: ""},
+		{id: "123"},
+		{id: "../projects"},
+		{id: packetDeviceID + "/events"},
+		{id: " " + packetDeviceID},
+		{id: "0e5d7a1b7c474a3c9c0b2a8f6d3e1f42"},
+		{id: "ge5d7a1b-7c47-4a3c-9c0b-2a8f6d3e1f42"},
+	}
+
+	for _, test := range tests {
+		id, err := parsePacketDeviceID(test.id)
+		if len(test.want) == 0 {
+			if err == nil {
+				t.Errorf("%q: want an error, got %s", test.id, id)
+			} else if class := ErrorClass(err); class != "not_found" {
+				t.Errorf("%q: want class not_found, got %s", test.id, class)
+			}
+			continue
+		}
+		if err != nil || id != test.want {
+			t.Errorf("%q: want %s, got %s with error %v", test.id, test.want, id, err)
+		}
+	}
+}
+
+// TestParseIDsQuick checks the parsers with random IDs: they must never
+// panic, and an ID which parses must name the same host when formatted
+// again
+func TestParseIDsQuick(t *testing.T) {
+	droplet := func(id string) bool {
+		sid, err := parseDropletID(id)
+		return err != nil || (sid > 0 && strconv.Itoa(sid) == id)
+	}
+	if err := quick.Check(droplet, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+
+	device := func(id string) bool {
+		parsed, err := parsePacketDeviceID(id)
+		if err != nil {
+			return true
+		}
+		again, err := parsePacketDeviceID(parsed)
+		return err == nil && again == parsed && len(parsed) == len(id)
+	}
+	if err := quick.Check(device, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStatusOfMalformedID(t *testing.T) {
+	do, doAPI := newTestDigitalOceanProvisioner(t)
+	defer doAPI.close()
+
+	for _, id := range []string{"", "abc", "-1"} {
+		if _, err := do.Status(id); ErrorClass(err) != "not_found" {
+			t.Errorf("DigitalOcean Status of %q: want class not_found, got %v", id, err)
+		}
+		if err := do.Delete(id); ErrorClass(err) != "not_found" {
+			t.Errorf("DigitalOcean Delete of %q: want class not_found, got %v", id, err)
+		}
+	}
+	if got := doAPI.requested("GET /v2/droplets/0"); got != 0 {
+		t.Errorf("want no request for droplet 0, got %d", got)
+	}
+
+	packet, packetAPI := newTestPacketProvisioner(t)
+	defer packetAPI.close()
+
+	for _, id := range []string{"", "abc", "../projects"} {
+		if _, err := packet.Status(id); ErrorClass(err) != "not_found" {
+			t.Errorf("Packet Status of %q: want class not_found, got %v", id, err)
+		}
+		if err := packet.Delete(id); ErrorClass(err) != "not_found" {
+			t.Errorf("Packet Delete of %q: want class not_found, got %v", id, err)
+		}
+	}
+	if got := packetAPI.requested("GET /projects"); got != 0 {
+		t.Errorf("want no request outside of /devices, got %d", got)
+	}
+}
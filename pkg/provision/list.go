@@ -0,0 +1,128 @@
+package provision
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listCacheTTL is how long the hosts returned by List are reused, so that
+// the orphan check and the adoption of exit-nodes, which run often, don't
+// list every host of the account each time
+const listCacheTTL = 30 * time.Second
+
+// deletedHostTTL is how long a host which was deleted is left out of List,
+// since a provider may list it for a while after it was deleted
+const deletedHostTTL = 15 * time.Minute
+
+type cachedList struct {
+	lock   sync.Mutex
+	hosts  []ListedHost
+	listed time.Time
+}
+
+// deletedHost is a host which a provisioner deleted, since IDs are only
+// unique within a provider
+type deletedHost struct {
+	provisioner Provisioner
+	id          string
+}
+
+var (
+	lists        = map[Provisioner]map[string]*cachedList{}
+	deletedHosts = map[deletedHost]time.Time{}
+	listsLock    sync.Mutex
+)
+
+// ListHosts returns the hosts of a provisioner which have all of the tags
+// of the filter. The hosts are cached for listCacheTTL, and callers which
+// list the same hosts at once wait for a single call to the provider.
+func ListHosts(p Provisioner, filter HostFilter) ([]ListedHost, error) {
+	lister, ok := p.(HostLister)
+	if !ok {
+		return nil, fmt.Errorf("provisioner %T cannot list hosts", p)
+	}
+
+	key := filterKey(filter)
+
+	listsLock.Lock()
+	if lists[p] == nil {
+		lists[p] = map[string]*cachedList{}
+	}
+	cached, ok := lists[p][key]
+	if !ok {
+		cached = &cachedList{}
+		lists[p][key] = cached
+	}
+	listsLock.Unlock()
+
+	cached.lock.Lock()
+	defer cached.lock.Unlock()
+
+	if cached.hosts != nil && time.Since(cached.listed) < listCacheTTL {
+		return cached.hosts, nil
+	}
+
+	listed, err := lister.List(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	listsLock.Lock()
+	hosts := []ListedHost{}
+	for _, host := range listed {
+		if deleted, ok := deletedHosts[deletedHost{p, host.ID}]; !ok || time.Since(deleted) > deletedHostTTL {
+			hosts = append(hosts, host)
+		}
+	}
+	listsLock.Unlock()
+
+	cached.hosts = hosts
+	cached.listed = time.Now()
+	return hosts, nil
+}
+
+// ForgetHosts drops the cached hosts of a provisioner after it created a
+// host, so that the next List sees the change
+func ForgetHosts(p Provisioner) {
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	delete(lists, p)
+}
+
+// ForgetDeletedHost drops the cached hosts of a provisioner after it
+// deleted a host, and leaves the host out of List whilst the provider may
+// still return it
+func ForgetDeletedHost(p Provisioner, id string) {
+	listsLock.Lock()
+	defer listsLock.Unlock()
+	delete(lists, p)
+
+	now := time.Now()
+	for host, deleted := range deletedHosts {
+		if now.Sub(deleted) > deletedHostTTL {
+			delete(deletedHosts, host)
+		}
+	}
+	deletedHosts[deletedHost{p, id}] = now
+}
+
+// filterKey returns the filter as a string which is the same for equal
+// filters
+func filterKey(filter HostFilter) string {
+	parts := []string{}
+	for _, values := range []map[string]string{filter.Tags, filter.Additional} {
+		keys := []string{}
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			parts = append(parts, key+"="+values[key])
+		}
+		parts = append(parts, "|")
+	}
+	return strings.Join(parts, ",")
+}
@@ -1,7 +1,8 @@
 package provision
 
 import (
-	"net/http"
+	"fmt"
+	"time"
 
 	"github.com/packethost/packngo"
 )
@@ -14,39 +15,223 @@ type PacketProvisioner struct {
 // NewPacketProvisioner with an accessKey
 func NewPacketProvisioner(accessKey string) (*PacketProvisioner, error) {
 	return &PacketProvisioner{
-		client: packngo.NewClientWithAuth("", accessKey, http.DefaultClient),
+		client: packngo.NewClientWithAuth("", accessKey, newObservedClient("packet")),
 	}, nil
 }
 
 func (p *PacketProvisioner) Status(id string) (*ProvisionedHost, error) {
+	id, err := parsePacketDeviceID(id)
+	if err != nil {
+		return nil, err
+	}
+
 	device, _, err := p.client.Devices.Get(id, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
-	state := device.State
+	return &ProvisionedHost{
+		ID:     device.ID,
+		Status: device.State,
+		IP:     getDeviceIP(device),
+	}, nil
+}
+
+// packetTagUpdates is the most devices whose tags are updated by one call
+// of SetTags, since Packet updates the tags of one device per call. The
+// rest are updated by the next call.
+const packetTagUpdates = 20
 
-	ip := ""
+// SetTags updates the tags of each device which needs it, up to
+// packetTagUpdates devices
+func (p *PacketProvisioner) SetTags(hosts []ListedHost, tags map[string]map[string]string, keys []string) error {
+	updated := 0
+	for _, host := range hosts {
+		want, ok := tags[host.ID]
+		if !ok {
+			continue
+		}
+		add, remove := diffTags(host, want, keys)
+		if len(add) == 0 && len(remove) == 0 {
+			continue
+		}
+		if updated == packetTagUpdates {
+			return nil
+		}
+
+		deviceTags := append([]string{}, add...)
+		for _, tag := range host.Tags {
+			if !hasTags(remove, []string{tag}) {
+				deviceTags = append(deviceTags, tag)
+			}
+		}
+		if _, _, err := p.client.Devices.Update(host.ID, &packngo.DeviceUpdateRequest{Tags: &deviceTags}); err != nil {
+			return err
+		}
+		updated++
+	}
+	return nil
+}
+
+func getDeviceIP(device *packngo.Device) string {
 	for _, network := range device.Network {
 		if network.Public {
-			ip = network.IpAddressCommon.Address
-			break
+			return network.IpAddressCommon.Address
 		}
 	}
+	return ""
+}
 
-	return &ProvisionedHost{
-		ID:     device.ID,
-		Status: state,
-		IP:     ip,
-	}, nil
+// List returns the devices of the project with all of the tags. The API
+// can't filter devices by tag, so packngo follows the pages of the project
+// and the tags are checked here.
+func (p *PacketProvisioner) List(filter HostFilter) ([]ListedHost, error) {
+	projectID := filter.Additional["project_id"]
+	if len(projectID) == 0 {
+		return nil, fmt.Errorf("project_id is needed to list devices")
+	}
+
+	format := func(tag string) string { return tag }
+	tags := tagList(filter.Tags, format)
+
+	devices, _, err := p.client.Devices.List(projectID, &packngo.ListOptions{PerPage: 100})
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []ListedHost{}
+	for i := range devices {
+		device := &devices[i]
+		if !hasTags(device.Tags, tags) {
+			continue
+		}
+		created, _ := time.Parse(time.RFC3339, device.Created)
+		hosts = append(hosts, ListedHost{
+			ProvisionedHost: ProvisionedHost{
+				ID:     device.ID,
+				Status: device.State,
+				IP:     getDeviceIP(device),
+			},
+			Name:    device.Hostname,
+			Tags:    device.Tags,
+			Created: created,
+			format:  format,
+		})
+	}
+	return hosts, nil
+}
+
+// CheckPermissions reads the project which hosts are provisioned into and
+// lists its devices
+func (p *PacketProvisioner) CheckPermissions(host BasicHost) ([]string, error) {
+	projectID := host.Additional["project_id"]
+	if len(projectID) == 0 {
+		return []string{"project-id is not set"}, nil
+	}
+
+	if _, _, err := p.client.Projects.Get(projectID, nil); err != nil {
+		if isForbidden(err) || isNotFound(err) {
+			return []string{"project:read for " + projectID}, nil
+		}
+		return nil, err
+	}
+
+	if _, _, err := p.client.Devices.List(projectID, &packngo.ListOptions{PerPage: 1}); err != nil {
+		if isForbidden(err) {
+			return []string{"device:read for " + projectID}, nil
+		}
+		return nil, err
+	}
+	return []string{}, nil
 }
 
 func (p *PacketProvisioner) Delete(id string) error {
-	_, err := p.client.Devices.Delete(id)
+	id, err := parsePacketDeviceID(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.client.Devices.Delete(id)
 	return err
 }
 
+// Regions returns the codes of the facilities where devices can be created
+func (p *PacketProvisioner) Regions() ([]string, error) {
+	facilities, _, err := p.client.Facilities.List(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := []string{}
+	for _, facility := range facilities {
+		codes = append(codes, facility.Code)
+	}
+	return codes, nil
+}
+
+// Events returns the events of a device, i.e. its provisioning
+func (p *PacketProvisioner) Events(id string) ([]HostEvent, error) {
+	id, err := parsePacketDeviceID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceEvents, _, err := p.client.Devices.ListEvents(id, &packngo.ListOptions{PerPage: 200})
+	if err != nil {
+		return nil, err
+	}
+
+	events := []HostEvent{}
+	for _, deviceEvent := range deviceEvents {
+		event := HostEvent{Type: deviceEvent.Type, Status: deviceEvent.State, Message: deviceEvent.Interpolated}
+		if deviceEvent.CreatedAt != nil {
+			event.Time = deviceEvent.CreatedAt.Time
+		}
+		events = append(events, event)
+	}
+	sortEvents(events)
+	return events, nil
+}
+
+// Inspect returns the actual facility, plan, OS and hostname of a device
+func (p *PacketProvisioner) Inspect(id string) (*BasicHost, error) {
+	id, err := parsePacketDeviceID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	device, _, err := p.client.Devices.Get(id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	host := &BasicHost{
+		Name: device.Hostname,
+	}
+	if device.Facility != nil {
+		host.Region = device.Facility.Code
+	}
+	if device.Plan != nil {
+		host.Plan = device.Plan.Slug
+	}
+	if device.OS != nil {
+		host.OS = device.OS.Slug
+	}
+
+	return host, nil
+}
+
+// SupportsTCP is true since devices have no firewall by default
+func (p *PacketProvisioner) SupportsTCP() bool {
+	return true
+}
+
+// HourlyCost returns the estimated cost of a device from the list price of its plan
+func (p *PacketProvisioner) HourlyCost(host BasicHost) (float64, error) {
+	return lookupHourlyCost(packetHourlyCosts, host.Plan)
+}
+
 func (p *PacketProvisioner) Provision(host BasicHost) (*ProvisionedHost, error) {
 	if host.Region == "" {
 		host.Region = "ams1"
@@ -61,6 +246,7 @@ func (p *PacketProvisioner) Provision(host BasicHost) (*ProvisionedHost, error)
 		OS:           host.OS,
 		BillingCycle: "hourly",
 		UserData:     host.UserData,
+		Tags:         tagList(host.Tags, func(tag string) string { return tag }),
 	}
 
 	device, _, err := p.client.Devices.Create(createReq)
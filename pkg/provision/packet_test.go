@@ -0,0 +1,205 @@
+package provision
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	packetNotFound = `{"errors": ["Not found"]}`
+	packetDeviceID = "0e5d7a1b-7c47-4a3c-9c0b-2a8f6d3e1f42"
+)
+
+func newTestPacketProvisioner(t *testing.T) (*PacketProvisioner, *fakeAPI) {
+	api := newFakeAPI(t, packetNotFound)
+
+	p, err := NewPacketProvisioner("token")
+	if err != nil {
+		t.Fatalf("error creating provisioner: %s", err.Error())
+	}
+	p.client.BaseURL, _ = url.Parse(api.server.URL + "/")
+	return p, api
+}
+
+func packetDevice(state, ip string) map[string]interface{} {
+	addresses := []map[string]interface{}{}
+	if len(ip) > 0 {
+		addresses = append(addresses,
+			map[string]interface{}{"address": ip, "public": true, "address_family": 4},
+			map[string]interface{}{"address": "10.80.0.3", "public": false, "address_family": 4},
+		)
+	}
+	return map[string]interface{}{
+		"id":           packetDeviceID,
+		"hostname":     "inlets-app",
+		"state":        state,
+		"ip_addresses": addresses,
+	}
+}
+
+func TestPacketProvisionThenPoll(t *testing.T) {
+	p, api := newTestPacketProvisioner(t)
+	defer api.close()
+
+	var created map[string]interface{}
+	api.handle("POST /projects/project1/devices", func(w http.ResponseWriter, r *http.Request) {
+		created = readJSON(t, r)
+		writeJSON(w, http.StatusCreated, packetDevice("queued", ""))
+	})
+
+	polls := 0
+	api.handle("GET /devices/"+packetDeviceID, func(w http.ResponseWriter, r *http.Request) {
+		polls++
+		if polls < 3 {
+			writeJSON(w, http.StatusOK, packetDevice("provisioning", ""))
+			return
+		}
+		writeJSON(w, http.StatusOK, packetDevice("active", "203.0.113.20"))
+	})
+
+	res, err := p.Provision(BasicHost{
+		Name:       "inlets-app",
+		Plan:       "t1.small.x86",
+		OS:         "ubuntu_16_04",
+		Additional: map[string]string{"project_id": "project1"},
+		Tags:       map[string]string{"team": "web"},
+	})
+	if err != nil {
+		t.Fatalf("Provision: %s", err.Error())
+	}
+	if res.ID != packetDeviceID {
+		t.Errorf("want ID %s, got %q", packetDeviceID, res.ID)
+	}
+
+	if want := []interface{}{"ams1"}; !reflect.DeepEqual(created["facility"], want) {
+		t.Errorf("want the default facility %v, got %v", want, created["facility"])
+	}
+	if created["billing_cycle"] != "hourly" {
+		t.Errorf("want hourly billing, got %v", created["billing_cycle"])
+	}
+	if want := []interface{}{"team:web"}; !reflect.DeepEqual(created["tags"], want) {
+		t.Errorf("want the tags %v, got %v", want, created["tags"])
+	}
+
+	var status *ProvisionedHost
+	for i := 0; i < 5; i++ {
+		status, err = p.Status(res.ID)
+		if err != nil {
+			t.Fatalf("Status: %s", err.Error())
+		}
+		if status.Status == "active" {
+			break
+		}
+		if len(status.IP) > 0 {
+			t.Errorf("want no IP whilst %s, got %s", status.Status, status.IP)
+		}
+	}
+	if status.Status != "active" || status.IP != "203.0.113.20" {
+		t.Errorf("want active with the public IP 203.0.113.20, got %s with %q", status.Status, status.IP)
+	}
+}
+
+func TestPacketNotFound(t *testing.T) {
+	p, api := newTestPacketProvisioner(t)
+	defer api.close()
+
+	_, err := p.Status(packetDeviceID)
+	if class := ErrorClass(err); class != "not_found" {
+		t.Errorf("Status: want class not_found, got %s: %v", class, err)
+	}
+
+	err = p.Delete(packetDeviceID)
+	if class := ErrorClass(err); class != "not_found" {
+		t.Errorf("Delete: want class not_found, got %s: %v", class, err)
+	}
+}
+
+func TestPacketErrorClasses(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		class  string
+	}{
+		{
+			name:   "invalid token",
+			status: http.StatusUnauthorized,
+			body:   `{"error": "Invalid authentication token"}`,
+			class:  "forbidden",
+		},
+		{
+			name:   "not a member of the project",
+			status: http.StatusForbidden,
+			body:   `{"errors": ["You are not authorized to view this project"]}`,
+			class:  "forbidden",
+		},
+		{
+			name:   "conflict",
+			status: http.StatusConflict,
+			body:   `{"errors": ["Hostname has already been taken"]}`,
+			class:  "other",
+		},
+		{
+			name:   "rate limited",
+			status: http.StatusTooManyRequests,
+			body:   `{"errors": ["Rate limit exceeded"]}`,
+			class:  "rate_limited",
+		},
+		{
+			name:   "no capacity",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"errors": ["Facility ams1 does not have enough capacity for t1.small.x86"]}`,
+			class:  "capacity",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, api := newTestPacketProvisioner(t)
+			defer api.close()
+
+			api.failNext("POST /projects/project1/devices", test.status, test.body)
+
+			_, err := p.Provision(BasicHost{
+				Name:       "inlets-app",
+				Plan:       "t1.small.x86",
+				OS:         "ubuntu_16_04",
+				Additional: map[string]string{"project_id": "project1"},
+			})
+			if err == nil {
+				t.Fatalf("want an error")
+			}
+			if class := ErrorClass(err); class != test.class {
+				t.Errorf("want class %s, got %s: %s", test.class, class, err.Error())
+			}
+			if got := api.requested("POST /projects/project1/devices"); got != 1 {
+				t.Errorf("want 1 create, got %d", got)
+			}
+		})
+	}
+}
+
+func TestPacketEvents(t *testing.T) {
+	p, api := newTestPacketProvisioner(t)
+	defer api.close()
+
+	api.handle("GET /devices/"+packetDeviceID+"/events", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"events": []map[string]interface{}{
+				{"id": "e2", "type": "provisioning.104", "state": "success", "interpolated": "Provision complete", "created_at": "2019-10-14T10:05:00Z"},
+				{"id": "e1", "type": "provisioning.101", "state": "success", "interpolated": "Provision started", "created_at": "2019-10-14T10:00:00Z"},
+			},
+		})
+	})
+
+	events, err := p.Events(strings.ToUpper(packetDeviceID))
+	if err != nil {
+		t.Fatalf("Events: %s", err.Error())
+	}
+	if len(events) != 2 || events[0].Message != "Provision started" || events[1].Message != "Provision complete" {
+		t.Fatalf("want the events oldest first, got %v", events)
+	}
+}
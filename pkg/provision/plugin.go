@@ -0,0 +1,382 @@
+package provision
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The handshake of a provisioner plugin, after hashicorp/go-plugin. The
+// operator starts the plugin with the cookie, its access key and a secret
+// generated for this launch in its environment, and the plugin writes one
+// line to stdout:
+//
+//	2|1|tcp|127.0.0.1:43121|jsonrpc
+//
+// which is the version of the handshake, the version of the plugin
+// protocol, the network and address it listens on, and the protocol. The
+// operator then connects, writes the secret and a newline, and calls the
+// "Provisioner" service of the plugin over JSON-RPC 1.0, which a plugin
+// can serve from any language. The plugin closes connections which don't
+// start with the secret, so that other processes on the host can't call
+// it with its access key. JSON-RPC is used instead of the gRPC of
+// go-plugin, as neither gRPC nor go-plugin are vendored.
+const (
+	pluginHandshakeVersion = 2
+	PluginProtocolVersion  = 1
+
+	PluginCookieKey    = "INLETS_PROVISIONER_PLUGIN"
+	PluginCookieValue  = "f3b1a4c2-inlets-provisioner"
+	PluginAccessKeyEnv = "INLETS_PROVISIONER_ACCESS_KEY"
+	PluginSecretEnv    = "INLETS_PROVISIONER_PLUGIN_SECRET"
+)
+
+// pluginSecretLength is the length of the hex-encoded secret of a launch
+const pluginSecretLength = 64
+
+// pluginStartTimeout is how long a plugin has to write its handshake
+const pluginStartTimeout = 10 * time.Second
+
+// The capabilities of a plugin, which say which of the optional
+// interfaces of a Provisioner it implements
+const (
+	PluginCapabilityTCP     = "tcp"
+	PluginCapabilityRegions = "regions"
+)
+
+// PluginError is an error returned by a plugin, with the class which
+// ErrorClass reports for it, such as "capacity" or "not_found"
+type PluginError struct {
+	Message string `json:"message"`
+	Class   string `json:"class,omitempty"`
+}
+
+func (e *PluginError) Error() string {
+	return e.Message
+}
+
+// The arguments and replies of the methods of the "Provisioner" service of
+// a plugin. Errors of the provider are returned in Err, so that their
+// class is kept, and the error of the call itself is for failures of the
+// plugin.
+type (
+	PluginIDArgs struct {
+		ID string `json:"id"`
+	}
+
+	PluginHostReply struct {
+		Host *ProvisionedHost `json:"host,omitempty"`
+		Err  *PluginError     `json:"error,omitempty"`
+	}
+
+	PluginErrorReply struct {
+		Err *PluginError `json:"error,omitempty"`
+	}
+
+	PluginRegionsReply struct {
+		Regions []string     `json:"regions"`
+		Err     *PluginError `json:"error,omitempty"`
+	}
+
+	PluginCapabilitiesReply struct {
+		ProtocolVersion int      `json:"protocolVersion"`
+		Capabilities    []string `json:"capabilities"`
+	}
+)
+
+var (
+	plugins     = map[string]string{}
+	pluginsLock sync.RWMutex
+)
+
+// RegisterPlugin makes NewProvisioner start the plugin at path for a
+// provider, which takes precedence over a built-in provisioner of the same
+// name
+func RegisterPlugin(provider, path string) {
+	pluginsLock.Lock()
+	defer pluginsLock.Unlock()
+	plugins[provider] = path
+}
+
+func getPluginPath(provider string) (string, bool) {
+	pluginsLock.RLock()
+	defer pluginsLock.RUnlock()
+	path, ok := plugins[provider]
+	return path, ok
+}
+
+// pluginProvisioner calls a provisioner in a plugin process. The process
+// is started again by the next call after it exits. Once it is closed, the
+// process is stopped when the last call in flight returns.
+type pluginProvisioner struct {
+	provider  string
+	path      string
+	accessKey string
+
+	lock         sync.Mutex
+	cmd          *exec.Cmd
+	stdin        io.WriteCloser
+	client       *rpc.Client
+	capabilities map[string]bool
+	calls        int
+	closed       bool
+}
+
+// pluginRegionProvisioner is a plugin which can list its regions
+type pluginRegionProvisioner struct {
+	*pluginProvisioner
+}
+
+// newPluginProvisioner starts the plugin for a provider with an access key
+func newPluginProvisioner(provider, path, accessKey string) (Provisioner, error) {
+	p := &pluginProvisioner{provider: provider, path: path, accessKey: accessKey}
+	if _, err := p.getClient(); err != nil {
+		return nil, err
+	}
+
+	if p.capabilities[PluginCapabilityRegions] {
+		return &pluginRegionProvisioner{p}, nil
+	}
+	return p, nil
+}
+
+// getClient returns the client of the plugin, starting it when it isn't
+// running
+func (p *pluginProvisioner) getClient() (*rpc.Client, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.startPlugin()
+}
+
+// startPlugin starts the plugin when it isn't running, and must be called
+// with the lock held
+func (p *pluginProvisioner) startPlugin() (*rpc.Client, error) {
+	if p.client != nil {
+		return p.client, nil
+	}
+
+	secret := make([]byte, pluginSecretLength/2)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(p.path)
+	cmd.Env = append(os.Environ(),
+		PluginCookieKey+"="+PluginCookieValue,
+		PluginAccessKeyEnv+"="+p.accessKey,
+		PluginSecretEnv+"="+hex.EncodeToString(secret))
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting plugin for %s: %s", p.provider, err.Error())
+	}
+	go cmd.Wait()
+
+	addr, err := readPluginHandshake(stdout)
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("error starting plugin for %s: %s", p.provider, err.Error())
+	}
+	go io.Copy(ioutil.Discard, stdout)
+
+	conn, err := net.DialTimeout("tcp", addr, pluginStartTimeout)
+	if err == nil {
+		_, err = conn.Write([]byte(hex.EncodeToString(secret) + "\n"))
+	}
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("error connecting to plugin for %s: %s", p.provider, err.Error())
+	}
+	client := jsonrpc.NewClient(conn)
+
+	reply := PluginCapabilitiesReply{}
+	if err := client.Call("Provisioner.Capabilities", struct{}{}, &reply); err != nil {
+		client.Close()
+		stdin.Close()
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("error reading capabilities of plugin for %s: %s", p.provider, err.Error())
+	}
+	if reply.ProtocolVersion != PluginProtocolVersion {
+		client.Close()
+		stdin.Close()
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("plugin for %s speaks protocol %d, not %d", p.provider, reply.ProtocolVersion, PluginProtocolVersion)
+	}
+
+	p.capabilities = map[string]bool{}
+	for _, capability := range reply.Capabilities {
+		p.capabilities[capability] = true
+	}
+	p.cmd = cmd
+	p.stdin = stdin
+	p.client = client
+	return client, nil
+}
+
+// readPluginHandshake reads the address of a plugin from its first line
+func readPluginHandshake(stdout io.Reader) (string, error) {
+	lines := make(chan string, 1)
+	errs := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		if err != nil {
+			errs <- err
+			return
+		}
+		lines <- line
+	}()
+
+	var line string
+	select {
+	case line = <-lines:
+	case err := <-errs:
+		return "", fmt.Errorf("plugin exited before its handshake: %s", err.Error())
+	case <-time.After(pluginStartTimeout):
+		return "", fmt.Errorf("no handshake within %s", pluginStartTimeout)
+	}
+
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 5 {
+		return "", fmt.Errorf("invalid handshake: %q", line)
+	}
+	if parts[0] != fmt.Sprintf("%d", pluginHandshakeVersion) {
+		return "", fmt.Errorf("unsupported handshake version: %s", parts[0])
+	}
+	if parts[1] != fmt.Sprintf("%d", PluginProtocolVersion) {
+		return "", fmt.Errorf("unsupported protocol version: %s", parts[1])
+	}
+	if parts[2] != "tcp" || parts[4] != "jsonrpc" {
+		return "", fmt.Errorf("unsupported network or protocol: %s, %s", parts[2], parts[4])
+	}
+	return parts[3], nil
+}
+
+// call calls a method of the plugin. When the plugin has exited, it is
+// stopped so that the next call starts it again.
+func (p *pluginProvisioner) call(method string, args, reply interface{}) error {
+	if err := injectCallFault(p.provider, method); err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	client, err := p.startPlugin()
+	if err != nil {
+		p.lock.Unlock()
+		return err
+	}
+	p.calls++
+	p.lock.Unlock()
+
+	err = client.Call("Provisioner."+method, args, reply)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.calls--
+	if (err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF) && p.client == client {
+		p.stopPlugin()
+	}
+	if p.closed && p.calls == 0 {
+		p.stopPlugin()
+	}
+	return err
+}
+
+// Close stops the plugin, which should exit when its stdin is closed. A
+// plugin with calls in flight is stopped when the last of them returns.
+func (p *pluginProvisioner) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	if p.calls == 0 {
+		p.stopPlugin()
+	}
+	return nil
+}
+
+// stopPlugin stops the plugin when it is running, and must be called with
+// the lock held
+func (p *pluginProvisioner) stopPlugin() {
+	if p.client == nil {
+		return
+	}
+	p.client.Close()
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.client = nil
+}
+
+func (p *pluginProvisioner) Provision(host BasicHost) (*ProvisionedHost, error) {
+	reply := PluginHostReply{}
+	if err := p.call("Provision", host, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	return reply.Host, nil
+}
+
+func (p *pluginProvisioner) Status(id string) (*ProvisionedHost, error) {
+	reply := PluginHostReply{}
+	if err := p.call("Status", PluginIDArgs{ID: id}, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	return reply.Host, nil
+}
+
+func (p *pluginProvisioner) Delete(id string) error {
+	reply := PluginErrorReply{}
+	if err := p.call("Delete", PluginIDArgs{ID: id}, &reply); err != nil {
+		return err
+	}
+	if reply.Err != nil {
+		return reply.Err
+	}
+	return nil
+}
+
+// SupportsTCP is true when the plugin has the "tcp" capability
+func (p *pluginProvisioner) SupportsTCP() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.capabilities[PluginCapabilityTCP]
+}
+
+// Regions returns the regions of a plugin with the "regions" capability
+func (p *pluginRegionProvisioner) Regions() ([]string, error) {
+	reply := PluginRegionsReply{}
+	if err := p.call("Regions", struct{}{}, &reply); err != nil {
+		return nil, err
+	}
+	if reply.Err != nil {
+		return nil, reply.Err
+	}
+	return reply.Regions, nil
+}
@@ -0,0 +1,148 @@
+package provision
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain serves a FakeProvisioner as a plugin when the test binary is
+// started as one by the tests below. The access key "slow" adds latency
+// to each call.
+func TestMain(m *testing.M) {
+	if os.Getenv(PluginCookieKey) == PluginCookieValue {
+		err := ServePlugin(func(accessKey string) (Provisioner, error) {
+			fake := NewFakeProvisioner()
+			if accessKey == "slow" {
+				fake.CallLatency = 500 * time.Millisecond
+			}
+			return fake, nil
+		}, PluginCapabilityTCP)
+		if err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestReadPluginHandshake(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		addr  string
+		valid bool
+	}{
+		{name: "valid", line: "2|1|tcp|127.0.0.1:43121|jsonrpc\n", addr: "127.0.0.1:43121", valid: true},
+		{name: "handshake without a secret", line: "1|1|tcp|127.0.0.1:43121|jsonrpc\n"},
+		{name: "another protocol version", line: "2|2|tcp|127.0.0.1:43121|jsonrpc\n"},
+		{name: "grpc", line: "2|1|tcp|127.0.0.1:43121|grpc\n"},
+		{name: "unix socket", line: "2|1|unix|/tmp/plugin.sock|jsonrpc\n"},
+		{name: "too few parts", line: "2|1|127.0.0.1:43121\n"},
+		{name: "exited", line: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := readPluginHandshake(strings.NewReader(test.line))
+			if test.valid && err != nil {
+				t.Fatalf("want a valid handshake, got %s", err.Error())
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("want an error for %q", test.line)
+			}
+			if addr != test.addr {
+				t.Errorf("want address %q, got %q", test.addr, addr)
+			}
+		})
+	}
+}
+
+func TestServePluginConnRequiresSecret(t *testing.T) {
+	secret := strings.Repeat("a", pluginSecretLength)
+	server := rpc.NewServer()
+	server.RegisterName("Provisioner", &pluginServer{provisioner: NewFakeProvisioner()})
+
+	for _, sent := range []string{strings.Repeat("b", pluginSecretLength), secret} {
+		client, conn := net.Pipe()
+		go servePluginConn(server, conn, secret)
+
+		client.Write([]byte(sent + "\n"))
+		reply := PluginCapabilitiesReply{}
+		err := jsonrpc.NewClient(client).Call("Provisioner.Capabilities", struct{}{}, &reply)
+
+		if sent == secret && err != nil {
+			t.Errorf("want a call with the secret to succeed, got %s", err.Error())
+		}
+		if sent != secret && err == nil {
+			t.Errorf("want a call with another secret to fail")
+		}
+		client.Close()
+	}
+}
+
+func TestPluginProvisioner(t *testing.T) {
+	provisioner, err := newPluginProvisioner("test", os.Args[0], "key")
+	if err != nil {
+		t.Fatalf("newPluginProvisioner: %s", err.Error())
+	}
+	p := provisioner.(*pluginProvisioner)
+	defer p.Close()
+
+	if !p.SupportsTCP() {
+		t.Errorf("want the tcp capability of the plugin")
+	}
+
+	host, err := p.Provision(BasicHost{Name: "app"})
+	if err != nil {
+		t.Fatalf("Provision: %s", err.Error())
+	}
+	if _, err := p.Status(host.ID); err != nil {
+		t.Errorf("Status: %s", err.Error())
+	}
+	if err := p.Delete(host.ID); err != nil {
+		t.Errorf("Delete: %s", err.Error())
+	}
+	if _, err := p.Status(host.ID); ErrorClass(err) != "not_found" {
+		t.Errorf("want a not_found error for a deleted host, got %v", err)
+	}
+}
+
+func TestPluginCloseWaitsForCalls(t *testing.T) {
+	provisioner, err := newPluginProvisioner("test", os.Args[0], "slow")
+	if err != nil {
+		t.Fatalf("newPluginProvisioner: %s", err.Error())
+	}
+	p := provisioner.(*pluginProvisioner)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := p.Provision(BasicHost{Name: "app"})
+		errs <- err
+	}()
+
+	for i := 0; i < 100; i++ {
+		p.lock.Lock()
+		calls := p.calls
+		p.lock.Unlock()
+		if calls > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	p.Close()
+
+	if err := <-errs; err != nil {
+		t.Errorf("want the call in flight to complete, got %s", err.Error())
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.client != nil {
+		t.Errorf("want the plugin to be stopped after its last call")
+	}
+}
@@ -0,0 +1,128 @@
+package provision
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"time"
+)
+
+// ServePlugin serves a provisioner as a plugin of the operator, for the
+// main of a plugin written in Go. newProvisioner is called with the access
+// key which the operator passed. It returns once the operator closes the
+// stdin of the plugin, or with an error when the plugin wasn't started by
+// the operator.
+func ServePlugin(newProvisioner func(accessKey string) (Provisioner, error), capabilities ...string) error {
+	if os.Getenv(PluginCookieKey) != PluginCookieValue {
+		return fmt.Errorf("this is a plugin of inlets-operator, start it with --provider-plugins")
+	}
+	secret := os.Getenv(PluginSecretEnv)
+	if len(secret) != pluginSecretLength {
+		return fmt.Errorf("no secret was given to the plugin in %s", PluginSecretEnv)
+	}
+
+	provisioner, err := newProvisioner(os.Getenv(PluginAccessKeyEnv))
+	if err != nil {
+		return err
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Provisioner", &pluginServer{provisioner: provisioner, capabilities: capabilities}); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	fmt.Printf("%d|%d|tcp|%s|jsonrpc\n", pluginHandshakeVersion, PluginProtocolVersion, listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go servePluginConn(server, conn, secret)
+		}
+	}()
+
+	io.Copy(ioutil.Discard, os.Stdin)
+	return nil
+}
+
+// servePluginConn serves a connection once it has sent the secret of the
+// plugin, and closes it otherwise.
+func servePluginConn(server *rpc.Server, conn net.Conn, secret string) {
+	line := make([]byte, len(secret)+1)
+
+	conn.SetReadDeadline(time.Now().Add(pluginStartTimeout))
+	if _, err := io.ReadFull(conn, line); err != nil ||
+		subtle.ConstantTimeCompare(line, []byte(secret+"\n")) != 1 {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	server.ServeCodec(jsonrpc.NewServerCodec(conn))
+}
+
+// pluginServer is the "Provisioner" service of a plugin
+type pluginServer struct {
+	provisioner  Provisioner
+	capabilities []string
+}
+
+func toPluginError(err error) *PluginError {
+	if err == nil {
+		return nil
+	}
+	if pluginErr, ok := err.(*PluginError); ok {
+		return pluginErr
+	}
+	return &PluginError{Message: err.Error(), Class: ErrorClass(err)}
+}
+
+func (s *pluginServer) Capabilities(args struct{}, reply *PluginCapabilitiesReply) error {
+	reply.ProtocolVersion = PluginProtocolVersion
+	reply.Capabilities = s.capabilities
+	return nil
+}
+
+func (s *pluginServer) Provision(host BasicHost, reply *PluginHostReply) error {
+	res, err := s.provisioner.Provision(host)
+	reply.Host = res
+	reply.Err = toPluginError(err)
+	return nil
+}
+
+func (s *pluginServer) Status(args PluginIDArgs, reply *PluginHostReply) error {
+	res, err := s.provisioner.Status(args.ID)
+	reply.Host = res
+	reply.Err = toPluginError(err)
+	return nil
+}
+
+func (s *pluginServer) Delete(args PluginIDArgs, reply *PluginErrorReply) error {
+	reply.Err = toPluginError(s.provisioner.Delete(args.ID))
+	return nil
+}
+
+func (s *pluginServer) Regions(args struct{}, reply *PluginRegionsReply) error {
+	lister, ok := s.provisioner.(RegionLister)
+	if !ok {
+		reply.Err = &PluginError{Message: "the plugin cannot list regions"}
+		return nil
+	}
+	regions, err := lister.Regions()
+	reply.Regions = regions
+	reply.Err = toPluginError(err)
+	return nil
+}
@@ -1,11 +1,195 @@
 package provision
 
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
 type Provisioner interface {
 	Provision(BasicHost) (*ProvisionedHost, error)
 	Status(id string) (*ProvisionedHost, error)
 	Delete(id string) error
 }
 
+// NewProvisioner returns the provisioner for a provider by its name,
+// i.e. "digitalocean" or "packet", or the plugin registered for it
+func NewProvisioner(provider, accessKey string) (Provisioner, error) {
+	if path, ok := getPluginPath(provider); ok {
+		return newPluginProvisioner(provider, path, accessKey)
+	}
+
+	switch provider {
+	case "digitalocean":
+		return NewDigitalOceanProvisioner(accessKey)
+	case "packet":
+		return NewPacketProvisioner(accessKey)
+	case "fake":
+		fake := NewFakeProvisioner()
+		fake.ProvisionLatency = 30 * time.Second
+		fake.CallLatency = 100 * time.Millisecond
+		fake.ExitNodeIP = os.Getenv("INLETS_FAKE_EXIT_NODE_IP")
+		return fake, nil
+	}
+	return nil, fmt.Errorf("unknown provider: %s", provider)
+}
+
+// TCPSupporter is implemented by provisioners whose hosts can expose any
+// TCP and UDP port, which is needed to tunnel traffic at L4
+type TCPSupporter interface {
+	SupportsTCP() bool
+}
+
+// SupportsTCP returns true when hosts from the provisioner can expose any TCP and UDP port
+func SupportsTCP(p Provisioner) bool {
+	if s, ok := p.(TCPSupporter); ok {
+		return s.SupportsTCP()
+	}
+	return false
+}
+
+// Inspector is implemented by provisioners which can look up the actual
+// region, plan, OS and name of a host, to detect changes made outside of
+// the operator
+type Inspector interface {
+	Inspect(id string) (*BasicHost, error)
+}
+
+// RegionLister is implemented by provisioners which can list the regions
+// that hosts can be provisioned into
+type RegionLister interface {
+	Regions() ([]string, error)
+}
+
+// IPReserver is implemented by provisioners which can reserve a public IP
+// that outlives a host, so that it can be moved to the host's replacement
+type IPReserver interface {
+	// ReserveIP reserves an IP in the region of a host and assigns it to the host
+	ReserveIP(id string) (string, error)
+	// AssignIP moves a reserved IP to a host
+	AssignIP(ip, id string) error
+	// ReleaseIP gives up a reserved IP
+	ReleaseIP(ip string) error
+}
+
+// Firewaller is implemented by provisioners which can limit the sources
+// that connect to a host with a firewall of the provider, which can be
+// changed after the host was provisioned
+type Firewaller interface {
+	// SetAllowedSources only lets the openSources connect to the open TCP
+	// ports of the host, and the CIDRs to its other ports. Either may be
+	// empty to allow every source, and both being empty removes the
+	// firewall.
+	SetAllowedSources(id string, openPorts []int, openSources, cidrs []string) error
+}
+
+// PermissionChecker is implemented by provisioners which can check that
+// their access key has the permissions needed to provision hosts like the
+// given one, without changing anything
+type PermissionChecker interface {
+	// CheckPermissions returns the permissions which the access key is
+	// missing, or an error when they could not be checked
+	CheckPermissions(host BasicHost) ([]string, error)
+}
+
+// UsageReporter is implemented by provisioners which can read the CPU,
+// memory and network usage of a host from the monitoring API of the
+// provider
+type UsageReporter interface {
+	// Usage returns the average usage of a host over the window before now
+	Usage(id string, window time.Duration) (*HostUsage, error)
+}
+
+// HostUsage is the average usage of a host over a window. A value is
+// negative when the provider did not report it.
+type HostUsage struct {
+	CPUPercent    float64
+	MemoryPercent float64
+
+	// ReceiveBytesPerSecond and TransmitBytesPerSecond are the traffic of
+	// the public interface of the host
+	ReceiveBytesPerSecond  float64
+	TransmitBytesPerSecond float64
+}
+
+// EventLister is implemented by provisioners which can list what the
+// provider did to a host, i.e. when it was created and powered on, to debug
+// a host which does not become active
+type EventLister interface {
+	// Events returns the events of a host, oldest first
+	Events(id string) ([]HostEvent, error)
+}
+
+// HostEvent is an action of a provider on a host
+type HostEvent struct {
+	Time time.Time
+	// Type is the action, i.e. "create" or "power_on"
+	Type string
+	// Status is how the action went, i.e. "in-progress" or "completed"
+	Status string
+	// Message describes the event, when the provider gives one
+	Message string
+}
+
+// HostLister is implemented by provisioners which can list their hosts
+// which have a set of tags, a page at a time
+type HostLister interface {
+	// List returns the hosts which have all of the tags of the filter
+	List(filter HostFilter) ([]ListedHost, error)
+}
+
+// HostFilter selects the hosts to list by their tags, given as for
+// BasicHost. Additional has the project_id of Packet.
+type HostFilter struct {
+	Tags       map[string]string
+	Additional map[string]string
+}
+
+// ListedHost is a host returned by List, with its tags as the provider
+// formatted them
+type ListedHost struct {
+	ProvisionedHost
+
+	Name    string
+	Tags    []string
+	Created time.Time
+
+	format func(string) string
+}
+
+// HasTags returns true when the host has all of the tags, given as for
+// BasicHost
+func (h ListedHost) HasTags(tags map[string]string) bool {
+	return hasTags(h.Tags, tagList(tags, h.format))
+}
+
+func hasTags(have, want []string) bool {
+	for _, tag := range want {
+		found := false
+		for _, existing := range have {
+			if existing == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Tagger is implemented by provisioners which can change the tags of
+// hosts after they were provisioned, coalescing the changes to many hosts
+// into as few calls as the provider allows
+type Tagger interface {
+	// SetTags changes the tags of the listed hosts whose ID is in tags to
+	// match the tags given for that host. Tags with one of the keys which
+	// are not given are removed, and other tags are left as they are.
+	SetTags(hosts []ListedHost, tags map[string]map[string]string, keys []string) error
+}
+
 type ProvisionedHost struct {
 	IP     string
 	ID     string
@@ -19,4 +203,31 @@ type BasicHost struct {
 	Name       string
 	UserData   string
 	Additional map[string]string
+
+	// Tags are added to the host as "key:value", so that its cost can be
+	// attributed to a team or environment
+	Tags map[string]string
+}
+
+// tagList returns the tags of a host as "key:value", sorted by key
+// sortEvents sorts events oldest first, since providers list them newest
+// first
+func sortEvents(events []HostEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+}
+
+func tagList(tags map[string]string, format func(string) string) []string {
+	keys := []string{}
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := []string{}
+	for _, key := range keys {
+		list = append(list, format(key+":"+tags[key]))
+	}
+	return list
 }
@@ -0,0 +1,48 @@
+package provision
+
+import (
+	"strings"
+)
+
+// tagBatchSize is the most hosts which are tagged or untagged in one call
+const tagBatchSize = 50
+
+// diffTags returns the tags which a listed host is missing, and those with
+// one of the keys which it should no longer have
+func diffTags(host ListedHost, tags map[string]string, keys []string) ([]string, []string) {
+	want := tagList(tags, host.format)
+
+	add := []string{}
+	for _, tag := range want {
+		if !hasTags(host.Tags, []string{tag}) {
+			add = append(add, tag)
+		}
+	}
+
+	remove := []string{}
+	for _, tag := range host.Tags {
+		if hasTags(want, []string{tag}) {
+			continue
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(tag, host.format(key+":")) {
+				remove = append(remove, tag)
+				break
+			}
+		}
+	}
+	return add, remove
+}
+
+// batchIDs splits IDs into batches of up to tagBatchSize
+func batchIDs(ids []string) [][]string {
+	batches := [][]string{}
+	for len(ids) > tagBatchSize {
+		batches = append(batches, ids[:tagBatchSize])
+		ids = ids[tagBatchSize:]
+	}
+	if len(ids) > 0 {
+		batches = append(batches, ids)
+	}
+	return batches
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	// pollJitter spreads the polls of tunnels which started to provision
+	// at the same time by up to this fraction of their interval.
+	pollJitter = 0.2
+
+	// pollBackoffFactor is the fraction of the time since the status of an
+	// exit-node last changed which the operator waits before polling it
+	// again, so that an exit-node which is slow to boot is polled less.
+	pollBackoffFactor = 4
+)
+
+// pollState is when the exit-node of a tunnel was last polled, and when
+// its status last changed.
+type pollState struct {
+	status  string
+	changed time.Time
+	next    time.Time
+}
+
+// getPollInterval returns how long to wait before polling the exit-node of
+// a tunnel again. It starts at the poll interval of the provider whenever
+// the status changes, then grows with the time since, up to
+// --provision-poll-max-interval, with jitter.
+func (c *Controller) getPollInterval(state *pollState, provider string, now time.Time) time.Duration {
+	interval := c.infra().GetProvisionPollInterval(provider)
+
+	if backoff := now.Sub(state.changed) / pollBackoffFactor; backoff > interval {
+		interval = backoff
+	}
+	if max := c.infra().ProvisionPollMaxInterval; max > 0 && interval > max {
+		interval = max
+	}
+	return wait.Jitter(interval, pollJitter)
+}
+
+// enqueueTunnelAfterPoll syncs a tunnel again once its exit-node is due to
+// be polled, with the status it was last polled with, or "" when it was
+// not polled, such as whilst a Job runs.
+func (c *Controller) enqueueTunnelAfterPoll(tunnel *inletsv1alpha1.Tunnel, provider, status string) {
+	key, err := cache.MetaNamespaceKeyFunc(tunnel)
+	if err != nil {
+		return
+	}
+	if len(provider) == 0 {
+		provider = c.infra().Provider
+	}
+
+	now := time.Now()
+
+	c.pollLock.Lock()
+	state, ok := c.polls[key]
+	if !ok {
+		state = &pollState{changed: now}
+		c.polls[key] = state
+	}
+	if len(status) > 0 && status != state.status {
+		state.status = status
+		state.changed = now
+	}
+	interval := c.getPollInterval(state, provider, now)
+	state.next = now.Add(interval)
+	c.pollLock.Unlock()
+
+	c.workqueue.AddAfter(key, interval)
+}
+
+// pollDue returns false, with how long is left, when the exit-node of a
+// tunnel is not yet due to be polled, so that a resync or a change to the
+// tunnel doesn't poll the provider again.
+func (c *Controller) pollDue(tunnel *inletsv1alpha1.Tunnel) (bool, time.Duration) {
+	key, err := cache.MetaNamespaceKeyFunc(tunnel)
+	if err != nil {
+		return true, 0
+	}
+
+	c.pollLock.Lock()
+	defer c.pollLock.Unlock()
+
+	state, ok := c.polls[key]
+	if !ok {
+		return true, 0
+	}
+	if left := time.Until(state.next); left > time.Second {
+		return false, left
+	}
+	return true, 0
+}
+
+// forgetPoll drops the poll state of a tunnel once its exit-node is active
+// or the tunnel is deleted.
+func (c *Controller) forgetPoll(tunnel *inletsv1alpha1.Tunnel) {
+	key, err := cache.MetaNamespaceKeyFunc(tunnel)
+	if err != nil {
+		return
+	}
+
+	c.pollLock.Lock()
+	delete(c.polls, key)
+	c.pollLock.Unlock()
+}
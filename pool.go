@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	password "github.com/sethvargo/go-password/password"
+)
+
+// warmPoolSecretName is the Secret which records the exit-nodes of the warm
+// pool, along with their tokens.
+const warmPoolSecretName = "inlets-operator-warm-pool"
+
+// warmPoolCheckInterval is how often the warm pool is replenished.
+const warmPoolCheckInterval = 30 * time.Second
+
+// parseWarmPool parses the number of exit-nodes to keep ready for each
+// target, such as "digitalocean:lon1=2,packet:ams1=1"
+func parseWarmPool(value string) (map[ProvisionTarget]int, error) {
+	pool := map[ProvisionTarget]int{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("warm pool must be given as provider:region=size, not %q", entry)
+		}
+
+		size, err := strconv.Atoi(parts[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("warm pool size must be a positive number, not %q", parts[1])
+		}
+
+		targets := parseFailover(parts[0])
+		if len(targets) != 1 {
+			return nil, fmt.Errorf("warm pool must be given as provider:region=size, not %q", entry)
+		}
+		pool[targets[0]] = size
+	}
+	return pool, nil
+}
+
+// syncWarmPool provisions exit-nodes until each target of the warm pool has
+// as many as it should, records those which became active, and deletes any
+// more than are needed. Only one instance of the operator keeps the pool.
+func (c *Controller) syncWarmPool() {
+	if c.infra().Shards > 1 && c.getShard() != 0 {
+		return
+	}
+
+	pool, err := c.listRetained(warmPoolSecretName)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	counts := map[ProvisionTarget]int{}
+	for key, entry := range pool {
+		target := ProvisionTarget{Provider: entry.Provider, Region: entry.Region}
+
+		if counts[target] >= c.infra().WarmPool[target] {
+			c.removePooledExitNode(key, entry)
+			continue
+		}
+		counts[target]++
+
+		if entry.HostStatus == "provisioning" {
+			if err := c.syncPooledExitNode(key, entry); err != nil {
+				utilruntime.HandleError(err)
+			}
+		}
+	}
+
+	for target, size := range c.infra().WarmPool {
+		for i := counts[target]; i < size; i++ {
+			// The pool is refilled on its next sync when the provider
+			// is at its bound
+			if err := c.addPooledExitNode(target); err != nil {
+				if err != errProviderBusy {
+					utilruntime.HandleError(err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// addPooledExitNode provisions an exit-node for HTTP tunnels into the pool
+// of a target, with a token of its own.
+func (c *Controller) addPooledExitNode(target ProvisionTarget) error {
+	token, err := c.generateAuthToken()
+	if err != nil {
+		return err
+	}
+
+	suffix, err := password.Generate(8, 2, 0, true, true)
+	if err != nil {
+		return err
+	}
+
+	tunnel := &inletsv1alpha1.Tunnel{}
+	tunnel.Name = "inlets-pool-" + suffix
+	tunnel.Namespace = c.infra().RetainedNamespace
+	tunnel.Spec.AuthToken = token
+
+	release, exceeded, message := c.reserveExitNode(tunnel, c.makeExitHost(tunnel, target), target.Provider)
+	if exceeded {
+		return fmt.Errorf("unable to refill the warm pool of %s: %s", target, message)
+	}
+	defer release()
+
+	res, _, err := c.provisionExitNode(tunnel, []ProvisionTarget{target}, "warm-pool")
+	if err != nil {
+		return err
+	}
+
+	logWith("provider", target.Provider, "region", target.Region, "hostID", res.ID).Info("Provisioning exit-node for the warm pool")
+
+	entry := retainedExitNode{
+		HostID:     res.ID,
+		HostStatus: "provisioning",
+		Provider:   target.Provider,
+		Region:     target.Region,
+		HourlyCost: c.getHourlyCost(c.makeExitHost(tunnel, target), target.Provider),
+		AuthToken:  token,
+	}
+
+	err = c.updateRetained(warmPoolSecretName, func(pool map[string]retainedExitNode) {
+		pool[tunnel.Name] = entry
+	})
+	if err != nil {
+		// The exit-node would be lost without a record of it
+		c.removePooledExitNode(tunnel.Name, entry)
+	}
+	return err
+}
+
+// syncPooledExitNode records the IP of a pooled exit-node once it is active.
+func (c *Controller) syncPooledExitNode(key string, entry retainedExitNode) error {
+	provisioner, err := c.getTunnelProvisioner(getRetainedTunnel(c.infra().RetainedNamespace, entry))
+	if err != nil {
+		return err
+	}
+
+	host, err := provisioner.Status(entry.HostID)
+	if err != nil {
+		return err
+	}
+
+	if host.Status != "active" || len(host.IP) == 0 {
+		return nil
+	}
+
+	logWith("provider", entry.Provider, "region", entry.Region, "hostID", entry.HostID, "ip", host.IP).Info("Exit-node is ready in the warm pool")
+
+	return c.updateRetained(warmPoolSecretName, func(pool map[string]retainedExitNode) {
+		if found, ok := pool[key]; ok && found.HostID == entry.HostID {
+			found.HostStatus = "active"
+			found.HostIP = host.IP
+			pool[key] = found
+		}
+	})
+}
+
+// removePooledExitNode deletes an exit-node of the warm pool, then removes
+// its record.
+func (c *Controller) removePooledExitNode(key string, entry retainedExitNode) {
+	logWith("provider", entry.Provider, "region", entry.Region, "hostID", entry.HostID).Info("Deleting exit-node from the warm pool")
+	if err := c.deleteHost(getRetainedTunnel(c.infra().RetainedNamespace, entry), "warm-pool"); err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	err := c.updateRetained(warmPoolSecretName, func(pool map[string]retainedExitNode) {
+		if pool[key].HostID == entry.HostID {
+			delete(pool, key)
+		}
+	})
+	if err != nil {
+		utilruntime.HandleError(err)
+	}
+}
+
+// findPooledExitNode returns the key of an active exit-node in the pool of
+// a target, or an empty string.
+func findPooledExitNode(pool map[string]retainedExitNode, target ProvisionTarget) string {
+	for key, entry := range pool {
+		if entry.HostStatus == "active" && entry.Provider == target.Provider && entry.Region == target.Region {
+			return key
+		}
+	}
+	return ""
+}
+
+// claimPooledExitNode takes an active exit-node from the warm pool for a
+// tunnel, so that it gets an IP without waiting for one to be provisioned.
+// Only HTTP tunnels without a TunnelClass or a custom exit-node can claim
+// an exit-node, since pooled exit-nodes are provisioned with the defaults
+// of the operator, i.e. their firewalls allow every source.
+// It returns true when the tunnel was updated.
+func (c *Controller) claimPooledExitNode(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	if len(c.infra().WarmPool) == 0 || isProTunnel(tunnel) || len(tunnel.Spec.TunnelClassName) > 0 || hasCustomExitNode(tunnel) {
+		return false, nil
+	}
+
+	target := c.getTargets(tunnel)[0]
+	if c.infra().WarmPool[target] == 0 {
+		return false, nil
+	}
+
+	pool, err := c.listRetained(warmPoolSecretName)
+	if err != nil || len(findPooledExitNode(pool, target)) == 0 {
+		return false, err
+	}
+
+	var entry *retainedExitNode
+	err = c.updateRetained(warmPoolSecretName, func(pool map[string]retainedExitNode) {
+		entry = nil
+		if key := findPooledExitNode(pool, target); len(key) > 0 {
+			found := pool[key]
+			entry = &found
+			delete(pool, key)
+		}
+	})
+	if err != nil || entry == nil {
+		return false, err
+	}
+
+	if err := c.adoptExitNode(tunnel, entry); err != nil {
+		return true, err
+	}
+
+	c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessAdopted,
+		"Claimed exit-node %s from the warm pool of %s", entry.HostIP, target)
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func (f *fixture) addPooled(target ProvisionTarget, id string) {
+	err := f.controller.updateRetained(warmPoolSecretName, func(pool map[string]retainedExitNode) {
+		pool["inlets-pool-"+id] = retainedExitNode{
+			HostID:     id,
+			HostStatus: "active",
+			HostIP:     "203.0.113.10",
+			Provider:   target.Provider,
+			Region:     target.Region,
+			AuthToken:  "pool-token",
+		}
+	})
+	if err != nil {
+		f.t.Fatalf("error adding pooled exit-node: %s", err.Error())
+	}
+}
+
+func TestClaimPooledExitNode(t *testing.T) {
+	target := ProvisionTarget{Provider: "fake"}
+	f := newFixture(t, func(infra *InfraConfig) { infra.WarmPool = map[ProvisionTarget]int{target: 1} })
+	f.addPooled(target, "fake-1")
+
+	tunnel := newTunnel("app")
+	f.create(tunnel)
+
+	claimed, err := f.controller.claimPooledExitNode(tunnel)
+	if err != nil || !claimed {
+		t.Fatalf("want the pooled exit-node to be claimed, got %v %v", claimed, err)
+	}
+
+	got := f.get("app")
+	if got.Status.HostID != "fake-1" || got.Status.HostStatus != "active" || got.Spec.AuthToken != "pool-token" {
+		t.Errorf("want the tunnel to have the pooled exit-node and its token, got %q %q", got.Status.HostID, got.Status.HostStatus)
+	}
+
+	pool, err := f.controller.listRetained(warmPoolSecretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool) != 0 {
+		t.Errorf("want the exit-node to be taken from the pool, got %v", pool)
+	}
+}
+
+func TestClaimPooledExitNodeSkipsAllowedSourceCIDRs(t *testing.T) {
+	target := ProvisionTarget{Provider: "fake"}
+	f := newFixture(t, func(infra *InfraConfig) { infra.WarmPool = map[ProvisionTarget]int{target: 1} })
+	f.addPooled(target, "fake-1")
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.AllowedSourceCIDRs = []string{"198.51.100.0/24"}
+	f.create(tunnel)
+
+	claimed, err := f.controller.claimPooledExitNode(tunnel)
+	if err != nil || claimed {
+		t.Fatalf("want the pooled exit-node not to be claimed, since its firewall allows every source, got %v %v", claimed, err)
+	}
+
+	pool, err := f.controller.listRetained(warmPoolSecretName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool) != 1 {
+		t.Errorf("want the exit-node to stay in the pool, got %v", pool)
+	}
+}
+
+func TestAddPooledExitNodeChecksQuota(t *testing.T) {
+	target := ProvisionTarget{Provider: "fake"}
+	f := newFixture(t, func(infra *InfraConfig) {
+		infra.WarmPool = map[ProvisionTarget]int{target: 1}
+		infra.MaxExitNodes = 1
+	})
+
+	tunnel := newTunnel("app")
+	tunnel.Status.HostID = "fake-1"
+	f.create(tunnel)
+
+	err := f.controller.addPooledExitNode(target)
+	if err == nil || !strings.Contains(err.Error(), "1 of 1 exit-nodes") {
+		t.Errorf("want the quota to stop the pool being refilled, got %v", err)
+	}
+	if calls := f.provisioner.Calls("Provision"); calls != 0 {
+		t.Errorf("want no exit-node provisioned, got %d", calls)
+	}
+
+	f.controller.infra().MaxExitNodes = 2
+	if err := f.controller.addPooledExitNode(target); err != nil {
+		t.Fatalf("want the pool to be refilled below the quota, got %s", err.Error())
+	}
+	if calls := f.provisioner.Calls("Provision"); calls != 1 {
+		t.Errorf("want an exit-node provisioned, got %d", calls)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// preflightInterval is how often the preflight checks are run again, so
+// that /readyz recovers once a missing permission is granted.
+const preflightInterval = 10 * time.Minute
+
+// preflightPermission is a verb on a resource which the operator needs.
+type preflightPermission struct {
+	Group       string
+	Resource    string
+	Subresource string
+	Verb        string
+}
+
+func (p preflightPermission) String() string {
+	resource := p.Resource
+	if len(p.Subresource) > 0 {
+		resource += "/" + p.Subresource
+	}
+	if len(p.Group) > 0 {
+		resource += "." + p.Group
+	}
+	return p.Verb + " " + resource
+}
+
+// preflightCheck is the outcome of a preflight check, with the permissions
+// which are missing when it failed.
+type preflightCheck struct {
+	Name    string
+	Missing []string
+	Error   error
+}
+
+func (p preflightCheck) passed() bool {
+	return len(p.Missing) == 0 && p.Error == nil
+}
+
+// preflightResults are the outcomes of the last preflight checks, and of
+// the last checks of the credentials of the providers.
+type preflightResults struct {
+	lock      sync.Mutex
+	checks    []preflightCheck
+	checkedAt time.Time
+
+	credentials          []preflightCheck
+	credentialsCheckedAt time.Time
+}
+
+// getPreflightPermissions returns the permissions which the operator needs
+// with its flags, as granted by artifacts/operator-rbac.yaml.
+func (c *Controller) getPreflightPermissions() []preflightPermission {
+	permissions := []preflightPermission{}
+	add := func(group, resource, subresource string, verbs ...string) {
+		for _, verb := range verbs {
+			permissions = append(permissions, preflightPermission{
+				Group:       group,
+				Resource:    resource,
+				Subresource: subresource,
+				Verb:        verb,
+			})
+		}
+	}
+
+	add("inlets.alexellis.io", "tunnels", "", "get", "list", "watch", "create", "update", "delete")
+	add("inlets.alexellis.io", "tunnels", "status", "update")
+	add("inlets.alexellis.io", "tunnelclasses", "", "list", "watch")
+	add("", "secrets", "", "get", "create", "update")
+	add("", "services", "", "list", "watch", "update")
+	add("", "services", "status", "update")
+	add("", "endpoints", "", "list", "watch")
+	add("", "events", "", "create", "patch")
+	add("apps", "deployments", "", "list", "watch", "create", "update", "delete")
+
+	if c.infra().Executor == "job" {
+		add("batch", "jobs", "", "get", "create", "delete")
+	}
+	if c.infra().Shards > 1 {
+		add("coordination.k8s.io", "leases", "", "get", "create", "update")
+	}
+	if c.infra().ClientNetworkPolicy {
+		add("networking.k8s.io", "networkpolicies", "", "get", "create", "update")
+	}
+	return permissions
+}
+
+// checkRBAC returns the permissions which the ServiceAccount of the
+// operator is missing, from a SelfSubjectAccessReview of each.
+func (c *Controller) checkRBAC() preflightCheck {
+	check := preflightCheck{Name: "rbac"}
+
+	for _, permission := range c.getPreflightPermissions() {
+		review, err := c.kubeclientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Group:       permission.Group,
+					Resource:    permission.Resource,
+					Subresource: permission.Subresource,
+					Verb:        permission.Verb,
+				},
+			},
+		})
+		if err != nil {
+			check.Error = fmt.Errorf("error reviewing access: %s", err.Error())
+			return check
+		}
+		if !review.Status.Allowed {
+			check.Missing = append(check.Missing, permission.String())
+		}
+	}
+	return check
+}
+
+// checkProvider returns the permissions which the access key of a provider
+// is missing, when its provisioner can check them.
+func (c *Controller) checkProvider(target ProvisionTarget) preflightCheck {
+	check := preflightCheck{Name: "provider:" + target.Provider}
+
+	provisioner, err := c.getProvisioner(target.Provider)
+	if err != nil {
+		check.Error = err
+		return check
+	}
+
+	checker, ok := provisioner.(provision.PermissionChecker)
+	if !ok {
+		return check
+	}
+
+	check.Missing, check.Error = checker.CheckPermissions(provision.BasicHost{
+		Region:     target.Region,
+		Additional: map[string]string{"project_id": c.infra().ProjectID},
+	})
+	return check
+}
+
+// runPreflight checks the RBAC of the operator and the access key of each
+// provider it provisions with, then logs every missing permission, so that
+// they are found before a Tunnel fails with a 403.
+func (c *Controller) runPreflight() {
+	checks := []preflightCheck{c.checkRBAC()}
+
+	checked := map[string]bool{}
+	for _, target := range c.infra().GetTargets() {
+		if checked[target.Provider] {
+			continue
+		}
+		checked[target.Provider] = true
+		checks = append(checks, c.checkProvider(target))
+	}
+
+	for _, check := range checks {
+		if check.Error != nil {
+			logWith("check", check.Name).Error(check.Error, "Preflight check failed")
+		}
+		for _, missing := range check.Missing {
+			logWith("check", check.Name, "permission", missing).Warn("Preflight check failed, missing permission")
+		}
+
+		if strings.HasPrefix(check.Name, "provider:") && !check.passed() {
+			message := "missing " + strings.Join(check.Missing, ", ")
+			if check.Error != nil {
+				message = check.Error.Error()
+			}
+			c.infra().Notifier.Notify(notification{
+				Type:     notifyCredentialsInvalid,
+				Reason:   "PreflightFailed",
+				Provider: strings.TrimPrefix(check.Name, "provider:"),
+				Message:  message,
+			})
+		}
+	}
+
+	c.preflight.lock.Lock()
+	c.preflight.checks = checks
+	c.preflight.checkedAt = time.Now()
+	c.preflight.lock.Unlock()
+}
+
+// handleReadyz reports the outcome of each preflight check, the credentials
+// of each provider and the webhook, and fails until they have run and
+// passed.
+func (c *Controller) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	c.preflight.lock.Lock()
+	checks := append([]preflightCheck{}, c.preflight.checks...)
+	checkedAt := c.preflight.checkedAt
+	ready := len(checks) > 0 && !c.preflight.credentialsCheckedAt.IsZero()
+	checks = append(checks, c.preflight.credentials...)
+	c.preflight.lock.Unlock()
+
+	if c.infra().WebhookPort > 0 {
+		checks = append(checks, c.checkWebhook())
+	}
+
+	lines := []string{}
+	for _, check := range checks {
+		switch {
+		case check.Error != nil:
+			ready = false
+			lines = append(lines, fmt.Sprintf("[-]%s failed: %s", check.Name, check.Error.Error()))
+		case len(check.Missing) > 0:
+			ready = false
+			lines = append(lines, fmt.Sprintf("[-]%s failed: missing %s", check.Name, strings.Join(check.Missing, ", ")))
+		default:
+			lines = append(lines, fmt.Sprintf("[+]%s ok", check.Name))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	if checkedAt.IsZero() {
+		fmt.Fprintln(w, "preflight checks have not run yet")
+	} else if ready {
+		fmt.Fprintf(w, "readyz check passed at %s\n", checkedAt.UTC().Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(w, "readyz check failed at %s\n", checkedAt.UTC().Format(time.RFC3339))
+	}
+}
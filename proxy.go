@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// clientNoProxy are the hosts which the client always reaches directly,
+// since its upstreams are in the cluster.
+var clientNoProxy = []string{"127.0.0.1", "localhost", ".svc", ".cluster.local"}
+
+// egressProxy is the HTTP proxy which the operator, its Jobs and the
+// clients reach the Internet through, from --http-proxy, --https-proxy and
+// --no-proxy, which default to the standard environment variables.
+type egressProxy struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+}
+
+// getEnv returns the first of the environment variables which is set.
+func getEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); len(value) > 0 {
+			return value
+		}
+	}
+	return ""
+}
+
+func (p egressProxy) enabled() bool {
+	return len(p.HTTPProxy) > 0 || len(p.HTTPSProxy) > 0
+}
+
+// apply sets the environment variables of the proxy for the operator, which
+// the default transport of net/http and so every provider SDK reads the
+// first time that it makes a request, so it must be called before then.
+func (p egressProxy) apply() {
+	for name, value := range map[string]string{
+		"HTTP_PROXY":  p.HTTPProxy,
+		"HTTPS_PROXY": p.HTTPSProxy,
+		"NO_PROXY":    p.NoProxy,
+	} {
+		if len(value) > 0 {
+			os.Setenv(name, value)
+			os.Setenv(strings.ToLower(name), value)
+		}
+	}
+}
+
+// env returns the environment variables of the proxy for a container, with
+// extra hosts which it should reach directly added to NO_PROXY.
+func (p egressProxy) env(noProxy ...string) []corev1.EnvVar {
+	if !p.enabled() {
+		return nil
+	}
+
+	hosts := []string{}
+	if len(p.NoProxy) > 0 {
+		hosts = append(hosts, p.NoProxy)
+	}
+	for _, host := range noProxy {
+		if len(host) > 0 {
+			hosts = append(hosts, host)
+		}
+	}
+
+	env := []corev1.EnvVar{}
+	for _, entry := range []struct{ name, value string }{
+		{"HTTP_PROXY", p.HTTPProxy},
+		{"HTTPS_PROXY", p.HTTPSProxy},
+		{"NO_PROXY", strings.Join(hosts, ",")},
+	} {
+		if len(entry.value) > 0 {
+			env = append(env, corev1.EnvVar{Name: entry.name, Value: entry.value})
+		}
+	}
+	return env
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// quotaExceeded returns true with a message when provisioning the host
+// would exceed the limits on exit-nodes or spend, or with an error when
+// the quota could not be checked.
+func (c *Controller) quotaExceeded(host provision.BasicHost, provider string) (bool, string, error) {
+	c.quotaLock.Lock()
+	defer c.quotaLock.Unlock()
+
+	return c.checkQuota(nil, host, provider)
+}
+
+// reserveExitNode checks the quota for a new exit-node of a tunnel as
+// quotaExceeded does, holding it back when the quota could not be checked,
+// and, when there is room, counts the exit-node against
+// the quota until release is called, so that workers which provision at
+// once can't exceed it between them. The exit-node is counted from its ID
+// once it is recorded, so release is called after that.
+func (c *Controller) reserveExitNode(tunnel *inletsv1alpha1.Tunnel, host provision.BasicHost, provider string) (release func(), exceeded bool, message string) {
+	c.quotaLock.Lock()
+	defer c.quotaLock.Unlock()
+
+	if exceeded, message, err := c.checkQuota(tunnel, host, provider); exceeded {
+		if err != nil {
+			c.tunnelLog(tunnel).Error(err, "Error checking quota")
+		}
+		return func() {}, true, message
+	}
+
+	key := tunnel.Namespace + "/" + tunnel.Name
+	c.reserved[key] = true
+	return func() {
+		c.quotaLock.Lock()
+		defer c.quotaLock.Unlock()
+
+		delete(c.reserved, key)
+	}, false, ""
+}
+
+// checkQuota returns true with a message when provisioning the host for a
+// tunnel would exceed the limits on exit-nodes or spend. The quota fails
+// closed: it returns true with an error when it could not be checked. It
+// is called with quotaLock held.
+func (c *Controller) checkQuota(tunnel *inletsv1alpha1.Tunnel, host provision.BasicHost, provider string) (bool, string, error) {
+	if c.infra().MaxExitNodes == 0 && c.infra().MaxMonthlySpend == 0 {
+		return false, "", nil
+	}
+
+	known, creating, err := c.countExitNodes(tunnel)
+	if err != nil {
+		return true, "unable to count exit-nodes for the quota", err
+	}
+
+	exitNodes := known + creating
+	if c.infra().MaxExitNodes > 0 && exitNodes >= c.infra().MaxExitNodes {
+		return true, fmt.Sprintf("%d of %d exit-nodes already provisioned", exitNodes, c.infra().MaxExitNodes), nil
+	}
+
+	if c.infra().MaxMonthlySpend > 0 {
+		provisioner, err := c.getProvisioner(provider)
+		if err != nil {
+			return true, "unable to estimate the cost of the exit-node for the quota", err
+		}
+
+		// The spend of a provider which can't estimate its costs, such as
+		// a plugin, isn't limited
+		estimator, ok := provisioner.(provision.CostEstimator)
+		if !ok {
+			return false, "", nil
+		}
+
+		hourly, err := estimator.HourlyCost(host)
+		if err != nil {
+			return true, "unable to estimate the cost of the exit-node for the quota", err
+		}
+
+		recorded, err := c.getRecordedHourlyCost()
+		if err != nil {
+			return true, "unable to sum the cost of exit-nodes for the quota", err
+		}
+
+		// Exit-nodes being created have no cost recorded yet, so they are
+		// estimated to cost the same as the new host
+		monthly := (recorded + hourly*float64(creating+1)) * provision.HoursPerMonth
+		if monthly > c.infra().MaxMonthlySpend {
+			return true, fmt.Sprintf("estimated monthly spend of %.2f USD would exceed the limit of %.2f USD",
+				monthly, c.infra().MaxMonthlySpend), nil
+		}
+	}
+
+	return false, "", nil
+}
+
+// getRecordedHourlyCost returns the sum of the estimated hourly cost which
+// is recorded for each exit-node the operator has a record of. The cost
+// of an exit-node whose provider could not estimate it is not counted.
+func (c *Controller) getRecordedHourlyCost() (float64, error) {
+	costs := map[string]string{}
+
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return 0, err
+	}
+	for _, tunnel := range tunnels {
+		if len(tunnel.Status.HostID) > 0 {
+			costs[tunnel.Status.HostID] = tunnel.Status.EstimatedHourlyCost
+		}
+		if replacement := tunnel.Status.Replacement; replacement != nil && len(replacement.HostID) > 0 {
+			costs[replacement.HostID] = replacement.EstimatedHourlyCost
+		}
+	}
+
+	for _, name := range []string{retainedSecretName, warmPoolSecretName} {
+		entries, err := c.listRetained(name)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			costs[entry.HostID] = entry.HourlyCost
+		}
+	}
+
+	total := 0.0
+	for _, cost := range costs {
+		if hourly, err := strconv.ParseFloat(cost, 64); err == nil {
+			total += hourly
+		}
+	}
+	return total, nil
+}
+
+// countExitNodes returns the number of exit-nodes which count against the
+// quota: every exit-node which the operator has a record of, and those
+// being created for other tunnels, whose IDs are not recorded yet, which
+// are counted separately. It is called with quotaLock held.
+func (c *Controller) countExitNodes(tunnel *inletsv1alpha1.Tunnel) (int, int, error) {
+	known, err := c.getKnownHostIDs()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	self, selfJob := "", ""
+	if tunnel != nil {
+		self = tunnel.Namespace + "/" + tunnel.Name
+		selfJob = "inlets-create-" + string(tunnel.UID)
+	}
+
+	creating := map[string]bool{}
+	for key := range c.reserved {
+		creating[key] = true
+	}
+
+	// An operation is recorded before its exit-node is created
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, t := range tunnels {
+		key := t.Namespace + "/" + t.Name
+		if key != self && len(t.Status.HostID) == 0 && t.Status.Operation != nil {
+			creating[key] = true
+		}
+	}
+
+	// A Job which provisions an exit-node is deleted once the ID which it
+	// reported is recorded
+	if c.infra().Executor == "job" {
+		jobs, err := c.kubeclientset.BatchV1().Jobs(c.infra().JobNamespace).List(metav1.ListOptions{})
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, job := range jobs.Items {
+			if strings.HasPrefix(job.Name, "inlets-create-") && job.Name != selfJob && job.Status.Failed == 0 {
+				creating[job.Namespace+"/"+job.Name] = true
+			}
+		}
+	}
+
+	return len(known), len(creating), nil
+}
+
+// getHourlyCost returns the estimated cost in USD per hour of a host, or
+// an empty string when the provider cannot estimate it.
+func (c *Controller) getHourlyCost(host provision.BasicHost, provider string) string {
+	provisioner, err := c.getProvisioner(provider)
+	if err != nil {
+		return ""
+	}
+
+	estimator, ok := provisioner.(provision.CostEstimator)
+	if !ok {
+		return ""
+	}
+
+	hourly, err := estimator.HourlyCost(host)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%.4f", hourly)
+}
+
+// holdForQuota records that the tunnel is pending due to the quota, so
+// that it is provisioned once capacity is available on a later sync.
+func (c *Controller) holdForQuota(tunnel *inletsv1alpha1.Tunnel, message string) error {
+	condition := inletsv1alpha1.TunnelCondition{
+		Type:    inletsv1alpha1.TunnelPending,
+		Status:  corev1.ConditionTrue,
+		Reason:  "QuotaExceeded",
+		Message: message,
+	}
+
+	if hasCondition(tunnel.Status.Conditions, condition) {
+		return nil
+	}
+
+	c.tunnelLog(tunnel).Info("Tunnel is pending quota", "message", message)
+	c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrQuotaExceeded, message)
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, condition)
+
+	_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err
+}
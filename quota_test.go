@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func (f *fixture) reserve(tunnel *inletsv1alpha1.Tunnel) (func(), bool) {
+	release, exceeded, _ := f.controller.reserveExitNode(tunnel, f.controller.makeExitHost(tunnel, f.controller.getTargets(tunnel)[0]), "fake")
+	return release, exceeded
+}
+
+func TestQuotaCountsExitNodesBeingCreated(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.MaxExitNodes = 1 })
+
+	release, exceeded := f.reserve(newTunnel("first"))
+	if exceeded {
+		t.Fatalf("want room for the first exit-node")
+	}
+
+	if _, exceeded := f.reserve(newTunnel("second")); !exceeded {
+		t.Errorf("want the quota to count the exit-node which is being created for the first tunnel")
+	}
+
+	release()
+	if _, exceeded := f.reserve(newTunnel("second")); exceeded {
+		t.Errorf("want room once the first exit-node was not created")
+	}
+}
+
+func TestQuotaCountsOperationsOfOtherTunnels(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.MaxExitNodes = 1 })
+
+	tunnel := newTunnel("app")
+	tunnel.Status.Operation = &inletsv1alpha1.TunnelOperation{Phase: operationCreating, ID: "op1", Provider: "fake"}
+	f.create(tunnel)
+
+	if _, exceeded := f.reserve(tunnel); exceeded {
+		t.Errorf("want the operation of a tunnel not to count against itself")
+	}
+	if _, exceeded := f.reserve(newTunnel("other")); !exceeded {
+		t.Errorf("want the operation of a tunnel to count against the quota")
+	}
+}
+
+func TestQuotaCountsReplacementsPoolAndRetained(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.MaxExitNodes = 4 })
+
+	tunnel := newTunnel("app")
+	tunnel.Status.HostID = "fake-1"
+	tunnel.Status.Replacement = &inletsv1alpha1.TunnelReplacement{HostStatus: "provisioning", HostID: "fake-2"}
+	f.create(tunnel)
+
+	if exceeded, message, _ := f.controller.quotaExceeded(f.controller.makeExitHost(tunnel, f.controller.getTargets(tunnel)[0]), "fake"); exceeded {
+		t.Fatalf("want room for 2 more exit-nodes, got %s", message)
+	}
+
+	for name, id := range map[string]string{retainedSecretName: "fake-3", warmPoolSecretName: "fake-4"} {
+		err := f.controller.updateRetained(name, func(entries map[string]retainedExitNode) {
+			entries[id] = retainedExitNode{HostID: id, HostStatus: "active", Provider: "fake"}
+		})
+		if err != nil {
+			t.Fatalf("error recording exit-node: %s", err.Error())
+		}
+	}
+
+	exceeded, message, _ := f.controller.quotaExceeded(f.controller.makeExitHost(tunnel, f.controller.getTargets(tunnel)[0]), "fake")
+	if !exceeded {
+		t.Errorf("want the replacement, retained and pooled exit-nodes to count against the quota")
+	}
+	if message != "4 of 4 exit-nodes already provisioned" {
+		t.Errorf("want the exit-nodes in the message, got %q", message)
+	}
+}
+
+func TestQuotaSumsRecordedSpend(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.MaxMonthlySpend = 100 })
+	f.provisioner.CostPerHour = 0.05
+
+	// The existing exit-node is on a larger plan than the new one
+	existing := newTunnel("existing")
+	existing.Status.HostID = "fake-1"
+	existing.Status.EstimatedHourlyCost = "0.1000"
+	f.create(existing)
+
+	tunnel := newTunnel("app")
+	exceeded, message, err := f.controller.quotaExceeded(f.controller.makeExitHost(tunnel, f.controller.getTargets(tunnel)[0]), "fake")
+	if err != nil || !exceeded {
+		t.Fatalf("want the recorded cost of the existing exit-node to count against the quota, got %v %v", exceeded, err)
+	}
+	if !strings.Contains(message, "109.50 USD") {
+		t.Errorf("want the estimated spend in the message, got %q", message)
+	}
+
+	f.provisioner.CostPerHour = 0.03
+	if exceeded, message, _ := f.controller.quotaExceeded(f.controller.makeExitHost(tunnel, f.controller.getTargets(tunnel)[0]), "fake"); exceeded {
+		t.Errorf("want room for a cheaper exit-node, got %s", message)
+	}
+}
+
+func TestQuotaFailsClosed(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.MaxMonthlySpend = 100 })
+	f.provisioner.FailNext("HourlyCost", fmt.Errorf("unavailable"))
+
+	if _, exceeded := f.reserve(newTunnel("app")); !exceeded {
+		t.Errorf("want the tunnel to be held when its cost can't be estimated")
+	}
+	if _, exceeded := f.reserve(newTunnel("app")); exceeded {
+		t.Errorf("want the tunnel to be provisioned once its cost can be estimated")
+	}
+}
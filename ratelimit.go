@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// validateRateLimit checks that the limits of a rateLimit are not negative
+// and that its banDuration is a duration of at least a second.
+func validateRateLimit(rateLimit *inletsv1alpha1.TunnelRateLimit) error {
+	if rateLimit == nil {
+		return nil
+	}
+
+	if rateLimit.ConnectionsPerSource < 0 || rateLimit.NewConnectionsPerMinute < 0 {
+		return fmt.Errorf("rateLimit.connectionsPerSource and rateLimit.newConnectionsPerMinute must not be negative")
+	}
+	if rateLimit.ConnectionsPerSource == 0 && rateLimit.NewConnectionsPerMinute == 0 {
+		return fmt.Errorf("rateLimit needs connectionsPerSource or newConnectionsPerMinute")
+	}
+
+	if len(rateLimit.BanDuration) > 0 {
+		if rateLimit.NewConnectionsPerMinute == 0 {
+			return fmt.Errorf("rateLimit.banDuration needs newConnectionsPerMinute")
+		}
+		duration, err := time.ParseDuration(rateLimit.BanDuration)
+		if err != nil || duration < time.Second {
+			return fmt.Errorf("rateLimit.banDuration must be a duration of at least 1s, i.e. 10m, not %q", rateLimit.BanDuration)
+		}
+	}
+	return nil
+}
+
+// makeRateLimitUserdata returns iptables rules which limit the connections
+// of each source to the data-ports of an exit-node, being every TCP port
+// apart from the control-port and SSH. A source over newConnectionsPerMinute
+// has its new connections dropped, and is banned for banDuration when set,
+// in the manner of fail2ban. The rules are inserted before any rules of
+// allowedSourceCIDRs, so that allowed sources are limited too.
+func makeRateLimitUserdata(rateLimit *inletsv1alpha1.TunnelRateLimit, controlPort int) string {
+	if rateLimit == nil {
+		return ""
+	}
+
+	banSeconds := 0
+	if duration, err := time.ParseDuration(rateLimit.BanDuration); err == nil {
+		banSeconds = int(duration.Seconds())
+	}
+
+	lines := []string{"", ""}
+	for _, command := range []string{"iptables", "ip6tables"} {
+		mask := 32
+		if command == "ip6tables" {
+			mask = 128
+		}
+
+		match := fmt.Sprintf("! -i lo -p tcp -m multiport ! --dports %d,22 -m conntrack --ctstate NEW", controlPort)
+		rules := []string{}
+
+		if banSeconds > 0 {
+			rules = append(rules, fmt.Sprintf("%s -m recent --name inlets-ban --rcheck --seconds %d -j DROP", match, banSeconds))
+		}
+
+		if rateLimit.NewConnectionsPerMinute > 0 {
+			action := "-j DROP"
+			if banSeconds > 0 {
+				action = "-m recent --name inlets-ban --set -j DROP"
+			}
+			rules = append(rules, fmt.Sprintf("%s -m hashlimit --hashlimit-name inlets-rate --hashlimit-mode srcip --hashlimit-srcmask %d --hashlimit-above %d/minute --hashlimit-burst %d %s",
+				match, mask, rateLimit.NewConnectionsPerMinute, rateLimit.NewConnectionsPerMinute, action))
+		}
+
+		if rateLimit.ConnectionsPerSource > 0 {
+			rules = append(rules, fmt.Sprintf("%s -m connlimit --connlimit-above %d --connlimit-mask %d -j REJECT --reject-with tcp-reset",
+				match, rateLimit.ConnectionsPerSource, mask))
+		}
+
+		for i, rule := range rules {
+			lines = append(lines, fmt.Sprintf("%s -I INPUT %d %s", command, i+1, rule))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
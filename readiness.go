@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// publishProbeInterval is how often a tunnel is probed until its IP can be
+// published, since nothing else syncs it once its client is ready.
+const publishProbeInterval = 10 * time.Second
+
+// publishWhenReady writes the IP of the exit-node into the Service of a
+// tunnel once traffic flows through the tunnel end-to-end, so that the
+// Service and DNS never point at an exit-node without a connected client.
+// It returns true when the IP was published and the tunnel was updated.
+func (c *Controller) publishWhenReady(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	if len(tunnel.Spec.ServiceName) == 0 || isPublished(tunnel) {
+		return false, nil
+	}
+
+	service, err := c.getTunnelService(tunnel)
+	if err != nil {
+		return false, err
+	}
+
+	// The operator may not be allowed to connect to the data-ports, or has
+	// to sign in to the auth proxy, so the IP is published once a client is
+	// ready
+	if len(tunnel.Spec.AllowedSourceCIDRs) > 0 || hasExitNodeAuth(tunnel) {
+		err = c.probeClientConnection(tunnel)
+	} else {
+		err = probeTunnel(tunnel, service)
+	}
+
+	if err != nil {
+		c.tunnelLog(tunnel).Info("Waiting to publish ip", "ip", tunnel.Status.HostIP, "probe", err.Error())
+		c.workqueue.AddAfter(tunnel.Namespace+"/"+tunnel.Name, wait.Jitter(publishProbeInterval, 0.2))
+		return false, nil
+	}
+
+	if err := c.updateService(tunnel, tunnel.Status.HostIP); err != nil {
+		return false, err
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelCondition{
+		Type:   inletsv1alpha1.TunnelPublished,
+		Status: corev1.ConditionTrue,
+		Reason: "ProbeSucceeded",
+	})
+
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err == nil, err
+}
+
+func isPublished(tunnel *inletsv1alpha1.Tunnel) bool {
+	condition := getCondition(tunnel.Status.Conditions, inletsv1alpha1.TunnelPublished)
+	return condition != nil && condition.Status == corev1.ConditionTrue
+}
+
+// probeTunnel sends traffic through the exit-node of a tunnel. HTTP tunnels
+// must answer with a response which did not come from the exit-node itself,
+// which replies with a 502 when no client is connected. TCP tunnels must
+// accept a connection on their first data-port, and tunnels with only UDP
+// ports cannot be probed.
+func probeTunnel(tunnel *inletsv1alpha1.Tunnel, service *corev1.Service) error {
+	if !isProTunnel(tunnel) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/", tunnel.Status.HostIP), nil)
+		if err != nil {
+			return err
+		}
+		if len(tunnel.Spec.Hostname) > 0 {
+			req.Host = tunnel.Spec.Hostname
+		}
+
+		client := http.Client{Timeout: healthCheckTimeout}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		switch res.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return fmt.Errorf("exit-node returned %d", res.StatusCode)
+		}
+		return nil
+	}
+
+	_, ports := getUpstream(tunnel, service)
+	if tunnel.Spec.TLS != nil {
+		ports = []int32{tlsProxyPort}
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+
+	address := net.JoinHostPort(tunnel.Status.HostIP, fmt.Sprintf("%d", ports[0]))
+	conn, err := net.DialTimeout("tcp", address, healthCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
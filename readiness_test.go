@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listenTCP returns a listener on a free port of the loopback address, and
+// the port.
+func listenTCP(t *testing.T) (net.Listener, int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err.Error())
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return listener, int32(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// closedPort returns a port of the loopback address which nothing listens on.
+func closedPort(t *testing.T) int32 {
+	listener, port := listenTCP(t)
+	listener.Close()
+	return port
+}
+
+func TestProbeTunnelHTTP(t *testing.T) {
+	status := http.StatusBadGateway
+	host := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	// The exit-node is the test server, so its IP includes the port
+	tunnel := newTunnel("app")
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Status.HostIP = server.Listener.Addr().String()
+
+	if err := probeTunnel(tunnel, nil); err == nil {
+		t.Errorf("want an error whilst the exit-node answers with a %d", status)
+	}
+	if host != tunnel.Spec.Hostname {
+		t.Errorf("want the probe to be sent for the hostname of the tunnel, got %q", host)
+	}
+
+	status = http.StatusNotFound
+	if err := probeTunnel(tunnel, nil); err != nil {
+		t.Errorf("want a response from the upstream to pass, got %s", err.Error())
+	}
+}
+
+func TestProbeTunnelTCP(t *testing.T) {
+	listener, port := listenTCP(t)
+	defer listener.Close()
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.Protocol = "tcp"
+	tunnel.Status.HostIP = "127.0.0.1"
+
+	open := newPortsService(corev1.ServicePort{Name: "db", Port: port, Protocol: corev1.ProtocolTCP})
+	if err := probeTunnel(tunnel, open); err != nil {
+		t.Errorf("want an open data-port to pass, got %s", err.Error())
+	}
+
+	closed := newPortsService(corev1.ServicePort{Name: "db", Port: closedPort(t), Protocol: corev1.ProtocolTCP})
+	if err := probeTunnel(tunnel, closed); err == nil {
+		t.Errorf("want an error for a closed data-port")
+	}
+
+	udp := newPortsService(corev1.ServicePort{Name: "dns", Port: closedPort(t), Protocol: corev1.ProtocolUDP})
+	if err := probeTunnel(tunnel, udp); err != nil {
+		t.Errorf("want a tunnel with only UDP ports to pass, got %s", err.Error())
+	}
+}
+
+func TestPublishWhenReady(t *testing.T) {
+	f := newFixture(t)
+	services := f.kubeInformers.Core().V1().Services().Informer().GetIndexer()
+
+	listener, port := listenTCP(t)
+	defer listener.Close()
+
+	service := newPortsService(corev1.ServicePort{Name: "db", Port: closedPort(t), Protocol: corev1.ProtocolTCP})
+	if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Create(service); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+	services.Add(service)
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.Protocol = "tcp"
+	tunnel.Status.HostIP = "127.0.0.1"
+	f.create(tunnel)
+
+	published, err := f.controller.publishWhenReady(tunnel)
+	if err != nil {
+		t.Fatalf("publishWhenReady: %s", err.Error())
+	}
+	if published {
+		t.Fatalf("want the IP to wait whilst the data-port is closed")
+	}
+	got, _ := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get("app", metav1.GetOptions{})
+	if len(got.Spec.ExternalIPs) > 0 {
+		t.Errorf("want no IP on the Service before the probe passes, got %v", got.Spec.ExternalIPs)
+	}
+
+	service = service.DeepCopy()
+	service.Spec.Ports[0].Port = port
+	services.Update(service)
+
+	published, err = f.controller.publishWhenReady(tunnel)
+	if err != nil {
+		t.Fatalf("publishWhenReady: %s", err.Error())
+	}
+	if !published {
+		t.Fatalf("want the IP to be published once the data-port is open")
+	}
+	got, _ = f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get("app", metav1.GetOptions{})
+	if len(got.Spec.ExternalIPs) == 0 || got.Spec.ExternalIPs[0] != "127.0.0.1" {
+		t.Errorf("want the IP of the exit-node on the Service, got %v", got.Spec.ExternalIPs)
+	}
+	if !isPublished(f.get("app")) {
+		t.Errorf("want the tunnel to have the Published condition")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// regionsCacheTTL is how long the regions of a provider are cached for.
+const regionsCacheTTL = time.Hour
+
+type cachedRegions struct {
+	regions []string
+	expires time.Time
+}
+
+// getRegions returns the regions of a provider, or nil when the provider
+// cannot list them.
+func (c *Controller) getRegions(provider string, provisioner provision.Provisioner) ([]string, error) {
+	lister, ok := provisioner.(provision.RegionLister)
+	if !ok {
+		return nil, nil
+	}
+
+	c.regionsLock.Lock()
+	defer c.regionsLock.Unlock()
+
+	if cached, ok := c.regions[provider]; ok && time.Now().Before(cached.expires) {
+		return cached.regions, nil
+	}
+
+	regions, err := lister.Regions()
+	if err != nil {
+		return nil, err
+	}
+
+	c.regions[provider] = cachedRegions{
+		regions: regions,
+		expires: time.Now().Add(regionsCacheTTL),
+	}
+	return regions, nil
+}
+
+// validateRegion returns an error when the region of a tunnel is not one
+// of the regions of its provider. Tunnels are let through when the regions
+// cannot be listed, so that an outage of the provider's API does not block
+// changes to them.
+func (c *Controller) validateRegion(tunnel *inletsv1alpha1.Tunnel) error {
+	if len(tunnel.Spec.Region) == 0 {
+		return nil
+	}
+
+	class, err := c.getTunnelClass(tunnel)
+	if err != nil {
+		return err
+	}
+
+	target := c.getTargets(tunnel)[0]
+	provisioner, err := c.getClassProvisioner(class, target.Provider)
+	if err != nil {
+		return nil
+	}
+
+	regions, err := c.getRegions(target.Provider, provisioner)
+	if err != nil {
+		logWith("provider", target.Provider).Error(err, "Error listing regions")
+		return nil
+	}
+	if regions == nil {
+		return nil
+	}
+
+	for _, region := range regions {
+		if region == tunnel.Spec.Region {
+			return nil
+		}
+	}
+
+	// The cached regions are shared, so they are sorted as a copy
+	sorted := append([]string{}, regions...)
+	sort.Strings(sorted)
+	return fmt.Errorf("region %q is not a region of %s, use one of: %s",
+		tunnel.Spec.Region, target.Provider, strings.Join(sorted, ", "))
+}
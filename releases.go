@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	inletsRelease     = "https://github.com/inlets/inlets/releases/download/2.7.4/inlets"
+	inletsProRelease  = "https://github.com/inlets/inlets-pro/releases/download/0.5.1/inlets-pro"
+	ghostunnelRelease = "https://github.com/ghostunnel/ghostunnel/releases/download/v1.5.2/ghostunnel-v1.5.2-linux-amd64"
+)
+
+// releases are the downloads of exit-nodes by the name of their checksum in
+// --release-checksums. Each is pinned to a version, apart from caddy-jwt,
+// which is built on request, so its checksum changes with its modules.
+var releases = map[string]string{
+	"inlets":       inletsRelease,
+	"inlets-pro":   inletsProRelease,
+	"ghostunnel":   ghostunnelRelease,
+	"caddy":        caddyRelease,
+	"caddy-jwt":    caddyJWTRelease,
+	"oauth2-proxy": authProxyRelease,
+}
+
+var sha256Pattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// parseReleaseChecksums parses the SHA256 checksums of releases such as
+// "inlets-pro=<sha256>,ghostunnel=<sha256>"
+func parseReleaseChecksums(value string) (map[string]string, error) {
+	checksums := parseAccessKeyFiles(value)
+	for name, checksum := range checksums {
+		if _, ok := releases[name]; !ok {
+			return nil, fmt.Errorf("unknown release %q", name)
+		}
+		checksums[name] = strings.ToLower(checksum)
+		if !sha256Pattern.MatchString(checksums[name]) {
+			return nil, fmt.Errorf("the checksum of %s must be a hex-encoded SHA256", name)
+		}
+	}
+	return checksums, nil
+}
+
+// getTunnelReleases returns the names of the releases which the exit-node
+// of a tunnel downloads.
+func getTunnelReleases(tunnel *inletsv1alpha1.Tunnel) []string {
+	names := []string{"inlets"}
+	if isProTunnel(tunnel) {
+		names = []string{"inlets-pro"}
+	}
+	if usesControlPlaneTLS(tunnel) {
+		names = append(names, "ghostunnel")
+	}
+	if usesServiceAccountToken(tunnel) {
+		names = append(names, "caddy-jwt")
+	}
+	if tunnel.Spec.AuthProxy != nil {
+		names = append(names, "oauth2-proxy")
+	}
+	if tunnel.Spec.Auth != nil && tunnel.Spec.Auth.Basic != nil {
+		names = append(names, "caddy")
+	}
+	return names
+}
+
+// validateReleaseChecksums returns an error when there is no checksum for a
+// release which the exit-node of a tunnel downloads, as it would run it
+// without knowing it is the one which was pinned.
+func (c *Controller) validateReleaseChecksums(tunnel *inletsv1alpha1.Tunnel) error {
+	missing := []string{}
+	for _, name := range getTunnelReleases(tunnel) {
+		if len(c.infra().ReleaseChecksums[name]) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("no checksum for %s in --release-checksums, which the exit-node would download without verifying it",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// makeVerifiedDownload returns a script which downloads a release to a path
+// and checks its SHA256 checksum, for the caller to install it after with
+// &&, so that a release which doesn't match is never run.
+func makeVerifiedDownload(release, path, checksum string) string {
+	return `curl -sLSf "` + release + `" -o ` + path + ` && \
+	echo "` + checksum + `  ` + path + `" | sha256sum -c --quiet -`
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func TestParseReleaseChecksums(t *testing.T) {
+	checksums, err := parseReleaseChecksums("inlets-pro=" + strings.ToUpper(fakeReleaseChecksum[:63]) + "a, ghostunnel=" + fakeReleaseChecksum)
+	if err != nil {
+		t.Fatalf("parseReleaseChecksums: %s", err.Error())
+	}
+	if checksums["inlets-pro"] != fakeReleaseChecksum[:63]+"a" || checksums["ghostunnel"] != fakeReleaseChecksum {
+		t.Errorf("want lower-case checksums of inlets-pro and ghostunnel, got %v", checksums)
+	}
+
+	for _, value := range []string{
+		"inlets-pro=abc",
+		"inlets-pro=" + fakeReleaseChecksum + "; curl",
+		"frp=" + fakeReleaseChecksum,
+	} {
+		if _, err := parseReleaseChecksums(value); err == nil {
+			t.Errorf("want an error for %q", value)
+		}
+	}
+}
+
+func TestGetTunnelReleases(t *testing.T) {
+	tunnel := newTunnel("app")
+	tunnel.Spec.Auth = &inletsv1alpha1.TunnelAuth{Basic: &inletsv1alpha1.TunnelBasicAuth{SecretName: "app-auth"}}
+	if got := strings.Join(getTunnelReleases(tunnel), ","); got != "inlets,caddy" {
+		t.Errorf("want inlets and caddy for basic auth, got %s", got)
+	}
+
+	tunnel = newTunnel("app")
+	tunnel.Spec.Protocol = "tcp"
+	tunnel.Spec.MutualTLS = true
+	if got := strings.Join(getTunnelReleases(tunnel), ","); got != "inlets-pro,ghostunnel" {
+		t.Errorf("want inlets-pro and ghostunnel for mutual TLS, got %s", got)
+	}
+}
+
+func TestSyncHoldsTunnelWithoutReleaseChecksum(t *testing.T) {
+	f := newFixture(t)
+	delete(f.controller.infra().ReleaseChecksums, "inlets")
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	f.create(tunnel)
+	if err := f.sync("app"); err != nil {
+		t.Fatalf("want a missing checksum to be reported with an event, got %s", err.Error())
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, corev1.EventTypeWarning+" "+ErrReleaseNotVerified+" ") || !strings.Contains(event, "inlets") {
+			t.Errorf("want a warning with reason %s for inlets, got %q", ErrReleaseNotVerified, event)
+		}
+	default:
+		t.Errorf("want a warning with reason %s, got no event", ErrReleaseNotVerified)
+	}
+	if calls := f.provisioner.Calls("Provision"); calls != 0 {
+		t.Errorf("want no exit-node without a checksum, got %d", calls)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/alexellis/inlets-operator/pkg/provision"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// reservedIPAnnotation can be set to "true" on a Service to reserve an IP
+// for its tunnels, which is kept when their exit-nodes are replaced.
+const reservedIPAnnotation = "dev.inlets.reserved-ip"
+
+// getIPReserver returns the provisioner of a tunnel when it can reserve IPs.
+func (c *Controller) getIPReserver(tunnel *inletsv1alpha1.Tunnel) (provision.IPReserver, error) {
+	provisioner, err := c.getTunnelProvisioner(tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	reserver, ok := provisioner.(provision.IPReserver)
+	if !ok {
+		return nil, fmt.Errorf("provider %s cannot reserve IPs", c.getTunnelProvider(tunnel))
+	}
+	return reserver, nil
+}
+
+// validateReservedIP checks that the exit-node of a tunnel with a reserved
+// IP is its own, and that its provider can reserve IPs.
+func (c *Controller) validateReservedIP(tunnel *inletsv1alpha1.Tunnel) error {
+	if !tunnel.Spec.ReservedIP {
+		return nil
+	}
+	if len(tunnel.Spec.SharedExitNode) > 0 {
+		return fmt.Errorf("reservedIP cannot be set on a tunnel which shares an exit-node")
+	}
+
+	_, err := c.getIPReserver(tunnel)
+	return err
+}
+
+// syncReservedIP assigns the reserved IP of a tunnel to its exit-node with
+// the given ID and returns the IP to record for the exit-node. An IP is
+// reserved the first time, then recorded in the status of the tunnel before
+// the exit-node is marked active, so that it is not lost. It returns true
+// when the tunnel was updated and is synced again.
+func (c *Controller) syncReservedIP(tunnel *inletsv1alpha1.Tunnel, id, ip string) (string, bool, error) {
+	if !tunnel.Spec.ReservedIP {
+		return ip, false, nil
+	}
+
+	reserver, err := c.getIPReserver(tunnel)
+	if err != nil {
+		return "", true, err
+	}
+
+	if len(tunnel.Status.ReservedIP) == 0 {
+		reservedIP, err := reserver.ReserveIP(id)
+		c.audit(tunnel, auditRecord{Action: "reserve-ip", Trigger: "tunnel-created", HostID: id, HostIP: reservedIP}, err)
+		if err != nil {
+			return "", true, err
+		}
+		c.tunnelLog(tunnel).Info("Reserved ip", "ip", reservedIP)
+
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Status.ReservedIP = reservedIP
+
+		_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+		return "", true, err
+	}
+
+	if err := reserver.AssignIP(tunnel.Status.ReservedIP, id); err != nil {
+		return "", true, err
+	}
+	return tunnel.Status.ReservedIP, false, nil
+}
+
+// releaseReservedIP releases the reserved IP of a Tunnel which was deleted.
+func (c *Controller) releaseReservedIP(tunnel *inletsv1alpha1.Tunnel) {
+	if len(tunnel.Status.ReservedIP) == 0 {
+		return
+	}
+
+	reserver, err := c.getIPReserver(tunnel)
+	if err == nil {
+		err = reserver.ReleaseIP(tunnel.Status.ReservedIP)
+	}
+	c.audit(tunnel, auditRecord{Action: "release-ip", Trigger: "tunnel-deleted", HostIP: tunnel.Status.ReservedIP}, err)
+	if err != nil {
+		c.tunnelLog(tunnel).Error(err, "Error releasing reserved ip", "ip", tunnel.Status.ReservedIP)
+		return
+	}
+	c.tunnelLog(tunnel).Info("Released reserved ip", "ip", tunnel.Status.ReservedIP)
+}
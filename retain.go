@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/util/retry"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// retainedSecretName is the Secret which records exit-nodes kept after
+// their Tunnel was deleted, along with their tokens.
+const retainedSecretName = "inlets-operator-retained-exit-nodes"
+
+// retainedCheckInterval is how often expired exit-nodes are deleted.
+const retainedCheckInterval = time.Minute
+
+// retainedExitNode is an exit-node whose Tunnel was deleted, which is kept
+// until it expires so that a Tunnel with the same name can take it over, or
+// an exit-node in the warm pool which is yet to be claimed.
+type retainedExitNode struct {
+	HostID     string            `json:"hostId"`
+	HostIP     string            `json:"hostIP"`
+	Provider   string            `json:"provider,omitempty"`
+	Region     string            `json:"region,omitempty"`
+	HourlyCost string            `json:"hourlyCost,omitempty"`
+	AuthToken  string            `json:"authToken"`
+	Pro        bool              `json:"pro,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Expires    metav1.Time       `json:"expires,omitempty"`
+
+	// HostStatus is "provisioning" until a pooled exit-node is active.
+	HostStatus string `json:"hostStatus,omitempty"`
+
+	// TunnelClassName is kept so that the exit-node is deleted with the
+	// access key of its TunnelClass.
+	TunnelClassName string `json:"tunnelClassName,omitempty"`
+}
+
+// getRetainedKey returns the key of the exit-node of a Tunnel in the Secret,
+// namespaces cannot contain a "." so the key is not ambiguous.
+func getRetainedKey(namespace, name string) string {
+	return namespace + "." + name
+}
+
+// parseRetained returns the retained exit-nodes in the Secret. It fails
+// when an exit-node cannot be decrypted, so that it is not dropped from the
+// Secret when it is written again.
+func (c *Controller) parseRetained(secret *corev1.Secret) (map[string]retainedExitNode, error) {
+	retained := map[string]retainedExitNode{}
+	for key, value := range secret.Data {
+		value, err := c.openSecretValue(key, value)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := retainedExitNode{}
+		if err := json.Unmarshal(value, &entry); err != nil {
+			logWith("key", key, "secret", secret.Name).Error(err, "Error reading retained exit-node")
+			continue
+		}
+		retained[key] = entry
+	}
+	return retained, nil
+}
+
+// listRetained returns the exit-nodes recorded in a Secret without
+// changing them.
+func (c *Controller) listRetained(name string) (map[string]retainedExitNode, error) {
+	secret, err := c.kubeclientset.CoreV1().Secrets(c.infra().RetainedNamespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return map[string]retainedExitNode{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return c.parseRetained(secret)
+}
+
+// updateRetained reads, changes and writes the exit-nodes recorded in a
+// Secret, creating the Secret when needed and retrying on conflicts.
+func (c *Controller) updateRetained(name string, update func(map[string]retainedExitNode)) error {
+	secrets := c.kubeclientset.CoreV1().Secrets(c.infra().RetainedNamespace)
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := secrets.Get(name, metav1.GetOptions{})
+		create := errors.IsNotFound(err)
+		if create {
+			secret = &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      name,
+					Namespace: c.infra().RetainedNamespace,
+				},
+			}
+		} else if err != nil {
+			return err
+		}
+
+		retained, err := c.parseRetained(secret)
+		if err != nil {
+			return err
+		}
+		update(retained)
+
+		secret.Data = map[string][]byte{}
+		for key, entry := range retained {
+			value, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			secret.Data[key] = value
+		}
+
+		if err := c.sealSecretData(secret.Data); err != nil {
+			return err
+		}
+
+		if create {
+			_, err = secrets.Create(secret)
+			return err
+		}
+		_, err = secrets.Update(secret)
+		return err
+	})
+}
+
+// retainExitNode records the exit-node of a deleted Tunnel instead of
+// deleting it, until --deletion-ttl has passed.
+func (c *Controller) retainExitNode(tunnel *inletsv1alpha1.Tunnel) error {
+	entry := retainedExitNode{
+		HostID:     tunnel.Status.HostID,
+		HostIP:     tunnel.Status.HostIP,
+		Provider:   tunnel.Status.Provider,
+		Region:     tunnel.Status.Region,
+		HourlyCost: tunnel.Status.EstimatedHourlyCost,
+		AuthToken:  tunnel.Spec.AuthToken,
+		Pro:        isProTunnel(tunnel),
+		Labels:     tunnel.Labels,
+		Expires:    metav1.NewTime(time.Now().Add(c.infra().DeletionTTL)),
+
+		TunnelClassName: tunnel.Spec.TunnelClassName,
+	}
+
+	c.tunnelLog(tunnel).Info("Keeping exit-node", "ip", entry.HostIP, "until", entry.Expires.Format(time.RFC3339))
+
+	return c.updateRetained(retainedSecretName, func(retained map[string]retainedExitNode) {
+		retained[getRetainedKey(tunnel.Namespace, tunnel.Name)] = entry
+	})
+}
+
+// hasCustomExitNode returns true when the exit-node of a tunnel is
+// provisioned with settings of the tunnel other than its token and whether
+// it uses inlets-pro, i.e. its firewall or rate limit, which an exit-node
+// provisioned for another Tunnel may not have.
+func hasCustomExitNode(tunnel *inletsv1alpha1.Tunnel) bool {
+	return tunnel.Spec.ReservedIP || usesControlPlaneTLS(tunnel) || hasExitNodeAuth(tunnel) ||
+		len(tunnel.Spec.AllowedSourceCIDRs) > 0 || tunnel.Spec.RateLimit != nil || tunnel.Spec.Sandbox ||
+		len(tunnel.Spec.ProxyProtocol) > 0 || tunnel.Spec.MutualTLS || tunnel.Spec.ServiceAccountToken != nil ||
+		tunnel.Spec.AuthTokenFrom != nil
+}
+
+// adoptRetainedExitNode makes the exit-node kept for a deleted Tunnel of the
+// same name the exit-node of a tunnel, so that a Service which is deleted
+// and created again keeps its IP. Only the token, inlets-pro and the
+// TunnelClass of the exit-node are recorded, so a tunnel with a custom
+// exit-node provisions a new one instead. It returns true when the tunnel
+// was updated.
+func (c *Controller) adoptRetainedExitNode(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	if c.infra().DeletionTTL == 0 || hasCustomExitNode(tunnel) {
+		return false, nil
+	}
+
+	key := getRetainedKey(tunnel.Namespace, tunnel.Name)
+
+	retained, err := c.listRetained(retainedSecretName)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := retained[key]; !ok {
+		return false, nil
+	}
+
+	var entry *retainedExitNode
+	err = c.updateRetained(retainedSecretName, func(retained map[string]retainedExitNode) {
+		entry = nil
+		if found, ok := retained[key]; ok && found.Pro == isProTunnel(tunnel) && found.TunnelClassName == tunnel.Spec.TunnelClassName &&
+			time.Now().Before(found.Expires.Time) {
+			entry = &found
+			delete(retained, key)
+		}
+	})
+	if err != nil || entry == nil {
+		return false, err
+	}
+
+	if err := c.adoptExitNode(tunnel, entry); err != nil {
+		return true, err
+	}
+
+	c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessAdopted,
+		"Took over exit-node %s which was kept after the tunnel was deleted", entry.HostIP)
+	return true, nil
+}
+
+// adoptExitNode makes an existing exit-node the exit-node of a tunnel, with
+// the token it was provisioned with.
+func (c *Controller) adoptExitNode(tunnel *inletsv1alpha1.Tunnel, entry *retainedExitNode) error {
+	c.tunnelLog(tunnel).Info("Adopting exit-node", "hostID", entry.HostID, "ip", entry.HostIP)
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Spec.AuthToken = entry.AuthToken
+
+	updated, err := c.updateTunnel(tunnelCopy)
+	if err != nil {
+		return err
+	}
+
+	updated.Status.Provider = entry.Provider
+	updated.Status.Region = entry.Region
+	updated.Status.EstimatedHourlyCost = entry.HourlyCost
+	return c.updateTunnelProvisioningStatus(updated, "active", entry.HostID, entry.HostIP)
+}
+
+// getRetainedTunnel returns a Tunnel with the exit-node of an entry, to
+// poll or delete the exit-node.
+func getRetainedTunnel(namespace string, entry retainedExitNode) *inletsv1alpha1.Tunnel {
+	tunnel := &inletsv1alpha1.Tunnel{}
+	tunnel.Namespace = namespace
+	tunnel.Spec.TunnelClassName = entry.TunnelClassName
+	tunnel.Status.HostID = entry.HostID
+	tunnel.Status.Provider = entry.Provider
+	return tunnel
+}
+
+// deleteExpiredExitNodes deletes the retained exit-nodes whose TTL has
+// passed, which are in the shard of this instance. Each one is only removed
+// from the Secret once it was deleted, so that failures are retried.
+func (c *Controller) deleteExpiredExitNodes() {
+	retained, err := c.listRetained(retainedSecretName)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for key, entry := range retained {
+		namespace := strings.SplitN(key, ".", 2)[0]
+		if !c.ownsObject(&metav1.ObjectMeta{Namespace: namespace, Labels: entry.Labels}) ||
+			time.Now().Before(entry.Expires.Time) {
+			continue
+		}
+
+		retainedTunnel := getRetainedTunnel(namespace, entry)
+		c.tunnelLog(retainedTunnel).Info("Deleting expired exit-node", "ip", entry.HostIP)
+		if err := c.deleteHost(retainedTunnel, "retention-expired"); err != nil {
+			utilruntime.HandleError(err)
+			continue
+		}
+
+		err := c.updateRetained(retainedSecretName, func(retained map[string]retainedExitNode) {
+			if retained[key].HostID == entry.HostID {
+				delete(retained, key)
+			}
+		})
+		if err != nil {
+			utilruntime.HandleError(err)
+		}
+	}
+}
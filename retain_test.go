@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// retain records an exit-node as retained for the Tunnel "app"
+func (f *fixture) retain(entry retainedExitNode) {
+	err := f.controller.updateRetained(retainedSecretName, func(retained map[string]retainedExitNode) {
+		retained[getRetainedKey(metav1.NamespaceDefault, "app")] = entry
+	})
+	if err != nil {
+		f.t.Fatalf("error retaining exit-node: %s", err.Error())
+	}
+}
+
+func newRetainedEntry() retainedExitNode {
+	return retainedExitNode{
+		HostID:    "fake-1",
+		HostIP:    "203.0.113.10",
+		Provider:  "fake",
+		AuthToken: "retained-token",
+		Expires:   metav1.NewTime(time.Now().Add(time.Hour)),
+	}
+}
+
+func TestAdoptRetainedExitNode(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) { infra.DeletionTTL = time.Hour })
+	f.retain(newRetainedEntry())
+
+	tunnel := newTunnel("app")
+	f.create(tunnel)
+
+	adopted, err := f.controller.adoptRetainedExitNode(tunnel)
+	if err != nil || !adopted {
+		t.Fatalf("want the retained exit-node to be adopted, got %v %v", adopted, err)
+	}
+
+	got := f.get("app")
+	if got.Status.HostID != "fake-1" || got.Status.HostIP != "203.0.113.10" || got.Spec.AuthToken != "retained-token" {
+		t.Errorf("want the tunnel to have the retained exit-node and its token, got %q %q", got.Status.HostID, got.Status.HostIP)
+	}
+}
+
+func TestAdoptRetainedExitNodeRefusesOtherExitNodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		entry     func(*retainedExitNode)
+		configure func(*inletsv1alpha1.Tunnel)
+	}{
+		{
+			name: "expired",
+			entry: func(entry *retainedExitNode) {
+				entry.Expires = metav1.NewTime(time.Now().Add(-time.Minute))
+			},
+		},
+		{
+			name: "inlets-pro",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Protocol = "tcp"
+			},
+		},
+		{
+			name: "other TunnelClass",
+			entry: func(entry *retainedExitNode) {
+				entry.TunnelClassName = "large"
+			},
+		},
+		{
+			name: "allowedSourceCIDRs",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.AllowedSourceCIDRs = []string{"198.51.100.0/24"}
+			},
+		},
+		{
+			name: "rateLimit",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.RateLimit = &inletsv1alpha1.TunnelRateLimit{}
+			},
+		},
+		{
+			name: "sandbox",
+			configure: func(tunnel *inletsv1alpha1.Tunnel) {
+				tunnel.Spec.Sandbox = true
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := newRetainedEntry()
+			if test.entry != nil {
+				test.entry(&entry)
+			}
+			f := newFixture(t, func(infra *InfraConfig) { infra.DeletionTTL = time.Hour })
+			f.retain(entry)
+
+			tunnel := newTunnel("app")
+			if test.configure != nil {
+				test.configure(tunnel)
+			}
+			f.create(tunnel)
+
+			adopted, err := f.controller.adoptRetainedExitNode(tunnel)
+			if err != nil || adopted {
+				t.Errorf("want the retained exit-node not to be adopted, got %v %v", adopted, err)
+			}
+			if got := f.get("app"); len(got.Status.HostID) > 0 {
+				t.Errorf("want the tunnel to have no exit-node, got %q", got.Status.HostID)
+			}
+		})
+	}
+}
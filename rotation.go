@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// minRotationPeriod stops exit-nodes from being replaced before they have
+// had a chance to serve any traffic.
+const minRotationPeriod = time.Hour
+
+// parseRotationPolicy returns the period after which an exit-node should
+// be replaced, or 0 when no rotation policy is set.
+func parseRotationPolicy(policy string) (time.Duration, error) {
+	switch policy {
+	case "":
+		return 0, nil
+	case "daily":
+		return time.Hour * 24, nil
+	case "weekly":
+		return time.Hour * 24 * 7, nil
+	}
+
+	period, err := time.ParseDuration(policy)
+	if err != nil {
+		return 0, fmt.Errorf("rotationPolicy must be daily, weekly or a duration, not %q", policy)
+	}
+
+	if period < minRotationPeriod {
+		return 0, fmt.Errorf("rotationPolicy must be at least %s, not %q", minRotationPeriod, policy)
+	}
+
+	return period, nil
+}
+
+// rotationDue returns true when the exit-node of the tunnel is older than
+// its rotation policy allows.
+func rotationDue(tunnel *inletsv1alpha1.Tunnel, now time.Time) (bool, error) {
+	period, err := parseRotationPolicy(tunnel.Spec.RotationPolicy)
+	if err != nil || period == 0 {
+		return false, err
+	}
+
+	// Tunnels which share an exit-node are rotated along with its Tunnel
+	if tunnel.Status.ProvisionedAt == nil || len(tunnel.Status.HostID) == 0 {
+		return false, nil
+	}
+
+	return now.Sub(tunnel.Status.ProvisionedAt.Time) >= period, nil
+}
+
+// rotateExitNode replaces the exit-node of a tunnel with one which has a
+// new token. With the recreate strategy, the exit-node is deleted and the
+// status of the tunnel is reset so that a new exit-node is provisioned.
+func (c *Controller) rotateExitNode(tunnel *inletsv1alpha1.Tunnel) error {
+	token, err := c.generateAuthToken()
+	if err != nil {
+		return err
+	}
+
+	c.notifyTunnel(tunnel, notifyTokenRotated, "Rotation",
+		fmt.Sprintf("Replacing exit-node %s with a new token due to rotationPolicy %q", tunnel.Status.HostIP, tunnel.Spec.RotationPolicy))
+
+	if c.usesBlueGreen(tunnel) {
+		c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessRotated,
+			"Replacing exit-node %s due to rotationPolicy %q", tunnel.Status.HostIP, tunnel.Spec.RotationPolicy)
+		return c.startReplacement(tunnel, token, "Rotation")
+	}
+
+	c.tunnelLog(tunnel).Info("Rotating exit-node", "ip", tunnel.Status.HostIP)
+	if err := c.deprovisionExitNode(tunnel, "rotation"); err != nil {
+		return err
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Spec.AuthToken = token
+	clearExitNode(&tunnelCopy.Status)
+
+	if err := c.updateTunnelSpecAndStatus(tunnelCopy); err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessRotated,
+		"Exit-node %s replaced due to rotationPolicy %q", tunnel.Status.HostIP, tunnel.Spec.RotationPolicy)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func TestParseRotationPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{policy: "", want: 0},
+		{policy: "daily", want: 24 * time.Hour},
+		{policy: "weekly", want: 7 * 24 * time.Hour},
+		{policy: "36h", want: 36 * time.Hour},
+		{policy: "30m", wantErr: true},
+		{policy: "monthly", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseRotationPolicy(test.policy)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%q: want %s (error %v), got %s (%v)", test.policy, test.want, test.wantErr, got, err)
+		}
+	}
+}
+
+func TestRotateExitNodeUnpublishesAndClearsStatus(t *testing.T) {
+	f := newFixture(t)
+	if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Create(newPublishedService()); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+
+	provisionedAt := metav1.NewTime(time.Now().Add(-48 * time.Hour))
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Spec.RotationPolicy = "daily"
+	tunnel.Spec.AuthToken = "old-token"
+	tunnel.Status.HostIP = "203.0.113.1"
+	tunnel.Status.ProvisionedAt = &provisionedAt
+	tunnel.Status.ActiveClient = "app-client-0"
+	tunnel.Status.Conditions = []inletsv1alpha1.TunnelCondition{
+		{Type: inletsv1alpha1.TunnelPublished, Status: corev1.ConditionTrue},
+		{Type: inletsv1alpha1.TunnelClientConnected, Status: corev1.ConditionTrue},
+	}
+	f.create(tunnel)
+
+	if err := f.controller.rotateExitNode(tunnel); err != nil {
+		t.Fatalf("error rotating exit-node: %s", err.Error())
+	}
+
+	got := f.get("app")
+	if got.Spec.AuthToken == "old-token" || len(got.Spec.AuthToken) == 0 {
+		t.Errorf("want a new token, got %q", got.Spec.AuthToken)
+	}
+	if len(got.Status.HostID) > 0 || len(got.Status.HostIP) > 0 || got.Status.ProvisionedAt != nil || len(got.Status.ActiveClient) > 0 {
+		t.Errorf("want the exit-node to be cleared from the status, got %+v", got.Status)
+	}
+	if len(got.Status.Conditions) > 0 {
+		t.Errorf("want the conditions of the exit-node to be removed, got %v", got.Status.Conditions)
+	}
+
+	service, _ := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get("app", metav1.GetOptions{})
+	for _, ip := range service.Spec.ExternalIPs {
+		if ip == "203.0.113.1" {
+			t.Errorf("want the IP of the rotated exit-node to be unpublished, got %v", service.Spec.ExternalIPs)
+		}
+	}
+}
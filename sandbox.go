@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// sandboxDeniedSyscalls are the system calls which the inlets server is not
+// allowed to make. They are listed by name, since the system call groups of
+// systemd are newer than the systemd of the exit-node images.
+var sandboxDeniedSyscalls = []string{
+	"acct", "add_key", "bpf", "chroot", "clock_adjtime", "clock_settime",
+	"delete_module", "finit_module", "init_module", "ioperm", "iopl",
+	"kexec_file_load", "kexec_load", "keyctl", "mount", "move_pages",
+	"open_by_handle_at", "perf_event_open", "pivot_root", "process_vm_readv",
+	"process_vm_writev", "ptrace", "quotactl", "reboot", "request_key",
+	"setns", "settimeofday", "swapoff", "swapon", "umount2", "unshare",
+	"uselib", "userfaultfd",
+}
+
+// makeSandboxUserdata returns a script which confines the inlets server,
+// run by the systemd unit and binary of the same name, when the tunnel has
+// sandbox set. The unit gets a seccomp filter, no new privileges and a
+// read-only filesystem, and the binary an AppArmor profile which only lets
+// it use the network and read what it needs to run.
+func makeSandboxUserdata(tunnel *inletsv1alpha1.Tunnel, name string) string {
+	if !tunnel.Spec.Sandbox {
+		return ""
+	}
+
+	return `
+
+cat > /etc/apparmor.d/usr.local.bin.` + name + ` <<'EOF'
+#include <tunables/global>
+
+/usr/local/bin/` + name + ` {
+  #include <abstractions/base>
+  #include <abstractions/nameservice>
+  #include <abstractions/ssl_certs>
+
+  network inet stream,
+  network inet6 stream,
+  network inet dgram,
+  network inet6 dgram,
+
+  /usr/local/bin/` + name + ` mr,
+  /proc/sys/net/core/somaxconn r,
+  /sys/kernel/mm/transparent_hugepage/hpage_pmd_size r,
+  owner /tmp/** rw,
+
+  deny /etc/shadow r,
+  deny /root/** rw,
+  deny /home/** rw,
+}
+EOF
+apparmor_parser -r /etc/apparmor.d/usr.local.bin.` + name + `
+
+mkdir -p /etc/systemd/system/` + name + `.service.d
+cat > /etc/systemd/system/` + name + `.service.d/sandbox.conf <<'EOF'
+[Service]
+NoNewPrivileges=true
+PrivateTmp=true
+PrivateDevices=true
+ProtectSystem=full
+ProtectHome=true
+ReadOnlyDirectories=/
+ReadWriteDirectories=/tmp
+CapabilityBoundingSet=CAP_NET_BIND_SERVICE
+SystemCallArchitectures=native
+SystemCallFilter=~` + strings.Join(sandboxDeniedSyscalls, " ") + `
+AppArmorProfile=/usr/local/bin/` + name + `
+EOF
+
+systemctl daemon-reload && \
+	systemctl restart ` + name
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+const (
+	serviceAccountTokenMountPath = "/var/run/secrets/inlets"
+
+	// serviceAccountTokenProxyPort is the port of the proxy on the
+	// exit-node which validates the ServiceAccount token of the client, in
+	// between the TLS proxy and inlets-pro.
+	serviceAccountTokenProxyPort = mutualTLSBackendPort + 1
+
+	// caddyJWTRelease is Caddy built with the caddy-jwt module, which
+	// validates JWTs against a JWKS URL.
+	caddyJWTRelease = "https://caddyserver.com/api/download?os=linux&arch=amd64&p=github.com%2Fggicci%2Fcaddy-jwt"
+
+	defaultServiceAccountTokenExpiration = int64(3600)
+)
+
+// serviceAccountIssuer is the issuer of ServiceAccount tokens of the
+// cluster, and the URL of its keys.
+type serviceAccountIssuer struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// serviceAccountIssuerCache holds the issuer which was discovered from the
+// API server, which doesn't change whilst the operator runs.
+type serviceAccountIssuerCache struct {
+	lock   sync.Mutex
+	issuer *serviceAccountIssuer
+}
+
+// usesServiceAccountToken returns true when the client of a tunnel
+// authenticates with a projected ServiceAccount token.
+func usesServiceAccountToken(tunnel *inletsv1alpha1.Tunnel) bool {
+	return tunnel.Spec.ServiceAccountToken != nil
+}
+
+// getServiceAccountTokenAudience returns the audience of the token of the
+// client, which is unique to the tunnel unless it is set, so that a token
+// for one tunnel can't connect to the exit-node of another.
+func getServiceAccountTokenAudience(tunnel *inletsv1alpha1.Tunnel) string {
+	if len(tunnel.Spec.ServiceAccountToken.Audience) > 0 {
+		return tunnel.Spec.ServiceAccountToken.Audience
+	}
+	return "inlets:" + tunnel.Namespace + ":" + tunnel.Name
+}
+
+func validateServiceAccountToken(tunnel *inletsv1alpha1.Tunnel) error {
+	if !usesServiceAccountToken(tunnel) {
+		return nil
+	}
+	if !canUseControlPlaneTLS(tunnel) {
+		return fmt.Errorf("serviceAccountToken needs inlets-pro, its own exit-node and a clientMode other than sidecar")
+	}
+	if tunnel.Spec.ServiceAccountToken.ExpirationSeconds < 0 ||
+		(tunnel.Spec.ServiceAccountToken.ExpirationSeconds > 0 && tunnel.Spec.ServiceAccountToken.ExpirationSeconds < 600) {
+		return fmt.Errorf("serviceAccountToken.expirationSeconds must be at least 600")
+	}
+	if strings.ContainsAny(tunnel.Spec.ServiceAccountToken.Audience, " \t\r\n{}\"") {
+		return fmt.Errorf("serviceAccountToken.audience must not have spaces, braces or quotes")
+	}
+	return nil
+}
+
+// getServiceAccountIssuer returns the issuer of ServiceAccount tokens from
+// --service-account-issuer and --service-account-jwks-url, or else from
+// the OIDC discovery document of the API server. The keys must be
+// reachable from the exit-nodes.
+func (c *Controller) getServiceAccountIssuer() (*serviceAccountIssuer, error) {
+	issuer := serviceAccountIssuer{
+		Issuer:  c.infra().ServiceAccountIssuer,
+		JWKSURI: c.infra().ServiceAccountJWKSURL,
+	}
+	if len(issuer.Issuer) > 0 && len(issuer.JWKSURI) > 0 {
+		return &issuer, nil
+	}
+
+	c.serviceAccountIssuer.lock.Lock()
+	defer c.serviceAccountIssuer.lock.Unlock()
+
+	if c.serviceAccountIssuer.issuer == nil {
+		body, err := c.kubeclientset.Discovery().RESTClient().
+			Get().
+			AbsPath("/.well-known/openid-configuration").
+			Do().
+			Raw()
+		if err != nil {
+			return nil, fmt.Errorf("error discovering the service account issuer: %s", err.Error())
+		}
+
+		discovered := serviceAccountIssuer{}
+		if err := json.Unmarshal(body, &discovered); err != nil {
+			return nil, err
+		}
+		c.serviceAccountIssuer.issuer = &discovered
+	}
+
+	if len(issuer.Issuer) == 0 {
+		issuer.Issuer = c.serviceAccountIssuer.issuer.Issuer
+	}
+	if len(issuer.JWKSURI) == 0 {
+		issuer.JWKSURI = c.serviceAccountIssuer.issuer.JWKSURI
+	}
+
+	if parsed, err := url.Parse(issuer.JWKSURI); err != nil || parsed.Scheme != "https" {
+		return nil, fmt.Errorf("the service account issuer has no https JWKS URL, set --service-account-jwks-url")
+	}
+	return &issuer, nil
+}
+
+// addServiceAccountTokenUserdata adds Caddy to the userdata of the exit-node
+// of a tunnel which authenticates with a ServiceAccount token. The TLS proxy
+// forwards to Caddy, which terminates the TLS of inlets-pro, validates the
+// token of the client against the keys of the issuer, then replaces it with
+// the token of the exit-node before forwarding to inlets-pro.
+func (c *Controller) addServiceAccountTokenUserdata(tunnel *inletsv1alpha1.Tunnel, host *provision.BasicHost) error {
+	if !usesServiceAccountToken(tunnel) {
+		return nil
+	}
+
+	issuer, err := c.getServiceAccountIssuer()
+	if err != nil {
+		return err
+	}
+
+	host.UserData += `
+
+iptables -I INPUT -p tcp --dport ` + fmt.Sprintf("%d", serviceAccountTokenProxyPort) + ` ! -i lo -j DROP
+
+` + makeVerifiedDownload(caddyJWTRelease, "/tmp/caddy-jwt", c.infra().ReleaseChecksums["caddy-jwt"]) + ` && \
+	chmod +x /tmp/caddy-jwt && \
+	mv /tmp/caddy-jwt /usr/local/bin/caddy-jwt
+
+mkdir -p /etc/caddy-jwt
+cat > /etc/caddy-jwt/Caddyfile <<EOF
+{
+	order jwtauth before reverse_proxy
+}
+https://127.0.0.1:` + fmt.Sprintf("%d", serviceAccountTokenProxyPort) + ` {
+	tls internal
+	jwtauth {
+		jwk_url ` + issuer.JWKSURI + `
+		issuer_whitelist ` + issuer.Issuer + `
+		audience_whitelist ` + getServiceAccountTokenAudience(tunnel) + `
+	}
+	reverse_proxy https://127.0.0.1:` + fmt.Sprintf("%d", mutualTLSBackendPort) + ` {
+		header_up Authorization "Bearer $AUTHTOKEN"
+		transport http {
+			tls_insecure_skip_verify
+		}
+	}
+}
+EOF
+
+cat > /etc/systemd/system/caddy-jwt.service <<EOF
+[Unit]
+Description=Validates the ServiceAccount token of the inlets-pro client
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+ExecStart=/usr/local/bin/caddy-jwt run --config /etc/caddy-jwt/Caddyfile --adapter caddyfile
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start caddy-jwt && \
+	systemctl enable caddy-jwt`
+
+	return nil
+}
+
+// getControlPlaneTarget returns the port which the TLS proxy of an
+// exit-node forwards the connection of the client to.
+func getControlPlaneTarget(tunnel *inletsv1alpha1.Tunnel) int {
+	if usesServiceAccountToken(tunnel) {
+		return serviceAccountTokenProxyPort
+	}
+	return mutualTLSBackendPort
+}
+
+// addServiceAccountTokenVolume mounts a projected ServiceAccount token with
+// the audience of a tunnel into its client, which reads it instead of the
+// token of the tunnel.
+func addServiceAccountTokenVolume(deployment *appsv1.Deployment, tunnel *inletsv1alpha1.Tunnel) {
+	podSpec := &deployment.Spec.Template.Spec
+
+	expiration := tunnel.Spec.ServiceAccountToken.ExpirationSeconds
+	if expiration == 0 {
+		expiration = defaultServiceAccountTokenExpiration
+	}
+
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "serviceaccount-token",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          getServiceAccountTokenAudience(tunnel),
+							ExpirationSeconds: &expiration,
+							Path:              "token",
+						},
+					},
+				},
+			},
+		},
+	})
+
+	client := &podSpec.Containers[0]
+	client.VolumeMounts = append(client.VolumeMounts, corev1.VolumeMount{
+		Name:      "serviceaccount-token",
+		MountPath: serviceAccountTokenMountPath,
+		ReadOnly:  true,
+	})
+
+	for i, arg := range client.Args {
+		if strings.HasPrefix(arg, "--token=") {
+			client.Args[i] = "--token-from=" + serviceAccountTokenMountPath + "/token"
+		}
+	}
+}
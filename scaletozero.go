@@ -0,0 +1,107 @@
+package main
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// syncScaleToZero records whether the Service of an active tunnel has ready
+// endpoints, and deprovisions its exit-node once it has had none for
+// --scale-to-zero-after. It returns true when the tunnel was updated.
+func (c *Controller) syncScaleToZero(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	// Tunnels which share an exit-node have no HostID to deprovision
+	if c.infra().ScaleToZeroAfter == 0 || len(tunnel.Status.HostID) == 0 {
+		return false, nil
+	}
+
+	ready, err := c.countReadyEndpoints(tunnel)
+	if err != nil || ready < 0 {
+		return false, err
+	}
+
+	condition := inletsv1alpha1.TunnelCondition{
+		Type:   inletsv1alpha1.TunnelEndpointsReady,
+		Status: corev1.ConditionTrue,
+		Reason: "EndpointsReady",
+	}
+	if ready == 0 {
+		condition.Status = corev1.ConditionFalse
+		condition.Reason = "NoReadyEndpoints"
+	}
+
+	existing := getCondition(tunnel.Status.Conditions, inletsv1alpha1.TunnelEndpointsReady)
+	if existing == nil || existing.Status != condition.Status {
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, condition)
+
+		_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+		return true, err
+	}
+
+	if ready > 0 || time.Since(existing.LastTransitionTime.Time) < c.infra().ScaleToZeroAfter {
+		return false, nil
+	}
+
+	return true, c.scaleToZero(tunnel)
+}
+
+// scaleToZero deletes the exit-node and client of a tunnel, and records
+// that it is scaled to zero so that it is not provisioned again until its
+// Service has ready endpoints.
+func (c *Controller) scaleToZero(tunnel *inletsv1alpha1.Tunnel) error {
+	c.tunnelLog(tunnel).Info("Scaling exit-node to zero", "ip", tunnel.Status.HostIP)
+	if err := c.deprovisionExitNode(tunnel, "scale-to-zero"); err != nil {
+		return err
+	}
+
+	if err := c.deleteClient(tunnel); err != nil {
+		return err
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Spec.ClientDeploymentRef = nil
+	clearExitNode(&tunnelCopy.Status)
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelCondition{
+		Type:   inletsv1alpha1.TunnelScaledToZero,
+		Status: corev1.ConditionTrue,
+		Reason: "NoReadyEndpoints",
+	})
+
+	if err := c.updateTunnelSpecAndStatus(tunnelCopy); err != nil {
+		return err
+	}
+
+	c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessScaledToZero,
+		"Exit-node %s deprovisioned after its Service had no ready endpoints for %s",
+		tunnel.Status.HostIP, c.infra().ScaleToZeroAfter)
+	return nil
+}
+
+// syncScaledToZero keeps a tunnel which was scaled to zero from being
+// provisioned until its Service has ready endpoints again, or scaling to
+// zero is turned off. It returns true
+// when the tunnel should not be synced any further.
+func (c *Controller) syncScaledToZero(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	if !hasConditionType(tunnel.Status.Conditions, inletsv1alpha1.TunnelScaledToZero) {
+		return false, nil
+	}
+
+	ready, err := c.countReadyEndpoints(tunnel)
+	if err != nil {
+		return true, err
+	}
+	if ready == 0 && c.infra().ScaleToZeroAfter > 0 {
+		return true, nil
+	}
+
+	c.tunnelLog(tunnel).Info("Scaling tunnel up from zero")
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelScaledToZero)
+
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return true, err
+}
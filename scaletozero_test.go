@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func scaleToZeroAfter(infra *InfraConfig) {
+	infra.ScaleToZeroAfter = 10 * time.Minute
+}
+
+// addReadyEndpoints gives the Service "app" a ready endpoint.
+func (f *fixture) addReadyEndpoints() {
+	f.kubeInformers.Core().V1().Endpoints().Informer().GetIndexer().Add(&corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: metav1.NamespaceDefault},
+		Subsets: []corev1.EndpointSubset{
+			{Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}}},
+		},
+	})
+}
+
+func TestSyncScaleToZero(t *testing.T) {
+	f := newFixture(t, scaleToZeroAfter)
+	if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Create(newPublishedService()); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Status.HostIP = "203.0.113.1"
+	f.create(tunnel)
+
+	// The first sync records that the Service has no ready endpoints
+	if updated, err := f.controller.syncScaleToZero(tunnel); err != nil || !updated {
+		t.Fatalf("want the endpoints to be recorded, got %v %v", updated, err)
+	}
+	condition := getCondition(f.get("app").Status.Conditions, inletsv1alpha1.TunnelEndpointsReady)
+	if condition == nil || condition.Status != corev1.ConditionFalse {
+		t.Fatalf("want no ready endpoints to be recorded, got %+v", condition)
+	}
+
+	// The exit-node is kept until there were no endpoints for long enough
+	if updated, err := f.controller.syncScaleToZero(f.get("app")); err != nil || updated {
+		t.Fatalf("want the exit-node to be kept, got %v %v", updated, err)
+	}
+
+	tunnel = f.get("app")
+	tunnel.Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-time.Hour))
+	if updated, err := f.controller.syncScaleToZero(tunnel); err != nil || !updated {
+		t.Fatalf("want the exit-node to be scaled to zero, got %v %v", updated, err)
+	}
+
+	got := f.get("app")
+	if len(got.Status.HostID) > 0 || len(got.Status.HostIP) > 0 {
+		t.Errorf("want the exit-node to be cleared from the status, got %q %q", got.Status.HostID, got.Status.HostIP)
+	}
+	if !hasConditionType(got.Status.Conditions, inletsv1alpha1.TunnelScaledToZero) {
+		t.Errorf("want the tunnel to be recorded as scaled to zero, got %v", got.Status.Conditions)
+	}
+
+	service, _ := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get("app", metav1.GetOptions{})
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "203.0.113.2" {
+		t.Errorf("want the IP of the exit-node to be unpublished, got %v", service.Spec.ExternalIPs)
+	}
+}
+
+func TestSyncScaledToZero(t *testing.T) {
+	f := newFixture(t, scaleToZeroAfter)
+
+	tunnel := newTunnel("app")
+	tunnel.Status.Conditions = []inletsv1alpha1.TunnelCondition{
+		{Type: inletsv1alpha1.TunnelScaledToZero, Status: corev1.ConditionTrue},
+	}
+	f.create(tunnel)
+
+	if stop, err := f.controller.syncScaledToZero(tunnel); err != nil || !stop {
+		t.Fatalf("want the tunnel to be held without endpoints, got %v %v", stop, err)
+	}
+	if !hasConditionType(f.get("app").Status.Conditions, inletsv1alpha1.TunnelScaledToZero) {
+		t.Fatalf("want the tunnel to stay scaled to zero")
+	}
+
+	f.addReadyEndpoints()
+	if stop, err := f.controller.syncScaledToZero(tunnel); err != nil || !stop {
+		t.Fatalf("want the tunnel to be scaled up, got %v %v", stop, err)
+	}
+	if hasConditionType(f.get("app").Status.Conditions, inletsv1alpha1.TunnelScaledToZero) {
+		t.Errorf("want the tunnel to be scaled up from zero")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// scheduleDays maps the days of a schedule to their weekday.
+var scheduleDays = map[string]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+// parseScheduleTime parses the start or end of a schedule as an offset
+// from midnight.
+func parseScheduleTime(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("schedule times must be given as HH:MM, not %q", value)
+	}
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
+
+// inSchedule returns whether a time is within the window of a schedule,
+// and when the window next starts or ends.
+func inSchedule(schedule *inletsv1alpha1.TunnelSchedule, now time.Time) (bool, time.Time, error) {
+	start, err := parseScheduleTime(schedule.Start)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	end, err := parseScheduleTime(schedule.End)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if start == end {
+		return false, time.Time{}, fmt.Errorf("schedule must not start and end at the same time")
+	}
+
+	location, err := time.LoadLocation(schedule.TimeZone)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("unknown schedule timeZone %q", schedule.TimeZone)
+	}
+
+	days := map[time.Weekday]bool{}
+	for _, day := range schedule.Days {
+		weekday, ok := scheduleDays[day]
+		if !ok {
+			return false, time.Time{}, fmt.Errorf("schedule days must be one of Mon, Tue, Wed, Thu, Fri, Sat or Sun, not %q", day)
+		}
+		days[weekday] = true
+	}
+
+	now = now.In(location)
+	var next time.Time
+
+	// A window which runs overnight may have started the day before
+	for offset := -1; offset <= 7; offset++ {
+		day := time.Date(now.Year(), now.Month(), now.Day()+offset, 0, 0, 0, 0, location)
+		if len(days) > 0 && !days[day.Weekday()] {
+			continue
+		}
+
+		windowStart := day.Add(start)
+		windowEnd := day.Add(end)
+		if end < start {
+			windowEnd = windowEnd.Add(24 * time.Hour)
+		}
+
+		if !now.Before(windowStart) && now.Before(windowEnd) {
+			return true, windowEnd, nil
+		}
+		if windowStart.After(now) && (next.IsZero() || windowStart.Before(next)) {
+			next = windowStart
+		}
+	}
+
+	return false, next, nil
+}
+
+// syncSchedule deprovisions the exit-node and client of a tunnel outside
+// the window of its schedule, and keeps a new one from being provisioned
+// until the window starts. The tunnel is synced again when the window next
+// starts or ends. It returns true when the tunnel should not be synced any
+// further.
+func (c *Controller) syncSchedule(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	outside := hasConditionType(tunnel.Status.Conditions, inletsv1alpha1.TunnelOutsideSchedule)
+
+	active := true
+	if tunnel.Spec.Schedule != nil {
+		var next time.Time
+		var err error
+		active, next, err = inSchedule(tunnel.Spec.Schedule, time.Now())
+		if err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return true, nil
+		}
+
+		if key, err := cache.MetaNamespaceKeyFunc(tunnel); err == nil && !next.IsZero() {
+			c.workqueue.AddAfter(key, time.Until(next))
+		}
+	}
+
+	if active {
+		if !outside {
+			return false, nil
+		}
+
+		c.tunnelLog(tunnel).Info("Schedule started")
+
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Status.Conditions = removeCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelOutsideSchedule)
+
+		_, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+		return true, err
+	}
+
+	if outside && len(tunnel.Status.HostID) == 0 {
+		return true, nil
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+
+	// Tunnels which share an exit-node have no HostID to deprovision
+	if len(tunnel.Status.HostID) > 0 {
+		c.tunnelLog(tunnel).Info("Deprovisioning exit-node outside of schedule", "ip", tunnel.Status.HostIP)
+		if err := c.deprovisionExitNode(tunnel, "schedule"); err != nil {
+			return true, err
+		}
+
+		c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessOutsideSchedule,
+			"Exit-node %s deprovisioned at the end of the schedule", tunnel.Status.HostIP)
+	}
+
+	if err := c.deleteClient(tunnel); err != nil {
+		return true, err
+	}
+
+	tunnelCopy.Spec.ClientDeploymentRef = nil
+	clearExitNode(&tunnelCopy.Status)
+	tunnelCopy.Status.Conditions = setCondition(tunnelCopy.Status.Conditions, inletsv1alpha1.TunnelCondition{
+		Type:   inletsv1alpha1.TunnelOutsideSchedule,
+		Status: corev1.ConditionTrue,
+		Reason: "Scheduled",
+	})
+
+	return true, c.updateTunnelSpecAndStatus(tunnelCopy)
+}
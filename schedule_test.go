@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func TestInSchedule(t *testing.T) {
+	workdays := []string{"Mon", "Tue", "Wed", "Thu", "Fri"}
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %s", err.Error())
+	}
+
+	// 1 January 2024 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		schedule inletsv1alpha1.TunnelSchedule
+		now      time.Time
+		want     bool
+		wantNext time.Time
+		wantErr  bool
+	}{
+		{
+			name:     "within the window of a workday",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "09:00", End: "17:00", Days: workdays},
+			now:      at(1, 10, 0),
+			want:     true,
+			wantNext: at(1, 17, 0),
+		},
+		{
+			name:     "at the end of the window",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "09:00", End: "17:00", Days: workdays},
+			now:      at(1, 17, 0),
+			wantNext: at(2, 9, 0),
+		},
+		{
+			name:     "at the weekend",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "09:00", End: "17:00", Days: workdays},
+			now:      at(6, 10, 0),
+			wantNext: at(8, 9, 0),
+		},
+		{
+			name:     "overnight window which started the day before",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "22:00", End: "06:00", Days: []string{"Mon"}},
+			now:      at(2, 2, 0),
+			want:     true,
+			wantNext: at(2, 6, 0),
+		},
+		{
+			name:     "overnight window on another day",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "22:00", End: "06:00", Days: []string{"Mon"}},
+			now:      at(3, 2, 0),
+			wantNext: at(8, 22, 0),
+		},
+		{
+			name:     "every day in a time zone",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "09:00", End: "17:00", TimeZone: "America/New_York"},
+			now:      at(1, 15, 0),
+			want:     true,
+			wantNext: time.Date(2024, time.January, 1, 17, 0, 0, 0, newYork),
+		},
+		{
+			name:     "start and end are the same",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "09:00", End: "09:00"},
+			wantErr:  true,
+		},
+		{
+			name:     "time is not HH:MM",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "9am", End: "17:00"},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown day",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "09:00", End: "17:00", Days: []string{"Monday"}},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown time zone",
+			schedule: inletsv1alpha1.TunnelSchedule{Start: "09:00", End: "17:00", TimeZone: "Mars/Olympus"},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, next, err := inSchedule(&test.schedule, test.now)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("want error %v, got %v", test.wantErr, err)
+			}
+			if got != test.want {
+				t.Errorf("want in schedule %v, got %v", test.want, got)
+			}
+			if !next.Equal(test.wantNext) {
+				t.Errorf("want the window to next start or end at %s, got %s", test.wantNext, next)
+			}
+		})
+	}
+}
+
+func TestSyncScheduleDeprovisionsOutsideWindow(t *testing.T) {
+	f := newFixture(t)
+	if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Create(newPublishedService()); err != nil {
+		t.Fatalf("error creating service: %s", err.Error())
+	}
+
+	// A window which starts later today or overnight never includes now
+	now := time.Now().UTC()
+	tunnel := newActiveTunnel("app")
+	tunnel.Spec.Hostname = "app.example.com"
+	tunnel.Spec.Schedule = &inletsv1alpha1.TunnelSchedule{
+		Start: now.Add(2 * time.Hour).Format("15:04"),
+		End:   now.Add(3 * time.Hour).Format("15:04"),
+	}
+	tunnel.Status.HostIP = "203.0.113.1"
+	f.create(tunnel)
+
+	if stop, err := f.controller.syncSchedule(tunnel); err != nil || !stop {
+		t.Fatalf("want the exit-node to be deprovisioned, got %v %v", stop, err)
+	}
+
+	got := f.get("app")
+	if len(got.Status.HostID) > 0 || len(got.Status.HostIP) > 0 {
+		t.Errorf("want the exit-node to be cleared from the status, got %q %q", got.Status.HostID, got.Status.HostIP)
+	}
+	if !hasConditionType(got.Status.Conditions, inletsv1alpha1.TunnelOutsideSchedule) {
+		t.Errorf("want the tunnel to be recorded as outside its schedule, got %v", got.Status.Conditions)
+	}
+
+	service, _ := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get("app", metav1.GetOptions{})
+	if len(service.Spec.ExternalIPs) != 1 || service.Spec.ExternalIPs[0] != "203.0.113.2" {
+		t.Errorf("want the IP of the exit-node to be unpublished, got %v", service.Spec.ExternalIPs)
+	}
+
+	// The tunnel is held until the window starts
+	if stop, err := f.controller.syncSchedule(got); err != nil || !stop {
+		t.Errorf("want the tunnel to be held outside the window, got %v %v", stop, err)
+	}
+}
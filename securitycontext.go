@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	// seccompPodAnnotation sets the seccomp profile of a Pod, since the
+	// seccompProfile field is not available in the Kubernetes API version
+	// used by the operator.
+	seccompPodAnnotation = "seccomp.security.alpha.kubernetes.io/pod"
+
+	// clientUser is the user the client runs as, "nobody", since the client
+	// images don't set a non-root user of their own.
+	clientUser = int64(65534)
+)
+
+// applyClientSecurityContext runs the containers of a client Pod as
+// non-root with a read-only root filesystem, no capabilities and the
+// runtime's default seccomp profile, when --client-security-context is
+// restricted. Clients on the host network are left as they are, since
+// restricted Pods can't use it. Ports below 1024 are unprivileged in the
+// Pod, so that the TLS proxy can still listen on 443.
+func applyClientSecurityContext(template *corev1.PodTemplateSpec, tunnel *inletsv1alpha1.Tunnel, mode string) {
+	if mode != "restricted" || (tunnel.Spec.Client != nil && tunnel.Spec.Client.HostNetwork) {
+		return
+	}
+
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[seccompPodAnnotation] = "runtime/default"
+
+	runAsNonRoot := true
+	user := clientUser
+	template.Spec.SecurityContext = &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+		RunAsUser:    &user,
+		RunAsGroup:   &user,
+	}
+	if tunnel.Spec.TLS != nil {
+		template.Spec.SecurityContext.Sysctls = []corev1.Sysctl{
+			{Name: "net.ipv4.ip_unprivileged_port_start", Value: fmt.Sprintf("%d", tlsProxyPort)},
+		}
+	}
+
+	for i := range template.Spec.Containers {
+		allowPrivilegeEscalation := false
+		readOnlyRootFilesystem := true
+		template.Spec.Containers[i].SecurityContext = &corev1.SecurityContext{
+			AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+			ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+			Capabilities: &corev1.Capabilities{
+				Drop: []corev1.Capability{"ALL"},
+			},
+		}
+	}
+}
+
+// clientSecurityContextChanged returns true when the Pod template of a
+// client does not have the security context it would be given.
+func clientSecurityContextChanged(template corev1.PodTemplateSpec, tunnel *inletsv1alpha1.Tunnel, mode string) bool {
+	want := template.DeepCopy()
+	applyClientSecurityContext(want, tunnel, mode)
+
+	return !reflect.DeepEqual(template.Annotations, want.Annotations) ||
+		!reflect.DeepEqual(template.Spec.SecurityContext, want.Spec.SecurityContext) ||
+		!reflect.DeepEqual(template.Spec.Containers, want.Spec.Containers)
+}
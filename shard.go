@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+)
+
+const (
+	// shardLeaseDuration is how long a shard is held without being renewed
+	// before another instance of the operator can take it over.
+	shardLeaseDuration = 15 * time.Second
+	// shardRenewInterval is how often the lease of a shard is renewed, or
+	// a free shard is looked for.
+	shardRenewInterval = 5 * time.Second
+)
+
+// getShardLeaseName returns the name of the Lease for a shard.
+func getShardLeaseName(shard int) string {
+	return fmt.Sprintf("inlets-operator-shard-%d", shard)
+}
+
+// getShardFor returns the shard which a namespace or label value is in.
+func getShardFor(value string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(value))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// getShard returns the shard held by this instance, or -1.
+func (c *Controller) getShard() int {
+	c.shardLock.Lock()
+	defer c.shardLock.Unlock()
+
+	return c.shard
+}
+
+func (c *Controller) setShard(shard int) {
+	c.shardLock.Lock()
+	defer c.shardLock.Unlock()
+
+	c.shard = shard
+}
+
+// ownsObject returns true when a Tunnel or Service is in the shard held by
+// this instance. Objects are sharded by their namespace, or by the value of
+// --shard-label when it is set.
+func (c *Controller) ownsObject(object metav1.Object) bool {
+	if c.infra().Shards <= 1 {
+		return true
+	}
+
+	shard := c.getShard()
+	if shard < 0 {
+		return false
+	}
+
+	value := object.GetNamespace()
+	if len(c.infra().ShardLabel) > 0 {
+		value = object.GetLabels()[c.infra().ShardLabel]
+	}
+	return getShardFor(value, c.infra().Shards) == shard
+}
+
+// getShardLabels returns the shard label of a Service, so that its Tunnels
+// are in the same shard.
+func getShardLabels(service *corev1.Service, shardLabel string) map[string]string {
+	value, ok := service.Labels[shardLabel]
+	if len(shardLabel) == 0 || !ok {
+		return nil
+	}
+	return map[string]string{shardLabel: value}
+}
+
+// syncShardLease renews the Lease of the shard held by this instance, or
+// takes the first shard without a holder, or whose holder stopped renewing.
+func (c *Controller) syncShardLease() {
+	leases := c.kubeclientset.CoordinationV1().Leases(c.infra().ShardLeaseNamespace)
+	now := metav1.NowMicro()
+
+	if shard := c.getShard(); shard >= 0 {
+		lease, err := leases.Get(getShardLeaseName(shard), metav1.GetOptions{})
+		if err == nil && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == c.shardIdentity {
+			lease.Spec.RenewTime = &now
+			if _, err = leases.Update(lease); err == nil {
+				return
+			}
+		}
+
+		logWith("shard", shard).Warn("Lost the lease of shard")
+		c.setShard(-1)
+		if err != nil {
+			utilruntime.HandleError(err)
+		}
+		return
+	}
+
+	duration := int32(shardLeaseDuration / time.Second)
+
+	for shard := 0; shard < c.infra().Shards; shard++ {
+		lease, err := leases.Get(getShardLeaseName(shard), metav1.GetOptions{})
+
+		if errors.IsNotFound(err) {
+			_, err = leases.Create(&coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      getShardLeaseName(shard),
+					Namespace: c.infra().ShardLeaseNamespace,
+				},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &c.shardIdentity,
+					LeaseDurationSeconds: &duration,
+					AcquireTime:          &now,
+					RenewTime:            &now,
+				},
+			})
+		} else if err == nil && leaseExpired(lease, now.Time) {
+			transitions := int32(1)
+			if lease.Spec.LeaseTransitions != nil {
+				transitions = *lease.Spec.LeaseTransitions + 1
+			}
+
+			lease.Spec.HolderIdentity = &c.shardIdentity
+			lease.Spec.LeaseDurationSeconds = &duration
+			lease.Spec.AcquireTime = &now
+			lease.Spec.RenewTime = &now
+			lease.Spec.LeaseTransitions = &transitions
+
+			// The update fails with a conflict when another instance
+			// took the shard first
+			_, err = leases.Update(lease)
+		} else if err == nil {
+			continue
+		}
+
+		if err != nil {
+			if !errors.IsAlreadyExists(err) && !errors.IsConflict(err) {
+				utilruntime.HandleError(err)
+			}
+			continue
+		}
+
+		logWith("shard", shard, "shards", c.infra().Shards).Info("Acquired the lease of shard")
+		c.setShard(shard)
+		return
+	}
+}
+
+// leaseExpired returns true when a Lease has no holder, or was not renewed
+// within its duration.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.HolderIdentity == nil || len(*lease.Spec.HolderIdentity) == 0 ||
+		lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now.After(expiry)
+}
+
+// releaseShardLease clears the holder of the Lease of this instance's
+// shard, so that another instance can take it over straight away.
+func (c *Controller) releaseShardLease() {
+	shard := c.getShard()
+	if c.infra().Shards <= 1 || shard < 0 {
+		return
+	}
+	c.setShard(-1)
+
+	leases := c.kubeclientset.CoordinationV1().Leases(c.infra().ShardLeaseNamespace)
+	lease, err := leases.Get(getShardLeaseName(shard), metav1.GetOptions{})
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != c.shardIdentity {
+		return
+	}
+
+	lease.Spec.HolderIdentity = nil
+	if _, err := leases.Update(lease); err != nil {
+		utilruntime.HandleError(err)
+	}
+}
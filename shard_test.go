@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newShardFixture returns a fixture for one of two instances of the
+// operator, which hold their shards with the Leases of kubeclient.
+func newShardFixture(t *testing.T, identity string, shared *fixture) *fixture {
+	f := newFixture(t, func(infra *InfraConfig) {
+		infra.Shards = 2
+		infra.ShardLeaseNamespace = metav1.NamespaceDefault
+		infra.ShardIdentity = identity
+	})
+	if shared != nil {
+		f.kubeclient = shared.kubeclient
+		f.controller.kubeclientset = shared.kubeclient
+	}
+	return f
+}
+
+func TestGetShardFor(t *testing.T) {
+	counts := map[int]int{}
+	for i := 0; i < 100; i++ {
+		namespace := fmt.Sprintf("team-%d", i)
+
+		shard := getShardFor(namespace, 3)
+		if shard < 0 || shard >= 3 {
+			t.Fatalf("want a shard between 0 and 2 for %s, got %d", namespace, shard)
+		}
+		if again := getShardFor(namespace, 3); again != shard {
+			t.Errorf("want the same shard for %s each time, got %d and %d", namespace, shard, again)
+		}
+		counts[shard]++
+	}
+
+	for shard := 0; shard < 3; shard++ {
+		if counts[shard] == 0 {
+			t.Errorf("want namespaces in every shard, got %v", counts)
+		}
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	now := time.Now()
+	holder := "operator-0"
+	empty := ""
+	duration := int32(15)
+	renewed := metav1.NewMicroTime(now.Add(-10 * time.Second))
+	stale := metav1.NewMicroTime(now.Add(-20 * time.Second))
+
+	cases := []struct {
+		name string
+		spec coordinationv1.LeaseSpec
+		want bool
+	}{
+		{"renewed", coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &duration, RenewTime: &renewed}, false},
+		{"stale", coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &duration, RenewTime: &stale}, true},
+		{"released", coordinationv1.LeaseSpec{HolderIdentity: &empty, LeaseDurationSeconds: &duration, RenewTime: &renewed}, true},
+		{"no holder", coordinationv1.LeaseSpec{LeaseDurationSeconds: &duration, RenewTime: &renewed}, true},
+		{"never renewed", coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &duration}, true},
+	}
+
+	for _, c := range cases {
+		if got := leaseExpired(&coordinationv1.Lease{Spec: c.spec}, now); got != c.want {
+			t.Errorf("%s: want %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestSyncShardLease(t *testing.T) {
+	a := newShardFixture(t, "operator-a", nil)
+	b := newShardFixture(t, "operator-b", a)
+
+	// Neither instance syncs anything until it holds a shard
+	tunnel := newTunnel("app")
+	if a.controller.ownsObject(tunnel) {
+		t.Errorf("want no objects to be owned without a shard")
+	}
+
+	a.controller.syncShardLease()
+	b.controller.syncShardLease()
+
+	if a.controller.getShard() != 0 || b.controller.getShard() != 1 {
+		t.Fatalf("want each instance to hold a shard, got %d and %d", a.controller.getShard(), b.controller.getShard())
+	}
+	if a.controller.ownsObject(tunnel) == b.controller.ownsObject(tunnel) {
+		t.Errorf("want the tunnel to be owned by exactly one instance")
+	}
+
+	// The lease is renewed rather than another shard being taken
+	a.controller.syncShardLease()
+	if a.controller.getShard() != 0 {
+		t.Errorf("want the shard to be kept, got %d", a.controller.getShard())
+	}
+
+	// A third instance takes the shard of one which stopped renewing it
+	leases := a.kubeclient.CoordinationV1().Leases(metav1.NamespaceDefault)
+	lease, err := leases.Get(getShardLeaseName(0), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting lease: %s", err.Error())
+	}
+	stale := metav1.NewMicroTime(time.Now().Add(-2 * shardLeaseDuration))
+	lease.Spec.RenewTime = &stale
+	if _, err := leases.Update(lease); err != nil {
+		t.Fatalf("error updating lease: %s", err.Error())
+	}
+
+	c := newShardFixture(t, "operator-c", a)
+	c.controller.syncShardLease()
+	if c.controller.getShard() != 0 {
+		t.Errorf("want the expired shard to be taken over, got %d", c.controller.getShard())
+	}
+
+	// The instance which lost its lease stops syncing its shard
+	a.controller.syncShardLease()
+	if a.controller.getShard() != -1 {
+		t.Errorf("want the lost shard to be dropped, got %d", a.controller.getShard())
+	}
+
+	// A released shard is taken over straight away
+	b.controller.releaseShardLease()
+	a.controller.syncShardLease()
+	if a.controller.getShard() != 1 {
+		t.Errorf("want the released shard to be taken over, got %d", a.controller.getShard())
+	}
+}
+
+func TestOwnsObjectByShardLabel(t *testing.T) {
+	f := newFixture(t, func(infra *InfraConfig) {
+		infra.Shards = 2
+		infra.ShardLabel = "team"
+	})
+
+	tunnel := newTunnel("app")
+	tunnel.Labels = map[string]string{"team": "payments"}
+
+	f.controller.setShard(getShardFor("payments", 2))
+	if !f.controller.ownsObject(tunnel) {
+		t.Errorf("want a tunnel to be owned by the shard of its label")
+	}
+
+	f.controller.setShard(1 - getShardFor("payments", 2))
+	if f.controller.ownsObject(tunnel) {
+		t.Errorf("want a tunnel not to be owned by another shard")
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// sharedExitNodeAnnotation can be set on a Service to the name of a Tunnel
+// in the same namespace, to share the exit-node of that Tunnel.
+const sharedExitNodeAnnotation = "dev.inlets.shared-exit-node"
+
+// getWildcardHostname returns the subdomain of a wildcard domain which is
+// assigned to a tunnel without a hostname.
+func getWildcardHostname(tunnel *inletsv1alpha1.Tunnel, domain string) string {
+	if len(tunnel.Spec.Hostname) > 0 || len(domain) == 0 {
+		return tunnel.Spec.Hostname
+	}
+	return tunnel.Name + "." + domain
+}
+
+func validateSharedExitNode(tunnel, owner *inletsv1alpha1.Tunnel) error {
+	if len(owner.Spec.SharedExitNode) > 0 {
+		return fmt.Errorf("tunnel %s shares the exit-node of another tunnel, so it cannot be shared", owner.Name)
+	}
+	if owner.Spec.AuthTokenFrom != nil {
+		return fmt.Errorf("tunnel %s reads its token from authTokenFrom, so it cannot be shared", owner.Name)
+	}
+	if isProTunnel(tunnel) || isProTunnel(owner) {
+		return fmt.Errorf("only HTTP tunnels can share an exit-node, since it routes requests by their Host header")
+	}
+	return nil
+}
+
+// syncSharedExitNode points a tunnel at the exit-node of the Tunnel named in
+// its sharedExitNode, with the token of that Tunnel and a subdomain of its
+// wildcard domain. The exit-node routes each request to a client by its Host
+// header. It returns true when the tunnel should not be synced any further,
+// i.e. when it was updated or the exit-node is not active yet.
+func (c *Controller) syncSharedExitNode(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	owner, err := c.tunnelsLister.Tunnels(tunnel.Namespace).Get(tunnel.Spec.SharedExitNode)
+	if err != nil && !errors.IsNotFound(err) {
+		return true, err
+	}
+
+	if err == nil {
+		if err := validateSharedExitNode(tunnel, owner); err != nil {
+			c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrInvalidSpec, err.Error())
+			return true, nil
+		}
+	}
+
+	if owner == nil || owner.Status.HostStatus != "active" || len(owner.Status.HostIP) == 0 {
+		c.tunnelLog(tunnel).Info("Waiting for shared exit-node", "sharedExitNode", tunnel.Spec.SharedExitNode)
+
+		if len(tunnel.Status.HostStatus) > 0 {
+			return true, c.updateTunnelProvisioningStatus(tunnel, "", "", "")
+		}
+		return true, nil
+	}
+
+	hostname := getWildcardHostname(tunnel, owner.Spec.WildcardDomain)
+
+	if tunnel.Status.HostStatus == "active" &&
+		tunnel.Status.HostIP == owner.Status.HostIP &&
+		tunnel.Spec.AuthToken == owner.Spec.AuthToken &&
+		tunnel.Spec.Hostname == hostname {
+		return false, nil
+	}
+
+	if tunnel.Spec.AuthToken != owner.Spec.AuthToken || tunnel.Spec.Hostname != hostname {
+		tunnelCopy := tunnel.DeepCopy()
+		tunnelCopy.Spec.AuthToken = owner.Spec.AuthToken
+		tunnelCopy.Spec.Hostname = hostname
+
+		updated, err := c.updateTunnel(tunnelCopy)
+		if err != nil {
+			return true, err
+		}
+		tunnel = updated
+	}
+
+	// The exit-node belongs to the other Tunnel, so no ID is recorded and
+	// it is not deleted along with this tunnel.
+	return true, c.updateTunnelProvisioningStatus(tunnel, "active", "", owner.Status.HostIP)
+}
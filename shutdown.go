@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// startWork records that a Tunnel is being synced, so that shutdown waits
+// for any exit-node being provisioned or deleted for it.
+func (c *Controller) startWork(key string) {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+
+	if c.inFlight[key] == 0 {
+		c.inFlightSince[key] = time.Now()
+	}
+	c.inFlight[key]++
+	c.inFlightWait.Add(1)
+}
+
+func (c *Controller) finishWork(key string) {
+	c.inFlightLock.Lock()
+	defer c.inFlightLock.Unlock()
+
+	c.inFlight[key]--
+	if c.inFlight[key] <= 0 {
+		delete(c.inFlight, key)
+		delete(c.inFlightSince, key)
+	}
+	c.inFlightWait.Done()
+}
+
+// drain waits for in-flight work to finish, so that the ID of each exit-node
+// which is provisioned is written to the status of its Tunnel before the
+// operator exits. Work still running after the timeout is logged, since the
+// exit-nodes of those Tunnels may need to be deleted by hand.
+func (c *Controller) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		c.inFlightWait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		klog.Info("Drained in-flight work")
+	case <-time.After(timeout):
+		c.inFlightLock.Lock()
+		defer c.inFlightLock.Unlock()
+
+		keys := []string{}
+		for key := range c.inFlight {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		klog.Warningf("Gave up waiting for in-flight work after %s, check the exit-nodes of: %s",
+			timeout, strings.Join(keys, ", "))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"time"
+)
+
+// sloWindows are the windows over which the ratio of exit-nodes which were
+// ready within --ready-slo is reported, in pairs of a short and a long
+// window for alerts on the rate at which the error budget is burnt.
+var sloWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"6h", 6 * time.Hour},
+}
+
+// readyEventRetention is how long the time to ready of each exit-node is
+// kept for, which is the longest of the sloWindows.
+const readyEventRetention = 6 * time.Hour
+
+// provisioningStart is when an exit-node started provisioning, with which
+// provider.
+type provisioningStart struct {
+	since    time.Time
+	provider string
+}
+
+// readyEvent is an exit-node which became ready, and how long it took.
+type readyEvent struct {
+	at   time.Time
+	took time.Duration
+}
+
+// observeReady records how long an exit-node of a provider took to become
+// ready. It is called with the lock held.
+func (m *operatorMetrics) observeReady(provider string, took time.Duration) {
+	now := time.Now()
+	events := append(m.readyEvents[provider], readyEvent{at: now, took: took})
+
+	first := 0
+	for first < len(events) && now.Sub(events[first].at) > readyEventRetention {
+		first++
+	}
+	m.readyEvents[provider] = events[first:]
+}
+
+// writeReadySLO writes the fraction of exit-nodes which became ready
+// within --ready-slo over each of the sloWindows, and the rate at which
+// the error budget of --ready-slo-target is burnt, for each provider. An
+// exit-node which is still provisioning after the objective counts as
+// missing it straight away, so that a provider which is stuck shows up
+// before its exit-nodes become ready.
+func (c *Controller) writeReadySLO(w io.Writer) {
+	objective := c.infra().ReadySLO
+	target := c.infra().ReadySLOTarget
+	if objective <= 0 {
+		return
+	}
+
+	now := time.Now()
+	m := c.metrics
+	m.lock.Lock()
+
+	providers := map[string]bool{}
+	for provider := range m.readyEvents {
+		providers[provider] = true
+	}
+	for _, start := range m.provisioningSince {
+		providers[start.provider] = true
+	}
+	sorted := []string{}
+	for provider := range providers {
+		sorted = append(sorted, provider)
+	}
+	sort.Strings(sorted)
+
+	ratios := []metricSample{}
+	burnRates := []metricSample{}
+	for _, provider := range sorted {
+		for _, window := range sloWindows {
+			total, met := 0.0, 0.0
+			for _, event := range m.readyEvents[provider] {
+				if now.Sub(event.at) > window.duration {
+					continue
+				}
+				total++
+				if event.took <= objective {
+					met++
+				}
+			}
+			for _, start := range m.provisioningSince {
+				if start.provider == provider && now.Sub(start.since) > objective {
+					total++
+				}
+			}
+			if total == 0 {
+				continue
+			}
+
+			sampleLabels := map[string]string{"provider": provider, "window": window.name}
+			ratio := met / total
+			ratios = append(ratios, metricSample{Labels: sampleLabels, Value: ratio})
+			if target < 1 {
+				burnRates = append(burnRates, metricSample{Labels: sampleLabels, Value: (1 - ratio) / (1 - target)})
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	writeGauge(w, "inlets_operator_exit_node_ready_slo_objective_seconds",
+		"The time within which exit-nodes should become ready, from --ready-slo.",
+		[]metricSample{{Value: objective.Seconds()}})
+	writeGauge(w, "inlets_operator_exit_node_ready_slo_target",
+		"The fraction of exit-nodes which should become ready within the objective, from --ready-slo-target.",
+		[]metricSample{{Value: target}})
+	writeGauge(w, "inlets_operator_exit_node_ready_slo_ratio",
+		"Fraction of exit-nodes which became ready within the objective, by provider and window.", ratios)
+	writeGauge(w, "inlets_operator_exit_node_ready_slo_burn_rate",
+		"Rate at which the error budget of the objective is being used, by provider and window, where 1 uses it up exactly.", burnRates)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+const (
+	// rotateSSHKeyAnnotation can be set to "true" on a Tunnel to rotate the
+	// SSH key of its exit-node straight away.
+	rotateSSHKeyAnnotation = "dev.inlets.rotate-ssh-key"
+
+	// sshKeyCreatedAnnotation records when the key in an SSH key Secret was
+	// generated.
+	sshKeyCreatedAnnotation = "dev.inlets.ssh-key-created-at"
+)
+
+// getSSHKeySecretName returns the name of the Secret with the SSH key of
+// the exit-node of a tunnel.
+func getSSHKeySecretName(tunnel *inletsv1alpha1.Tunnel) string {
+	return tunnel.Name + "-ssh"
+}
+
+// generateSSHKey returns a new ECDSA key as PEM, and its public key in the
+// format of authorized_keys.
+func generateSSHKey() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The wire format of an ecdsa-sha2-nistp256 public key, since
+	// golang.org/x/crypto/ssh is not vendored
+	wire := &bytes.Buffer{}
+	for _, value := range [][]byte{
+		[]byte("ecdsa-sha2-nistp256"),
+		[]byte("nistp256"),
+		elliptic.Marshal(key.Curve, key.X, key.Y),
+	} {
+		binary.Write(wire, binary.BigEndian, uint32(len(value)))
+		wire.Write(value)
+	}
+	publicKey := "ecdsa-sha2-nistp256 " + base64.StdEncoding.EncodeToString(wire.Bytes()) + " inlets-operator\n"
+
+	return encodePEM("EC PRIVATE KEY", privateKey), []byte(publicKey), nil
+}
+
+// writeSSHKey generates a new SSH key for a tunnel, and creates its Secret
+// or replaces the key in it.
+func (c *Controller) writeSSHKey(tunnel *inletsv1alpha1.Tunnel, secret *corev1.Secret) (*corev1.Secret, error) {
+	privateKey, publicKey, err := generateSSHKey()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace)
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+
+	if secret != nil {
+		secretCopy := secret.DeepCopy()
+		if secretCopy.Annotations == nil {
+			secretCopy.Annotations = map[string]string{}
+		}
+		secretCopy.Annotations[sshKeyCreatedAnnotation] = createdAt
+		secretCopy.Data = map[string][]byte{"id_ecdsa": privateKey, "id_ecdsa.pub": publicKey}
+		return secrets.Update(secretCopy)
+	}
+
+	return secrets.Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        getSSHKeySecretName(tunnel),
+			Namespace:   tunnel.Namespace,
+			Annotations: map[string]string{sshKeyCreatedAnnotation: createdAt},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(tunnel, schema.GroupVersionKind{
+					Group:   inletsv1alpha1.SchemeGroupVersion.Group,
+					Version: inletsv1alpha1.SchemeGroupVersion.Version,
+					Kind:    "Tunnel",
+				}),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{"id_ecdsa": privateKey, "id_ecdsa.pub": publicKey},
+	})
+}
+
+// addSSHKeyUserdata authorizes the SSH key of a tunnel for root on its
+// exit-node when --ssh-keys is set, generating the key the first time.
+// The key is added with the userdata, so that it works with every provider.
+func (c *Controller) addSSHKeyUserdata(tunnel *inletsv1alpha1.Tunnel, host *provision.BasicHost) error {
+	if !c.infra().SSHKeys {
+		return nil
+	}
+
+	secret, err := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace).Get(getSSHKeySecretName(tunnel), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		secret, err = c.writeSSHKey(tunnel, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	host.UserData += `
+
+mkdir -p /root/.ssh && chmod 700 /root/.ssh
+cat > /root/.ssh/authorized_keys <<'EOF'
+` + string(secret.Data["id_ecdsa.pub"]) + `EOF
+chmod 600 /root/.ssh/authorized_keys`
+
+	return nil
+}
+
+// syncSSHKey rotates the SSH key of a tunnel when it is older than
+// --ssh-key-max-age or the rotate-ssh-key annotation is set, then replaces
+// the exit-node once its key is older than the one in the Secret, since
+// the key can only be changed by provisioning a new exit-node. Exit-nodes
+// provisioned before --ssh-keys was set have no key to rotate. It returns
+// true when the tunnel should not be synced any further.
+func (c *Controller) syncSSHKey(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	if !c.infra().SSHKeys || len(tunnel.Status.HostID) == 0 || tunnel.Status.Replacement != nil ||
+		tunnel.Status.ProvisionedAt == nil {
+		return false, nil
+	}
+
+	secret, err := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace).Get(getSSHKeySecretName(tunnel), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	createdAt, _ := time.Parse(time.RFC3339, secret.Annotations[sshKeyCreatedAnnotation])
+	maxAge := c.infra().SSHKeyMaxAge
+	requested := tunnel.Annotations[rotateSSHKeyAnnotation] == "true"
+
+	if requested || (maxAge > 0 && time.Since(createdAt) >= maxAge) {
+		c.tunnelLog(tunnel).Info("Rotating ssh key")
+		if _, err := c.writeSSHKey(tunnel, secret); err != nil {
+			return true, err
+		}
+
+		if requested {
+			tunnelCopy := tunnel.DeepCopy()
+			delete(tunnelCopy.Annotations, rotateSSHKeyAnnotation)
+			_, err := c.updateTunnel(tunnelCopy)
+			return true, err
+		}
+		c.enqueueTunnel(tunnel)
+		return true, nil
+	}
+
+	if !createdAt.After(tunnel.Status.ProvisionedAt.Time) {
+		return false, nil
+	}
+
+	c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessSSHKeyRotated,
+		"Replacing exit-node %s to rotate its SSH key", tunnel.Status.HostIP)
+	c.notifyTunnel(tunnel, notifySSHKeyRotated, "SSHKeyRotation",
+		fmt.Sprintf("Replacing exit-node %s to rotate its SSH key", tunnel.Status.HostIP))
+
+	if c.usesBlueGreen(tunnel) {
+		return true, c.startReplacement(tunnel, tunnel.Spec.AuthToken, "SSHKeyRotation")
+	}
+	return true, c.deleteExitNode(tunnel, "ssh-key-rotation")
+}
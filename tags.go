@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// The tags which the operator adds to every exit-node, so that its
+// exit-nodes can be listed with a filter of the provider, and an exit-node
+// which was provisioned for a tunnel, but not recorded in its status, can
+// be found again.
+const (
+	managedByTag   = "managed-by"
+	managedByValue = "inlets-operator"
+	tunnelTag      = "inlets-tunnel"
+	tokenTag       = "inlets-token"
+)
+
+// getManagedTags returns the tags which mark an exit-node as provisioned
+// by the operator for a tunnel with its token.
+func getManagedTags(tunnel *inletsv1alpha1.Tunnel) map[string]string {
+	return map[string]string{
+		managedByTag: managedByValue,
+		tunnelTag:    tunnel.Namespace + "." + tunnel.Name,
+		tokenTag:     getTokenChecksum(tunnel.Spec.AuthToken),
+	}
+}
+
+// getExitNodeTags returns the tags for the exit-node of a tunnel, which are
+// the tags of the operator and those copied from the labels and annotations
+// named by --tag-labels. The Tunnel is looked at first, then its Service.
+func (c *Controller) getExitNodeTags(tunnel *inletsv1alpha1.Tunnel) map[string]string {
+	tags := getManagedTags(tunnel)
+	if operation := tunnel.Status.Operation; operation != nil {
+		tags[operationTag] = operation.ID
+	}
+	if len(c.infra().TagLabels) == 0 {
+		return tags
+	}
+
+	sources := []map[string]string{tunnel.Labels, tunnel.Annotations}
+	if service, _ := c.getTunnelService(tunnel); service != nil {
+		sources = append(sources, service.Labels, service.Annotations)
+	}
+
+	for key, tag := range c.infra().TagLabels {
+		if _, ok := tags[tag]; ok {
+			continue
+		}
+		for _, source := range sources {
+			if value, ok := source[key]; ok {
+				tags[tag] = value
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// getTagKeys returns the keys of the tags which the operator sets, so that
+// a tag with one of them which no longer applies is removed.
+func (c *Controller) getTagKeys() []string {
+	keys := []string{managedByTag, tunnelTag, tokenTag}
+	for _, tag := range c.infra().TagLabels {
+		keys = append(keys, tag)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// tagBatch is the tags for the exit-nodes of one provisioner.
+type tagBatch struct {
+	provider string
+	tags     map[string]map[string]string
+}
+
+// syncExitNodeTags sets the tags of the active exit-nodes of Tunnels in
+// this shard to those they would be provisioned with, i.e. after a label
+// of --tag-labels changed. The changes are coalesced for each provider and
+// made by one call to provision.Tagger for each sync, which reads the
+// current tags from the list of exit-nodes shared with the orphan check,
+// rather than with a call for each Tunnel when it is synced.
+func (c *Controller) syncExitNodeTags() {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	batches := map[provision.Provisioner]*tagBatch{}
+	for _, tunnel := range tunnels {
+		if !c.ownsObject(tunnel) || tunnel.Status.HostStatus != "active" || len(tunnel.Status.HostID) == 0 {
+			continue
+		}
+
+		provisioner, err := c.getTunnelProvisioner(tunnel)
+		if err != nil {
+			continue
+		}
+		if _, ok := provisioner.(provision.Tagger); !ok {
+			continue
+		}
+
+		batch, ok := batches[provisioner]
+		if !ok {
+			batch = &tagBatch{provider: c.getTunnelProvider(tunnel), tags: map[string]map[string]string{}}
+			batches[provisioner] = batch
+		}
+		batch.tags[tunnel.Status.HostID] = c.getExitNodeTags(tunnel)
+	}
+
+	keys := c.getTagKeys()
+	for provisioner, batch := range batches {
+		hosts, err := provision.ListHosts(provisioner, c.getManagedFilter(batch.provider))
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("error listing exit-nodes of %s: %s", batch.provider, err.Error()))
+			continue
+		}
+
+		err = provisioner.(provision.Tagger).SetTags(hosts, batch.tags, keys)
+		provision.ForgetHosts(provisioner)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("error tagging exit-nodes of %s: %s", batch.provider, err.Error()))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+#!/bin/bash
+export INLETSTOKEN="golden-token"
+export CONTROLPORT="8080"
+
+curl -sLSf "https://github.com/inlets/inlets/releases/download/2.7.4/inlets" -o /tmp/inlets && \
+	echo "0000000000000000000000000000000000000000000000000000000000000000  /tmp/inlets" | sha256sum -c --quiet - && \
+	chmod +x /tmp/inlets && \
+	mv /tmp/inlets /usr/local/bin/inlets
+
+echo "AUTHTOKEN=$INLETSTOKEN" > /etc/default/inlets
+echo "CONTROLPORT=$CONTROLPORT" >> /etc/default/inlets
+
+cat > /etc/systemd/system/inlets.service <<'EOF'
+[Unit]
+Description=inlets server
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+EnvironmentFile=/etc/default/inlets
+ExecStart=/usr/local/bin/inlets server --port=80 --control-port=${CONTROLPORT} --token=${AUTHTOKEN}
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start inlets && \
+	systemctl enable inlets
+
+iptables -A INPUT -i lo -j ACCEPT
+iptables -A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+iptables -A INPUT -s 192.0.2.0/24 -p tcp --dport 8080 -j ACCEPT
+iptables -A INPUT -p tcp --dport 8080 -j DROP
+ip6tables -A INPUT -i lo -j ACCEPT
+ip6tables -A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+ip6tables -A INPUT -p tcp --dport 8080 -j DROP
\ No newline at end of file
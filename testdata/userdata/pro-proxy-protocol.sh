@@ -0,0 +1,39 @@
+#!/bin/bash
+export AUTHTOKEN="golden-token"
+export CONTROLPORT="8123"
+export PROXYPROTOCOL="v2"
+export IP=$(curl -sfSL https://checkip.amazonaws.com)
+
+curl -sLSf "https://github.com/inlets/inlets-pro/releases/download/0.5.1/inlets-pro" -o /tmp/inlets-pro && \
+	echo "0000000000000000000000000000000000000000000000000000000000000000  /tmp/inlets-pro" | sha256sum -c --quiet - && \
+	chmod +x /tmp/inlets-pro && \
+	mv /tmp/inlets-pro /usr/local/bin/inlets-pro
+
+cat > /etc/systemd/system/inlets-pro.service <<EOF
+[Unit]
+Description=inlets-pro server
+After=network.target
+
+[Service]
+Type=simple
+Restart=always
+RestartSec=2
+ExecStart=/usr/local/bin/inlets-pro server --auto-tls --common-name=$IP --control-port=$CONTROLPORT --token=$AUTHTOKEN --proxy-protocol=$PROXYPROTOCOL
+
+[Install]
+WantedBy=multi-user.target
+EOF
+
+systemctl start inlets-pro && \
+	systemctl enable inlets-pro
+
+iptables -A INPUT -i lo -j ACCEPT
+iptables -A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+iptables -A INPUT -s 192.0.2.0/24 -p tcp --dport 8123 -j ACCEPT
+iptables -A INPUT -p tcp --dport 8123 -j DROP
+iptables -A INPUT -s 198.51.100.0/24 -j ACCEPT
+iptables -A INPUT -j DROP
+ip6tables -A INPUT -i lo -j ACCEPT
+ip6tables -A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+ip6tables -A INPUT -p tcp --dport 8123 -j DROP
+ip6tables -A INPUT -j DROP
\ No newline at end of file
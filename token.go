@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math"
+)
+
+const (
+	// minTokenLength and maxTokenLength bound the number of random bytes in
+	// a generated token.
+	minTokenLength = 32
+	maxTokenLength = 64
+
+	// minTokenEntropy is the least estimated entropy in bits of a token set
+	// on a Tunnel by hand.
+	minTokenEntropy = 128
+)
+
+// generateAuthToken returns a new token for the inlets server, made of
+// --token-length random bytes encoded as base64url.
+func (c *Controller) generateAuthToken() (string, error) {
+	length := c.infra().TokenLength
+	if length == 0 {
+		length = minTokenLength
+	}
+
+	data := make([]byte, length)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// validateAuthToken rejects tokens which are too weak to protect the
+// exit-node. The entropy of a token is estimated from its length and the
+// number of distinct characters in it, so that tokens such as "aaaa..."
+// or "password" are rejected.
+func validateAuthToken(token string) error {
+	distinct := map[rune]bool{}
+	for _, r := range token {
+		distinct[r] = true
+	}
+
+	entropy := float64(len([]rune(token))) * math.Log2(float64(len(distinct)))
+	if len(distinct) == 0 || entropy < minTokenEntropy {
+		return fmt.Errorf("authToken has an estimated entropy of %.0f bits, it must have at least %d bits, leave it empty to have one generated",
+			math.Max(entropy, 0), minTokenEntropy)
+	}
+	return nil
+}
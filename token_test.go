@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestGenerateAuthToken(t *testing.T) {
+	f := newFixture(t)
+
+	for _, length := range []int{0, 48} {
+		f.controller.infra().TokenLength = length
+
+		token, err := f.controller.generateAuthToken()
+		if err != nil {
+			t.Fatalf("generateAuthToken: %s", err.Error())
+		}
+
+		data, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			t.Fatalf("want a base64url token, got %q: %s", token, err.Error())
+		}
+
+		want := length
+		if want == 0 {
+			want = minTokenLength
+		}
+		if len(data) != want {
+			t.Errorf("--token-length=%d: want %d random bytes, got %d", length, want, len(data))
+		}
+		if err := validateAuthToken(token); err != nil {
+			t.Errorf("want a generated token to be valid, got %s", err.Error())
+		}
+	}
+
+	first, _ := f.controller.generateAuthToken()
+	second, _ := f.controller.generateAuthToken()
+	if first == second {
+		t.Errorf("want a new token each time, got %q twice", first)
+	}
+}
+
+func TestValidateAuthToken(t *testing.T) {
+	tests := []struct {
+		token string
+		valid bool
+	}{
+		{token: "", valid: false},
+		{token: "password", valid: false},
+		{token: strings.Repeat("a", 256), valid: false},
+		{token: "0123456789abcdef", valid: false},
+		{token: "abcdefghijklmnopqrstuvwxyzABCDEF", valid: true},
+		{token: "yRvmk7J2xQ0bZ_3Lw9TnA-dHcUe5sPgV", valid: true},
+	}
+
+	for _, test := range tests {
+		err := validateAuthToken(test.token)
+		if test.valid && err != nil {
+			t.Errorf("%q: want a valid token, got %s", test.token, err.Error())
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: want a weak token to be rejected", test.token)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// validateAuthTokenFrom checks that the authTokenFrom of a tunnel names
+// exactly one Secret key or Key Vault secret. The token can't be changed by
+// the operator, so it can't be rotated or taken from a shared exit-node.
+func validateAuthTokenFrom(tunnel *inletsv1alpha1.Tunnel) error {
+	from := tunnel.Spec.AuthTokenFrom
+
+	if len(tunnel.Spec.AuthToken) > 0 {
+		return fmt.Errorf("authToken and authTokenFrom cannot both be set")
+	}
+	if len(tunnel.Spec.SharedExitNode) > 0 {
+		return fmt.Errorf("authTokenFrom cannot be set with sharedExitNode, which uses the token of the shared exit-node")
+	}
+	if len(tunnel.Spec.RotationPolicy) > 0 {
+		return fmt.Errorf("rotationPolicy cannot be set with authTokenFrom, change the token where authTokenFrom reads it instead")
+	}
+
+	if (from.SecretKeyRef == nil) == (len(from.KeyVaultSecret) == 0) {
+		return fmt.Errorf("authTokenFrom must set one of secretKeyRef or keyVaultSecret")
+	}
+	if from.SecretKeyRef != nil {
+		if len(from.SecretKeyRef.Name) == 0 || len(from.SecretKeyRef.Key) == 0 {
+			return fmt.Errorf("authTokenFrom.secretKeyRef must set a name and a key")
+		}
+		return nil
+	}
+	return parseKeyVaultSecretURL(from.KeyVaultSecret)
+}
+
+// resolveAuthToken reads the token of a tunnel from its authTokenFrom, i.e.
+// from a Secret in the namespace of the tunnel or from Azure Key Vault with
+// the identity of the operator.
+func (c *Controller) resolveAuthToken(tunnel *inletsv1alpha1.Tunnel) (string, error) {
+	from := tunnel.Spec.AuthTokenFrom
+
+	var token string
+	if from.SecretKeyRef != nil {
+		secret, err := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace).Get(from.SecretKeyRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("unable to read the token from Secret %s: %s", from.SecretKeyRef.Name, err)
+		}
+		value, ok := secret.Data[from.SecretKeyRef.Key]
+		if !ok {
+			return "", fmt.Errorf("Secret %s has no key %q for the token", from.SecretKeyRef.Name, from.SecretKeyRef.Key)
+		}
+		token = string(value)
+	} else {
+		if c.infra().KeyVaultSecrets == nil {
+			return "", fmt.Errorf("the operator is not configured to read secrets from Azure Key Vault")
+		}
+		value, err := c.infra().KeyVaultSecrets.GetSecret(from.KeyVaultSecret)
+		if err != nil {
+			return "", fmt.Errorf("unable to read the token from Key Vault: %s", err)
+		}
+		token = value
+	}
+
+	token = strings.TrimSpace(token)
+	if len(token) == 0 {
+		return "", fmt.Errorf("the token in authTokenFrom is empty")
+	}
+	return token, nil
+}
+
+// syncReferencedToken reads the token of a tunnel with authTokenFrom and
+// returns a copy of the tunnel with the token, which is never written back
+// to the Tunnel. When the token changed since the exit-node was
+// provisioned, the exit-node is deleted so that one with the new token is
+// provisioned, and nil is returned as the tunnel should not be synced any
+// further.
+func (c *Controller) syncReferencedToken(tunnel *inletsv1alpha1.Tunnel) (*inletsv1alpha1.Tunnel, error) {
+	token, err := c.resolveAuthToken(tunnel)
+	if err != nil {
+		c.recorder.Event(tunnel, corev1.EventTypeWarning, ErrTokenNotResolved, err.Error())
+		return nil, err
+	}
+
+	// The token Secret of the client has the token which the exit-node was
+	// provisioned with, when the operator restarted since
+	previous, ok := c.getCachedToken(tunnel)
+	if !ok {
+		secret, err := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace).Get(getTokenSecretName(tunnel), metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			previous = string(secret.Data["token"])
+		}
+	}
+
+	// The token is only cached once the exit-node was deleted, so that the
+	// change is found again and the delete retried when it fails.
+	if len(previous) > 0 && previous != token && len(tunnel.Status.HostID) > 0 {
+		c.tunnelLog(tunnel).Info("Replacing exit-node whose token changed in authTokenFrom", "ip", tunnel.Status.HostIP)
+		if err := c.deleteExitNode(tunnel, "token-changed"); err != nil {
+			return nil, err
+		}
+
+		c.cacheToken(tunnel, token)
+		c.recorder.Eventf(tunnel, corev1.EventTypeNormal, SuccessTokenChanged,
+			"Replacing exit-node %s, since its token changed in authTokenFrom", tunnel.Status.HostIP)
+		return nil, nil
+	}
+
+	c.cacheToken(tunnel, token)
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Spec.AuthToken = token
+	return tunnelCopy, nil
+}
+
+// updateTunnel writes the spec of a tunnel, without the token of a tunnel
+// with authTokenFrom, which is only kept by the operator in memory.
+func (c *Controller) updateTunnel(tunnel *inletsv1alpha1.Tunnel) (*inletsv1alpha1.Tunnel, error) {
+	if tunnel.Spec.AuthTokenFrom != nil && len(tunnel.Spec.AuthToken) > 0 {
+		tunnel = tunnel.DeepCopy()
+		tunnel.Spec.AuthToken = ""
+	}
+	return c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).Update(tunnel)
+}
+
+// getRecordedToken returns the token to record in the status of a tunnel
+// for an exit-node, which is empty for a tunnel with authTokenFrom, as its
+// token is read again instead.
+func getRecordedToken(tunnel *inletsv1alpha1.Tunnel, token string) string {
+	if tunnel.Spec.AuthTokenFrom != nil {
+		return ""
+	}
+	return token
+}
+
+// withCachedToken returns a copy of a tunnel with authTokenFrom with the
+// token last read for it, for checks outside of a sync. It returns false
+// when the token was not read yet.
+func (c *Controller) withCachedToken(tunnel *inletsv1alpha1.Tunnel) (*inletsv1alpha1.Tunnel, bool) {
+	if tunnel.Spec.AuthTokenFrom == nil {
+		return tunnel, true
+	}
+
+	token, ok := c.getCachedToken(tunnel)
+	if !ok {
+		return nil, false
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Spec.AuthToken = token
+	return tunnelCopy, true
+}
+
+func (c *Controller) getCachedToken(tunnel *inletsv1alpha1.Tunnel) (string, bool) {
+	c.tokensLock.Lock()
+	defer c.tokensLock.Unlock()
+
+	token, ok := c.tokens[tunnel.Namespace+"/"+tunnel.Name]
+	return token, ok
+}
+
+func (c *Controller) cacheToken(tunnel *inletsv1alpha1.Tunnel, token string) {
+	c.tokensLock.Lock()
+	defer c.tokensLock.Unlock()
+
+	c.tokens[tunnel.Namespace+"/"+tunnel.Name] = token
+}
+
+// forgetToken drops the token of a deleted tunnel from the cache.
+func (c *Controller) forgetToken(tunnel *inletsv1alpha1.Tunnel) {
+	c.tokensLock.Lock()
+	defer c.tokensLock.Unlock()
+
+	delete(c.tokens, tunnel.Namespace+"/"+tunnel.Name)
+}
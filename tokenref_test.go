@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	referencedToken = "referenced-0123456789012345678901234567890123456789012345678901"
+	changedToken    = "changed-0123456789012345678901234567890123456789012345678901234"
+)
+
+// fakeKeyVault returns the secrets of Key Vault from a map.
+type fakeKeyVault map[string]string
+
+func (v fakeKeyVault) GetSecret(secretURL string) (string, error) {
+	value, ok := v[secretURL]
+	if !ok {
+		return "", fmt.Errorf("secret %s not found", secretURL)
+	}
+	return value, nil
+}
+
+func newTokenSecret(name, token string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: metav1.NamespaceDefault},
+		Data:       map[string][]byte{"token": []byte(token + "\n")},
+	}
+}
+
+func newSecretRefTunnel(name, secretName string) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel(name)
+	tunnel.Spec.AuthTokenFrom = &inletsv1alpha1.TunnelTokenSource{
+		SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+			Key:                  "token",
+		},
+	}
+	return tunnel
+}
+
+// syncActive syncs a tunnel with a token in a Secret until its exit-node is
+// active, then once more to write its token Secret and client.
+func (f *fixture) syncActive(name string) *inletsv1alpha1.Tunnel {
+	if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Get(name, metav1.GetOptions{}); err != nil {
+		service := newPortsService(corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP})
+		if _, err := f.kubeclient.CoreV1().Services(metav1.NamespaceDefault).Create(service); err != nil {
+			f.t.Fatalf("error creating service: %s", err.Error())
+		}
+		f.kubeInformers.Core().V1().Services().Informer().GetIndexer().Add(service)
+	}
+
+	f.syncUntil(name, "active")
+	if err := f.sync(name); err != nil {
+		f.t.Fatalf("error syncing tunnel: %s", err.Error())
+	}
+	return f.get(name)
+}
+
+// hostHasToken returns whether the userdata of an exit-node has a token.
+func (f *fixture) hostHasToken(id, token string) bool {
+	host, ok := f.provisioner.Host(id)
+	return ok && strings.Contains(host.UserData, token)
+}
+
+func TestValidateAuthTokenFrom(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(tunnel *inletsv1alpha1.Tunnel)
+		want   string
+	}{
+		{"secret", func(tunnel *inletsv1alpha1.Tunnel) {}, ""},
+		{"key vault", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.AuthTokenFrom = &inletsv1alpha1.TunnelTokenSource{KeyVaultSecret: "https://my-vault.vault.azure.net/secrets/inlets-token"}
+		}, ""},
+		{"both sources", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.AuthTokenFrom.KeyVaultSecret = "https://my-vault.vault.azure.net/secrets/inlets-token"
+		}, "one of secretKeyRef or keyVaultSecret"},
+		{"no source", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.AuthTokenFrom = &inletsv1alpha1.TunnelTokenSource{}
+		}, "one of secretKeyRef or keyVaultSecret"},
+		{"no key", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.AuthTokenFrom.SecretKeyRef.Key = ""
+		}, "a name and a key"},
+		{"not key vault", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.AuthTokenFrom = &inletsv1alpha1.TunnelTokenSource{KeyVaultSecret: "https://example.com/secrets/inlets-token"}
+		}, "URL of an Azure Key Vault secret"},
+		{"key vault key", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.AuthTokenFrom = &inletsv1alpha1.TunnelTokenSource{KeyVaultSecret: "https://my-vault.vault.azure.net/keys/inlets-operator"}
+		}, "URL of an Azure Key Vault secret"},
+		{"authToken", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.AuthToken = referencedToken
+		}, "cannot both be set"},
+		{"rotationPolicy", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.RotationPolicy = "daily"
+		}, "rotationPolicy"},
+		{"sharedExitNode", func(tunnel *inletsv1alpha1.Tunnel) {
+			tunnel.Spec.SharedExitNode = "other"
+		}, "sharedExitNode"},
+	}
+
+	for _, c := range cases {
+		tunnel := newSecretRefTunnel("app", "app-credentials")
+		c.change(tunnel)
+
+		err := validateAuthTokenFrom(tunnel)
+		if len(c.want) == 0 && err != nil {
+			t.Errorf("%s: want no error, got %s", c.name, err.Error())
+		}
+		if len(c.want) > 0 && (err == nil || !strings.Contains(err.Error(), c.want)) {
+			t.Errorf("%s: want an error with %q, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestSyncReadsTokenFromSecret(t *testing.T) {
+	f := newFixture(t)
+	f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Create(newTokenSecret("app-credentials", referencedToken))
+	f.create(newSecretRefTunnel("app", "app-credentials"))
+
+	tunnel := f.syncActive("app")
+
+	if len(tunnel.Spec.AuthToken) > 0 {
+		t.Errorf("want the token not to be written to the Tunnel, got %q", tunnel.Spec.AuthToken)
+	}
+	if !f.hostHasToken(tunnel.Status.HostID, referencedToken) {
+		t.Errorf("want the exit-node to be provisioned with the token from the Secret")
+	}
+
+	secret, err := f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Get("app-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting token Secret: %s", err.Error())
+	}
+	if string(secret.Data["token"]) != referencedToken {
+		t.Errorf("want the client to get the token from the Secret, got %q", string(secret.Data["token"]))
+	}
+}
+
+func TestSyncReplacesExitNodeWhenReferencedTokenChanges(t *testing.T) {
+	f := newFixture(t)
+	recorder := record.NewFakeRecorder(100)
+	f.controller.recorder = recorder
+
+	f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Create(newTokenSecret("app-credentials", referencedToken))
+	f.create(newSecretRefTunnel("app", "app-credentials"))
+	old := f.syncActive("app")
+
+	// The token of the exit-node is found in the token Secret after a
+	// restart of the operator
+	f.controller.forgetToken(old)
+	f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Update(newTokenSecret("app-credentials", changedToken))
+
+	if err := f.sync("app"); err != nil {
+		t.Fatalf("error syncing tunnel: %s", err.Error())
+	}
+	if _, ok := f.provisioner.Host(old.Status.HostID); ok {
+		t.Errorf("want the exit-node with the old token to be deleted")
+	}
+
+	found := false
+	for len(recorder.Events) > 0 {
+		if strings.Contains(<-recorder.Events, SuccessTokenChanged) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("want a %s event", SuccessTokenChanged)
+	}
+
+	tunnel := f.syncActive("app")
+	if tunnel.Status.HostID == old.Status.HostID || !f.hostHasToken(tunnel.Status.HostID, changedToken) {
+		t.Errorf("want a new exit-node with the new token, got %q", tunnel.Status.HostID)
+	}
+	if len(tunnel.Spec.AuthToken) > 0 {
+		t.Errorf("want the token not to be written to the Tunnel, got %q", tunnel.Spec.AuthToken)
+	}
+}
+
+func TestSyncReadsTokenFromKeyVault(t *testing.T) {
+	secretURL := "https://my-vault.vault.azure.net/secrets/inlets-token"
+	f := newFixture(t, func(infra *InfraConfig) {
+		infra.KeyVaultSecrets = fakeKeyVault{secretURL: referencedToken}
+	})
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthTokenFrom = &inletsv1alpha1.TunnelTokenSource{KeyVaultSecret: secretURL}
+	f.create(tunnel)
+
+	tunnel = f.syncUntil("app", "active")
+
+	if len(tunnel.Spec.AuthToken) > 0 {
+		t.Errorf("want the token not to be written to the Tunnel, got %q", tunnel.Spec.AuthToken)
+	}
+	if !f.hostHasToken(tunnel.Status.HostID, referencedToken) {
+		t.Errorf("want the exit-node to be provisioned with the token from Key Vault")
+	}
+}
+
+func TestSyncHoldsTunnelWithoutReferencedToken(t *testing.T) {
+	f := newFixture(t)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	f.create(newSecretRefTunnel("app", "missing"))
+
+	if err := f.sync("app"); err == nil {
+		t.Errorf("want an error to retry the sync")
+	}
+	if got := f.provisioner.Calls("Provision"); got != 0 {
+		t.Errorf("want no exit-node without a token, got %d calls to Provision", got)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, ErrTokenNotResolved) {
+			t.Errorf("want a %s event, got %q", ErrTokenNotResolved, event)
+		}
+	default:
+		t.Errorf("want a %s event", ErrTokenNotResolved)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	// tokenEnv is the environment variable of the client with its token,
+	// which is read from the token Secret of its tunnel.
+	tokenEnv = "INLETS_TOKEN"
+
+	// tokenChecksumAnnotation is set on the Pod template of the client to
+	// a checksum of its token, so that the client is restarted when the
+	// token changes.
+	tokenChecksumAnnotation = "dev.inlets.token-checksum"
+
+	// licenseEnv is the environment variable of an inlets-pro client with
+	// the license, which is read from the token Secret of its tunnel.
+	licenseEnv = "INLETS_LICENSE"
+
+	// licenseChecksumAnnotation is set on the Pod template of an
+	// inlets-pro client to a checksum of the license, so that the client is
+	// restarted when the license changes.
+	licenseChecksumAnnotation = "dev.inlets.license-checksum"
+)
+
+// getTokenSecretName returns the name of the Secret with the token of a
+// tunnel, which its client reads.
+func getTokenSecretName(tunnel *inletsv1alpha1.Tunnel) string {
+	return tunnel.Name + "-token"
+}
+
+func getTokenChecksum(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// syncTokenSecret writes the token of a tunnel into its own Secret, which
+// is owned by the Tunnel, along with the license when its client uses
+// inlets-pro and its TunnelClass sets copyLicense. The Secret is not sealed
+// with --kms-key, since the client reads it.
+func (c *Controller) syncTokenSecret(tunnel *inletsv1alpha1.Tunnel) error {
+	secrets := c.kubeclientset.CoreV1().Secrets(tunnel.Namespace)
+	data := map[string][]byte{"token": []byte(tunnel.Spec.AuthToken)}
+	if isProTunnel(tunnel) && c.copiesLicense(tunnel) {
+		data["license"] = []byte(c.infra().GetLicense())
+	}
+
+	secret, err := secrets.Get(getTokenSecretName(tunnel), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = secrets.Create(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      getTokenSecretName(tunnel),
+				Namespace: tunnel.Namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					*metav1.NewControllerRef(tunnel, schema.GroupVersionKind{
+						Group:   inletsv1alpha1.SchemeGroupVersion.Group,
+						Version: inletsv1alpha1.SchemeGroupVersion.Version,
+						Kind:    "Tunnel",
+					}),
+				},
+			},
+			Type: corev1.SecretTypeOpaque,
+			Data: data,
+		})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if reflect.DeepEqual(secret.Data, data) {
+		return nil
+	}
+
+	secretCopy := secret.DeepCopy()
+	secretCopy.Data = data
+	_, err = secrets.Update(secretCopy)
+	return err
+}
+
+// addTokenEnv gives the first container of a client the token of its
+// tunnel from the token Secret, and records its checksum on the Pod
+// template.
+func addTokenEnv(template *corev1.PodTemplateSpec, tunnel *inletsv1alpha1.Tunnel) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[tokenChecksumAnnotation] = getTokenChecksum(tunnel.Spec.AuthToken)
+
+	container := &template.Spec.Containers[0]
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name: tokenEnv,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: getTokenSecretName(tunnel),
+				},
+				Key: "token",
+			},
+		},
+	})
+}
+
+// addLicenseEnv gives the first container of an inlets-pro client the
+// license from the token Secret of its tunnel, and records its checksum on
+// the Pod template, so that the license isn't in the arguments of the
+// client.
+func addLicenseEnv(template *corev1.PodTemplateSpec, tunnel *inletsv1alpha1.Tunnel, license string) {
+	template.Annotations[licenseChecksumAnnotation] = getTokenChecksum(license)
+
+	container := &template.Spec.Containers[0]
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name: licenseEnv,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: getTokenSecretName(tunnel),
+				},
+				Key: "license",
+			},
+		},
+	})
+}
+
+// clientTokenChanged returns true when the client reads its token or
+// license in another way, or has a token or license with another checksum.
+func clientTokenChanged(template, desired corev1.PodTemplateSpec) bool {
+	return template.Annotations[tokenChecksumAnnotation] != desired.Annotations[tokenChecksumAnnotation] ||
+		template.Annotations[licenseChecksumAnnotation] != desired.Annotations[licenseChecksumAnnotation] ||
+		!reflect.DeepEqual(template.Spec.Containers[0].Env, desired.Spec.Containers[0].Env)
+}
+
+// applyClientToken copies the environment and the checksums of the token
+// and license of the desired client into the Pod template of an existing
+// client.
+func applyClientToken(template *corev1.PodTemplateSpec, desired corev1.PodTemplateSpec) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[tokenChecksumAnnotation] = desired.Annotations[tokenChecksumAnnotation]
+	delete(template.Annotations, licenseChecksumAnnotation)
+	if checksum, ok := desired.Annotations[licenseChecksumAnnotation]; ok {
+		template.Annotations[licenseChecksumAnnotation] = checksum
+	}
+	template.Spec.Containers[0].Env = desired.Spec.Containers[0].Env
+}
+
+// sharesExitNode returns true when two tunnels use the same exit-node, and
+// so the same token.
+func sharesExitNode(tunnel, other *inletsv1alpha1.Tunnel) bool {
+	if tunnel.Namespace != other.Namespace {
+		return false
+	}
+	return tunnel.Spec.SharedExitNode == other.Name || other.Spec.SharedExitNode == tunnel.Name ||
+		(len(tunnel.Spec.SharedExitNode) > 0 && tunnel.Spec.SharedExitNode == other.Spec.SharedExitNode)
+}
+
+// findTokenReuse returns the oldest other Tunnel with the same token as a
+// tunnel, other than those which share its exit-node, or nil when the
+// token is not reused.
+func (c *Controller) findTokenReuse(tunnel *inletsv1alpha1.Tunnel) (*inletsv1alpha1.Tunnel, error) {
+	if len(tunnel.Spec.AuthToken) == 0 {
+		return nil, nil
+	}
+
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var oldest *inletsv1alpha1.Tunnel
+	for _, other := range tunnels {
+		if other.UID == tunnel.UID || other.Spec.AuthToken != tunnel.Spec.AuthToken || sharesExitNode(tunnel, other) {
+			continue
+		}
+		if oldest == nil || isOlderTunnel(other, oldest) {
+			oldest = other
+		}
+	}
+	return oldest, nil
+}
+
+// isOlderTunnel returns true when a Tunnel was created before another, by
+// namespace and name when they were created at the same time.
+func isOlderTunnel(tunnel, other *inletsv1alpha1.Tunnel) bool {
+	if !tunnel.CreationTimestamp.Equal(&other.CreationTimestamp) {
+		return tunnel.CreationTimestamp.Before(&other.CreationTimestamp)
+	}
+	return tunnel.Namespace+"/"+tunnel.Name < other.Namespace+"/"+other.Name
+}
+
+// validateUniqueToken rejects a token which another Tunnel created before
+// it already uses, so that one leaked token can't be used to connect to
+// other exit-nodes. Tunnels which are being created have no UID yet. The
+// other Tunnel is only logged by the operator, since it may be in a
+// namespace which the owner of the tunnel can't see.
+func (c *Controller) validateUniqueToken(tunnel *inletsv1alpha1.Tunnel) error {
+	other, err := c.findTokenReuse(tunnel)
+	if err != nil || other == nil || (len(tunnel.UID) > 0 && isOlderTunnel(tunnel, other)) {
+		return err
+	}
+
+	c.tunnelLog(tunnel).Warn("Rejected authToken which another tunnel uses", "otherTunnel", other.Namespace+"/"+other.Name)
+	return fmt.Errorf("authToken is already in use, leave it empty to have one generated")
+}
+
+// syncTokenReuse gives an active tunnel a new token and replaces its
+// exit-node when another Tunnel created before it has the same token, i.e.
+// when tokens were copied between Tunnels by hand. The oldest Tunnel keeps
+// the token. It returns true when the tunnel should not be synced any
+// further.
+func (c *Controller) syncTokenReuse(tunnel *inletsv1alpha1.Tunnel) (bool, error) {
+	if len(tunnel.Spec.SharedExitNode) > 0 || tunnel.Spec.AuthTokenFrom != nil || tunnel.Status.Replacement != nil || len(tunnel.Status.HostID) == 0 {
+		return false, nil
+	}
+
+	other, err := c.findTokenReuse(tunnel)
+	if err != nil {
+		return true, err
+	}
+	if other == nil || isOlderTunnel(tunnel, other) {
+		return false, nil
+	}
+
+	token, err := c.generateAuthToken()
+	if err != nil {
+		return true, err
+	}
+
+	c.tunnelLog(tunnel).Info("Replacing exit-node whose token another tunnel uses", "otherTunnel", other.Namespace+"/"+other.Name)
+
+	message := fmt.Sprintf("Replacing exit-node %s with a new token, since its token is also used by another tunnel", tunnel.Status.HostIP)
+	c.recorder.Event(tunnel, corev1.EventTypeNormal, SuccessTokenRotated, message)
+	c.notifyTunnel(tunnel, notifyTokenRotated, "TokenReuse", message)
+
+	if c.usesBlueGreen(tunnel) {
+		return true, c.startReplacement(tunnel, token, "TokenReuse")
+	}
+
+	// The exit-node is deleted before the token is changed, so that the
+	// reuse is found again and the delete retried when it fails.
+	if err := c.deleteExitNode(tunnel, "token-reuse"); err != nil {
+		return true, err
+	}
+
+	latest, err := c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).Get(tunnel.Name, metav1.GetOptions{})
+	if err != nil {
+		return true, err
+	}
+
+	tunnelCopy := latest.DeepCopy()
+	tunnelCopy.Spec.AuthToken = token
+	_, err = c.updateTunnel(tunnelCopy)
+	return true, err
+}
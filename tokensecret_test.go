@@ -0,0 +1,174 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+func newTokenTunnel(namespace, name string, created time.Time) *inletsv1alpha1.Tunnel {
+	tunnel := newTunnel(name)
+	tunnel.Namespace = namespace
+	tunnel.UID = types.UID("uid-" + namespace + "-" + name)
+	tunnel.CreationTimestamp = metav1.NewTime(created)
+	tunnel.Spec.AuthToken = "reused-token"
+	return tunnel
+}
+
+func TestValidateUniqueToken(t *testing.T) {
+	f := newFixture(t)
+
+	created := time.Now().Add(-time.Hour)
+	f.create(newTokenTunnel("team-a", "secret-app", created))
+
+	// A Tunnel which is being created has no UID
+	tunnel := newTokenTunnel("team-b", "app", time.Time{})
+	tunnel.UID = ""
+
+	err := f.controller.validateUniqueToken(tunnel)
+	if err == nil {
+		t.Fatalf("want an error for a token which another tunnel uses")
+	}
+	if !strings.Contains(err.Error(), "authToken is already in use") {
+		t.Errorf("want a generic error, got %q", err.Error())
+	}
+	if strings.Contains(err.Error(), "team-a") || strings.Contains(err.Error(), "secret-app") {
+		t.Errorf("want the error not to name the other tunnel, got %q", err.Error())
+	}
+
+	// The oldest Tunnel keeps its token
+	if err := f.controller.validateUniqueToken(newTokenTunnel("team-a", "secret-app", created)); err != nil {
+		t.Errorf("want no error for the oldest tunnel with the token, got %s", err.Error())
+	}
+
+	// Tunnels which share an exit-node share its token
+	sharing := newTokenTunnel("team-a", "sharing", time.Time{})
+	sharing.UID = ""
+	sharing.Spec.SharedExitNode = "secret-app"
+	if err := f.controller.validateUniqueToken(sharing); err != nil {
+		t.Errorf("want no error for a tunnel which shares the exit-node, got %s", err.Error())
+	}
+}
+
+func TestSyncTokenReuse(t *testing.T) {
+	f := newFixture(t)
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	f.create(newTokenTunnel("team-a", "secret-app", time.Now().Add(-time.Hour)))
+
+	tunnel := newTokenTunnel(metav1.NamespaceDefault, "app", time.Now())
+	tunnel.Status.HostStatus = "active"
+	tunnel.Status.HostID = "fake-1"
+	tunnel.Status.HostIP = "203.0.113.10"
+	f.create(tunnel)
+
+	stop, err := f.controller.syncTokenReuse(tunnel)
+	if err != nil || !stop {
+		t.Fatalf("want the exit-node to be replaced, got %v %v", stop, err)
+	}
+
+	got := f.get("app")
+	if got.Spec.AuthToken == "reused-token" || len(got.Spec.AuthToken) == 0 {
+		t.Errorf("want a new token, got %q", got.Spec.AuthToken)
+	}
+	if len(got.Status.HostID) > 0 {
+		t.Errorf("want the exit-node to be deleted so that a new one is provisioned, got %q", got.Status.HostID)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "another tunnel") || strings.Contains(event, "team-a") || strings.Contains(event, "secret-app") {
+			t.Errorf("want the event not to name the other tunnel, got %q", event)
+		}
+	default:
+		t.Errorf("want an event for the new token")
+	}
+}
+
+func TestSyncTokenSecretWritesLicenseForProClients(t *testing.T) {
+	f := newFixture(t)
+	f.controller.infra().License = "secret-license"
+	f.addLicenseClass()
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	if err := f.controller.syncTokenSecret(tunnel); err != nil {
+		t.Fatalf("syncTokenSecret: %s", err.Error())
+	}
+
+	secret, err := f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Get("app-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting token Secret: %s", err.Error())
+	}
+	if _, ok := secret.Data["license"]; ok {
+		t.Errorf("want no license in the Secret of an HTTP tunnel")
+	}
+
+	tunnel.Spec.Protocol = "tcp"
+	if err := f.controller.syncTokenSecret(tunnel); err != nil {
+		t.Fatalf("syncTokenSecret: %s", err.Error())
+	}
+
+	secret, err = f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Get("app-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting token Secret: %s", err.Error())
+	}
+	if got := string(secret.Data["license"]); got != "secret-license" {
+		t.Errorf("want the license in the Secret of an inlets-pro tunnel, got %q", got)
+	}
+
+	deployment, err := f.controller.makeClientFor(tunnel, nil)
+	if err != nil {
+		t.Fatalf("makeClientFor: %s", err.Error())
+	}
+	for _, arg := range deployment.Spec.Template.Spec.Containers[0].Args {
+		if strings.Contains(arg, "secret-license") {
+			t.Errorf("want the license to be left out of the arguments of the client, got %q", arg)
+		}
+	}
+}
+
+func TestSyncHoldsProTunnelWithoutCopyLicense(t *testing.T) {
+	f := newFixture(t)
+	f.controller.infra().License = "secret-license"
+	recorder := record.NewFakeRecorder(10)
+	f.controller.recorder = recorder
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Spec.Protocol = "tcp"
+	f.create(tunnel)
+
+	if err := f.sync("app"); err != nil {
+		t.Fatalf("want the tunnel to be held with an event, got %s", err.Error())
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, ErrLicenseRequired) || !strings.Contains(event, "copyLicense") {
+			t.Errorf("want a warning that the class doesn't copy the license, got %q", event)
+		}
+	default:
+		t.Errorf("want a warning that the class doesn't copy the license, got no event")
+	}
+	if calls := f.provisioner.Calls("Provision"); calls != 0 {
+		t.Errorf("want no exit-node without copyLicense, got %d", calls)
+	}
+
+	if err := f.controller.syncTokenSecret(tunnel); err != nil {
+		t.Fatalf("syncTokenSecret: %s", err.Error())
+	}
+	secret, err := f.kubeclient.CoreV1().Secrets(metav1.NamespaceDefault).Get("app-token", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("error getting token Secret: %s", err.Error())
+	}
+	if _, ok := secret.Data["license"]; ok {
+		t.Errorf("want no license in the namespace of a tunnel whose class doesn't copy it")
+	}
+}
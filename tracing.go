@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+const (
+	// traceExportInterval is how often finished spans are sent to the
+	// collector.
+	traceExportInterval = 5 * time.Second
+
+	// maxPendingSpans is how many finished spans are kept whilst the
+	// collector can't be reached, after which new spans are dropped.
+	maxPendingSpans = 2048
+)
+
+// tracer records spans for each sync of a Tunnel or Service and the steps
+// within it, such as provisioning and the rollout of the client, and sends
+// them to an OpenTelemetry collector with OTLP over HTTP, as JSON, since
+// the OpenTelemetry SDK is not vendored. A nil tracer records nothing.
+type tracer struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+
+	lock    sync.Mutex
+	active  map[string]*span
+	pending []*span
+}
+
+// span is a timed step of a sync, with its attributes.
+type span struct {
+	tracer     *tracer
+	traceID    string
+	spanID     string
+	parentID   string
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+// newTracer returns a tracer which sends spans to the OTLP endpoint of a
+// collector, i.e. "http://otel-collector:4318", with headers given as
+// "key=value,key=value", as in OTEL_EXPORTER_OTLP_HEADERS.
+func newTracer(endpoint, headers, serviceName string) (*tracer, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("otlp-endpoint must be an http or https URL, not %q", endpoint)
+	}
+
+	t := &tracer{
+		endpoint:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:     map[string]string{},
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		active:      map[string]*span{},
+	}
+
+	for _, header := range strings.Split(headers, ",") {
+		parts := strings.SplitN(strings.TrimSpace(header), "=", 2)
+		if len(parts) == 2 && len(parts[0]) > 0 {
+			t.headers[parts[0]] = parts[1]
+		}
+	}
+	return t, nil
+}
+
+func newTraceID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// startSync starts the root span of the sync of a key of the workqueue,
+// which the spans of the steps of the sync are children of.
+func (t *tracer) startSync(key string) *span {
+	if t == nil {
+		return nil
+	}
+
+	root := &span{
+		tracer:     t,
+		traceID:    newTraceID(16),
+		spanID:     newTraceID(8),
+		name:       "sync",
+		start:      time.Now(),
+		attributes: map[string]string{"inlets.key": key},
+	}
+
+	t.lock.Lock()
+	t.active[key] = root
+	t.lock.Unlock()
+	return root
+}
+
+// finishSync ends the root span of the sync of a key.
+func (t *tracer) finishSync(key string, root *span, err error) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	delete(t.active, key)
+	t.lock.Unlock()
+
+	root.finish(err)
+}
+
+// startSpan starts a span for a step of the sync of a tunnel, with
+// attributes given as pairs of keys and values. The workqueue never syncs
+// the same key in two workers at once, so the key finds the root span.
+func (c *Controller) startSpan(tunnel *inletsv1alpha1.Tunnel, name string, attributes ...string) *span {
+	t := c.infra().Tracer
+	if t == nil {
+		return nil
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(tunnel)
+	if err != nil {
+		return nil
+	}
+
+	t.lock.Lock()
+	parent := t.active[key]
+	t.lock.Unlock()
+
+	s := &span{
+		tracer:     t,
+		traceID:    newTraceID(16),
+		spanID:     newTraceID(8),
+		name:       name,
+		start:      time.Now(),
+		attributes: map[string]string{},
+	}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	}
+
+	s.attributes["inlets.tunnel"] = tunnel.Name
+	s.attributes["k8s.namespace.name"] = tunnel.Namespace
+	if len(tunnel.UID) > 0 {
+		s.attributes["inlets.tunnel.uid"] = string(tunnel.UID)
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		s.attributes[attributes[i]] = attributes[i+1]
+	}
+	return s
+}
+
+// setAttribute sets an attribute of a span which is known once the step
+// has run, such as the ID of a host.
+func (s *span) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// finish ends a span with the error of its step, if any, and queues it to
+// be sent.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+
+	t := s.tracer
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.pending) < maxPendingSpans {
+		t.pending = append(t.pending, s)
+	}
+}
+
+// run sends the finished spans to the collector until stopCh is closed.
+func (t *tracer) run(stopCh <-chan struct{}) {
+	wait.Until(t.export, traceExportInterval, stopCh)
+	t.export()
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func makeOTLPAttributes(values map[string]string) []otlpAttribute {
+	attributes := []otlpAttribute{}
+	for key, value := range values {
+		attribute := otlpAttribute{Key: key}
+		attribute.Value.StringValue = value
+		attributes = append(attributes, attribute)
+	}
+	return attributes
+}
+
+// export sends the finished spans to the collector, and keeps them for the
+// next export when it fails.
+func (t *tracer) export() {
+	t.lock.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.lock.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	otlpSpans := []otlpSpan{}
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        makeOTLPAttributes(s.attributes),
+		}
+		if s.err != nil {
+			o.Status.Code = 2
+			o.Status.Message = s.err.Error()
+		}
+		otlpSpans = append(otlpSpans, o)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": makeOTLPAttributes(map[string]string{"service.name": t.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "inlets-operator"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		logWith().Error(err, "Error encoding spans")
+		return
+	}
+
+	if err := t.send(body); err != nil {
+		logWith("spans", len(spans)).Error(err, "Error exporting spans")
+
+		t.lock.Lock()
+		if len(t.pending)+len(spans) <= maxPendingSpans {
+			t.pending = append(spans, t.pending...)
+		}
+		t.lock.Unlock()
+	}
+}
+
+func (t *tracer) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d", t.endpoint, res.StatusCode)
+	}
+	return nil
+}
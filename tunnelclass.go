@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// tunnelClassAnnotation can be set on a Service to the TunnelClass for
+// its tunnel.
+const tunnelClassAnnotation = "dev.inlets.tunnel-class"
+
+// defaultTunnelClassAnnotation marks the TunnelClass which is used for
+// Tunnels without a tunnelClassName when set to "true".
+const defaultTunnelClassAnnotation = "tunnelclass.inlets.dev/is-default-class"
+
+// getTunnelClass returns the TunnelClass of a tunnel, the default
+// TunnelClass, or nil when the tunnel has no class and there is no default.
+func (c *Controller) getTunnelClass(tunnel *inletsv1alpha1.Tunnel) (*inletsv1alpha1.TunnelClass, error) {
+	if len(tunnel.Spec.TunnelClassName) > 0 {
+		return c.tunnelClassLister.Get(tunnel.Spec.TunnelClassName)
+	}
+
+	classes, err := c.tunnelClassLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, class := range classes {
+		if class.Annotations[defaultTunnelClassAnnotation] == "true" {
+			return class, nil
+		}
+	}
+	return nil, nil
+}
+
+// copiesLicense returns true when the license of the operator may be
+// copied into the namespace of a tunnel for its client, which its
+// TunnelClass has to allow.
+func (c *Controller) copiesLicense(tunnel *inletsv1alpha1.Tunnel) bool {
+	class, _ := c.getTunnelClass(tunnel)
+	return class != nil && class.Spec.CopyLicense
+}
+
+// getClassAccessKey reads the access key of a TunnelClass from its Secret.
+func (c *Controller) getClassAccessKey(class *inletsv1alpha1.TunnelClass) (string, error) {
+	ref := class.Spec.AccessKeySecret
+
+	secret, err := c.kubeclientset.CoreV1().Secrets(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := secret.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s for tunnel class %s", ref.Namespace, ref.Name, ref.Key, class.Name)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+// getClassProvisioner returns the provisioner for a provider, using the
+// access key of the TunnelClass when it is for the same provider.
+func (c *Controller) getClassProvisioner(class *inletsv1alpha1.TunnelClass, provider string) (provision.Provisioner, error) {
+	if class == nil || class.Spec.AccessKeySecret == nil || class.Spec.Provider != provider {
+		return c.getProvisioner(provider)
+	}
+
+	accessKey, err := c.getClassAccessKey(class)
+	if err != nil {
+		return nil, err
+	}
+
+	return provision.GetProvisioner(provider, accessKey)
+}
+
+// applyTunnelClass overrides the settings of the operator for the first
+// target and the host with those of a TunnelClass.
+func applyTunnelClass(class *inletsv1alpha1.TunnelClass, target *ProvisionTarget, host *provision.BasicHost) {
+	if class == nil {
+		return
+	}
+
+	if target != nil && len(class.Spec.Provider) > 0 {
+		target.Provider = class.Spec.Provider
+		target.Region = class.Spec.Region
+	} else if target != nil && len(class.Spec.Region) > 0 {
+		target.Region = class.Spec.Region
+	}
+
+	if host == nil {
+		return
+	}
+
+	if len(class.Spec.Plan) > 0 {
+		host.Plan = class.Spec.Plan
+	}
+	if len(class.Spec.OS) > 0 {
+		host.OS = class.Spec.OS
+	}
+	if len(class.Spec.ProjectID) > 0 {
+		host.Additional["project_id"] = class.Spec.ProjectID
+	}
+}
+
+// getClassHostname returns the hostname which a TunnelClass with a domain
+// publishes for a Service, or an empty string.
+func getClassHostname(class *inletsv1alpha1.TunnelClass, service *corev1.Service) string {
+	if class == nil || len(class.Spec.Domain) == 0 {
+		return ""
+	}
+	return service.Name + "." + service.Namespace + "." + class.Spec.Domain
+}
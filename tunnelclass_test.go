@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	provision "github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// addClass adds a TunnelClass to the cache of the informer.
+func (f *fixture) addClass(class *inletsv1alpha1.TunnelClass) {
+	f.informers.Inletsoperator().V1alpha1().TunnelClasses().Informer().GetIndexer().Add(class)
+}
+
+func newTunnelClass(name string, spec inletsv1alpha1.TunnelClassSpec) *inletsv1alpha1.TunnelClass {
+	return &inletsv1alpha1.TunnelClass{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       spec,
+	}
+}
+
+func TestGetTunnelClass(t *testing.T) {
+	f := newFixture(t)
+
+	tunnel := newTunnel("app")
+	if class, err := f.controller.getTunnelClass(tunnel); class != nil || err != nil {
+		t.Errorf("want no class without a default class, got %v %v", class, err)
+	}
+
+	f.addClass(newTunnelClass("small", inletsv1alpha1.TunnelClassSpec{Plan: "s-1vcpu-1gb"}))
+	if class, err := f.controller.getTunnelClass(tunnel); class != nil || err != nil {
+		t.Errorf("want no class when no class is the default, got %v %v", class, err)
+	}
+
+	large := newTunnelClass("large", inletsv1alpha1.TunnelClassSpec{Plan: "s-4vcpu-8gb"})
+	large.Annotations = map[string]string{defaultTunnelClassAnnotation: "true"}
+	f.addClass(large)
+	if class, err := f.controller.getTunnelClass(tunnel); err != nil || class == nil || class.Name != "large" {
+		t.Errorf("want the default class for a tunnel without a class, got %v %v", class, err)
+	}
+
+	tunnel.Spec.TunnelClassName = "small"
+	if class, err := f.controller.getTunnelClass(tunnel); err != nil || class == nil || class.Name != "small" {
+		t.Errorf("want the class of the tunnel over the default, got %v %v", class, err)
+	}
+
+	tunnel.Spec.TunnelClassName = "missing"
+	if _, err := f.controller.getTunnelClass(tunnel); err == nil {
+		t.Errorf("want an error for a class which doesn't exist")
+	}
+}
+
+func TestApplyTunnelClass(t *testing.T) {
+	cases := []struct {
+		name        string
+		spec        inletsv1alpha1.TunnelClassSpec
+		wantTarget  ProvisionTarget
+		wantPlan    string
+		wantOS      string
+		wantProject string
+	}{
+		{"empty", inletsv1alpha1.TunnelClassSpec{}, ProvisionTarget{Provider: "digitalocean", Region: "lon1"}, "s-1vcpu-1gb", "ubuntu-16-04-x64", ""},
+		{"provider", inletsv1alpha1.TunnelClassSpec{Provider: "packet"}, ProvisionTarget{Provider: "packet"}, "s-1vcpu-1gb", "ubuntu-16-04-x64", ""},
+		{"region", inletsv1alpha1.TunnelClassSpec{Region: "ams3"}, ProvisionTarget{Provider: "digitalocean", Region: "ams3"}, "s-1vcpu-1gb", "ubuntu-16-04-x64", ""},
+		{"host", inletsv1alpha1.TunnelClassSpec{Plan: "t1.small", OS: "ubuntu_18_04", ProjectID: "project"},
+			ProvisionTarget{Provider: "digitalocean", Region: "lon1"}, "t1.small", "ubuntu_18_04", "project"},
+	}
+
+	for _, c := range cases {
+		target := ProvisionTarget{Provider: "digitalocean", Region: "lon1"}
+		host := provision.BasicHost{Plan: "s-1vcpu-1gb", OS: "ubuntu-16-04-x64", Additional: map[string]string{}}
+
+		applyTunnelClass(newTunnelClass(c.name, c.spec), &target, &host)
+
+		if target != c.wantTarget {
+			t.Errorf("%s: want target %v, got %v", c.name, c.wantTarget, target)
+		}
+		if host.Plan != c.wantPlan || host.OS != c.wantOS || host.Additional["project_id"] != c.wantProject {
+			t.Errorf("%s: want plan %q, OS %q and project %q, got %q %q %q", c.name,
+				c.wantPlan, c.wantOS, c.wantProject, host.Plan, host.OS, host.Additional["project_id"])
+		}
+	}
+}
+
+func TestSyncProvisionsWithTunnelClass(t *testing.T) {
+	f := newFixture(t)
+
+	// The class has its own access key, and so its own provisioner
+	accessKey := fmt.Sprintf("%s-class-%d", t.Name(), time.Now().UnixNano())
+	f.kubeclient.CoreV1().Secrets("inlets").Create(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "fake-access-key", Namespace: "inlets"},
+		Data:       map[string][]byte{"key": []byte(accessKey + "\n")},
+	})
+	f.addClass(newTunnelClass("large", inletsv1alpha1.TunnelClassSpec{
+		Provider:        "fake",
+		Plan:            "s-4vcpu-8gb",
+		AccessKeySecret: &inletsv1alpha1.SecretKeyReference{Namespace: "inlets", Name: "fake-access-key", Key: "key"},
+	}))
+
+	provisioner, err := provision.GetProvisioner("fake", accessKey)
+	if err != nil {
+		t.Fatalf("error getting provisioner: %s", err.Error())
+	}
+	classProvisioner := provisioner.(*provision.FakeProvisioner)
+	classProvisioner.ProvisionLatency = 0
+	classProvisioner.CallLatency = 0
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.TunnelClassName = "large"
+	f.create(tunnel)
+
+	tunnel = f.syncUntil("app", "active")
+
+	if got := f.provisioner.Calls("Provision"); got != 0 {
+		t.Errorf("want no exit-node with the access key of the operator, got %d calls to Provision", got)
+	}
+
+	host, ok := classProvisioner.Host(tunnel.Status.HostID)
+	if !ok {
+		t.Fatalf("want the exit-node to be provisioned with the access key of the class")
+	}
+	if host.Plan != "s-4vcpu-8gb" {
+		t.Errorf("want the plan of the class, got %q", host.Plan)
+	}
+}
+
+func TestSyncHoldsTunnelWithMissingClass(t *testing.T) {
+	f := newFixture(t)
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.TunnelClassName = "missing"
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	f.create(tunnel)
+
+	f.sync("app")
+
+	if got := f.provisioner.Calls("Provision"); got != 0 {
+		t.Errorf("want no exit-node for a tunnel whose class doesn't exist, got %d calls to Provision", got)
+	}
+	if got := f.get("app"); len(got.Status.HostStatus) > 0 {
+		t.Errorf("want the tunnel to wait for its class, got %q", got.Status.HostStatus)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// The health probes of a tunnel, all of which must pass for it to be up.
+const (
+	probeExitNodePorts = "exit-node"
+	probeClient        = "client"
+)
+
+// tunnelUpState is whether a tunnel passed its last health probes, from
+// the exit-node through to its client, and when that last changed.
+type tunnelUpState struct {
+	namespace      string
+	service        string
+	provider       string
+	probes         map[string]bool
+	up             bool
+	lastTransition time.Time
+}
+
+// observeProbe records the result of a health probe of a tunnel. A tunnel
+// is up when every probe which has run for it passed.
+func (m *operatorMetrics) observeProbe(tunnel *inletsv1alpha1.Tunnel, provider, probe string, err error) {
+	key, keyErr := cache.MetaNamespaceKeyFunc(tunnel)
+	if keyErr != nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	state, ok := m.tunnelUp[key]
+	if !ok {
+		state = &tunnelUpState{probes: map[string]bool{}}
+		m.tunnelUp[key] = state
+	}
+	state.namespace = tunnel.Namespace
+	state.service = tunnel.Spec.ServiceName
+	state.provider = provider
+	state.probes[probe] = err == nil
+
+	up := true
+	for _, passed := range state.probes {
+		up = up && passed
+	}
+	if !ok || up != state.up {
+		state.lastTransition = time.Now()
+	}
+	state.up = up
+}
+
+// writeTunnelUp writes whether each tunnel is up, and when it last went up
+// or down, so that an alert can fire when a tunnel has been down for a
+// while. Tunnels which have been deleted are forgotten.
+func (c *Controller) writeTunnelUp(w io.Writer) error {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	exists := map[string]bool{}
+	for _, tunnel := range tunnels {
+		if key, err := cache.MetaNamespaceKeyFunc(tunnel); err == nil {
+			exists[key] = true
+		}
+	}
+
+	m := c.metrics
+	m.lock.Lock()
+	keys := []string{}
+	for key := range m.tunnelUp {
+		if !exists[key] {
+			delete(m.tunnelUp, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	up := []metricSample{}
+	transitions := []metricSample{}
+	for _, key := range keys {
+		state := m.tunnelUp[key]
+		sampleLabels := map[string]string{
+			"namespace": state.namespace,
+			"service":   state.service,
+			"provider":  state.provider,
+		}
+
+		value := 0.0
+		if state.up {
+			value = 1
+		}
+		up = append(up, metricSample{Labels: sampleLabels, Value: value})
+		transitions = append(transitions, metricSample{
+			Labels: sampleLabels,
+			Value:  float64(state.lastTransition.UnixNano()) / float64(time.Second),
+		})
+	}
+	m.lock.Unlock()
+
+	writeGauge(w, "inlets_tunnel_up",
+		"Whether the last health probes of the exit-node and client of a Tunnel passed, by namespace, service and provider.", up)
+	writeGauge(w, "inlets_tunnel_last_transition_timestamp_seconds",
+		"Time at which a Tunnel last went up or down, in seconds since the epoch.", transitions)
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+	"github.com/alexellis/inlets-operator/pkg/provision"
+)
+
+// exitNodeUsage is the last usage of the exit-node of a tunnel, for its
+// metrics.
+type exitNodeUsage struct {
+	namespace string
+	tunnel    string
+	provider  string
+	hostID    string
+	usage     provision.HostUsage
+}
+
+// checkUsage reads the usage of the exit-node of each active tunnel from
+// the monitoring API of its provider, for its status and metrics, so that
+// an exit-node whose plan is too small can be found.
+func (c *Controller) checkUsage() {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+
+	for _, tunnel := range tunnels {
+		if tunnel.Status.HostStatus != "active" || len(tunnel.Status.HostID) == 0 {
+			continue
+		}
+
+		if paused, _ := isPaused(tunnel); paused || !c.ownsObject(tunnel) {
+			continue
+		}
+
+		if err := c.syncUsage(tunnel); err != nil {
+			c.tunnelLog(tunnel).Error(err, "Error reading usage of exit-node")
+		}
+	}
+}
+
+func (c *Controller) syncUsage(tunnel *inletsv1alpha1.Tunnel) error {
+	provisioner, err := c.getTunnelProvisioner(tunnel)
+	if err != nil {
+		return err
+	}
+
+	reporter, ok := provisioner.(provision.UsageReporter)
+	if !ok {
+		return nil
+	}
+
+	usage, err := reporter.Usage(tunnel.Status.HostID, c.infra().UsageInterval)
+	if err != nil {
+		return err
+	}
+
+	c.metrics.observeUsage(tunnel, c.getTunnelProvider(tunnel), *usage)
+
+	status := &inletsv1alpha1.TunnelUsage{
+		CPUPercent:                    formatUsage(usage.CPUPercent, 1),
+		MemoryPercent:                 formatUsage(usage.MemoryPercent, 1),
+		NetworkReceiveBytesPerSecond:  formatUsage(usage.ReceiveBytesPerSecond, 0),
+		NetworkTransmitBytesPerSecond: formatUsage(usage.TransmitBytesPerSecond, 0),
+		ObservedAt:                    metav1.Now(),
+	}
+
+	// The status is only written when a value changes, so that each check
+	// doesn't sync every tunnel again
+	if existing := tunnel.Status.Usage; existing != nil &&
+		existing.CPUPercent == status.CPUPercent &&
+		existing.MemoryPercent == status.MemoryPercent &&
+		existing.NetworkReceiveBytesPerSecond == status.NetworkReceiveBytesPerSecond &&
+		existing.NetworkTransmitBytesPerSecond == status.NetworkTransmitBytesPerSecond {
+		return nil
+	}
+
+	tunnelCopy := tunnel.DeepCopy()
+	tunnelCopy.Status.Usage = status
+	_, err = c.operatorclientset.InletsoperatorV1alpha1().Tunnels(tunnel.Namespace).UpdateStatus(tunnelCopy)
+	return err
+}
+
+// formatUsage formats a value of usage for the status of a tunnel, or
+// returns "" when the provider did not report it.
+func formatUsage(value float64, precision int) string {
+	if value < 0 {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', precision, 64)
+}
+
+// observeUsage records the usage of the exit-node of a tunnel.
+func (m *operatorMetrics) observeUsage(tunnel *inletsv1alpha1.Tunnel, provider string, usage provision.HostUsage) {
+	key, err := cache.MetaNamespaceKeyFunc(tunnel)
+	if err != nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.usage[key] = &exitNodeUsage{
+		namespace: tunnel.Namespace,
+		tunnel:    tunnel.Name,
+		provider:  provider,
+		hostID:    tunnel.Status.HostID,
+		usage:     usage,
+	}
+}
+
+// writeUsage writes the last usage of the exit-node of each tunnel. Usage
+// of tunnels which were deleted, or whose exit-node was replaced, is
+// forgotten.
+func (c *Controller) writeUsage(w io.Writer) error {
+	tunnels, err := c.tunnelsLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	hostIDs := map[string]string{}
+	for _, tunnel := range tunnels {
+		if key, err := cache.MetaNamespaceKeyFunc(tunnel); err == nil {
+			hostIDs[key] = tunnel.Status.HostID
+		}
+	}
+
+	m := c.metrics
+	m.lock.Lock()
+	keys := []string{}
+	for key, entry := range m.usage {
+		if hostIDs[key] != entry.hostID {
+			delete(m.usage, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	gauges := []struct {
+		name, help string
+		value      func(provision.HostUsage) float64
+		samples    []metricSample
+	}{
+		{name: "inlets_exit_node_cpu_percent", help: "Average CPU usage of the exit-node of a Tunnel, in percent.",
+			value: func(u provision.HostUsage) float64 { return u.CPUPercent }},
+		{name: "inlets_exit_node_memory_percent", help: "Memory usage of the exit-node of a Tunnel, in percent.",
+			value: func(u provision.HostUsage) float64 { return u.MemoryPercent }},
+		{name: "inlets_exit_node_network_receive_bytes_per_second", help: "Average traffic received by the public interface of the exit-node of a Tunnel.",
+			value: func(u provision.HostUsage) float64 { return u.ReceiveBytesPerSecond }},
+		{name: "inlets_exit_node_network_transmit_bytes_per_second", help: "Average traffic sent by the public interface of the exit-node of a Tunnel.",
+			value: func(u provision.HostUsage) float64 { return u.TransmitBytesPerSecond }},
+	}
+
+	for _, key := range keys {
+		entry := m.usage[key]
+		sampleLabels := map[string]string{
+			"namespace": entry.namespace,
+			"tunnel":    entry.tunnel,
+			"provider":  entry.provider,
+			"host_id":   entry.hostID,
+		}
+		for i := range gauges {
+			if value := gauges[i].value(entry.usage); value >= 0 {
+				gauges[i].samples = append(gauges[i].samples, metricSample{Labels: sampleLabels, Value: value})
+			}
+		}
+	}
+	m.lock.Unlock()
+
+	for _, gauge := range gauges {
+		writeGauge(w, gauge.name, gauge.help, gauge.samples)
+	}
+	return nil
+}
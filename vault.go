@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultServiceAccountToken is the token of the operator's ServiceAccount,
+// which it signs in to Vault with.
+const vaultServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultCredentials reads the access keys of providers from the secret
+// engines of HashiCorp Vault, signing in with the Kubernetes auth method.
+// Each access key is cached for the lease it was issued with, which is
+// renewed when less than a third of it is left, so that short-lived keys
+// are only read again once they can't be renewed any more.
+type vaultCredentials struct {
+	addr      string
+	authPath  string
+	role      string
+	paths     map[string]vaultPath
+	tokenFile string
+	client    *http.Client
+	notifier  *notifier
+
+	lock        sync.Mutex
+	clientToken string
+	tokenLease  vaultLease
+	keys        map[string]vaultCredential
+}
+
+// vaultPath is the path of a secret in Vault and the field of its data
+// with the access key.
+type vaultPath struct {
+	Path  string
+	Field string
+}
+
+type vaultLease struct {
+	ID        string
+	Renewable bool
+	IssuedAt  time.Time
+	Expires   time.Time
+}
+
+// due returns true when less than a third of the lease is left.
+func (l vaultLease) due() bool {
+	if l.Expires.IsZero() {
+		return false
+	}
+	return time.Now().After(l.Expires.Add(-l.Expires.Sub(l.IssuedAt) / 3))
+}
+
+type vaultCredential struct {
+	AccessKey string
+	Lease     vaultLease
+}
+
+// vaultResponse is the part of a response from Vault which is read.
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+func newVaultLease(id string, seconds int, renewable bool) vaultLease {
+	lease := vaultLease{ID: id, Renewable: renewable, IssuedAt: time.Now()}
+	if seconds > 0 {
+		lease.Expires = lease.IssuedAt.Add(time.Duration(seconds) * time.Second)
+	}
+	return lease
+}
+
+// parseVaultPaths parses a list of secrets per provider, with an optional
+// field which defaults to "token", such as
+// "digitalocean=digitalocean/creds/inlets,packet=secret/data/packet#api-key"
+func parseVaultPaths(value string) (map[string]vaultPath, error) {
+	paths := map[string]vaultPath{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("vault-credentials must be a list of provider=path, not %q", entry)
+		}
+
+		path := vaultPath{Path: strings.Trim(parts[1], "/"), Field: "token"}
+		if index := strings.Index(path.Path, "#"); index > -1 {
+			path.Field = path.Path[index+1:]
+			path.Path = path.Path[:index]
+		}
+		paths[parts[0]] = path
+	}
+	return paths, nil
+}
+
+func newVaultCredentials(addr, authPath, role string, paths map[string]vaultPath) (*vaultCredentials, error) {
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("vault-addr or VAULT_ADDR must be set to read credentials from Vault")
+	}
+	if len(role) == 0 {
+		return nil, fmt.Errorf("vault-role must be set to read credentials from Vault")
+	}
+
+	return &vaultCredentials{
+		addr:      strings.TrimSuffix(addr, "/"),
+		authPath:  strings.Trim(authPath, "/"),
+		role:      role,
+		paths:     paths,
+		tokenFile: vaultServiceAccountToken,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		keys:      map[string]vaultCredential{},
+	}, nil
+}
+
+// Has returns true when the access key of a provider is read from Vault.
+func (v *vaultCredentials) Has(provider string) bool {
+	_, ok := v.paths[provider]
+	return ok
+}
+
+// GetAccessKey returns the access key of a provider, renewing its lease or
+// reading a new one when it is due.
+func (v *vaultCredentials) GetAccessKey(provider string) (string, error) {
+	path, ok := v.paths[provider]
+	if !ok {
+		return "", fmt.Errorf("no vault credentials for provider %s", provider)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	cached, ok := v.keys[provider]
+	if ok && !cached.Lease.due() {
+		return cached.AccessKey, nil
+	}
+
+	if ok && cached.Lease.Renewable && len(cached.Lease.ID) > 0 {
+		lease, err := v.renewLease(cached.Lease)
+		if err == nil && !lease.due() {
+			cached.Lease = lease
+			v.keys[provider] = cached
+			return cached.AccessKey, nil
+		}
+		if err != nil {
+			logWith("provider", provider).Error(err, "Error renewing vault lease, reading new credentials")
+		}
+	}
+
+	res, err := v.request(http.MethodGet, path.Path, nil)
+	if err != nil {
+		err = fmt.Errorf("error reading %s from vault: %s", path.Path, err.Error())
+		v.notifier.Notify(notification{
+			Type:     notifyCredentialsInvalid,
+			Reason:   "VaultReadFailed",
+			Provider: provider,
+			Message:  err.Error(),
+		})
+		return "", err
+	}
+
+	data := res.Data
+	// The secrets of the KV version 2 engine are nested under data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+
+	accessKey, _ := data[path.Field].(string)
+	if len(accessKey) == 0 {
+		return "", fmt.Errorf("%s in vault has no %s", path.Path, path.Field)
+	}
+
+	v.keys[provider] = vaultCredential{
+		AccessKey: accessKey,
+		Lease:     newVaultLease(res.LeaseID, res.LeaseDuration, res.Renewable),
+	}
+
+	if ok && cached.AccessKey != accessKey {
+		v.notifier.Notify(notification{
+			Type:     notifyCredentialsRotated,
+			Reason:   "VaultLeaseExpired",
+			Provider: provider,
+			Message:  fmt.Sprintf("The access key for %s was read again from %s in vault", provider, path.Path),
+		})
+	}
+	return accessKey, nil
+}
+
+// renewLease extends the lease of a credential by its original duration.
+func (v *vaultCredentials) renewLease(lease vaultLease) (vaultLease, error) {
+	res, err := v.request(http.MethodPut, "sys/leases/renew", map[string]interface{}{
+		"lease_id":  lease.ID,
+		"increment": int(lease.Expires.Sub(lease.IssuedAt).Seconds()),
+	})
+	if err != nil {
+		return lease, err
+	}
+	return newVaultLease(res.LeaseID, res.LeaseDuration, res.Renewable), nil
+}
+
+// request sends a request to Vault with a client token, signing in again
+// when the token is due.
+func (v *vaultCredentials) request(method, path string, body interface{}) (*vaultResponse, error) {
+	if len(v.clientToken) == 0 || v.tokenLease.due() {
+		if err := v.login(); err != nil {
+			return nil, fmt.Errorf("error signing in to vault: %s", err.Error())
+		}
+	}
+	return v.send(method, path, body, v.clientToken)
+}
+
+// login signs in with the token of the operator's ServiceAccount.
+func (v *vaultCredentials) login() error {
+	jwt, err := ioutil.ReadFile(v.tokenFile)
+	if err != nil {
+		return err
+	}
+
+	res, err := v.send(http.MethodPost, "auth/"+v.authPath+"/login", map[string]interface{}{
+		"role": v.role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}, "")
+	if err != nil {
+		return err
+	}
+	if res.Auth == nil || len(res.Auth.ClientToken) == 0 {
+		return fmt.Errorf("vault returned no client token")
+	}
+
+	v.clientToken = res.Auth.ClientToken
+	v.tokenLease = newVaultLease("", res.Auth.LeaseDuration, res.Auth.Renewable)
+	return nil
+}
+
+func (v *vaultCredentials) send(method, path string, body interface{}, token string) (*vaultResponse, error) {
+	reader := bytes.NewReader(nil)
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, v.addr+"/v1/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	result := &vaultResponse{}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil && res.StatusCode == http.StatusOK {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		if len(result.Errors) > 0 {
+			return nil, fmt.Errorf("vault returned %d: %s", res.StatusCode, strings.Join(result.Errors, ", "))
+		}
+		return nil, fmt.Errorf("vault returned %d", res.StatusCode)
+	}
+	return result, nil
+}
+
+// getAccessKey returns the access key for a provider, from Vault when
+// --vault-credentials has a path for it.
+func (c *Controller) getAccessKey(provider string) (string, error) {
+	vault := c.infra().VaultCredentials
+	if vault != nil && vault.Has(provider) {
+		return vault.GetAccessKey(provider)
+	}
+	return c.infra().GetAccessKeyFor(provider), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	inletsv1alpha1 "github.com/alexellis/inlets-operator/pkg/apis/inletsoperator/v1alpha1"
+)
+
+// sidecarAnnotation is set on the Pod template of a workload to the name of
+// a Tunnel with the "sidecar" client mode, to inject its client into each Pod.
+const sidecarAnnotation = "dev.inlets.sidecar"
+
+// sidecarContainerName is the name of the client container injected into Pods.
+const sidecarContainerName = "inlets-client"
+
+// admissionReview is the subset of admission.k8s.io/v1beta1 AdmissionReview
+// used by the webhook, since the admission API is not vendored.
+type admissionReview struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Request  *admissionRequest  `json:"request,omitempty"`
+	Response *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       types.UID       `json:"uid"`
+	Namespace string          `json:"namespace,omitempty"`
+	Object    json.RawMessage `json:"object,omitempty"`
+}
+
+type admissionResponse struct {
+	UID       types.UID      `json:"uid"`
+	Allowed   bool           `json:"allowed"`
+	Result    *metav1.Status `json:"status,omitempty"`
+	Patch     []byte         `json:"patch,omitempty"`
+	PatchType *string        `json:"patchType,omitempty"`
+}
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// serveWebhook serves the mutating webhook which injects the client as a
+// sidecar, and the validating webhook for Tunnels, until the server fails.
+func (c *Controller) serveWebhook(port int, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", c.handleMutate)
+	mux.HandleFunc("/validate", c.handleValidate)
+
+	logWith("port", port).Info("Serving webhook")
+	return http.ListenAndServeTLS(fmt.Sprintf(":%d", port), certFile, keyFile, mux)
+}
+
+// readReview reads an AdmissionReview with a request, or replies with an
+// error and returns nil.
+func readReview(w http.ResponseWriter, r *http.Request) *admissionReview {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	review := admissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return nil
+	}
+	return &review
+}
+
+// writeReview replies to an AdmissionReview with the response.
+func writeReview(w http.ResponseWriter, review *admissionReview, response *admissionResponse) {
+	review.Request = nil
+	review.Response = response
+
+	out, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+func (c *Controller) handleMutate(w http.ResponseWriter, r *http.Request) {
+	review := readReview(w, r)
+	if review == nil {
+		return
+	}
+
+	response := &admissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+
+	patch, err := c.mutatePod(review.Request)
+	if err != nil {
+		logWith("namespace", review.Request.Namespace).Error(err, "Error injecting sidecar")
+		response.Result = &metav1.Status{Message: err.Error()}
+	} else if len(patch) > 0 {
+		patchType := "JSONPatch"
+		response.Patch = patch
+		response.PatchType = &patchType
+	}
+
+	writeReview(w, review, response)
+}
+
+// handleValidate rejects Tunnels whose spec is invalid, such as a region
+// which their provider does not have, or a weak token, and Tunnels in a
+// denied namespace.
+func (c *Controller) handleValidate(w http.ResponseWriter, r *http.Request) {
+	review := readReview(w, r)
+	if review == nil {
+		return
+	}
+
+	response := &admissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+
+	tunnel := inletsv1alpha1.Tunnel{}
+	if err := json.Unmarshal(review.Request.Object, &tunnel); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: err.Error()}
+	} else if err := c.validateNamespace(review.Request.Namespace); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: err.Error()}
+	} else if err := c.validateRegion(&tunnel); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: err.Error()}
+	} else if err := validateServiceAccountToken(&tunnel); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: err.Error()}
+	} else if err := validateRateLimit(tunnel.Spec.RateLimit); err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: err.Error()}
+	} else if tunnel.Spec.AuthTokenFrom != nil {
+		if err := validateAuthTokenFrom(&tunnel); err != nil {
+			response.Allowed = false
+			response.Result = &metav1.Status{Message: err.Error()}
+		}
+	} else if len(tunnel.Spec.AuthToken) > 0 {
+		if err := validateAuthToken(tunnel.Spec.AuthToken); err != nil {
+			response.Allowed = false
+			response.Result = &metav1.Status{Message: err.Error()}
+		} else if len(tunnel.Spec.SharedExitNode) == 0 {
+			tunnel.Namespace = review.Request.Namespace
+			if err := c.validateUniqueToken(&tunnel); err != nil {
+				response.Allowed = false
+				response.Result = &metav1.Status{Message: err.Error()}
+			}
+		}
+	}
+
+	writeReview(w, review, response)
+}
+
+// mutatePod returns a JSON patch to add the client of the Tunnel named in
+// the sidecar annotation of a Pod, or no patch when the Pod has no such
+// annotation. Pods are admitted without a client whilst the Tunnel has no
+// active exit-node.
+func (c *Controller) mutatePod(request *admissionRequest) ([]byte, error) {
+	pod := corev1.Pod{}
+	if err := json.Unmarshal(request.Object, &pod); err != nil {
+		return nil, err
+	}
+
+	tunnelName := pod.Annotations[sidecarAnnotation]
+	if len(tunnelName) == 0 {
+		return nil, nil
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name == sidecarContainerName {
+			return nil, nil
+		}
+	}
+
+	namespace := pod.Namespace
+	if len(namespace) == 0 {
+		namespace = request.Namespace
+	}
+
+	tunnel, err := c.tunnelsLister.Tunnels(namespace).Get(tunnelName)
+	if err != nil {
+		return nil, err
+	}
+
+	if tunnel.Spec.ClientMode != "sidecar" {
+		return nil, fmt.Errorf("tunnel %s does not use the sidecar client mode", tunnelName)
+	}
+
+	if tunnel.Status.HostStatus != "active" {
+		return nil, fmt.Errorf("tunnel %s is not active yet", tunnelName)
+	}
+
+	service, err := c.getTunnelService(tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := c.makeClientFor(tunnel, service)
+	if err != nil {
+		return nil, err
+	}
+
+	container := client.Spec.Template.Spec.Containers[0]
+	container.Name = sidecarContainerName
+
+	c.tunnelLog(tunnel).Info("Injecting client into pod", "pod", pod.GenerateName)
+
+	return json.Marshal([]patchOperation{
+		{
+			Op:    "add",
+			Path:  "/spec/containers/-",
+			Value: container,
+		},
+	})
+}
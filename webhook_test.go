@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// sendReview sends an AdmissionReview of the object to a handler of the
+// webhook, and returns its response.
+func sendReview(t *testing.T, handler http.HandlerFunc, namespace string, object interface{}) *admissionResponse {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("error marshalling object: %s", err.Error())
+	}
+	body, _ := json.Marshal(admissionReview{
+		Request: &admissionRequest{UID: "review-1", Namespace: namespace, Object: raw},
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	review := admissionReview{}
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil || review.Response == nil {
+		t.Fatalf("want an AdmissionReview with a response, got %s", w.Body.String())
+	}
+	if review.Response.UID != "review-1" {
+		t.Errorf("want the UID of the request in the response, got %q", review.Response.UID)
+	}
+	return review.Response
+}
+
+func newSidecarPod(tunnelName string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "app-",
+			Annotations:  map[string]string{sidecarAnnotation: tunnelName},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app"}},
+		},
+	}
+}
+
+func TestHandleMutateInjectsSidecar(t *testing.T) {
+	f := newFixture(t)
+	f.kubeInformers.Core().V1().Services().Informer().GetIndexer().Add(
+		newPortsService(corev1.ServicePort{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP}))
+
+	tunnel := newTunnel("app")
+	tunnel.Spec.ClientMode = "sidecar"
+	tunnel.Spec.AuthToken = "0123456789012345678901234567890123456789012345678901234567890123"
+	tunnel.Status.HostStatus = "active"
+	tunnel.Status.HostIP = "203.0.113.10"
+	f.create(tunnel)
+
+	response := sendReview(t, f.controller.handleMutate, metav1.NamespaceDefault, newSidecarPod("app"))
+	if !response.Allowed {
+		t.Fatalf("want the Pod to be admitted")
+	}
+
+	patch := []patchOperation{}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil || len(patch) != 1 {
+		t.Fatalf("want one patch operation, got %s", string(response.Patch))
+	}
+	if patch[0].Op != "add" || patch[0].Path != "/spec/containers/-" {
+		t.Errorf("want the client to be added to the containers, got %s %s", patch[0].Op, patch[0].Path)
+	}
+	container, _ := patch[0].Value.(map[string]interface{})
+	if container["name"] != sidecarContainerName {
+		t.Errorf("want a container named %s, got %v", sidecarContainerName, container["name"])
+	}
+}
+
+func TestMutatePodAdmitsWithoutSidecar(t *testing.T) {
+	f := newFixture(t)
+
+	deployment := newTunnel("deployment")
+	deployment.Status.HostStatus = "active"
+	f.create(deployment)
+
+	provisioning := newTunnel("provisioning")
+	provisioning.Spec.ClientMode = "sidecar"
+	provisioning.Status.HostStatus = "provisioning"
+	f.create(provisioning)
+
+	injected := newSidecarPod("app")
+	injected.Spec.Containers = append(injected.Spec.Containers, corev1.Container{Name: sidecarContainerName})
+
+	unannotated := newSidecarPod("")
+	unannotated.Annotations = nil
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		wantErr bool
+	}{
+		{name: "no annotation", pod: unannotated},
+		{name: "already injected", pod: injected},
+		{name: "unknown tunnel", pod: newSidecarPod("missing"), wantErr: true},
+		{name: "deployment client mode", pod: newSidecarPod("deployment"), wantErr: true},
+		{name: "exit-node not active", pod: newSidecarPod("provisioning"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := sendReview(t, f.controller.handleMutate, metav1.NamespaceDefault, test.pod)
+			if !response.Allowed {
+				t.Errorf("want the Pod to be admitted")
+			}
+			if len(response.Patch) > 0 {
+				t.Errorf("want no patch, got %s", string(response.Patch))
+			}
+			if gotErr := response.Result != nil; gotErr != test.wantErr {
+				t.Errorf("want an error: %t, got %v", test.wantErr, response.Result)
+			}
+		})
+	}
+}
+
+func TestHandleValidateRegion(t *testing.T) {
+	f := newFixture(t)
+
+	tests := []struct {
+		region  string
+		allowed bool
+	}{
+		{region: "", allowed: true},
+		{region: "fake-2", allowed: true},
+		{region: "lon1", allowed: false},
+	}
+
+	for _, test := range tests {
+		tunnel := newTunnel("app")
+		tunnel.Spec.Region = test.region
+
+		response := sendReview(t, f.controller.handleValidate, metav1.NamespaceDefault, tunnel)
+		if response.Allowed != test.allowed {
+			t.Errorf("region %q: want allowed: %t, got %t", test.region, test.allowed, response.Allowed)
+		}
+		if !test.allowed && (response.Result == nil || !strings.Contains(response.Result.Message, "fake-1, fake-2")) {
+			t.Errorf("region %q: want the regions of the provider in the message, got %v", test.region, response.Result)
+		}
+	}
+}
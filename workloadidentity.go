@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// azureFederatedIdentity exchanges a projected ServiceAccount token of the
+// operator for an Azure AD access token with workload identity federation,
+// so that no client secret is stored in the cluster. It is read from the
+// variables which the Azure workload identity webhook sets on the Pod.
+type azureFederatedIdentity struct {
+	AuthorityHost string
+	TenantID      string
+	ClientID      string
+	TokenFile     string
+}
+
+// getAzureFederatedIdentity returns the federated identity of the operator,
+// or nil when AZURE_FEDERATED_TOKEN_FILE is not set.
+func getAzureFederatedIdentity() *azureFederatedIdentity {
+	tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if len(tokenFile) == 0 {
+		return nil
+	}
+
+	authorityHost := os.Getenv("AZURE_AUTHORITY_HOST")
+	if len(authorityHost) == 0 {
+		authorityHost = "https://login.microsoftonline.com/"
+	}
+
+	return &azureFederatedIdentity{
+		AuthorityHost: strings.TrimSuffix(authorityHost, "/"),
+		TenantID:      os.Getenv("AZURE_TENANT_ID"),
+		ClientID:      os.Getenv("AZURE_CLIENT_ID"),
+		TokenFile:     tokenFile,
+	}
+}
+
+// getAccessToken returns an access token for a scope, such as
+// "https://vault.azure.net/.default", and when it expires. The token file
+// is read each time, since the kubelet rotates it.
+func (f *azureFederatedIdentity) getAccessToken(client *http.Client, scope string) (string, time.Time, error) {
+	if len(f.TenantID) == 0 || len(f.ClientID) == 0 {
+		return "", time.Time{}, fmt.Errorf("AZURE_TENANT_ID and AZURE_CLIENT_ID must be set with AZURE_FEDERATED_TOKEN_FILE")
+	}
+
+	assertion, err := ioutil.ReadFile(f.TokenFile)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", f.ClientID)
+	form.Set("scope", scope)
+	form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+
+	res, err := client.PostForm(f.AuthorityHost+"/"+f.TenantID+"/oauth2/v2.0/token", form)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer res.Body.Close()
+
+	result := struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil && res.StatusCode == http.StatusOK {
+		return "", time.Time{}, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		if len(result.ErrorDescription) > 0 {
+			return "", time.Time{}, fmt.Errorf("azure AD returned %d for a federated token: %s", res.StatusCode, result.ErrorDescription)
+		}
+		return "", time.Time{}, fmt.Errorf("azure AD returned %d for a federated token", res.StatusCode)
+	}
+	return result.AccessToken, time.Now().Add(time.Duration(result.ExpiresIn) * time.Second), nil
+}